@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Chunking modes, which decide how a source is broken into snippets.
+const (
+	// ChunkingLLM hands the whole document to the model in one prompt.
+	ChunkingLLM = "llm"
+	// ChunkingMarkdown splits the document along its headings without the
+	// model, which is fast and deterministic.
+	ChunkingMarkdown = "markdown"
+	// ChunkingRefine splits the document along its headings and has the
+	// model break each section into snippets, which keeps prompts small.
+	ChunkingRefine = "refine"
+)
+
+// maxSectionBytes is the size above which a markdown section is split
+// further, between paragraphs, lists and code blocks.
+const maxSectionBytes = 4000
+
+var (
+	headingPattern  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	fencePattern    = regexp.MustCompile("^[ \t]*(`{3,}|~{3,})")
+	listItemPattern = regexp.MustCompile(`^\s*(?:[-*+]|\d{1,9}[.)])(?:\s|$)`)
+)
+
+// extractedSnippet is a piece of a source to be stored as a snippet.
+type extractedSnippet struct {
+	Text string
+	// HeadingPath is the titles of the headings the text is under,
+	// outermost first. It is empty when the text is not under any heading.
+	HeadingPath []string
+	// Start and End are the byte offsets in the source of the text the
+	// snippet was taken from, End exclusive. Both are zero when the text
+	// could not be found in the source.
+	Start, End int
+}
+
+// markdownSection is a run of a markdown document under one heading.
+type markdownSection struct {
+	// HeadingPath is the titles of the section's heading and the headings
+	// it is nested under, outermost first.
+	HeadingPath []string
+	// Text is the section's heading line followed by its body.
+	Text string
+	// Start and End are the byte offsets in the document of the text the
+	// section was taken from, End exclusive.
+	Start, End int
+}
+
+// extractSnippets breaks a source's content into snippets in the app's
+// chunking mode. A positive limit caps how many snippets come out. Snippets
+// the model returns are looked up in content to find where they came from.
+func (app *App) extractSnippets(ctx context.Context, p *progressReporter, content string, limit int) ([]extractedSnippet, error) {
+	var sections []markdownSection
+	switch app.chunking {
+	case ChunkingMarkdown:
+		sections = mergeSections(splitMarkdown(content, maxSectionBytes), limit)
+
+	case ChunkingRefine:
+		for i, section := range splitMarkdown(content, maxSectionBytes) {
+			p.logf("Refining section %d: %s", i+1, strings.Join(section.HeadingPath, " > "))
+			var refined []string
+			err := app.retry.do(ctx, "Refining section", func() (err error) {
+				refined, err = app.llm.RefineSection(ctx, section.Text, section.HeadingPath)
+				return err
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to refine section %d: %v", i+1, err)
+			}
+			from := section.Start
+			for _, text := range refined {
+				if text = strings.TrimSpace(text); text == "" {
+					continue
+				}
+				refinedSection := markdownSection{HeadingPath: section.HeadingPath, Text: text}
+				if start, end, ok := locate(content, text, from, section.End); ok {
+					refinedSection.Start, refinedSection.End = start, end
+					from = end
+				}
+				sections = append(sections, refinedSection)
+			}
+		}
+		sections = mergeSections(sections, limit)
+
+	default:
+		var texts []string
+		err := app.retry.do(ctx, "Extracting snippets", func() (err error) {
+			texts, err = app.llm.ExtractSnippets(ctx, content, limit)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		doc := newMarkdownDoc(content)
+		from := 0
+		for _, text := range texts {
+			section := markdownSection{Text: text}
+			start, end, ok := locate(content, text, from, len(content))
+			if !ok {
+				start, end, ok = locate(content, text, 0, len(content))
+			}
+			if ok {
+				section.Start, section.End = start, end
+				section.HeadingPath = doc.headingPathAt(start)
+				from = end
+			}
+			sections = append(sections, section)
+		}
+	}
+
+	snippets := make([]extractedSnippet, len(sections))
+	for i, section := range sections {
+		snippets[i] = extractedSnippet{
+			Text:        section.Text,
+			HeadingPath: section.HeadingPath,
+			Start:       section.Start,
+			End:         section.End,
+		}
+	}
+	return snippets, nil
+}
+
+// locate finds text in content[from:to], exactly or else up to differences
+// in whitespace, and returns its offsets in content. It reports false if the
+// text is not there.
+func locate(content, text string, from, to int) (int, int, bool) {
+	if from > to || strings.TrimSpace(text) == "" {
+		return 0, 0, false
+	}
+	window := content[from:to]
+	if i := strings.Index(window, text); i >= 0 {
+		return from + i, from + i + len(text), true
+	}
+	fields := strings.Fields(text)
+	for i, field := range fields {
+		fields[i] = regexp.QuoteMeta(field)
+	}
+	re, err := regexp.Compile(strings.Join(fields, `\s+`))
+	if err != nil {
+		return 0, 0, false
+	}
+	m := re.FindStringIndex(window)
+	if m == nil {
+		return 0, 0, false
+	}
+	return from + m[0], from + m[1], true
+}
+
+// splitMarkdown splits a markdown document into a section per heading. ATX
+// headings ("## Title") start sections; lines in fenced code blocks, such as
+// shell comments, never do. Text before the first heading forms a section of
+// its own, and headings with nothing but subheadings under them are only kept
+// in the heading paths of their subsections. A section longer than maxBytes
+// is split between blocks, never inside a paragraph, list or code block, and
+// each part after the first repeats the section's heading line.
+func splitMarkdown(content string, maxBytes int) []markdownSection {
+	doc := newMarkdownDoc(content)
+	var sections []markdownSection
+	for _, h := range doc.headings() {
+		sections = append(sections, doc.splitSection(h, maxBytes)...)
+	}
+	return sections
+}
+
+// markdownDoc is a markdown document split into lines.
+type markdownDoc struct {
+	content string
+	lines   []string
+	// starts holds the byte offset of each line in content.
+	starts []int
+}
+
+func newMarkdownDoc(content string) *markdownDoc {
+	doc := &markdownDoc{content: content, lines: strings.Split(content, "\n")}
+	doc.starts = make([]int, len(doc.lines))
+	offset := 0
+	for i, line := range doc.lines {
+		doc.starts[i] = offset
+		offset += len(line) + 1
+	}
+	return doc
+}
+
+// line returns line i without any carriage return ending it.
+func (d *markdownDoc) line(i int) string {
+	return strings.TrimSuffix(d.lines[i], "\r")
+}
+
+// end returns the offset in content just past line i.
+func (d *markdownDoc) end(i int) int {
+	return d.starts[i] + len(d.line(i))
+}
+
+// markdownHeading is a heading of a document and the lines of its body.
+type markdownHeading struct {
+	// Line is the index of the heading line, or -1 for the text before the
+	// first heading.
+	Line int
+	// Path is the titles of the heading and those it is nested under.
+	Path []string
+	// From and To are the lines of the body, To exclusive.
+	From, To int
+}
+
+// headings returns the document's headings in order, preceded by the text
+// before the first one.
+func (d *markdownDoc) headings() []markdownHeading {
+	type level struct {
+		depth int
+		title string
+	}
+	var stack []level
+	headings := []markdownHeading{{Line: -1}}
+	var fence string
+	for i := range d.lines {
+		line := d.line(i)
+		if fence != "" {
+			if closesFence(line, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if m := fencePattern.FindStringSubmatch(line); m != nil {
+			fence = m[1]
+			continue
+		}
+		m := headingPattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		headings[len(headings)-1].To = i
+		depth := len(m[1])
+		for len(stack) > 0 && stack[len(stack)-1].depth >= depth {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, level{depth: depth, title: strings.TrimSpace(m[2])})
+		path := make([]string, len(stack))
+		for j, l := range stack {
+			path[j] = l.title
+		}
+		headings = append(headings, markdownHeading{Line: i, Path: path, From: i + 1})
+	}
+	headings[len(headings)-1].To = len(d.lines)
+	return headings
+}
+
+// headingPathAt returns the heading path of the section that offset falls
+// in.
+func (d *markdownDoc) headingPathAt(offset int) []string {
+	var path []string
+	for _, h := range d.headings() {
+		if h.Line >= 0 && d.starts[h.Line] > offset {
+			break
+		}
+		path = h.Path
+	}
+	return path
+}
+
+// closesFence reports whether line closes a code block opened by fence: a
+// run of the same character at least as long, with nothing after it. Fences
+// may be indented, as they are in lists.
+func closesFence(line, fence string) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	run := len(trimmed) - len(strings.TrimLeft(trimmed, fence[:1]))
+	return run >= len(fence) && strings.TrimSpace(trimmed[run:]) == ""
+}
+
+// splitSection turns a heading and its body into sections of at most
+// maxBytes, where the body's blocks allow. A heading with an empty body
+// yields nothing. The first section runs from the heading line to the end
+// of its last block, as in the document; later ones start with the heading
+// line, followed by their blocks.
+func (d *markdownDoc) splitSection(h markdownHeading, maxBytes int) []markdownSection {
+	blocks := d.blocks(h.From, h.To)
+	if len(blocks) == 0 {
+		return nil
+	}
+	headingLine := ""
+	if h.Line >= 0 {
+		headingLine = d.line(h.Line)
+	}
+	var sections []markdownSection
+	first, last := -1, -1
+	emit := func() {
+		if first < 0 {
+			return
+		}
+		start := d.starts[blocks[first][0]]
+		end := d.end(blocks[last][1] - 1)
+		text := d.content[start:end]
+		if h.Line >= 0 {
+			if len(sections) == 0 {
+				start = d.starts[h.Line]
+				text = d.content[start:end]
+			} else {
+				text = headingLine + "\n" + text
+			}
+		}
+		sections = append(sections, markdownSection{HeadingPath: h.Path, Text: text, Start: start, End: end})
+		first, last = -1, -1
+	}
+	size := 0
+	for i, block := range blocks {
+		blockSize := d.end(block[1]-1) - d.starts[block[0]]
+		if first >= 0 && size+blockSize > maxBytes {
+			emit()
+		}
+		if first < 0 {
+			first = i
+			size = len(headingLine) + 1
+			if h.Line >= 0 && len(sections) == 0 {
+				size = d.starts[block[0]] - d.starts[h.Line]
+			}
+		} else {
+			size += d.starts[block[0]] - d.end(blocks[i-1][1]-1)
+		}
+		last = i
+		size += blockSize
+	}
+	emit()
+	return sections
+}
+
+// blocks splits lines from to to (exclusive) into blocks separated by blank
+// lines, keeping each fenced code block and each list, with the blank lines
+// between its items, in one block. Each block is a range of lines, the end
+// exclusive.
+func (d *markdownDoc) blocks(from, to int) [][2]int {
+	var blocks [][2]int
+	start := -1
+	inList := false
+	flush := func(end int) {
+		if start >= 0 {
+			blocks = append(blocks, [2]int{start, end})
+		}
+		start = -1
+		inList = false
+	}
+	var fence string
+	for i := from; i < to; i++ {
+		line := d.line(i)
+		if fence != "" {
+			if closesFence(line, fence) {
+				fence = ""
+			}
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			if inList && d.listContinues(i+1, to) {
+				continue
+			}
+			flush(i)
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		if m := fencePattern.FindStringSubmatch(line); m != nil {
+			fence = m[1]
+			continue
+		}
+		if listItemPattern.MatchString(line) {
+			inList = true
+		}
+	}
+	flush(to)
+	// A block running to the end of the body may end in blank lines.
+	if n := len(blocks); n > 0 {
+		for blocks[n-1][1] > blocks[n-1][0]+1 && strings.TrimSpace(d.line(blocks[n-1][1]-1)) == "" {
+			blocks[n-1][1]--
+		}
+	}
+	return blocks
+}
+
+// listContinues reports whether the first non-blank line from line from on
+// carries on a list: another item, or a line indented under the previous
+// one.
+func (d *markdownDoc) listContinues(from, to int) bool {
+	for i := from; i < to; i++ {
+		line := d.line(i)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		return listItemPattern.MatchString(line) || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+	}
+	return false
+}
+
+// mergeSections merges neighbouring sections until there are at most limit
+// of them, each time joining the pair that makes the smallest section. A
+// merged section keeps the heading path the two have in common. A limit of
+// zero or less leaves the sections as they are. A merged section spans both
+// sections in the document, if both were found there.
+func mergeSections(sections []markdownSection, limit int) []markdownSection {
+	if limit <= 0 {
+		return sections
+	}
+	for len(sections) > limit {
+		best := 0
+		for i := 1; i < len(sections)-1; i++ {
+			if len(sections[i].Text)+len(sections[i+1].Text) < len(sections[best].Text)+len(sections[best+1].Text) {
+				best = i
+			}
+		}
+		a, b := sections[best], sections[best+1]
+		merged := markdownSection{
+			HeadingPath: commonPrefix(a.HeadingPath, b.HeadingPath),
+			Text:        a.Text + "\n\n" + b.Text,
+			Start:       a.Start,
+			End:         b.End,
+		}
+		if a.End == 0 || b.End == 0 {
+			merged.Start, merged.End = 0, 0
+		}
+		sections = append(sections[:best], append([]markdownSection{merged}, sections[best+2:]...)...)
+	}
+	return sections
+}
+
+// commonPrefix returns the leading elements a and b share.
+func commonPrefix(a, b []string) []string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n:n]
+}
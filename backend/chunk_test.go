@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const chunkTestDoc = `Read this first.
+
+# Guide
+
+## Building
+
+Run the build:
+
+` + "```bash" + `
+# not a heading
+make build
+` + "```" + `
+
+## Style
+
+### Go
+
+- Run gofmt.
+
+- Run go vet:
+  ` + "```" + `
+  go vet ./...
+  ` + "```" + `
+- Keep functions short.
+
+Prefer table tests.
+
+## Empty ##
+`
+
+func TestSplitMarkdown(t *testing.T) {
+	sections := splitMarkdown(chunkTestDoc, maxSectionBytes)
+	want := []markdownSection{
+		{Text: "Read this first."},
+		{HeadingPath: []string{"Guide", "Building"}, Text: "## Building\n\nRun the build:\n\n```bash\n# not a heading\nmake build\n```"},
+		{HeadingPath: []string{"Guide", "Style", "Go"}, Text: "### Go\n\n- Run gofmt.\n\n- Run go vet:\n  ```\n  go vet ./...\n  ```\n- Keep functions short.\n\nPrefer table tests."},
+	}
+	for i := range sections {
+		// Sections that are not split are taken from the document as is.
+		if got := chunkTestDoc[sections[i].Start:sections[i].End]; got != sections[i].Text {
+			t.Errorf("section %d spans %q, want its text", i, got)
+		}
+		sections[i].Start, sections[i].End = 0, 0
+	}
+	if !reflect.DeepEqual(sections, want) {
+		t.Errorf("splitMarkdown =\n%q\nwant\n%q", sections, want)
+	}
+
+	// Carriage returns do not get in the way.
+	crlf := strings.ReplaceAll(chunkTestDoc, "\n", "\r\n")
+	if got := splitMarkdown(crlf, maxSectionBytes); len(got) != 3 || !reflect.DeepEqual(got[2].HeadingPath, want[2].HeadingPath) {
+		t.Errorf("splitMarkdown with CRLF line endings = %q", got)
+	}
+}
+
+func TestSplitMarkdown_LongSection(t *testing.T) {
+	// With a tiny size limit every block becomes a section of its own, but
+	// neither the list nor the code block is broken up.
+	sections := splitMarkdown(chunkTestDoc, 10)
+	var texts []string
+	for _, section := range sections {
+		texts = append(texts, section.Text)
+	}
+	want := []string{
+		"Read this first.",
+		"## Building\n\nRun the build:",
+		"## Building\n```bash\n# not a heading\nmake build\n```",
+		"### Go\n\n- Run gofmt.\n\n- Run go vet:\n  ```\n  go vet ./...\n  ```\n- Keep functions short.",
+		"### Go\nPrefer table tests.",
+	}
+	if !reflect.DeepEqual(texts, want) {
+		t.Errorf("splitMarkdown =\n%q\nwant\n%q", texts, want)
+	}
+	// A later part spans its blocks, without the repeated heading.
+	if got := chunkTestDoc[sections[2].Start:sections[2].End]; got != strings.TrimPrefix(want[2], "## Building\n") {
+		t.Errorf("second part of a section spans %q", got)
+	}
+}
+
+func TestSplitMarkdown_Sample(t *testing.T) {
+	content, err := os.ReadFile("../samples/GEMINI.md")
+	if err != nil {
+		t.Fatalf("Failed to read sample file: %v", err)
+	}
+	sections := splitMarkdown(string(content), maxSectionBytes)
+	if !reflect.DeepEqual(sections, splitMarkdown(string(content), maxSectionBytes)) {
+		t.Error("splitMarkdown is not deterministic")
+	}
+	// The "## React" heading only has subsections, so it is not a section
+	// itself, and one long subsection of it is split in two.
+	if len(sections) != 21 {
+		t.Errorf("got %d sections, want 21", len(sections))
+	}
+	for _, section := range sections {
+		if strings.Count(section.Text, "```")%2 != 0 {
+			t.Errorf("section %q splits a code block", section.HeadingPath)
+		}
+		if len(section.Text) > maxSectionBytes {
+			t.Errorf("section %q is %d bytes long", section.HeadingPath, len(section.Text))
+		}
+	}
+	if got := sections[2].HeadingPath; !reflect.DeepEqual(got, []string{"Writing Tests", "Test Structure and Framework"}) {
+		t.Errorf("heading path = %q", got)
+	}
+}
+
+func TestMergeSections(t *testing.T) {
+	sections := []markdownSection{
+		{HeadingPath: []string{"A", "B"}, Text: "long section b"},
+		{HeadingPath: []string{"A", "C"}, Text: "c"},
+		{HeadingPath: []string{"A", "D"}, Text: "d"},
+		{HeadingPath: []string{"E"}, Text: "long section e"},
+	}
+	got := mergeSections(sections, 3)
+	want := []markdownSection{
+		{HeadingPath: []string{"A", "B"}, Text: "long section b"},
+		{HeadingPath: []string{"A"}, Text: "c\n\nd"},
+		{HeadingPath: []string{"E"}, Text: "long section e"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSections = %q, want %q", got, want)
+	}
+	if got := mergeSections(want, 0); len(got) != 3 {
+		t.Errorf("mergeSections without a limit returned %d sections", len(got))
+	}
+}
+
+func TestExtractSnippets_Modes(t *testing.T) {
+	ctx := context.Background()
+	llm := newFakeLLM()
+	app := &App{llm: llm, retry: fastRetry}
+	p := app.newProgressReporter(&Job{SourceID: "chunking"})
+
+	app.chunking = ChunkingMarkdown
+	snippets, err := app.extractSnippets(ctx, p, chunkTestDoc, 0)
+	if err != nil || len(snippets) != 3 {
+		t.Fatalf("markdown extractSnippets = %v, %v; want 3 snippets", snippets, err)
+	}
+	if !reflect.DeepEqual(snippets[2].HeadingPath, []string{"Guide", "Style", "Go"}) {
+		t.Errorf("heading path = %q", snippets[2].HeadingPath)
+	}
+	if n := llm.Calls(fakeExtractSnippets) + llm.Calls(fakeRefineSection); n != 0 {
+		t.Errorf("markdown chunking called the model %d times", n)
+	}
+	if snippets, _ := app.extractSnippets(ctx, p, chunkTestDoc, 2); len(snippets) != 2 {
+		t.Errorf("markdown extractSnippets with a limit of 2 returned %d snippets", len(snippets))
+	}
+
+	app.chunking = ChunkingRefine
+	llm.QueueSnippets("Read this", "first.")
+	snippets, err = app.extractSnippets(ctx, p, chunkTestDoc, 0)
+	if err != nil || len(snippets) != 4 {
+		t.Fatalf("refine extractSnippets = %v, %v; want 4 snippets", snippets, err)
+	}
+	if n := llm.Calls(fakeRefineSection); n != 3 {
+		t.Errorf("RefineSection called %d times, want once per section", n)
+	}
+	if snippets[1].Text != "first." || snippets[3].HeadingPath[2] != "Go" {
+		t.Errorf("refined snippets = %+v", snippets)
+	}
+	if snippets, _ := app.extractSnippets(ctx, p, chunkTestDoc, 1); len(snippets) != 1 {
+		t.Errorf("refine extractSnippets with a limit of 1 returned %d snippets", len(snippets))
+	}
+
+	app.chunking = ChunkingLLM
+	if _, err := app.extractSnippets(ctx, p, chunkTestDoc, 0); err != nil || llm.Calls(fakeExtractSnippets) != 1 {
+		t.Errorf("llm extractSnippets = %v after %d calls, want one call", err, llm.Calls(fakeExtractSnippets))
+	}
+}
+
+func TestLocate(t *testing.T) {
+	content := "# Style\n\nRun   gofmt\nbefore committing.\n\nRun gofmt again."
+	tests := []struct {
+		text       string
+		from       int
+		start, end int
+		ok         bool
+	}{
+		{text: "Run gofmt again.", start: 41, end: 57, ok: true},
+		{text: "Run gofmt before committing.", start: 9, end: 39, ok: true},
+		{text: "Run gofmt", from: 20, start: 41, end: 50, ok: true},
+		{text: "Run go vet.", ok: false},
+		{text: " ", ok: false},
+	}
+	for _, tt := range tests {
+		start, end, ok := locate(content, tt.text, tt.from, len(content))
+		if start != tt.start || end != tt.end || ok != tt.ok {
+			t.Errorf("locate(%q) = %d, %d, %v; want %d, %d, %v", tt.text, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestExtractSnippets_LocatesModelOutput(t *testing.T) {
+	ctx := context.Background()
+	llm := newFakeLLM()
+	app := &App{llm: llm, retry: fastRetry}
+	p := app.newProgressReporter(&Job{SourceID: "locate"})
+
+	llm.QueueSnippets("Run the build:", "- Keep functions short.", "Invented text.")
+	snippets, err := app.extractSnippets(ctx, p, chunkTestDoc, 0)
+	if err != nil {
+		t.Fatalf("extractSnippets: %v", err)
+	}
+	if got := chunkTestDoc[snippets[1].Start:snippets[1].End]; got != "- Keep functions short." {
+		t.Errorf("snippet 2 spans %q", got)
+	}
+	if !reflect.DeepEqual(snippets[0].HeadingPath, []string{"Guide", "Building"}) || !reflect.DeepEqual(snippets[1].HeadingPath, []string{"Guide", "Style", "Go"}) {
+		t.Errorf("heading paths = %q, %q", snippets[0].HeadingPath, snippets[1].HeadingPath)
+	}
+	if snippets[2].End != 0 || snippets[2].HeadingPath != nil {
+		t.Errorf("invented snippet = %+v, want it unlocated", snippets[2])
+	}
+}
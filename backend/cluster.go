@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultSimilarityThreshold is the cosine similarity above which two
+// snippets are taken to give the same advice.
+const defaultSimilarityThreshold = 0.9
+
+// defaultSimilarLimit is how many snippets the similar endpoint returns
+// unless asked for another number.
+const defaultSimilarLimit = 10
+
+// dedupCandidateFactor is how many more candidates a deduplicated search
+// ranks, so that collapsing clusters still leaves a full page.
+const dedupCandidateFactor = 4
+
+// Cluster is a group of near-duplicate snippets, typically the same advice
+// copied between instruction files. Votes and sources are totalled over the
+// members.
+type Cluster struct {
+	// Canonical is the ID of the member that stands for the cluster.
+	Canonical string `json:"canonical"`
+	// Members are the IDs of the snippets in the cluster, oldest first.
+	Members    []string `json:"members"`
+	ThumbsUp   int      `json:"thumbs_up"`
+	ThumbsDown int      `json:"thumbs_down"`
+	// Sources is how many sources the members were extracted from.
+	Sources int `json:"sources"`
+}
+
+// clusterNeighbours is how many nearest neighbours of each snippet are
+// looked up to find its near-duplicates. Near-duplicates are each other's
+// closest matches, and larger groups are still joined through chains of
+// them, so a few are enough.
+const clusterNeighbours = 8
+
+// clusterLookups bounds how many nearest neighbour lookups a rebuild runs
+// at once against a store with a vector index.
+const clusterLookups = 8
+
+// neighbour is a snippet near another, and their cosine similarity.
+type neighbour struct {
+	id         string
+	similarity float64
+}
+
+// clusterIndex groups snippets into clusters of near-duplicates.
+type clusterIndex struct {
+	// byID maps the ID of every clustered snippet to its cluster.
+	byID map[string]*Cluster
+	// snippets maps snippet IDs to copies of the snippets, without their
+	// embeddings.
+	snippets map[string]*Snippet
+	// neighbours maps the ID of every clustered snippet to its nearest
+	// neighbours, most similar first, whatever their similarity.
+	neighbours map[string][]neighbour
+}
+
+// nearestNeighbours returns the nearest neighbours of the embedded,
+// unquarantined snippets, looking them up with nearest, up to
+// clusterLookups at a time. A snippet's neighbours in known are reused
+// unless one of them is gone, so that only new snippets are looked up.
+func nearestNeighbours(ctx context.Context, snippets []*Snippet, known map[string][]neighbour,
+	nearest func(ctx context.Context, embedding []float32, limit int) ([]ScoredSnippet, error)) (map[string][]neighbour, error) {
+	live := make(map[string]bool, len(snippets))
+	for _, snippet := range snippets {
+		if len(snippet.Embedding) > 0 && len(snippet.Quarantine) == 0 {
+			live[snippet.ID] = true
+		}
+	}
+	out := make(map[string][]neighbour, len(live))
+	var lookup []*Snippet
+snippets:
+	for _, snippet := range snippets {
+		if !live[snippet.ID] {
+			continue
+		}
+		if list, ok := known[snippet.ID]; ok {
+			for _, n := range list {
+				if !live[n.id] {
+					list = nil
+					break
+				}
+			}
+			if list != nil {
+				out[snippet.ID] = list
+				continue snippets
+			}
+		}
+		lookup = append(lookup, snippet)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var firstErr error
+	sem := make(chan struct{}, clusterLookups)
+	for _, snippet := range lookup {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// The snippet itself is among the nearest, so ask for one more.
+			scored, err := nearest(ctx, snippet.Embedding, clusterNeighbours+1)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				return
+			}
+			list := []neighbour{}
+			for _, s := range scored {
+				if s.Snippet.ID != snippet.ID && len(list) < clusterNeighbours {
+					list = append(list, neighbour{id: s.Snippet.ID, similarity: s.Score})
+				}
+			}
+			out[snippet.ID] = list
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return out, nil
+}
+
+// newClusterIndex clusters the embedded, unquarantined snippets: any two
+// where one is among the other's neighbours with a cosine similarity of at
+// least threshold end up in the same cluster, along with anything similar
+// to either of them.
+func newClusterIndex(snippets []*Snippet, neighbours map[string][]neighbour, threshold float64) *clusterIndex {
+	var embedded []*Snippet
+	index := make(map[string]int)
+	for _, snippet := range snippets {
+		if _, ok := neighbours[snippet.ID]; !ok || len(snippet.Embedding) == 0 || len(snippet.Quarantine) > 0 {
+			continue
+		}
+		index[snippet.ID] = len(embedded)
+		embedded = append(embedded, snippet)
+	}
+
+	// Union-find over the pairs above the threshold. similarity[i] sums
+	// each snippet's similarity to the others in its cluster.
+	parent := make([]int, len(embedded))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	similarity := make([]float64, len(embedded))
+	seen := make(map[[2]int]bool)
+	for i, snippet := range embedded {
+		for _, n := range neighbours[snippet.ID] {
+			j, ok := index[n.id]
+			if !ok || n.similarity < threshold {
+				continue
+			}
+			pair := [2]int{min(i, j), max(i, j)}
+			if seen[pair] {
+				continue
+			}
+			seen[pair] = true
+			parent[find(i)] = find(j)
+			similarity[i] += n.similarity
+			similarity[j] += n.similarity
+		}
+	}
+
+	idx := &clusterIndex{byID: make(map[string]*Cluster), snippets: make(map[string]*Snippet), neighbours: neighbours}
+	groups := make(map[int][]int)
+	var roots []int
+	for i := range embedded {
+		root := find(i)
+		if _, ok := groups[root]; !ok {
+			roots = append(roots, root)
+		}
+		groups[root] = append(groups[root], i)
+	}
+	for _, root := range roots {
+		members := groups[root]
+		sort.SliceStable(members, func(a, b int) bool {
+			return embedded[members[a]].CreatedAt.Before(embedded[members[b]].CreatedAt)
+		})
+		cluster := &Cluster{}
+		sources := make(map[string]bool)
+		best := -1
+		for _, i := range members {
+			snippet := embedded[i]
+			cluster.Members = append(cluster.Members, snippet.ID)
+			cluster.ThumbsUp += snippet.ThumbsUp
+			cluster.ThumbsDown += snippet.ThumbsDown
+			sources[snippet.SourceID] = true
+			if best < 0 || canonicalBefore(snippet, similarity[i], embedded[best], similarity[best]) {
+				best = i
+			}
+
+			stored := *snippet
+			stored.Embedding = nil
+			idx.snippets[snippet.ID] = &stored
+			idx.byID[snippet.ID] = cluster
+		}
+		cluster.Canonical = embedded[best].ID
+		cluster.Sources = len(sources)
+	}
+	return idx
+}
+
+// canonicalBefore reports whether snippet a, whose similarities to the rest
+// of its cluster sum to simA, makes a better canonical member than b. The
+// best voted snippet wins, then the one closest to the others, so that a
+// cluster is represented by its most typical wording.
+func canonicalBefore(a *Snippet, simA float64, b *Snippet, simB float64) bool {
+	if va, vb := voteBalance(a), voteBalance(b); va != vb {
+		return va > vb
+	}
+	return simA > simB
+}
+
+// cluster returns the cluster of the snippet with the given ID, or nil if
+// the snippet was not clustered.
+func (idx *clusterIndex) cluster(id string) *Cluster {
+	return idx.byID[id]
+}
+
+// canonical returns the canonical snippet of a cluster.
+func (idx *clusterIndex) canonical(cluster *Cluster) *Snippet {
+	return idx.snippets[cluster.Canonical]
+}
+
+// clusterCache holds the clusters of all snippets, rebuilt from the store
+// when it is invalidated or older than lexicalIndexTTL. The neighbours of
+// each snippet are kept across rebuilds, so a rebuild only looks up those
+// of the snippets stored since the last one. One request rebuilds at a
+// time, without holding mu; the others use the previous clusters meanwhile,
+// or wait for the first ones.
+type clusterCache struct {
+	// Threshold is the lowest cosine similarity between near-duplicates.
+	// Zero means defaultSimilarityThreshold.
+	Threshold float64
+
+	mu      sync.Mutex
+	index   *clusterIndex
+	builtAt time.Time
+	// building is closed when the rebuild in progress, if any, ends.
+	building chan struct{}
+	// generation counts invalidations, so that a rebuild that overlapped
+	// one is not taken to be fresh.
+	generation int
+}
+
+// threshold returns the lowest cosine similarity between near-duplicates.
+func (c *clusterCache) threshold() float64 {
+	if c.Threshold == 0 {
+		return defaultSimilarityThreshold
+	}
+	return c.Threshold
+}
+
+// get returns the cached clusters, rebuilding them from store if needed.
+func (c *clusterCache) get(ctx context.Context, store SnippetStore) (*clusterIndex, error) {
+	c.mu.Lock()
+	for {
+		if c.index != nil && (c.building != nil || time.Since(c.builtAt) < lexicalIndexTTL) {
+			index := c.index
+			c.mu.Unlock()
+			return index, nil
+		}
+		if c.building == nil {
+			break
+		}
+		// The first clusters are being built; wait for them.
+		building := c.building
+		c.mu.Unlock()
+		select {
+		case <-building:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	var known map[string][]neighbour
+	if c.index != nil {
+		known = c.index.neighbours
+	}
+	building, generation := make(chan struct{}), c.generation
+	c.building = building
+	c.mu.Unlock()
+
+	index, err := c.build(ctx, store, known)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.building = nil
+	close(building)
+	if err != nil {
+		return nil, err
+	}
+	c.index = index
+	if c.generation == generation {
+		c.builtAt = time.Now()
+	}
+	return index, nil
+}
+
+// build clusters the snippets in store, reusing the neighbours in known.
+// Stores without a vector index compare each embedding against every
+// snippet, so the neighbours are ranked in memory among the snippets
+// already listed rather than by listing them again for each one.
+func (c *clusterCache) build(ctx context.Context, store SnippetStore, known map[string][]neighbour) (*clusterIndex, error) {
+	snippets, err := store.ListSnippets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nearest := func(ctx context.Context, embedding []float32, limit int) ([]ScoredSnippet, error) {
+		return store.NearestSnippets(ctx, embedding, SnippetFilter{}, limit)
+	}
+	if indexed, ok := store.(vectorIndexer); !ok || !indexed.vectorIndexed() {
+		nearest = func(ctx context.Context, embedding []float32, limit int) ([]ScoredSnippet, error) {
+			return rankByEmbedding(snippets, embedding, SnippetFilter{}, limit), nil
+		}
+	}
+	neighbours, err := nearestNeighbours(ctx, snippets, known, nearest)
+	if err != nil {
+		return nil, err
+	}
+	return newClusterIndex(snippets, neighbours, c.threshold()), nil
+}
+
+// invalidate makes the next get rebuild the clusters.
+func (c *clusterCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.builtAt = time.Time{}
+	c.generation++
+}
+
+// dedupResults collapses ranked results that belong to the same cluster into
+// the best ranked of them, which stands in for the cluster's canonical
+// snippet if that passes filter. Every result is given its cluster.
+func dedupResults(results []*SearchResult, clusters *clusterIndex, filter SnippetFilter) []*SearchResult {
+	seen := make(map[*Cluster]bool)
+	var out []*SearchResult
+	for _, r := range results {
+		cluster := clusters.cluster(r.Snippet.ID)
+		if cluster == nil {
+			out = append(out, r)
+			continue
+		}
+		if seen[cluster] {
+			continue
+		}
+		seen[cluster] = true
+		if canonical := clusters.canonical(cluster); canonical.ID != r.Snippet.ID && filter.matches(canonical) {
+			snippet := *canonical
+			r.Snippet = &snippet
+		}
+		r.Cluster = cluster
+		out = append(out, r)
+	}
+	return out
+}
+
+// SimilarResponse is the body returned by the similar snippets endpoint.
+type SimilarResponse struct {
+	SnippetID string  `json:"snippetId"`
+	Threshold float64 `json:"threshold"`
+	// Cluster is the snippet's cluster of near-duplicates, if it has an
+	// embedding.
+	Cluster *Cluster        `json:"cluster,omitempty"`
+	Results []ScoredSnippet `json:"results"`
+}
+
+// similarHandler serves GET /api/v1/snippets/{id}/similar. It returns up to
+// limit other snippets whose cosine similarity to the snippet is at least
+// threshold, most similar first, along with the snippet's cluster. The
+// threshold defaults to the one clusters are built with.
+func (app *App) similarHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, err := intParam(params.Get("limit"), defaultSimilarLimit, 1, maxSearchLimit)
+	if err != nil {
+		http.Error(w, "Invalid 'limit': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	threshold, err := floatParam(params.Get("threshold"), app.clusters.threshold(), -1, 1)
+	if err != nil {
+		http.Error(w, "Invalid 'threshold': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	snippet, err := app.store.GetSnippet(ctx, r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) || (err == nil && len(snippet.Quarantine) > 0) {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get snippet", http.StatusInternalServerError)
+		log.Printf("Failed to get snippet: %v", err)
+		return
+	}
+
+	resp := SimilarResponse{SnippetID: snippet.ID, Threshold: threshold, Results: []ScoredSnippet{}}
+	if len(snippet.Embedding) > 0 {
+		// The snippet itself is among the nearest, so ask for one more.
+		nearest, err := app.store.NearestSnippets(ctx, snippet.Embedding, SnippetFilter{}, limit+1)
+		if err != nil {
+			http.Error(w, "Failed to find similar snippets", http.StatusInternalServerError)
+			log.Printf("Failed to find similar snippets: %v", err)
+			return
+		}
+		for _, scored := range nearest {
+			if scored.Snippet.ID != snippet.ID && scored.Score >= threshold && len(resp.Results) < limit {
+				resp.Results = append(resp.Results, scored)
+			}
+		}
+		clusters, err := app.clusters.get(ctx, app.store)
+		if err != nil {
+			http.Error(w, "Failed to cluster snippets", http.StatusInternalServerError)
+			log.Printf("Failed to cluster snippets: %v", err)
+			return
+		}
+		resp.Cluster = clusters.cluster(snippet.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
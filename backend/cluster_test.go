@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewClusterIndex(t *testing.T) {
+	start := time.Now()
+	snippet := func(id, source string, up int, embedding ...float32) *Snippet {
+		return &Snippet{ID: id, SourceID: source, ThumbsUp: up, Embedding: embedding, CreatedAt: start.Add(time.Duration(len(id)) * time.Second)}
+	}
+	snippets := []*Snippet{
+		snippet("a", "s1", 0, 1, 0, 0),
+		snippet("bb", "s2", 2, 0.95, 0.1, 0),
+		// Similar to bb but not to a: it joins their cluster through bb.
+		snippet("ccc", "s2", 0, 0.85, 0.3, 0),
+		snippet("dddd", "s3", 1, 0, 1, 0),
+		snippet("eeeee", "s3", 0),
+		{ID: "ffffff", SourceID: "s1", Embedding: []float32{1, 0, 0}, Quarantine: []QuarantineReason{{Code: QuarantineDangerousCommand}}},
+	}
+	neighbours := func() map[string][]neighbour {
+		t.Helper()
+		out, err := nearestNeighbours(context.Background(), snippets, nil, func(ctx context.Context, embedding []float32, limit int) ([]ScoredSnippet, error) {
+			return rankByEmbedding(snippets, embedding, SnippetFilter{}, limit), nil
+		})
+		if err != nil {
+			t.Fatalf("nearestNeighbours: %v", err)
+		}
+		return out
+	}
+	idx := newClusterIndex(snippets, neighbours(), 0.95)
+
+	cluster := idx.cluster("a")
+	want := &Cluster{Canonical: "bb", Members: []string{"a", "bb", "ccc"}, ThumbsUp: 2, Sources: 2}
+	if !reflect.DeepEqual(cluster, want) {
+		t.Errorf("cluster = %+v, want %+v", cluster, want)
+	}
+	if idx.cluster("ccc") != cluster {
+		t.Error("ccc is not in the cluster of a")
+	}
+	if single := idx.cluster("dddd"); single == nil || single.Canonical != "dddd" || len(single.Members) != 1 {
+		t.Errorf("cluster of dddd = %+v, want it alone", single)
+	}
+	if idx.cluster("eeeee") != nil || idx.cluster("ffffff") != nil {
+		t.Error("unembedded or quarantined snippets were clustered")
+	}
+	if idx.canonical(cluster).Embedding != nil {
+		t.Error("the index kept embeddings")
+	}
+
+	// Without votes the snippet closest to the rest wins.
+	snippets[1].ThumbsUp = 0
+	if got := newClusterIndex(snippets, neighbours(), 0.95).cluster("a").Canonical; got != "bb" {
+		t.Errorf("canonical = %q, want the central bb", got)
+	}
+	snippets[2].ThumbsUp = 1
+	if got := newClusterIndex(snippets, neighbours(), 0.95).cluster("a").Canonical; got != "ccc" {
+		t.Errorf("canonical = %q, want the upvoted ccc", got)
+	}
+}
+
+func TestNearestNeighbours(t *testing.T) {
+	ctx := context.Background()
+	snippets := []*Snippet{
+		{ID: "a", Embedding: []float32{1, 0}},
+		{ID: "b", Embedding: []float32{0.9, 0.1}},
+		{ID: "c", Embedding: []float32{0, 1}},
+		{ID: "d"},
+	}
+	var mu sync.Mutex
+	var lookups []string
+	nearest := func(ctx context.Context, embedding []float32, limit int) ([]ScoredSnippet, error) {
+		results := rankByEmbedding(snippets, embedding, SnippetFilter{}, limit)
+		mu.Lock()
+		defer mu.Unlock()
+		lookups = append(lookups, results[0].Snippet.ID)
+		return results, nil
+	}
+	known, err := nearestNeighbours(ctx, snippets, nil, nearest)
+	if err != nil {
+		t.Fatalf("nearestNeighbours: %v", err)
+	}
+	if len(known) != 3 || len(known["a"]) != 2 || known["a"][0].id != "b" {
+		t.Fatalf("neighbours = %+v", known)
+	}
+
+	// Only the new snippet and those whose neighbours are gone are looked
+	// up again.
+	snippets = append(snippets[:2], &Snippet{ID: "e", Embedding: []float32{0.1, 0.9}})
+	lookups = nil
+	got, err := nearestNeighbours(ctx, snippets, known, nearest)
+	if err != nil {
+		t.Fatalf("nearestNeighbours: %v", err)
+	}
+	sort.Strings(lookups)
+	if want := []string{"a", "b", "e"}; !reflect.DeepEqual(lookups, want) {
+		t.Errorf("looked up %v, want %v", lookups, want)
+	}
+	if len(got) != 3 || got["e"][0].id != "b" {
+		t.Errorf("neighbours = %+v", got)
+	}
+	lookups = nil
+	if _, err := nearestNeighbours(ctx, snippets, got, nearest); err != nil || len(lookups) != 0 {
+		t.Errorf("unchanged snippets were looked up again: %v, %v", lookups, err)
+	}
+}
+
+// countingStore counts the snippet listings and nearest neighbour lookups
+// made against a memory store, which may claim a vector index.
+type countingStore struct {
+	*memoryStore
+	indexed        bool
+	lists, nearest atomic.Int32
+}
+
+func (s *countingStore) vectorIndexed() bool { return s.indexed }
+
+func (s *countingStore) ListSnippets(ctx context.Context) ([]*Snippet, error) {
+	s.lists.Add(1)
+	return s.memoryStore.ListSnippets(ctx)
+}
+
+func (s *countingStore) NearestSnippets(ctx context.Context, embedding []float32, filter SnippetFilter, limit int) ([]ScoredSnippet, error) {
+	s.nearest.Add(1)
+	return s.memoryStore.NearestSnippets(ctx, embedding, filter, limit)
+}
+
+func TestClusterCache_Build(t *testing.T) {
+	ctx := context.Background()
+	for _, indexed := range []bool{false, true} {
+		store := &countingStore{memoryStore: newMemoryStore(), indexed: indexed}
+		sourceID, _ := store.CreateSource(ctx, &Source{Key: "a"})
+		for _, embedding := range [][]float32{{1, 0}, {0.99, 0.1}, {0, 1}} {
+			store.AddSnippet(ctx, &Snippet{SourceID: sourceID, Content: "snippet", Embedding: embedding})
+		}
+
+		// Without an index, the listed snippets are ranked in memory rather
+		// than listed again for each one.
+		var cache clusterCache
+		clusters, err := cache.get(ctx, store)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		wantNearest := int32(0)
+		if indexed {
+			wantNearest = 3
+		}
+		if lists, nearest := store.lists.Load(), store.nearest.Load(); lists != 1 || nearest != wantNearest {
+			t.Errorf("indexed %v: %d listings and %d lookups, want 1 and %d", indexed, lists, nearest, wantNearest)
+		}
+		if len(clusters.neighbours) != 3 {
+			t.Errorf("indexed %v: neighbours = %+v", indexed, clusters.neighbours)
+		}
+		if again, _ := cache.get(ctx, store); again != clusters || store.lists.Load() != 1 {
+			t.Errorf("indexed %v: fresh clusters were rebuilt", indexed)
+		}
+	}
+}
+
+// nearDuplicates are instructions the fake embeddings put in one cluster,
+// and a third that is unrelated.
+var nearDuplicates = []string{
+	"Use conventional commits for every change.",
+	"Always use conventional commits for every change.",
+	"Run gofmt on Go code.",
+}
+
+// byContent returns the IDs of the snippets in app's store, in the order of
+// their texts in contents.
+func byContent(t *testing.T, app *App, contents []string) []string {
+	t.Helper()
+	snippets, err := app.store.ListSnippets(context.Background())
+	if err != nil {
+		t.Fatalf("ListSnippets: %v", err)
+	}
+	ids := make([]string, len(contents))
+	for _, snippet := range snippets {
+		for i, content := range contents {
+			if snippet.Content == content {
+				ids[i] = snippet.ID
+			}
+		}
+	}
+	return ids
+}
+
+func TestSimilarHandler(t *testing.T) {
+	app := newSearchTestApp(t, nearDuplicates, [][]string{{"git"}, {"git"}, {"go"}})
+	ids := byContent(t, app, nearDuplicates)
+
+	similar := func(id, query string) (int, SimilarResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/snippets/"+id+"/similar?"+query, nil)
+		req.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		app.similarHandler(rr, req)
+		var resp SimilarResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := similar(ids[0], "")
+	if code != http.StatusOK {
+		t.Fatalf("similar returned status %d", code)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Snippet.ID != ids[1] || resp.Threshold != defaultSimilarityThreshold {
+		t.Errorf("similar = %+v, want the other commit snippet", resp)
+	}
+	if resp.Cluster == nil || len(resp.Cluster.Members) != 2 || resp.Cluster.Sources != 1 {
+		t.Errorf("cluster = %+v", resp.Cluster)
+	}
+
+	if _, resp := similar(ids[0], "threshold=-1&limit=5"); len(resp.Results) != 2 {
+		t.Errorf("similar with no threshold returned %d results, want 2", len(resp.Results))
+	}
+	if code, _ := similar("missing", ""); code != http.StatusNotFound {
+		t.Errorf("similar for a missing snippet returned status %d", code)
+	}
+	if code, _ := similar(ids[0], "threshold=2"); code != http.StatusBadRequest {
+		t.Errorf("threshold 2 returned status %d", code)
+	}
+}
+
+func TestSearchHandler_Dedup(t *testing.T) {
+	app := newSearchTestApp(t, nearDuplicates, [][]string{{"git"}, {"git"}, {"go"}})
+	ctx := context.Background()
+	ids := byContent(t, app, nearDuplicates)
+	for _, user := range []string{"alice", "bob"} {
+		app.store.SetVote(ctx, ids[0], user, VoteThumbsUp)
+	}
+
+	if _, resp := doSearch(t, app, "q=always+conventional+commits"); len(resp.Results) != 3 || resp.Results[0].Cluster != nil {
+		t.Errorf("search without dedup = %+v, want every snippet", resp.Results)
+	}
+
+	_, resp := doSearch(t, app, "q=always+conventional+commits&dedup=true")
+	if !resp.Dedup || len(resp.Results) != 2 {
+		t.Fatalf("dedup search = %+v, want one result per cluster", resp)
+	}
+	top := resp.Results[0]
+	// The better match stands in for the upvoted canonical snippet.
+	if top.Snippet.ID != ids[0] || top.Cluster == nil || top.Cluster.ThumbsUp != 2 || len(top.Cluster.Members) != 2 {
+		t.Errorf("top result = %+v, want the canonical snippet with its cluster", top)
+	}
+	if top.Components.Votes != 0.5 {
+		t.Errorf("votes = %v, want the cluster's", top.Components.Votes)
+	}
+
+	if code, _ := doSearch(t, app, "q=commits&dedup=maybe"); code != http.StatusBadRequest {
+		t.Errorf("dedup=maybe returned status %d", code)
+	}
+}
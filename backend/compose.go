@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultComposeLimit is how many snippets a query selects unless asked for
+// another number.
+const defaultComposeLimit = 20
+
+// generalLabel heads the snippets that carry no label.
+const generalLabel = "general"
+
+// SnippetSelection picks the snippets of an instruction file, either by ID
+// or by searching for Query.
+type SnippetSelection struct {
+	// SnippetIDs lists the snippets to include, in order.
+	SnippetIDs []string `json:"snippetIds,omitempty"`
+	// Query selects the best matching snippets, up to Limit, that carry
+	// every one of Labels and are no less safe than MaxSafety.
+	Query     string   `json:"query,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+	MaxSafety *float64 `json:"maxSafety,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+// validate checks a selection and fills in its defaults. Its error is meant
+// for the client.
+func (s *SnippetSelection) validate() error {
+	s.Query = strings.TrimSpace(s.Query)
+	if (len(s.SnippetIDs) == 0) == (s.Query == "") {
+		return errors.New("Exactly one of 'snippetIds' and 'query' is required")
+	}
+	if s.Limit == 0 {
+		s.Limit = defaultComposeLimit
+	}
+	if s.Limit < 1 || s.Limit > maxSearchLimit {
+		return fmt.Errorf("Invalid 'limit': must be between 1 and %d", maxSearchLimit)
+	}
+	if s.MaxSafety != nil && (*s.MaxSafety < 0 || *s.MaxSafety > 1) {
+		return errors.New("Invalid 'maxSafety': must be between 0 and 1")
+	}
+	return nil
+}
+
+// ComposeRequest is the body accepted by the compose endpoint.
+type ComposeRequest struct {
+	SnippetSelection
+	// Format is one of the formats written as a single file, FormatAgents
+	// by default.
+	Format string `json:"format,omitempty"`
+	// Title replaces the format's default title as the document's heading.
+	Title string `json:"title,omitempty"`
+}
+
+// ComposeResponse is the body returned by the compose endpoint.
+type ComposeResponse struct {
+	Format string `json:"format"`
+	// Path is where the file goes in a repository.
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	// Snippets are the IDs of the snippets in the document, in the order
+	// they appear.
+	Snippets []string `json:"snippets"`
+	// Omitted lists the selected snippets left out as duplicates.
+	Omitted []OmittedSnippet `json:"omitted,omitempty"`
+	// Conflicts lists the pairs of included snippets found to conflict.
+	Conflicts []*ConflictCheck `json:"conflicts,omitempty"`
+}
+
+// OmittedSnippet is a selected snippet left out of a composition because it
+// repeats another.
+type OmittedSnippet struct {
+	ID          string `json:"id"`
+	DuplicateOf string `json:"duplicateOf"`
+}
+
+// composition is a selection of snippets arranged for an instruction file.
+type composition struct {
+	// Title replaces the format's default title.
+	Title  string
+	Groups []composedGroup
+	// Sources maps the IDs of the snippets' sources to the sources.
+	Sources map[string]*Source
+}
+
+// composedGroup is the snippets filed under one label.
+type composedGroup struct {
+	Label    string
+	Snippets []*Snippet
+}
+
+// snippetIDs returns the IDs of the snippets in c, in order.
+func (c *composition) snippetIDs() []string {
+	ids := []string{}
+	for _, group := range c.Groups {
+		for _, snippet := range group.Snippets {
+			ids = append(ids, snippet.ID)
+		}
+	}
+	return ids
+}
+
+// composeHandler serves POST /api/v1/compose. It builds an instruction file
+// from the snippets given by ID, or found by a query, leaving out near
+// duplicates. The file groups the snippets under their labels, with their
+// titles as headings, and ends with the sources they came from. With an
+// Accept header of text/markdown the file itself is returned; otherwise it
+// comes in a ComposeResponse along with any conflicts between its snippets.
+// Formats written as several files are served by exportHandler.
+func (app *App) composeHandler(w http.ResponseWriter, r *http.Request) {
+	var req ComposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = FormatAgents
+	}
+	format, ok := instructionFormats[req.Format]
+	if !ok {
+		http.Error(w, "Invalid 'format': must be one of "+strings.Join(exportFormats, ", "), http.StatusBadRequest)
+		return
+	}
+	if format.Path == "" {
+		http.Error(w, fmt.Sprintf("Format %q is written as several files; use /api/v1/export", req.Format), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	c, omitted, err := app.composeSelection(ctx, req.SnippetSelection, req.Title)
+	if err != nil {
+		composeError(w, err)
+		return
+	}
+	file := format.export(c, format)[0]
+
+	if strings.Contains(r.Header.Get("Accept"), "text/markdown") {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(file.Path)))
+		w.Write([]byte(file.Content))
+		return
+	}
+
+	resp := ComposeResponse{Format: req.Format, Path: file.Path, Content: file.Content, Snippets: c.snippetIDs(), Omitted: omitted}
+	if resp.Conflicts, err = app.conflictsAmong(ctx, resp.Snippets); err != nil {
+		// The document is still good; it just comes without warnings.
+		log.Printf("Failed to look up conflicts: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// composeSelection selects the snippets of an instruction file, leaves out
+// the near-duplicates and arranges the rest.
+func (app *App) composeSelection(ctx context.Context, sel SnippetSelection, title string) (*composition, []OmittedSnippet, error) {
+	snippets, err := app.selectSnippets(ctx, sel)
+	if err != nil {
+		return nil, nil, err
+	}
+	snippets, omitted, err := app.dedupSnippets(ctx, snippets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to deduplicate snippets: %v", err)
+	}
+	c, err := app.compose(ctx, snippets, title)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, omitted, nil
+}
+
+// composeError writes an error returned by composeSelection.
+func composeError(w http.ResponseWriter, err error) {
+	var invalid *invalidSelectionError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Failed to compose instructions", http.StatusInternalServerError)
+	log.Printf("Failed to compose instructions: %v", err)
+}
+
+// invalidSelectionError reports snippet IDs that cannot be composed.
+type invalidSelectionError struct {
+	reason string
+	ids    []string
+}
+
+func (e *invalidSelectionError) Error() string {
+	return fmt.Sprintf("%s: %s", e.reason, strings.Join(e.ids, ", "))
+}
+
+// selectSnippets returns the snippets req asks for: those it lists by ID,
+// in order, or the best matches for its query. Listing an unknown or
+// quarantined snippet is an invalidSelectionError.
+func (app *App) selectSnippets(ctx context.Context, req SnippetSelection) ([]*Snippet, error) {
+	if req.Query != "" {
+		filter := SnippetFilter{Labels: req.Labels, MaxSafety: req.MaxSafety}
+		results, err := app.search(ctx, req.Query, SearchModeHybrid, 0, filter, true, req.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search snippets: %v", err)
+		}
+		snippets := make([]*Snippet, len(results))
+		for i, result := range results {
+			snippets[i] = result.Snippet
+		}
+		return snippets, nil
+	}
+
+	var snippets []*Snippet
+	var missing, quarantined []string
+	seen := make(map[string]bool)
+	for _, id := range req.SnippetIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		snippet, err := app.store.GetSnippet(ctx, id)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			missing = append(missing, id)
+		case err != nil:
+			return nil, fmt.Errorf("failed to get snippet %s: %v", id, err)
+		case len(snippet.Quarantine) > 0:
+			quarantined = append(quarantined, id)
+		default:
+			snippets = append(snippets, snippet)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &invalidSelectionError{reason: "Unknown snippets", ids: missing}
+	}
+	if len(quarantined) > 0 {
+		return nil, &invalidSelectionError{reason: "Quarantined snippets", ids: quarantined}
+	}
+	return snippets, nil
+}
+
+// dedupSnippets drops the snippets that repeat an earlier one, either word
+// for word or by falling in the same cluster of near-duplicates, and returns
+// the rest along with what was dropped.
+func (app *App) dedupSnippets(ctx context.Context, snippets []*Snippet) ([]*Snippet, []OmittedSnippet, error) {
+	clusters, err := app.clusters.get(ctx, app.store)
+	if err != nil {
+		return nil, nil, err
+	}
+	var kept []*Snippet
+	var omitted []OmittedSnippet
+	byText := make(map[string]string)
+	byCluster := make(map[*Cluster]string)
+	for _, snippet := range snippets {
+		text := strings.Join(tokenize(snippet.Content), " ")
+		cluster := clusters.cluster(snippet.ID)
+		if id, ok := byText[text]; ok {
+			omitted = append(omitted, OmittedSnippet{ID: snippet.ID, DuplicateOf: id})
+			continue
+		}
+		if id, ok := byCluster[cluster]; ok && cluster != nil {
+			omitted = append(omitted, OmittedSnippet{ID: snippet.ID, DuplicateOf: id})
+			continue
+		}
+		byText[text] = snippet.ID
+		if cluster != nil {
+			byCluster[cluster] = snippet.ID
+		}
+		kept = append(kept, snippet)
+	}
+	return kept, omitted, nil
+}
+
+// compose arranges snippets for an instruction file. Each snippet is filed
+// under the one of its labels shared by the most snippets, so that related
+// snippets end up together; bigger groups come first.
+func (app *App) compose(ctx context.Context, snippets []*Snippet, title string) (*composition, error) {
+	counts := make(map[string]int)
+	for _, snippet := range snippets {
+		for _, label := range snippet.Labels {
+			counts[label]++
+		}
+	}
+	c := &composition{Title: title}
+	groups := make(map[string]int)
+	for _, snippet := range snippets {
+		label := generalLabel
+		best := 0
+		for _, l := range snippet.Labels {
+			if counts[l] > best {
+				label, best = l, counts[l]
+			}
+		}
+		i, ok := groups[label]
+		if !ok {
+			i = len(c.Groups)
+			groups[label] = i
+			c.Groups = append(c.Groups, composedGroup{Label: label})
+		}
+		c.Groups[i].Snippets = append(c.Groups[i].Snippets, snippet)
+	}
+	sortGroups(c.Groups)
+
+	c.Sources = make(map[string]*Source)
+	for _, snippet := range snippets {
+		if _, ok := c.Sources[snippet.SourceID]; ok {
+			continue
+		}
+		source, err := app.store.GetSource(ctx, snippet.SourceID)
+		if errors.Is(err, ErrNotFound) {
+			source = &Source{ID: snippet.SourceID}
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to get source %s: %v", snippet.SourceID, err)
+		}
+		c.Sources[snippet.SourceID] = source
+	}
+	return c, nil
+}
+
+// sortGroups orders groups biggest first, keeping the order of equal ones.
+func sortGroups(groups []composedGroup) {
+	for i := 1; i < len(groups); i++ {
+		for j := i; j > 0 && len(groups[j].Snippets) > len(groups[j-1].Snippets); j-- {
+			groups[j], groups[j-1] = groups[j-1], groups[j]
+		}
+	}
+}
+
+// renderMarkdown writes a composition as a markdown instruction file: a
+// title and introduction, a section per label with a subsection per
+// snippet, and a footer listing the sources.
+func renderMarkdown(c *composition, format instructionFormat) string {
+	title := c.Title
+	if title == "" {
+		title = format.Title
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n%s\n", title, format.Intro)
+	var snippets []*Snippet
+	for _, group := range c.Groups {
+		fmt.Fprintf(&b, "\n## %s\n", labelHeading(group.Label))
+		writeSnippets(&b, group.Snippets, 3)
+		snippets = append(snippets, group.Snippets...)
+	}
+	b.WriteString(provenanceFooter(snippets, c.Sources))
+	return b.String()
+}
+
+// writeSnippets writes each snippet's title as a heading of the given level,
+// followed by its content.
+func writeSnippets(b *strings.Builder, snippets []*Snippet, level int) {
+	for _, snippet := range snippets {
+		fmt.Fprintf(b, "\n%s %s\n\n%s\n", strings.Repeat("#", level), snippetTitle(snippet), demoteHeadings(strings.TrimSpace(snippet.Content), level))
+	}
+}
+
+// provenanceFooter lists where snippets came from, by source in order of
+// first use. sources maps source IDs to the sources.
+func provenanceFooter(snippets []*Snippet, sources map[string]*Source) string {
+	if len(snippets) == 0 {
+		return ""
+	}
+	var order []string
+	entries := make(map[string][]string)
+	for _, snippet := range snippets {
+		if _, ok := entries[snippet.SourceID]; !ok {
+			order = append(order, snippet.SourceID)
+		}
+		entry := snippetTitle(snippet)
+		if p := snippet.Provenance; p.Located() {
+			lines := fmt.Sprintf("line %d", p.StartLine)
+			if p.EndLine > p.StartLine {
+				lines = fmt.Sprintf("lines %d-%d", p.StartLine, p.EndLine)
+			}
+			if p.URL != "" {
+				lines = fmt.Sprintf("[%s](%s)", lines, p.URL)
+			}
+			entry += " (" + lines + ")"
+		}
+		entries[snippet.SourceID] = append(entries[snippet.SourceID], entry)
+	}
+
+	var b strings.Builder
+	b.WriteString("\n---\n\n## Sources\n\n")
+	for _, id := range order {
+		name := id
+		if source := sources[id]; source != nil && source.URL != "" {
+			name = source.URL
+		} else if source != nil && source.Key != "" {
+			name = source.Key
+		}
+		fmt.Fprintf(&b, "- %s: %s\n", name, strings.Join(entries[id], "; "))
+	}
+	return b.String()
+}
+
+// snippetTitle is the heading of a snippet, falling back to the start of its
+// content for snippets stored without a title.
+func snippetTitle(snippet *Snippet) string {
+	if title := strings.TrimSpace(snippet.Title); title != "" {
+		return title
+	}
+	if words := strings.Fields(snippet.Content); len(words) > 6 {
+		return strings.Join(words[:6], " ") + "…"
+	} else if len(words) > 0 {
+		return strings.Join(words, " ")
+	}
+	return snippet.ID
+}
+
+// labelHeading turns a label such as "code-review" into a heading such as
+// "Code review".
+func labelHeading(label string) string {
+	label = strings.NewReplacer("-", " ", "_", " ").Replace(label)
+	r, size := utf8.DecodeRuneInString(label)
+	return string(unicode.ToUpper(r)) + label[size:]
+}
+
+// demoteHeadings pushes the markdown headings of content down so that the
+// highest is one level below level, leaving fenced code blocks alone. Levels
+// past six become bold lines, as markdown has no deeper headings.
+func demoteHeadings(content string, level int) string {
+	doc := newMarkdownDoc(content)
+	headings := doc.headings()[1:]
+	depths := make([]int, len(headings))
+	top := 0
+	for i, h := range headings {
+		depths[i] = len(headingPattern.FindStringSubmatch(doc.line(h.Line))[1])
+		if top == 0 || depths[i] < top {
+			top = depths[i]
+		}
+	}
+	if top == 0 || top > level {
+		return content
+	}
+	shift := level + 1 - top
+	lines := doc.lines
+	for i, h := range headings {
+		title := h.Path[len(h.Path)-1]
+		if depths[i]+shift > 6 {
+			lines[h.Line] = "**" + title + "**"
+		} else {
+			lines[h.Line] = strings.Repeat("#", depths[i]+shift) + " " + title
+		}
+	}
+	return strings.Join(lines, "\n")
+}
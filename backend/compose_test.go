@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func doCompose(t *testing.T, app *App, body string, accept string) (*httptest.ResponseRecorder, ComposeResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/compose", bytes.NewBufferString(body))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rr := httptest.NewRecorder()
+	app.composeHandler(rr, req)
+	var resp ComposeResponse
+	if rr.Code == http.StatusOK && accept == "" {
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+	}
+	return rr, resp
+}
+
+func TestComposeHandler(t *testing.T) {
+	texts := append(append([]string{}, nearDuplicates...), "Write table-driven tests.")
+	app := newSearchTestApp(t, texts, [][]string{{"git"}, {"git"}, {"go"}, {"go", "testing"}})
+	ctx := context.Background()
+	ids := byContent(t, app, texts)
+	a, b := conflictPair(ids[2], ids[3])
+	app.store.SaveConflictCheck(ctx, &ConflictCheck{SnippetA: a, SnippetB: b, Similarity: 0.8, Conflict: true, Explanation: "Made up."})
+
+	body, _ := json.Marshal(ComposeRequest{SnippetSelection: SnippetSelection{SnippetIDs: ids}})
+	rr, resp := doCompose(t, app, string(body), "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("compose returned status %d: %s", rr.Code, rr.Body.String())
+	}
+	if resp.Format != FormatAgents || resp.Path != "AGENTS.md" || !strings.HasPrefix(resp.Content, "# AGENTS.md\n") {
+		t.Errorf("compose = %+v, want an AGENTS.md", resp)
+	}
+	// The bigger go group comes first; the second commit snippet repeats
+	// the first.
+	if want := []string{ids[2], ids[3], ids[0]}; !reflect.DeepEqual(resp.Snippets, want) {
+		t.Errorf("snippets = %v, want %v", resp.Snippets, want)
+	}
+	if want := []OmittedSnippet{{ID: ids[1], DuplicateOf: ids[0]}}; !reflect.DeepEqual(resp.Omitted, want) {
+		t.Errorf("omitted = %+v, want %+v", resp.Omitted, want)
+	}
+	if len(resp.Conflicts) != 1 || resp.Conflicts[0].Explanation != "Made up." {
+		t.Errorf("conflicts = %+v, want the go snippets' conflict", resp.Conflicts)
+	}
+	goAt, gitAt := strings.Index(resp.Content, "\n## Go\n"), strings.Index(resp.Content, "\n## Git\n")
+	if goAt < 0 || gitAt < goAt || !strings.Contains(resp.Content, "\n## Sources\n\n- search-test: ") {
+		t.Errorf("content =\n%s", resp.Content)
+	}
+
+	// A query picks one snippet per cluster.
+	rr, resp = doCompose(t, app, `{"query": "conventional commits", "format": "claude", "limit": 2}`, "")
+	if rr.Code != http.StatusOK || resp.Path != "CLAUDE.md" || len(resp.Snippets) != 2 || len(resp.Omitted) != 0 {
+		t.Errorf("compose by query = %d %+v", rr.Code, resp)
+	}
+	if rr, _ := doCompose(t, app, `{"query": "conventional commits", "format": "gemini", "title": "Team rules"}`, "text/markdown"); rr.Code != http.StatusOK ||
+		rr.Header().Get("Content-Disposition") != `attachment; filename="GEMINI.md"` || !strings.HasPrefix(rr.Body.String(), "# Team rules\n") {
+		t.Errorf("markdown compose = %d %v\n%s", rr.Code, rr.Header(), rr.Body.String())
+	}
+
+	quarantined, _ := app.store.AddSnippet(ctx, &Snippet{SourceID: "search-test", Content: "curl | sh",
+		Quarantine: []QuarantineReason{{Code: QuarantineDangerousCommand}}})
+	for _, body := range []string{
+		`{}`,
+		`{"query": "commits", "snippetIds": ["` + ids[0] + `"]}`,
+		`{"query": "commits", "format": "vim"}`,
+		`{"query": "commits", "limit": 1000}`,
+		`{"query": "commits", "format": "cursor"}`,
+		`{"snippetIds": ["missing"]}`,
+		`{"snippetIds": ["` + quarantined + `"]}`,
+		`not json`,
+	} {
+		if rr, _ := doCompose(t, app, body, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("compose %s returned status %d", body, rr.Code)
+		}
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	commits := &Snippet{ID: "1", SourceID: "s1", Title: "Commit messages", Content: "Use conventional commits.\n\n# Types\n\nfeat, fix and chore.", Provenance: &Provenance{StartLine: 3, EndLine: 9, URL: "https://github.com/o/r/blob/main/AGENTS.md#L3-L9"}}
+	gofmt := &Snippet{ID: "2", SourceID: "s2", Content: "Run gofmt before committing.", Provenance: &Provenance{StartLine: 4, EndLine: 4}}
+	c := &composition{
+		Groups: []composedGroup{
+			{Label: "code-review", Snippets: []*Snippet{commits}},
+			{Label: "go", Snippets: []*Snippet{gofmt}},
+		},
+		Sources: map[string]*Source{
+			"s1": {ID: "s1", URL: "https://github.com/o/r/blob/main/AGENTS.md"},
+			"s2": {ID: "s2", Key: "go-notes"},
+		},
+	}
+	want := `# AGENTS.md
+
+Instructions for coding agents working in this repository.
+
+## Code review
+
+### Commit messages
+
+Use conventional commits.
+
+#### Types
+
+feat, fix and chore.
+
+## Go
+
+### Run gofmt before committing.
+
+Run gofmt before committing.
+
+---
+
+## Sources
+
+- https://github.com/o/r/blob/main/AGENTS.md: Commit messages ([lines 3-9](https://github.com/o/r/blob/main/AGENTS.md#L3-L9))
+- go-notes: Run gofmt before committing. (line 4)
+`
+	if got := renderMarkdown(c, instructionFormats[FormatAgents]); got != want {
+		t.Errorf("renderMarkdown =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDemoteHeadings(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"No headings.", "No headings."},
+		{"## Setup\n\n### Tools", "#### Setup\n\n##### Tools"},
+		{"#### Already deep", "#### Already deep"},
+		{"# Top\n###### Deepest", "#### Top\n**Deepest**"},
+		{"```sh\n# a comment\n```\n# Run", "```sh\n# a comment\n```\n#### Run"},
+		{"#hashtag", "#hashtag"},
+		{"````md\n```\n# inside\n````\n## Closing #", "````md\n```\n# inside\n````\n#### Closing"},
+	}
+	for _, tt := range tests {
+		if got := demoteHeadings(tt.content, 3); got != tt.want {
+			t.Errorf("demoteHeadings(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the service settings, read from environment variables.
+type Config struct {
+	ProjectID string // GCP_PROJECT
+	Port      string // PORT, default 8080
+
+	// SnippetStore selects the storage backend: "firestore" (default),
+	// "sqlite", "postgres" or "memory".
+	SnippetStore string // SNIPPET_STORE
+	SQLitePath   string // SQLITE_PATH, default "snippets.db"
+	PostgresURL  string // POSTGRES_URL
+
+	// LLMProvider selects the model backend: "vertex" (default), "openai"
+	// for any OpenAI-compatible server such as Ollama or vLLM, or "fake".
+	LLMProvider     string // LLM_PROVIDER
+	GenerationModel string // LLM_MODEL
+	EmbeddingModel  string // EMBEDDING_MODEL
+
+	// EmbeddingDimensions is the size of the embedding vectors. Vertex AI
+	// is asked for vectors of this size; for other providers it must match
+	// what the model returns. Defaults to 768, which Firestore can index.
+	EmbeddingDimensions int // EMBEDDING_DIMENSIONS
+
+	VertexLocation string // VERTEX_LOCATION, default "global"
+
+	OpenAIBaseURL string // OPENAI_BASE_URL, default the local Ollama server
+	OpenAIAPIKey  string // OPENAI_API_KEY
+
+	// JobWorkers bounds how many sources are processed at once, and
+	// JobLease is how long a worker holds a job between heartbeats before
+	// another instance may take it over.
+	JobWorkers int           // JOB_WORKERS, default 4
+	JobLease   time.Duration // JOB_LEASE, default 1m
+
+	// Chunking selects how sources are broken into snippets: "llm"
+	// (default) hands the whole document to the model, "markdown" splits it
+	// along its headings without the model, and "refine" splits it along
+	// its headings and has the model break up each section.
+	Chunking string // CHUNKING
+
+	// FidelityPolicy is what happens to extracted snippets less than
+	// FidelityThreshold of which is found in the source: "flag" (default)
+	// stores them flagged, "reject" drops them and "off" does neither.
+	FidelityPolicy    string  // FIDELITY_POLICY
+	FidelityThreshold float64 // FIDELITY_THRESHOLD, default 0.8
+
+	// SimilarityThreshold is the lowest cosine similarity between two
+	// snippets for them to be clustered as near-duplicates.
+	SimilarityThreshold float64 // SIMILARITY_THRESHOLD, default 0.9
+
+	// ConflictThreshold is the lowest cosine similarity between two
+	// snippets for them to be checked for a conflict.
+	ConflictThreshold float64 // CONFLICT_THRESHOLD, default 0.75
+
+	// RedactionPolicy is what happens to content holding secrets or
+	// personal data: "redact" (default) replaces them with a marker,
+	// "reject" refuses the content and "warn" only records what was found.
+	RedactionPolicy string // REDACTION_POLICY
+
+	// SafetyClassifier selects how snippets are rated for safety: "genai"
+	// uses the Gemini safety filters as well as the local rules, "rules"
+	// only the rules and "off" neither. Defaults to "genai" with the vertex
+	// provider and "rules" otherwise.
+	SafetyClassifier string // SAFETY_CLASSIFIER
+
+	// RefreshToken must be sent as a bearer token to the refresh and
+	// conflict scan endpoints. They answer 503 while it is unset.
+	RefreshToken string // REFRESH_TOKEN
+
+	// MCPTransport selects how the Model Context Protocol server is
+	// reached: "http" (default) serves it at /mcp next to the API, and
+	// "stdio" serves it alone over standard input and output, for agents
+	// that start the backend themselves.
+	MCPTransport string // MCP_TRANSPORT
+
+	// MCPToken is a long-lived bearer token that /mcp accepts as well as
+	// Firebase ID tokens, for agents that cannot refresh those hourly.
+	MCPToken string // MCP_TOKEN
+}
+
+// Default models for the OpenAI-compatible provider, chosen to work with a
+// stock Ollama install.
+const (
+	defaultOpenAIBaseURL         = "http://localhost:11434/v1"
+	defaultOpenAIGenerationModel = "llama3.1"
+	defaultOpenAIEmbeddingModel  = "nomic-embed-text"
+
+	defaultOpenAIEmbeddingDimensions = 768
+)
+
+// loadConfig reads the configuration from the environment and fills in
+// defaults for anything unset.
+func loadConfig() Config {
+	cfg := Config{
+		ProjectID:       os.Getenv("GCP_PROJECT"),
+		Port:            envOr("PORT", "8080"),
+		SnippetStore:    envOr("SNIPPET_STORE", "firestore"),
+		SQLitePath:      envOr("SQLITE_PATH", "snippets.db"),
+		PostgresURL:     os.Getenv("POSTGRES_URL"),
+		LLMProvider:     envOr("LLM_PROVIDER", "vertex"),
+		GenerationModel: os.Getenv("LLM_MODEL"),
+		EmbeddingModel:  os.Getenv("EMBEDDING_MODEL"),
+		VertexLocation:  envOr("VERTEX_LOCATION", "global"),
+		OpenAIBaseURL:   envOr("OPENAI_BASE_URL", defaultOpenAIBaseURL),
+		OpenAIAPIKey:    os.Getenv("OPENAI_API_KEY"),
+		Chunking:        envOr("CHUNKING", ChunkingLLM),
+		FidelityPolicy:  envOr("FIDELITY_POLICY", FidelityFlag),
+		RedactionPolicy: envOr("REDACTION_POLICY", RedactionRedact),
+		RefreshToken:    os.Getenv("REFRESH_TOKEN"),
+		MCPTransport:    envOr("MCP_TRANSPORT", MCPTransportHTTP),
+		MCPToken:        os.Getenv("MCP_TOKEN"),
+	}
+
+	defaultGeneration, defaultEmbedding := defaultGenerationModel, defaultEmbeddingModel
+	defaultDimensions := defaultEmbeddingDimensions
+	switch cfg.LLMProvider {
+	case "openai":
+		defaultGeneration, defaultEmbedding = defaultOpenAIGenerationModel, defaultOpenAIEmbeddingModel
+		defaultDimensions = defaultOpenAIEmbeddingDimensions
+	case "fake":
+		defaultDimensions = fakeEmbeddingDims
+	}
+	if cfg.GenerationModel == "" {
+		cfg.GenerationModel = defaultGeneration
+	}
+	if cfg.EmbeddingModel == "" {
+		cfg.EmbeddingModel = defaultEmbedding
+	}
+	cfg.EmbeddingDimensions, _ = strconv.Atoi(os.Getenv("EMBEDDING_DIMENSIONS"))
+	if cfg.EmbeddingDimensions <= 0 {
+		cfg.EmbeddingDimensions = defaultDimensions
+	}
+	cfg.JobWorkers, _ = strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if cfg.JobWorkers <= 0 {
+		cfg.JobWorkers = defaultJobWorkers
+	}
+	cfg.JobLease, _ = time.ParseDuration(os.Getenv("JOB_LEASE"))
+	if cfg.JobLease <= 0 {
+		cfg.JobLease = defaultJobLease
+	}
+	if cfg.SafetyClassifier = os.Getenv("SAFETY_CLASSIFIER"); cfg.SafetyClassifier == "" {
+		cfg.SafetyClassifier = SafetyRules
+		if cfg.LLMProvider == "vertex" {
+			cfg.SafetyClassifier = SafetyGenAI
+		}
+	}
+	cfg.FidelityThreshold, _ = strconv.ParseFloat(os.Getenv("FIDELITY_THRESHOLD"), 64)
+	if cfg.FidelityThreshold <= 0 || cfg.FidelityThreshold > 1 {
+		cfg.FidelityThreshold = defaultFidelityThreshold
+	}
+	cfg.SimilarityThreshold, _ = strconv.ParseFloat(os.Getenv("SIMILARITY_THRESHOLD"), 64)
+	if cfg.SimilarityThreshold <= 0 || cfg.SimilarityThreshold > 1 {
+		cfg.SimilarityThreshold = defaultSimilarityThreshold
+	}
+	cfg.ConflictThreshold, _ = strconv.ParseFloat(os.Getenv("CONFLICT_THRESHOLD"), 64)
+	if cfg.ConflictThreshold <= 0 || cfg.ConflictThreshold > 1 {
+		cfg.ConflictThreshold = defaultConflictThreshold
+	}
+	return cfg
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultConflictThreshold is the cosine similarity above which two
+// snippets are taken to be on the same topic and checked for a conflict.
+// It is lower than defaultSimilarityThreshold: conflicting advice, such as
+// "indent with tabs" and "indent with two spaces", is rarely worded alike.
+const defaultConflictThreshold = 0.75
+
+// conflictNeighbours is how many of each snippet's nearest neighbours are
+// considered for a conflict check.
+const conflictNeighbours = 5
+
+// Page sizes accepted by the conflict scan endpoint.
+const (
+	defaultConflictScanLimit = 100
+	maxConflictScanLimit     = 1000
+)
+
+// conflictConcurrency bounds how many pairs a scan checks at once.
+const conflictConcurrency = 4
+
+// ConflictCheck is the model's verdict on whether two similar snippets
+// conflict. A pair is checked once; the verdict goes when either snippet is
+// deleted.
+type ConflictCheck struct {
+	// SnippetA and SnippetB are the IDs of the pair, SnippetA sorting first.
+	SnippetA string `firestore:"snippet_a" json:"snippetA"`
+	SnippetB string `firestore:"snippet_b" json:"snippetB"`
+	// Similarity is the cosine similarity of the snippets' embeddings.
+	Similarity float64 `firestore:"similarity" json:"similarity"`
+	Conflict   bool    `firestore:"conflict" json:"conflict"`
+	// Explanation says why the snippets conflict.
+	Explanation string    `firestore:"explanation" json:"explanation,omitempty"`
+	CheckedAt   time.Time `firestore:"checked_at" json:"checkedAt"`
+}
+
+// conflictPair returns the IDs of two snippets in the order a ConflictCheck
+// stores them.
+func conflictPair(a, b string) (string, string) {
+	if b < a {
+		return b, a
+	}
+	return a, b
+}
+
+// other returns the ID of the snippet in the pair that is not id.
+func (c *ConflictCheck) other(id string) string {
+	if c.SnippetA == id {
+		return c.SnippetB
+	}
+	return c.SnippetA
+}
+
+// candidatePair is a pair of similar snippets to check for a conflict.
+type candidatePair struct {
+	a, b       *Snippet
+	similarity float64
+}
+
+// conflictCandidates returns the pairs of unquarantined snippets where one
+// is among the other's nearest neighbours with a similarity of at least
+// threshold and that have not been checked yet, most similar first. The
+// neighbours are those the clusters were built from.
+func (app *App) conflictCandidates(ctx context.Context, threshold float64) ([]candidatePair, error) {
+	checks, err := app.store.ListConflictChecks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list conflict checks: %v", err)
+	}
+	seen := make(map[[2]string]bool, len(checks))
+	for _, check := range checks {
+		seen[[2]string{check.SnippetA, check.SnippetB}] = true
+	}
+	clusters, err := app.clusters.get(ctx, app.store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to cluster snippets: %v", err)
+	}
+
+	var pairs []candidatePair
+	for id, neighbours := range clusters.neighbours {
+		if len(neighbours) > conflictNeighbours {
+			neighbours = neighbours[:conflictNeighbours]
+		}
+		for _, n := range neighbours {
+			other, ok := clusters.snippets[n.id]
+			if !ok || n.similarity < threshold {
+				continue
+			}
+			a, b := conflictPair(id, n.id)
+			if seen[[2]string{a, b}] {
+				continue
+			}
+			seen[[2]string{a, b}] = true
+			pairs = append(pairs, candidatePair{a: clusters.snippets[id], b: other, similarity: n.similarity})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		if pairs[i].similarity != pairs[j].similarity {
+			return pairs[i].similarity > pairs[j].similarity
+		}
+		return pairs[i].a.ID < pairs[j].a.ID
+	})
+	return pairs, nil
+}
+
+// checkConflict asks the model whether a pair of snippets conflicts and
+// records the verdict.
+func (app *App) checkConflict(ctx context.Context, pair candidatePair) (*ConflictCheck, error) {
+	var conflict bool
+	var explanation string
+	err := app.retry.do(ctx, "Checking conflict", func() (err error) {
+		conflict, explanation, err = app.llm.CheckConflict(ctx, snippetText(pair.a), snippetText(pair.b))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	check := &ConflictCheck{Similarity: pair.similarity, Conflict: conflict, CheckedAt: time.Now().UTC()}
+	check.SnippetA, check.SnippetB = conflictPair(pair.a.ID, pair.b.ID)
+	if conflict {
+		check.Explanation = explanation
+	}
+	if err := app.store.SaveConflictCheck(ctx, check); err != nil {
+		return nil, fmt.Errorf("failed to save conflict check: %v", err)
+	}
+	return check, nil
+}
+
+// snippetText is a snippet as shown to the model: its title as a heading,
+// then its content.
+func snippetText(snippet *Snippet) string {
+	if snippet.Title == "" {
+		return snippet.Content
+	}
+	return "# " + snippet.Title + "\n" + snippet.Content
+}
+
+// ConflictScanResponse is the body returned by the conflict scan endpoint.
+type ConflictScanResponse struct {
+	// JobID is the job queued to run the scan. Its progress is at
+	// /api/v1/jobs/{id}, and the conflicts it finds at /api/v1/conflicts.
+	JobID     string  `json:"jobId"`
+	Threshold float64 `json:"threshold"`
+	Limit     int     `json:"limit"`
+}
+
+// conflictScanHandler serves POST /api/v1/conflicts/scan, meant to be
+// called on a schedule like the refresh endpoint. It queues a job that finds
+// pairs of similar snippets, those with a cosine similarity of at least
+// threshold, that have not been checked yet, and asks the model whether up
+// to limit of them conflict.
+func (app *App) conflictScanHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	limit, err := intParam(params.Get("limit"), defaultConflictScanLimit, 1, maxConflictScanLimit)
+	if err != nil {
+		http.Error(w, "Invalid 'limit': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	threshold, err := floatParam(params.Get("threshold"), app.conflictThreshold(), -1, 1)
+	if err != nil {
+		http.Error(w, "Invalid 'threshold': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := app.enqueueJob(r.Context(), &Job{Kind: JobConflictScan, Limit: limit, Threshold: threshold})
+	if err != nil {
+		http.Error(w, "Failed to queue conflict scan", http.StatusInternalServerError)
+		log.Printf("Failed to queue conflict scan: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ConflictScanResponse{JobID: jobID, Threshold: threshold, Limit: limit})
+}
+
+// scanConflicts runs a conflict scan job. Verdicts are saved as they come
+// in, so a scan run again after a worker died picks up where it left off;
+// pairs the model fails on are left for the next scan.
+func (app *App) scanConflicts(ctx context.Context, job *Job) error {
+	if job.Attempts > maxJobAttempts {
+		return fmt.Errorf("giving up after %d attempts", job.Attempts-1)
+	}
+	p := app.newProgressReporter(job)
+	pairs, err := app.conflictCandidates(ctx, job.Threshold)
+	if err != nil {
+		return err
+	}
+	remaining := 0
+	if len(pairs) > job.Limit {
+		remaining = len(pairs) - job.Limit
+		pairs = pairs[:job.Limit]
+	}
+	p.setTotal(ctx, len(pairs))
+	p.phase(ctx, PhaseChecking, 0)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, conflictConcurrency)
+	conflicts := 0
+	for _, pair := range pairs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			check, err := app.checkConflict(ctx, pair)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				p.logf("Failed to check snippets %s and %s for a conflict: %v", pair.a.ID, pair.b.ID, err)
+			} else if check.Conflict {
+				conflicts++
+			}
+			job.Current++
+			p.snippetDone(ctx, err)
+		}()
+	}
+	wg.Wait()
+	p.phase(ctx, PhaseDone, len(pairs))
+	p.logf("Conflict scan checked %d pairs and found %d conflicts; %d failed, %d remaining",
+		job.Stored, conflicts, job.Failed, remaining)
+	return ctx.Err()
+}
+
+// conflictThreshold returns the lowest similarity of pairs checked for a
+// conflict.
+func (app *App) conflictThreshold() float64 {
+	if app.conflictSimilarity == 0 {
+		return defaultConflictThreshold
+	}
+	return app.conflictSimilarity
+}
+
+// SnippetConflict is a snippet conflicting with another, and why.
+type SnippetConflict struct {
+	Snippet     *Snippet `json:"snippet"`
+	Similarity  float64  `json:"similarity"`
+	Explanation string   `json:"explanation,omitempty"`
+}
+
+// SnippetConflictsResponse is the body returned by the snippet conflicts
+// endpoint.
+type SnippetConflictsResponse struct {
+	SnippetID string            `json:"snippetId"`
+	Conflicts []SnippetConflict `json:"conflicts"`
+}
+
+// snippetConflictsHandler serves GET /api/v1/snippets/{id}/conflicts. It
+// returns the snippets found to conflict with the snippet, most similar
+// first.
+func (app *App) snippetConflictsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+	if _, err := app.store.GetSnippet(ctx, id); errors.Is(err, ErrNotFound) {
+		http.Error(w, "Snippet not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get snippet", http.StatusInternalServerError)
+		log.Printf("Failed to get snippet: %v", err)
+		return
+	}
+	checks, err := app.store.ListConflictChecksBySnippet(ctx, id)
+	if err != nil {
+		http.Error(w, "Failed to list conflicts", http.StatusInternalServerError)
+		log.Printf("Failed to list conflicts of snippet %s: %v", id, err)
+		return
+	}
+
+	resp := SnippetConflictsResponse{SnippetID: id, Conflicts: []SnippetConflict{}}
+	sortConflictChecks(checks)
+	for _, check := range checks {
+		if !check.Conflict {
+			continue
+		}
+		other, err := app.store.GetSnippet(ctx, check.other(id))
+		if err != nil {
+			log.Printf("Failed to get snippet %s conflicting with %s: %v", check.other(id), id, err)
+			continue
+		}
+		resp.Conflicts = append(resp.Conflicts, SnippetConflict{Snippet: other, Similarity: check.Similarity, Explanation: check.Explanation})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ConflictsResponse is the body returned by the conflicts endpoint.
+type ConflictsResponse struct {
+	Conflicts []*ConflictCheck `json:"conflicts"`
+}
+
+// conflictsHandler serves GET /api/v1/conflicts. It returns every pair of
+// snippets found to conflict, most similar first.
+func (app *App) conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	checks, err := app.store.ListConflictChecks(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list conflicts", http.StatusInternalServerError)
+		log.Printf("Failed to list conflicts: %v", err)
+		return
+	}
+	resp := ConflictsResponse{Conflicts: []*ConflictCheck{}}
+	for _, check := range checks {
+		if check.Conflict {
+			resp.Conflicts = append(resp.Conflicts, check)
+		}
+	}
+	sortConflictChecks(resp.Conflicts)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// sortConflictChecks orders checks most similar pair first.
+func sortConflictChecks(checks []*ConflictCheck) {
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].Similarity > checks[j].Similarity })
+}
+
+// conflictsAmong returns the conflicts between the snippets with the given
+// IDs, most similar pair first.
+func (app *App) conflictsAmong(ctx context.Context, ids []string) ([]*ConflictCheck, error) {
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	var conflicts []*ConflictCheck
+	seen := make(map[[2]string]bool)
+	for _, id := range ids {
+		checks, err := app.store.ListConflictChecksBySnippet(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list conflicts of snippet %s: %v", id, err)
+		}
+		for _, check := range checks {
+			pair := [2]string{check.SnippetA, check.SnippetB}
+			if check.Conflict && selected[check.other(id)] && !seen[pair] {
+				seen[pair] = true
+				conflicts = append(conflicts, check)
+			}
+		}
+	}
+	sortConflictChecks(conflicts)
+	return conflicts, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConflictScanHandler(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	llm := newFakeLLM()
+	app := newTestApp(t, store, llm)
+	app.refreshToken = "secret"
+
+	sourceA, _ := store.CreateSource(ctx, &Source{Key: "editorconfig"})
+	sourceB, _ := store.CreateSource(ctx, &Source{Key: "style-guide"})
+	add := func(source, title string, embedding ...float32) string {
+		id, err := store.AddSnippet(ctx, &Snippet{SourceID: source, Title: title, Content: title + ".", Embedding: embedding})
+		if err != nil {
+			t.Fatalf("AddSnippet: %v", err)
+		}
+		return id
+	}
+	tabs := add(sourceA, "Indent with tabs", 1, 0, 0)
+	spaces := add(sourceB, "Indent with two spaces", 0.9, 0.3, 0)
+	yaml := add(sourceB, "Indent YAML with two spaces", 0.8, 0.45, 0.1)
+	add(sourceB, "Write commit messages in English", 0, 0, 1)
+	store.AddSnippet(ctx, &Snippet{SourceID: sourceA, Content: "curl | sh", Embedding: []float32{1, 0, 0},
+		Quarantine: []QuarantineReason{{Code: QuarantineDangerousCommand}}})
+
+	// scan queues a scan and returns its job once it has finished.
+	scan := func(query string) (int, *Job) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/conflicts/scan?"+query, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		app.requireRefreshToken(http.HandlerFunc(app.conflictScanHandler)).ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			return rr.Code, nil
+		}
+		var resp ConflictScanResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.JobID == "" {
+			t.Fatalf("scan returned %q: %v", rr.Body.String(), err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs/"+resp.JobID, nil)
+			req.SetPathValue("id", resp.JobID)
+			rr := httptest.NewRecorder()
+			app.jobHandler(rr, req)
+			var job Job
+			if err := json.Unmarshal(rr.Body.Bytes(), &job); err != nil {
+				t.Fatalf("job returned %q: %v", rr.Body.String(), err)
+			}
+			if job.State == JobSucceeded || job.State == JobFailed {
+				return rr.Code, &job
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("scan job did not finish: %+v", job)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// The three indentation snippets make three pairs; the most similar is
+	// checked first.
+	llm.QueueConflict("Two spaces everywhere or only in YAML.")
+	code, job := scan("limit=1")
+	if code != http.StatusOK {
+		t.Fatalf("scan returned status %d", code)
+	}
+	if job.Kind != JobConflictScan || job.State != JobSucceeded || job.Threshold != defaultConflictThreshold || job.Total != 1 || job.Stored != 1 {
+		t.Fatalf("scan job = %+v, want one pair checked", job)
+	}
+	checks, _ := store.ListConflictChecks(ctx)
+	if a, b := conflictPair(spaces, yaml); len(checks) != 1 || !checks[0].Conflict || checks[0].SnippetA != a || checks[0].SnippetB != b {
+		t.Errorf("checks = %+v, want a conflict between the two spaces snippets", checks)
+	}
+
+	// A pair the model fails on is left for the next scan.
+	llm.QueueError(fakeCheckConflict, errors.New("invalid response"))
+	if _, job := scan(""); job.Total != 2 || job.Stored != 1 || job.Failed != 1 {
+		t.Errorf("second scan = %+v, want one pair checked and one failed", job)
+	}
+	if _, job := scan(""); job.Stored != 1 || job.Failed != 0 {
+		t.Errorf("third scan = %+v, want the failed pair checked", job)
+	}
+	if _, job := scan(""); job.Total != 0 {
+		t.Errorf("fourth scan = %+v, want nothing left to check", job)
+	}
+	if n := llm.Calls(fakeCheckConflict); n != 4 {
+		t.Errorf("CheckConflict called %d times, want 4", n)
+	}
+	if code, _ := scan("limit=1001"); code != http.StatusBadRequest {
+		t.Errorf("scan with too high a limit returned status %d", code)
+	}
+
+	rr := httptest.NewRecorder()
+	app.conflictsHandler(rr, httptest.NewRequest(http.MethodGet, "/api/v1/conflicts", nil))
+	var all ConflictsResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &all); err != nil || len(all.Conflicts) != 1 {
+		t.Errorf("conflicts = %s, want the one conflict", rr.Body.String())
+	}
+
+	snippetConflicts := func(id string) (int, SnippetConflictsResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/snippets/"+id+"/conflicts", nil)
+		req.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		app.snippetConflictsHandler(rr, req)
+		var resp SnippetConflictsResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		return rr.Code, resp
+	}
+	if _, resp := snippetConflicts(yaml); len(resp.Conflicts) != 1 || resp.Conflicts[0].Snippet.ID != spaces || resp.Conflicts[0].Explanation == "" {
+		t.Errorf("conflicts of the YAML snippet = %+v", resp)
+	}
+	if code, resp := snippetConflicts(tabs); code != http.StatusOK || resp.Conflicts == nil || len(resp.Conflicts) != 0 {
+		t.Errorf("conflicts of the tabs snippet = %d %+v, want none", code, resp)
+	}
+	if code, _ := snippetConflicts("missing"); code != http.StatusNotFound {
+		t.Errorf("conflicts of a missing snippet returned status %d", code)
+	}
+
+	app.refreshToken = "other"
+	if code, _ := scan(""); code != http.StatusUnauthorized {
+		t.Errorf("scan with the wrong token returned status %d", code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/jobs/missing", nil)
+	req.SetPathValue("id", "missing")
+	rr = httptest.NewRecorder()
+	app.jobHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("missing job returned status %d", rr.Code)
+	}
+}
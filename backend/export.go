@@ -0,0 +1,286 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats instruction files can be exported as.
+const (
+	FormatAgents   = "agents"
+	FormatClaude   = "claude"
+	FormatGemini   = "gemini"
+	FormatCopilot  = "copilot"
+	FormatCursor   = "cursor"
+	FormatWindsurf = "windsurf"
+)
+
+// exportFormats lists the formats in the order they are exported.
+var exportFormats = []string{FormatAgents, FormatClaude, FormatGemini, FormatCopilot, FormatCursor, FormatWindsurf}
+
+// instructionFormat is a kind of instruction file a composition can be
+// exported as.
+type instructionFormat struct {
+	// Path is where the file goes in a repository. It is empty for formats
+	// written as several files.
+	Path string
+	// Title heads the file unless the composition has a title of its own.
+	Title string
+	// Intro is the paragraph under the title, telling readers what the
+	// file is for.
+	Intro string
+	// export renders a composition as the format's files.
+	export func(c *composition, format instructionFormat) []ExportFile
+}
+
+// instructionFormats maps format names to the files they produce.
+var instructionFormats = map[string]instructionFormat{
+	FormatAgents: {
+		Path:   "AGENTS.md",
+		Title:  "AGENTS.md",
+		Intro:  "Instructions for coding agents working in this repository.",
+		export: exportMarkdown,
+	},
+	FormatClaude: {
+		Path:   "CLAUDE.md",
+		Title:  "CLAUDE.md",
+		Intro:  "This file provides guidance to Claude Code (claude.ai/code) when working with code in this repository.",
+		export: exportMarkdown,
+	},
+	FormatGemini: {
+		Path:   "GEMINI.md",
+		Title:  "GEMINI.md",
+		Intro:  "Instructions for Gemini CLI and Gemini Code Assist when working in this repository.",
+		export: exportMarkdown,
+	},
+	FormatCopilot: {
+		Path:   ".github/copilot-instructions.md",
+		Title:  "Copilot instructions",
+		Intro:  "Instructions for GitHub Copilot when working in this repository.",
+		export: exportMarkdown,
+	},
+	FormatCursor: {
+		export: exportCursorRules,
+	},
+	FormatWindsurf: {
+		Path:   ".windsurfrules",
+		Title:  "Windsurf rules",
+		Intro:  "Rules for Cascade when working in this workspace.",
+		export: exportMarkdown,
+	},
+}
+
+// ExportFile is a file of an exported instruction format.
+type ExportFile struct {
+	Format  string `json:"format"`
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// exportMarkdown writes a composition as the format's single markdown file.
+func exportMarkdown(c *composition, format instructionFormat) []ExportFile {
+	return []ExportFile{{Path: format.Path, Content: renderMarkdown(c, format)}}
+}
+
+// exportCursorRules writes a composition as Cursor project rules, one .mdc
+// file per label. A rule for a label with known file patterns, such as
+// "python", is attached to the matching files; any other rule is always
+// applied.
+func exportCursorRules(c *composition, _ instructionFormat) []ExportFile {
+	var files []ExportFile
+	names := make(map[string]int)
+	for _, group := range c.Groups {
+		name := slug(group.Label)
+		if names[name]++; names[name] > 1 {
+			name = fmt.Sprintf("%s-%d", name, names[name])
+		}
+		globs := labelGlobs(group.Label)
+
+		var b strings.Builder
+		b.WriteString("---\n")
+		fmt.Fprintf(&b, "description: %s\n", yamlScalar(labelHeading(group.Label)+" instructions"))
+		// Cursor writes globs as a bare comma separated list.
+		b.WriteString(strings.TrimSpace("globs: "+strings.Join(globs, ",")) + "\n")
+		fmt.Fprintf(&b, "alwaysApply: %t\n", len(globs) == 0)
+		b.WriteString("---\n\n")
+		fmt.Fprintf(&b, "# %s\n", labelHeading(group.Label))
+		writeSnippets(&b, group.Snippets, 2)
+		b.WriteString(provenanceFooter(group.Snippets, c.Sources))
+		files = append(files, ExportFile{Path: ".cursor/rules/" + name + ".mdc", Content: b.String()})
+	}
+	return files
+}
+
+// globsByLabel maps labels naming a language or file type to the patterns of
+// the files it covers.
+var globsByLabel = map[string][]string{
+	"bash":       {"**/*.sh", "**/*.bash"},
+	"c":          {"**/*.c", "**/*.h"},
+	"c#":         {"**/*.cs"},
+	"c++":        {"**/*.cc", "**/*.cpp", "**/*.h", "**/*.hpp"},
+	"cpp":        {"**/*.cc", "**/*.cpp", "**/*.h", "**/*.hpp"},
+	"csharp":     {"**/*.cs"},
+	"css":        {"**/*.css", "**/*.scss"},
+	"docker":     {"**/Dockerfile", "**/*.dockerfile"},
+	"dockerfile": {"**/Dockerfile", "**/*.dockerfile"},
+	"go":         {"**/*.go"},
+	"golang":     {"**/*.go"},
+	"html":       {"**/*.html"},
+	"java":       {"**/*.java"},
+	"javascript": {"**/*.js", "**/*.jsx", "**/*.mjs", "**/*.cjs"},
+	"kotlin":     {"**/*.kt", "**/*.kts"},
+	"markdown":   {"**/*.md"},
+	"php":        {"**/*.php"},
+	"protobuf":   {"**/*.proto"},
+	"python":     {"**/*.py"},
+	"react":      {"**/*.jsx", "**/*.tsx"},
+	"ruby":       {"**/*.rb"},
+	"rust":       {"**/*.rs"},
+	"shell":      {"**/*.sh", "**/*.bash"},
+	"sql":        {"**/*.sql"},
+	"svelte":     {"**/*.svelte"},
+	"swift":      {"**/*.swift"},
+	"terraform":  {"**/*.tf"},
+	"typescript": {"**/*.ts", "**/*.tsx"},
+	"vue":        {"**/*.vue"},
+	"yaml":       {"**/*.yaml", "**/*.yml"},
+}
+
+// labelGlobs returns the patterns of the files a label covers, or nil if it
+// is not about particular files.
+func labelGlobs(label string) []string {
+	return globsByLabel[strings.ToLower(strings.TrimSpace(label))]
+}
+
+// slug turns a label into a file name: lower case letters and digits
+// separated by dashes.
+func slug(label string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(label) {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "rules"
+	}
+	return b.String()
+}
+
+// yamlScalar returns s as a YAML scalar, quoting it if it could be read as
+// something other than a plain string.
+func yamlScalar(s string) string {
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// ExportRequest is the body accepted by the export endpoint.
+type ExportRequest struct {
+	SnippetSelection
+	// Formats lists the formats to export; all of them if empty.
+	Formats []string `json:"formats,omitempty"`
+	// Title replaces the formats' default titles as the heading of their
+	// markdown files.
+	Title string `json:"title,omitempty"`
+}
+
+// ExportResponse is the body returned by the export endpoint.
+type ExportResponse struct {
+	Files []ExportFile `json:"files"`
+	// Snippets are the IDs of the exported snippets.
+	Snippets []string `json:"snippets"`
+	// Omitted lists the selected snippets left out as duplicates.
+	Omitted []OmittedSnippet `json:"omitted,omitempty"`
+	// Conflicts lists the pairs of exported snippets found to conflict.
+	Conflicts []*ConflictCheck `json:"conflicts,omitempty"`
+}
+
+// exportHandler serves POST /api/v1/export. It composes the selected
+// snippets like the compose endpoint and writes them in each of the
+// requested formats. With an Accept header of application/zip the files are
+// returned as a zip archive laid out as in a repository.
+func (app *App) exportHandler(w http.ResponseWriter, r *http.Request) {
+	var req ExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Formats) == 0 {
+		req.Formats = exportFormats
+	}
+	for _, name := range req.Formats {
+		if _, ok := instructionFormats[name]; !ok {
+			http.Error(w, "Invalid 'formats': must be among "+strings.Join(exportFormats, ", "), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	c, omitted, err := app.composeSelection(ctx, req.SnippetSelection, req.Title)
+	if err != nil {
+		composeError(w, err)
+		return
+	}
+	resp := ExportResponse{Files: []ExportFile{}, Snippets: c.snippetIDs(), Omitted: omitted}
+	exported := make(map[string]bool)
+	for _, name := range req.Formats {
+		if exported[name] {
+			continue
+		}
+		exported[name] = true
+		format := instructionFormats[name]
+		for _, file := range format.export(c, format) {
+			file.Format = name
+			resp.Files = append(resp.Files, file)
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/zip") {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="instructions.zip"`)
+		zw := zip.NewWriter(w)
+		for _, file := range resp.Files {
+			f, err := zw.Create(file.Path)
+			if err != nil {
+				log.Printf("Failed to write %s to the archive: %v", file.Path, err)
+				return
+			}
+			f.Write([]byte(file.Content))
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("Failed to write the archive: %v", err)
+		}
+		return
+	}
+
+	if resp.Conflicts, err = app.conflictsAmong(ctx, resp.Snippets); err != nil {
+		log.Printf("Failed to look up conflicts: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// exportTestComposition composes a fixed set of snippets covering labelled,
+// unlabelled and located snippets from two sources.
+func exportTestComposition(t *testing.T) *composition {
+	t.Helper()
+	ctx := context.Background()
+	app := &App{store: newMemoryStore()}
+	repo, _ := app.store.CreateSource(ctx, &Source{Type: "url", URL: "https://github.com/example/service/blob/main/AGENTS.md"})
+	notes, _ := app.store.CreateSource(ctx, &Source{Key: "team-notes"})
+	snippets := []*Snippet{
+		{ID: "s1", SourceID: repo, Title: "Format with Black", Labels: []string{"python", "formatting"},
+			Content:    "Run `black .` before committing.\n\n## Configuration\n\nSet the line length to 100 in pyproject.toml:\n\n```toml\n# pyproject.toml\n[tool.black]\nline-length = 100\n```",
+			Provenance: &Provenance{StartLine: 3, EndLine: 12, URL: "https://github.com/example/service/blob/main/AGENTS.md#L3-L12"}},
+		{ID: "s2", SourceID: repo, Title: "Type hints", Labels: []string{"python"}, Content: "Annotate every public function.",
+			Provenance: &Provenance{StartLine: 14, EndLine: 14, URL: "https://github.com/example/service/blob/main/AGENTS.md#L14"}},
+		{ID: "s3", SourceID: notes, Title: "Wrapping errors", Labels: []string{"go"}, Content: "Wrap errors with context: `fmt.Errorf(\"failed to load config: %v\", err)`."},
+		{ID: "s4", SourceID: notes, Title: "Table-driven tests", Labels: []string{"testing", "go"}, Content: "Write table-driven tests with `t.Run` for each case."},
+		{ID: "s5", SourceID: notes, Title: "Commit messages", Content: "Use conventional commits, such as `fix: handle empty input`."},
+	}
+	c, err := app.compose(ctx, snippets, "")
+	if err != nil {
+		t.Fatalf("compose: %v", err)
+	}
+	return c
+}
+
+// TestExportGolden compares every format's files with those in
+// testdata/export/<format>. Run with -update to rewrite them.
+func TestExportGolden(t *testing.T) {
+	c := exportTestComposition(t)
+	for _, name := range exportFormats {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "export", name)
+			format := instructionFormats[name]
+			files := format.export(c, format)
+			if *update {
+				os.RemoveAll(dir)
+			}
+			var paths []string
+			for _, file := range files {
+				paths = append(paths, file.Path)
+				golden := filepath.Join(dir, filepath.FromSlash(file.Path))
+				if *update {
+					os.MkdirAll(filepath.Dir(golden), 0o755)
+					if err := os.WriteFile(golden, []byte(file.Content), 0o644); err != nil {
+						t.Fatalf("Failed to write %s: %v", golden, err)
+					}
+					continue
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("Failed to read golden file: %v", err)
+				}
+				if file.Content != string(want) {
+					t.Errorf("%s =\n%s\nwant\n%s", file.Path, file.Content, want)
+				}
+			}
+
+			var golden []string
+			filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(dir, path)
+					golden = append(golden, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			sort.Strings(paths)
+			sort.Strings(golden)
+			if !reflect.DeepEqual(paths, golden) {
+				t.Errorf("files = %v, want %v", paths, golden)
+			}
+		})
+	}
+}
+
+func TestLabelGlobs(t *testing.T) {
+	if got := labelGlobs(" Python "); !reflect.DeepEqual(got, []string{"**/*.py"}) {
+		t.Errorf("labelGlobs(Python) = %v", got)
+	}
+	if got := labelGlobs("testing"); got != nil {
+		t.Errorf("labelGlobs(testing) = %v, want none", got)
+	}
+	for label, want := range map[string]string{"Code Review": "code-review", "c++": "c", "---": "rules", "node.js": "node-js"} {
+		if got := slug(label); got != want {
+			t.Errorf("slug(%q) = %q, want %q", label, got, want)
+		}
+	}
+	for s, want := range map[string]string{"Go instructions": "Go instructions", "C++: style": `"C++: style"`, "true": `"true"`, "1.5": `"1.5"`} {
+		if got := yamlScalar(s); got != want {
+			t.Errorf("yamlScalar(%q) = %s, want %s", s, got, want)
+		}
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	app := newSearchTestApp(t, nearDuplicates, [][]string{{"git"}, {"git"}, {"go"}})
+	ids := byContent(t, app, nearDuplicates)
+
+	export := func(body, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/export", bytes.NewBufferString(body))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rr := httptest.NewRecorder()
+		app.exportHandler(rr, req)
+		return rr
+	}
+
+	rr := export(`{"snippetIds": ["`+ids[0]+`", "`+ids[1]+`", "`+ids[2]+`"]}`, "")
+	var resp ExportResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("export returned %d %s", rr.Code, rr.Body.String())
+	}
+	var paths []string
+	for _, file := range resp.Files {
+		paths = append(paths, file.Format+":"+file.Path)
+	}
+	want := []string{"agents:AGENTS.md", "claude:CLAUDE.md", "gemini:GEMINI.md", "copilot:.github/copilot-instructions.md",
+		"cursor:.cursor/rules/git.mdc", "cursor:.cursor/rules/go.mdc", "windsurf:.windsurfrules"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("files = %v, want %v", paths, want)
+	}
+	if len(resp.Snippets) != 2 || len(resp.Omitted) != 1 {
+		t.Errorf("export = %+v, want the near-duplicate omitted", resp)
+	}
+
+	rr = export(`{"query": "gofmt", "formats": ["cursor", "windsurf"]}`, "application/zip")
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatalf("export returned %d and no archive: %v", rr.Code, err)
+	}
+	var names []string
+	for _, f := range archive.File {
+		names = append(names, f.Name)
+	}
+	if len(names) < 2 || names[len(names)-1] != ".windsurfrules" {
+		t.Errorf("archive = %v", names)
+	}
+
+	if rr := export(`{"query": "gofmt", "formats": ["vim"]}`, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("export to vim returned status %d", rr.Code)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// rawURL rewrites a GitHub file page URL to the raw file it shows, and
+// returns any other URL unchanged.
+func rawURL(url string) string {
+	if strings.Contains(url, "github.com") && strings.Contains(url, "/blob/") {
+		url = strings.Replace(url, "github.com", "raw.githubusercontent.com", 1)
+		url = strings.Replace(url, "/blob/", "/", 1)
+	}
+	return url
+}
+
+// fetchedDocument is the result of fetching a source's URL.
+type fetchedDocument struct {
+	Content string
+	// ETag and LastModified are the validators the server sent, if any.
+	ETag         string
+	LastModified string
+	// NotModified is set when the server answered 304 Not Modified to the
+	// validators passed to fetchContent. Content is then empty and the
+	// validators are those passed in.
+	NotModified bool
+}
+
+// fetchContent downloads the document at url. If etag or lastModified is
+// set, the request is conditional on the document having changed since.
+func fetchContent(ctx context.Context, url, etag, lastModified string) (*fetchedDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL(url), nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+		return &fetchedDocument{ETag: etag, LastModified: lastModified, NotModified: true}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	return &fetchedDocument{
+		Content:      string(body),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions taken on snippets whose fidelity falls below the threshold.
+const (
+	// FidelityFlag stores the snippet with FlagLowFidelity.
+	FidelityFlag = "flag"
+	// FidelityReject drops the snippet, recording it as failed.
+	FidelityReject = "reject"
+	// FidelityOff scores snippets but takes no action.
+	FidelityOff = "off"
+)
+
+// FlagLowFidelity marks a snippet much of whose text is not in its source.
+const FlagLowFidelity = "low_fidelity"
+
+// defaultFidelityThreshold is the share of a snippet's words that must be
+// found in the source for the snippet to pass verification.
+const defaultFidelityThreshold = 0.8
+
+// fidelityShingle is how many consecutive words must match the source for
+// them to count as found there.
+const fidelityShingle = 3
+
+// fidelityPolicy decides what happens to snippets that fail verification.
+// The zero value flags snippets below defaultFidelityThreshold.
+type fidelityPolicy struct {
+	// Action is FidelityFlag, FidelityReject or FidelityOff. Empty means
+	// FidelityFlag.
+	Action string
+	// Threshold is the lowest passing score. Zero means
+	// defaultFidelityThreshold.
+	Threshold float64
+}
+
+// threshold returns the lowest passing score.
+func (f fidelityPolicy) threshold() float64 {
+	if f.Threshold == 0 {
+		return defaultFidelityThreshold
+	}
+	return f.Threshold
+}
+
+// check returns the flags to store a snippet with the given fidelity score
+// under, or an error if the snippet is rejected.
+func (f fidelityPolicy) check(score float64) ([]string, error) {
+	if score >= f.threshold() || f.Action == FidelityOff {
+		return nil, nil
+	}
+	if f.Action == FidelityReject {
+		return nil, fmt.Errorf("only %.0f%% of the snippet was found in the source, below the %.0f%% required", score*100, f.threshold()*100)
+	}
+	return []string{FlagLowFidelity}, nil
+}
+
+// fidelityChecker scores how faithfully snippets reproduce a source.
+type fidelityChecker struct {
+	content string
+	words   map[string]bool
+	// shingles holds every run of fidelityShingle consecutive words.
+	shingles map[string]bool
+}
+
+func newFidelityChecker(content string) *fidelityChecker {
+	c := &fidelityChecker{
+		content:  content,
+		words:    make(map[string]bool),
+		shingles: make(map[string]bool),
+	}
+	tokens := tokenize(content)
+	for i, token := range tokens {
+		c.words[token] = true
+		if i+fidelityShingle <= len(tokens) {
+			c.shingles[strings.Join(tokens[i:i+fidelityShingle], " ")] = true
+		}
+	}
+	return c
+}
+
+// score aligns text with the source and returns the share of its words that
+// are found there, from 0 to 1. Text found verbatim scores 1. Otherwise a
+// word counts as found if it is part of a run of fidelityShingle words that
+// also occurs in the source, so that reworded or invented sentences score
+// low even when their individual words appear somewhere in it. Case,
+// punctuation and markdown syntax are ignored. Text too short for a run is
+// scored word by word.
+func (c *fidelityChecker) score(text string) float64 {
+	if strings.Contains(c.content, text) {
+		return 1
+	}
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return 1
+	}
+	if len(tokens) < fidelityShingle {
+		found := 0
+		for _, token := range tokens {
+			if c.words[token] {
+				found++
+			}
+		}
+		return float64(found) / float64(len(tokens))
+	}
+	covered := make([]bool, len(tokens))
+	for i := 0; i+fidelityShingle <= len(tokens); i++ {
+		if c.shingles[strings.Join(tokens[i:i+fidelityShingle], " ")] {
+			for j := i; j < i+fidelityShingle; j++ {
+				covered[j] = true
+			}
+		}
+	}
+	found := 0
+	for _, ok := range covered {
+		if ok {
+			found++
+		}
+	}
+	return float64(found) / float64(len(tokens))
+}
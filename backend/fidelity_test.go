@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFidelityChecker(t *testing.T) {
+	content, err := os.ReadFile("../samples/GEMINI.md")
+	if err != nil {
+		t.Fatalf("Failed to read sample file: %v", err)
+	}
+	checker := newFidelityChecker(string(content))
+
+	paragraph := "This single command ensures that your changes meet all the quality gates of the project."
+	invented := "Always deploy to production on Fridays and skip code review for small changes."
+	tests := []struct {
+		name     string
+		text     string
+		min, max float64
+	}{
+		{"verbatim", paragraph, 1, 1},
+		{"reformatted", "- **Framework**:   All tests are written\nusing Vitest (describe, it, expect, vi).", 1, 1},
+		{"recased", strings.ToUpper(paragraph), 1, 1},
+		{"invented", invented, 0, 0.2},
+		{"half invented", paragraph + " " + invented, 0.4, 0.6},
+		{"short", "npm run preflight", 1, 1},
+		{"short invented", "deploy Fridays", 0, 0},
+		{"empty", "", 1, 1},
+	}
+	for _, tt := range tests {
+		if got := checker.score(tt.text); got < tt.min || got > tt.max {
+			t.Errorf("%s: score = %.2f, want between %.2f and %.2f", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestFidelityPolicy(t *testing.T) {
+	tests := []struct {
+		policy fidelityPolicy
+		score  float64
+		flags  int
+		err    bool
+	}{
+		{fidelityPolicy{}, 0.9, 0, false},
+		{fidelityPolicy{}, 0.5, 1, false},
+		{fidelityPolicy{Action: FidelityReject}, 0.5, 0, true},
+		{fidelityPolicy{Action: FidelityReject}, 0.8, 0, false},
+		{fidelityPolicy{Action: FidelityOff}, 0, 0, false},
+		{fidelityPolicy{Threshold: 0.4}, 0.5, 0, false},
+	}
+	for _, tt := range tests {
+		flags, err := tt.policy.check(tt.score)
+		if len(flags) != tt.flags || (err != nil) != tt.err {
+			t.Errorf("%+v.check(%v) = %q, %v", tt.policy, tt.score, flags, err)
+		}
+	}
+}
+
+func TestProcessSnippets_Fidelity(t *testing.T) {
+	ctx := context.Background()
+	content := "# Style\n\nRun gofmt before committing.\n"
+	faithful := "Run gofmt before committing."
+	invented := "Never write tests for private functions."
+
+	process := func(policy fidelityPolicy) (*Source, []*Snippet) {
+		store := newMemoryStore()
+		llm := newFakeLLM()
+		app := &App{store: store, jobs: store, llm: llm, retry: fastRetry, fidelity: policy}
+		sourceID, _ := store.CreateSource(ctx, &Source{Key: "fidelity", Content: content, Status: "processing"})
+		llm.QueueSnippets(faithful, invented)
+		if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+			t.Fatalf("processSource: %v", err)
+		}
+		source, _ := store.GetSource(ctx, sourceID)
+		snippets, _ := store.ListSnippetsBySource(ctx, sourceID)
+		return source, snippets
+	}
+
+	source, snippets := process(fidelityPolicy{})
+	if source.Status != "processed" || len(snippets) != 2 {
+		t.Fatalf("flag policy: status %q with %d snippets, want both stored", source.Status, len(snippets))
+	}
+	if *snippets[0].Fidelity != 1 || snippets[0].Flags != nil {
+		t.Errorf("faithful snippet = %+v", snippets[0])
+	}
+	if math.Abs(*snippets[1].Fidelity) > 0.01 || len(snippets[1].Flags) != 1 || snippets[1].Flags[0] != FlagLowFidelity {
+		t.Errorf("invented snippet = %+v, want it flagged", snippets[1])
+	}
+
+	source, snippets = process(fidelityPolicy{Action: FidelityReject})
+	if source.Status != "partially_processed" || len(snippets) != 1 || snippets[0].Content != faithful {
+		t.Fatalf("reject policy: status %q with %+v, want only the faithful snippet", source.Status, snippets)
+	}
+	if len(source.FailedSnippets) != 1 || source.FailedSnippets[0].Stage != stageFidelity || source.FailedSnippets[0].Content != invented {
+		t.Errorf("failed snippets = %+v", source.FailedSnippets)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Formats of submitted sources, besides those snippets are exported as.
+const (
+	// FormatMarkdown is any other document, processed as it is.
+	FormatMarkdown = "markdown"
+	// FormatCursorRules is the single .cursorrules file older versions of
+	// Cursor read.
+	FormatCursorRules = "cursorrules"
+)
+
+// maxImports caps how many of the files a source pulls in with @path lines
+// are recorded on it.
+const maxImports = 10
+
+// Scope is where a snippet applies, as declared by the rule file it came
+// from.
+type Scope struct {
+	// Globs are the patterns of the files the snippet applies to, relative
+	// to the repository root. Empty means any file.
+	Globs []string `firestore:"globs,omitempty" json:"globs,omitempty"`
+	// AlwaysApply marks rules meant to be included in every request.
+	AlwaysApply bool `firestore:"always_apply,omitempty" json:"alwaysApply,omitempty"`
+	// Description tells agents when to apply a rule that is not applied
+	// automatically.
+	Description string `firestore:"description,omitempty" json:"description,omitempty"`
+}
+
+// parsedSource is a source's content prepared for snippet extraction.
+type parsedSource struct {
+	Format string
+	// Content is the source's content with the parts that are metadata
+	// rather than instructions, such as frontmatter and import lines,
+	// blanked out. Blanking keeps every offset and line of the rest in
+	// place, so provenance still points into the source's content.
+	Content string
+	// Labels and Scope are given to every snippet of the source.
+	Labels []string
+	Scope  *Scope
+	// Imports are the paths of the files the source pulls in with @path
+	// lines, in order.
+	Imports []string
+}
+
+// parseSource detects the format of a source and separates the metadata in
+// its content from the instructions. Frontmatter of Cursor rules and of
+// Copilot's path-specific instructions becomes the snippets' scope, with
+// labels for the languages its globs cover. AGENTS.md, CLAUDE.md and
+// GEMINI.md files below a repository's root apply to their directory, and
+// the @path imports of CLAUDE.md files are collected.
+func parseSource(source *Source) *parsedSource {
+	p := &parsedSource{Format: detectFormat(source), Content: source.Content}
+	fm := parseFrontmatter(source.Content)
+	scope := &Scope{}
+	switch p.Format {
+	case FormatCursor:
+		if fm != nil {
+			p.Content = blank(p.Content, 0, fm.end)
+			scope.Globs = splitGlobs(fm.values["globs"])
+			scope.AlwaysApply, _ = strconv.ParseBool(fm.value("alwaysApply"))
+			scope.Description = fm.value("description")
+		}
+	case FormatCopilot:
+		if fm != nil {
+			p.Content = blank(p.Content, 0, fm.end)
+			scope.Globs = splitGlobs(fm.values["applyTo"])
+			scope.Description = fm.value("description")
+		}
+	case FormatAgents, FormatClaude, FormatGemini:
+		if dir := repositoryDir(source.URL); dir != "" {
+			scope.Globs = []string{dir + "/**"}
+		}
+		if p.Format == FormatClaude {
+			p.Content, p.Imports = extractImports(p.Content)
+		}
+	}
+
+	if len(scope.Globs) > 0 || scope.AlwaysApply || scope.Description != "" {
+		p.Scope = scope
+	}
+	seen := make(map[string]bool)
+	for _, glob := range scope.Globs {
+		if label := globLabel(glob); label != "" && !seen[label] {
+			seen[label] = true
+			p.Labels = append(p.Labels, label)
+		}
+	}
+	return p
+}
+
+// snippetHash identifies a snippet extracted from the source across
+// processing runs: its text and the metadata the source gives it.
+func (p *parsedSource) snippetHash(text string) string {
+	if p.Scope == nil && len(p.Labels) == 0 {
+		return contentHash(text)
+	}
+	meta, _ := json.Marshal(struct {
+		Labels []string
+		Scope  *Scope
+	}{p.Labels, p.Scope})
+	return contentHash(string(meta) + "\n" + text)
+}
+
+// detectFormat works out the format of a source from the name of the file
+// it came from, its URL or else its key, and failing that from the keys of
+// its frontmatter.
+func detectFormat(source *Source) string {
+	name := source.Key
+	if u, err := url.Parse(source.URL); err == nil && u.Path != "" {
+		name = u.Path
+	}
+	name = strings.ToLower(path.Base(name))
+	switch {
+	case strings.HasSuffix(name, ".mdc"):
+		return FormatCursor
+	case name == ".cursorrules":
+		return FormatCursorRules
+	case name == "copilot-instructions.md" || strings.HasSuffix(name, ".instructions.md"):
+		return FormatCopilot
+	case name == "claude.md" || name == "claude.local.md":
+		return FormatClaude
+	case name == "agents.md":
+		return FormatAgents
+	case name == "gemini.md":
+		return FormatGemini
+	case name == ".windsurfrules":
+		return FormatWindsurf
+	}
+	if fm := parseFrontmatter(source.Content); fm != nil {
+		if _, ok := fm.values["applyTo"]; ok {
+			return FormatCopilot
+		}
+		_, globs := fm.values["globs"]
+		_, alwaysApply := fm.values["alwaysApply"]
+		if globs || alwaysApply {
+			return FormatCursor
+		}
+	}
+	return FormatMarkdown
+}
+
+// frontmatter is the YAML block at the top of a rule file, read leniently
+// as rule files are written by hand: Cursor, for one, writes globs as bare
+// comma separated lists that strict YAML would reject.
+type frontmatter struct {
+	// values maps each top-level key to its value, or the items of a list.
+	values map[string][]string
+	// end is the offset just past the closing delimiter.
+	end int
+}
+
+// value returns the first value of key, or "".
+func (fm *frontmatter) value(key string) string {
+	if values := fm.values[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// parseFrontmatter reads the frontmatter at the start of content, or
+// returns nil if there is none.
+func parseFrontmatter(content string) *frontmatter {
+	bom := len(content)
+	content = strings.TrimPrefix(content, "\ufeff")
+	bom -= len(content)
+	offset := len(content)
+	first, rest, ok := strings.Cut(content, "\n")
+	if !ok || strings.TrimSpace(first) != "---" {
+		return nil
+	}
+	offset -= len(rest)
+	fm := &frontmatter{values: make(map[string][]string)}
+	var key string
+	for rest != "" {
+		var line string
+		line, rest, _ = strings.Cut(rest, "\n")
+		offset += len(line) + 1
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		switch {
+		case trimmed == "---" || trimmed == "...":
+			fm.end = bom + min(offset, len(content))
+			return fm
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+		case strings.HasPrefix(trimmed, "- ") && key != "" && indented:
+			fm.values[key] = append(fm.values[key], unquote(strings.TrimSpace(trimmed[2:])))
+		case !indented:
+			k, v, ok := strings.Cut(trimmed, ":")
+			if !ok {
+				return nil
+			}
+			key = strings.TrimSpace(k)
+			v = strings.TrimSpace(v)
+			switch {
+			case v == "":
+				fm.values[key] = nil
+			case strings.HasPrefix(v, "[") && strings.HasSuffix(v, "]"):
+				for _, item := range strings.Split(v[1:len(v)-1], ",") {
+					if item = unquote(strings.TrimSpace(item)); item != "" {
+						fm.values[key] = append(fm.values[key], item)
+					}
+				}
+			default:
+				fm.values[key] = []string{unquote(v)}
+			}
+		}
+	}
+	// Without a closing delimiter it was not frontmatter after all.
+	return nil
+}
+
+// unquote strips the quotes from a quoted YAML scalar.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		if s[0] == '"' {
+			if unquoted, err := strconv.Unquote(s); err == nil {
+				return unquoted
+			}
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// splitGlobs splits glob values, each of which may be a comma separated
+// list, into patterns. Patterns matching every file are dropped.
+func splitGlobs(values []string) []string {
+	var globs []string
+	for _, value := range values {
+		for _, glob := range strings.Split(value, ",") {
+			glob = unquote(strings.TrimSpace(glob))
+			if glob != "" && glob != "*" && glob != "**" && glob != "**/*" {
+				globs = append(globs, glob)
+			}
+		}
+	}
+	return globs
+}
+
+// globLabel returns the label for the language or file type a glob
+// matches, the reverse of labelGlobs, or "" if there is none. Where several
+// labels cover the file type, such as "c" and "c++" for headers, the most
+// specific one wins.
+func globLabel(glob string) string {
+	name := path.Base(glob)
+	var labels []string
+	for label, globs := range globsByLabel {
+		for _, g := range globs {
+			if path.Base(g) == name {
+				labels = append(labels, label)
+				break
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if a, b := len(globsByLabel[labels[i]]), len(globsByLabel[labels[j]]); a != b {
+			return a < b
+		}
+		return labels[i] < labels[j]
+	})
+	if len(labels) == 0 {
+		return ""
+	}
+	return labels[0]
+}
+
+// mergeLabels returns the declared labels followed by those of generated
+// that are not among them, ignoring case.
+func mergeLabels(declared, generated []string) []string {
+	if len(declared) == 0 {
+		return generated
+	}
+	labels := append([]string(nil), declared...)
+	seen := make(map[string]bool)
+	for _, label := range declared {
+		seen[strings.ToLower(label)] = true
+	}
+	for _, label := range generated {
+		if !seen[strings.ToLower(label)] {
+			seen[strings.ToLower(label)] = true
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// repositoryDir returns the directory of a file on GitHub, relative to the
+// repository root, or "" for files at the root or elsewhere.
+func repositoryDir(sourceURL string) string {
+	parts := githubBlobPath(sourceURL)
+	if len(parts) < 6 {
+		return ""
+	}
+	return strings.Join(parts[4:len(parts)-1], "/")
+}
+
+// importPattern matches a line of a CLAUDE.md file that does nothing but
+// import another file, possibly as a list item.
+var importPattern = regexp.MustCompile(`^[ \t]*(?:[-*+][ \t]+)?@(\S+)[ \t]*$`)
+
+// extractImports finds the lines of content outside code blocks that import
+// another file, and returns content with those lines blanked along with the
+// imported paths. Imports mentioned in running text are left in place.
+func extractImports(content string) (string, []string) {
+	var imports []string
+	seen := make(map[string]bool)
+	fence := ""
+	offset := 0
+	for _, line := range strings.SplitAfter(content, "\n") {
+		start := offset
+		offset += len(line)
+		if m := fencePattern.FindStringSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = m[1]
+			case closesFence(line, fence):
+				fence = ""
+			}
+			continue
+		}
+		if fence != "" {
+			continue
+		}
+		m := importPattern.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+		if m == nil {
+			continue
+		}
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			imports = append(imports, m[1])
+		}
+		content = blank(content, start, offset)
+	}
+	return content, imports
+}
+
+// blank replaces content[from:to] with spaces, keeping its line breaks.
+func blank(content string, from, to int) string {
+	b := []byte(content)
+	for i := from; i < to && i < len(b); i++ {
+		if b[i] != '\n' && b[i] != '\r' {
+			b[i] = ' '
+		}
+	}
+	return string(b)
+}
+
+// importURL resolves the path of a file imported by the source at base. It
+// reports false for imports that cannot be fetched from the same host, such
+// as those from the home directory.
+func importURL(base, importPath string) (string, bool) {
+	if strings.HasPrefix(importPath, "~") || strings.HasPrefix(importPath, "/") {
+		return "", false
+	}
+	b, err := url.Parse(base)
+	if err != nil || (b.Scheme != "https" && b.Scheme != "http") {
+		return "", false
+	}
+	ref, err := url.Parse(importPath)
+	if err != nil || ref.Scheme != "" || ref.Host != "" {
+		return "", false
+	}
+	resolved := b.ResolveReference(ref)
+	resolved.RawQuery, resolved.Fragment = "", ""
+	return resolved.String(), true
+}
+
+// sourceImports returns the files a source imports, as recorded on it:
+// resolved against its URL where possible and as written otherwise, without
+// the source itself, and at most maxImports of them.
+func sourceImports(source *Source, imports []string) []string {
+	var out []string
+	for _, importPath := range imports {
+		if len(out) == maxImports {
+			break
+		}
+		if source.URL != "" {
+			if u, ok := importURL(source.URL, importPath); ok {
+				if u == source.URL {
+					continue
+				}
+				importPath = u
+			}
+		}
+		out = append(out, importPath)
+	}
+	return out
+}
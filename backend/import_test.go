@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		source Source
+		want   string
+	}{
+		{Source{URL: "https://github.com/o/r/blob/main/.cursor/rules/python.mdc"}, FormatCursor},
+		{Source{Key: ".cursorrules"}, FormatCursorRules},
+		{Source{Key: "repo/.github/copilot-instructions.md"}, FormatCopilot},
+		{Source{Key: "react.instructions.md"}, FormatCopilot},
+		{Source{URL: "https://example.com/docs/CLAUDE.md?ref=main"}, FormatClaude},
+		{Source{Key: "AGENTS.md"}, FormatAgents},
+		{Source{Key: "GEMINI.md"}, FormatGemini},
+		{Source{Key: ".windsurfrules"}, FormatWindsurf},
+		{Source{Key: "rules", Content: "---\nglobs: *.go\n---\nUse gofmt."}, FormatCursor},
+		{Source{Key: "rules", Content: "---\napplyTo: \"**/*.ts\"\n---\nUse strict mode."}, FormatCopilot},
+		{Source{Key: "post", Content: "---\ntitle: Style\n---\nUse gofmt."}, FormatMarkdown},
+		{Source{Key: "notes"}, FormatMarkdown},
+	}
+	for _, tt := range tests {
+		if got := detectFormat(&tt.source); got != tt.want {
+			t.Errorf("detectFormat(%+v) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+}
+
+func TestParseFrontmatter(t *testing.T) {
+	content := "\ufeff---\r\ndescription: \"Style: Go\"\r\nglobs:\r\n  - '**/*.go'\r\n  - go.mod\r\ntags: [a, \"b\"]\r\n---\r\nBody"
+	fm := parseFrontmatter(content)
+	if fm == nil {
+		t.Fatal("parseFrontmatter found no frontmatter")
+	}
+	want := map[string][]string{"description": {"Style: Go"}, "globs": {"**/*.go", "go.mod"}, "tags": {"a", "b"}}
+	if !reflect.DeepEqual(fm.values, want) || content[fm.end:] != "Body" {
+		t.Errorf("frontmatter = %+v, want %v ending before the body", fm, want)
+	}
+	for _, content := range []string{"No frontmatter", "---\nglobs: *.go\nno closing line", "---\nnot yaml\n---\n"} {
+		if fm := parseFrontmatter(content); fm != nil {
+			t.Errorf("parseFrontmatter(%q) = %+v, want none", content, fm)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	rule := "---\ndescription: Python style\nglobs: src/**/*.py,tests/**/*.py\nalwaysApply: false\n---\n# Formatting\nUse black.\n"
+	parsed := parseSource(&Source{Key: "python.mdc", Content: rule})
+	if want := (&Scope{Globs: []string{"src/**/*.py", "tests/**/*.py"}, Description: "Python style"}); !reflect.DeepEqual(parsed.Scope, want) {
+		t.Errorf("scope = %+v, want %+v", parsed.Scope, want)
+	}
+	if !reflect.DeepEqual(parsed.Labels, []string{"python"}) {
+		t.Errorf("labels = %v, want python", parsed.Labels)
+	}
+	// The frontmatter is blanked, leaving the body where it was.
+	if len(parsed.Content) != len(rule) || strings.Contains(parsed.Content, "globs") || !strings.HasSuffix(parsed.Content, "\n# Formatting\nUse black.\n") {
+		t.Errorf("content = %q", parsed.Content)
+	}
+	if strings.Count(parsed.Content, "\n") != strings.Count(rule, "\n") {
+		t.Error("blanking the frontmatter moved lines")
+	}
+
+	parsed = parseSource(&Source{Key: "ts.instructions.md", Content: "---\napplyTo: \"**/*.ts,**/*.tsx\"\n---\nUse strict mode."})
+	if parsed.Scope == nil || !reflect.DeepEqual(parsed.Labels, []string{"typescript", "react"}) {
+		t.Errorf("copilot instructions = %+v, want typescript and react", parsed)
+	}
+
+	parsed = parseSource(&Source{URL: "https://github.com/o/r/blob/main/services/api/AGENTS.md", Content: "Run make test."})
+	if parsed.Scope == nil || !reflect.DeepEqual(parsed.Scope.Globs, []string{"services/api/**"}) || parsed.Content != "Run make test." {
+		t.Errorf("nested AGENTS.md = %+v, want it scoped to its directory", parsed)
+	}
+	if parsed := parseSource(&Source{URL: "https://github.com/o/r/blob/main/AGENTS.md"}); parsed.Scope != nil {
+		t.Errorf("AGENTS.md at the root has scope %+v", parsed.Scope)
+	}
+
+	claude := "# Project\n\n- @docs/git.md\n@README\n\nSee @docs/style.md for style.\n\n```\n@not/an/import\n```\n"
+	parsed = parseSource(&Source{Key: "CLAUDE.md", Content: claude})
+	if !reflect.DeepEqual(parsed.Imports, []string{"docs/git.md", "README"}) {
+		t.Errorf("imports = %v", parsed.Imports)
+	}
+	if strings.Contains(parsed.Content, "@docs/git.md") || !strings.Contains(parsed.Content, "See @docs/style.md") || len(parsed.Content) != len(claude) {
+		t.Errorf("content = %q, want the import lines blanked", parsed.Content)
+	}
+	if parsed.snippetHash("Use gofmt.") != contentHash("Use gofmt.") {
+		t.Error("a source without metadata changed the snippet hash")
+	}
+}
+
+func TestProcessSource_CursorRule(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	app := &App{store: store, jobs: store, llm: newFakeLLM()}
+	sourceID, _ := store.CreateSource(ctx, &Source{
+		Key:     "python.mdc",
+		Content: "---\ndescription: Python style\nglobs: **/*.py\nalwaysApply: false\n---\n\n# Formatting\nUse black.\n\n# Typing\nAnnotate public functions.\n",
+	})
+	if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	snippets, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(snippets) != 2 {
+		t.Fatalf("got %d snippets, want 2: %+v", len(snippets), snippets)
+	}
+	for _, snippet := range snippets {
+		if !reflect.DeepEqual(snippet.Labels, []string{"python", "general"}) || snippet.Scope == nil || snippet.Scope.Globs[0] != "**/*.py" {
+			t.Errorf("snippet = %+v, want the rule's label and scope", snippet)
+		}
+		if strings.Contains(snippet.Content, "globs") || snippet.Provenance.StartLine < 7 {
+			t.Errorf("snippet %q at %+v includes the frontmatter", snippet.Content, snippet.Provenance)
+		}
+	}
+
+	// A new scope replaces the snippets even though their text is the same.
+	source, _ := store.GetSource(ctx, sourceID)
+	source.Content = strings.Replace(source.Content, "**/*.py", "src/**/*.py", 1)
+	store.UpdateSource(ctx, source)
+	job := &Job{SourceID: sourceID}
+	if err := app.processSource(ctx, job); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	if job.Stored != 2 || job.Retired != 2 {
+		t.Errorf("progress = %+v, want both snippets replaced", job.JobProgress)
+	}
+}
+
+func TestProcessSource_Imports(t *testing.T) {
+	docs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repo/CLAUDE.md":
+			w.Write([]byte("# Project\nRead the docs.\n\n@docs/git.md\n@~/.claude/personal.md\n@CLAUDE.md\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer docs.Close()
+	app := newTestApp(t, newMemoryStore(), newFakeLLM())
+	ctx := context.Background()
+
+	id := submitSource(t, app, ProcessRequest{URL: docs.URL + "/repo/CLAUDE.md"})
+	waitForJob(t, app, id)
+	// The imports are recorded, resolved where they can be, but not
+	// submitted; the file importing itself is left out.
+	status, err := app.sourceStatus(ctx, id)
+	if err != nil {
+		t.Fatalf("sourceStatus: %v", err)
+	}
+	if want := []string{docs.URL + "/repo/docs/git.md", "~/.claude/personal.md"}; !reflect.DeepEqual(status.Imports, want) {
+		t.Errorf("imports = %v, want %v", status.Imports, want)
+	}
+	if sources, _ := app.store.ListSources(ctx); len(sources) != 1 {
+		t.Errorf("got %d sources, want only CLAUDE.md", len(sources))
+	}
+	snippets, _ := app.store.ListSnippetsBySource(ctx, id)
+	for _, snippet := range snippets {
+		if strings.Contains(snippet.Content, "@") {
+			t.Errorf("snippet %q kept an import line", snippet.Content)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Job states. A job is queued until a worker claims it, running while a
+// worker holds its lease, and succeeded or failed once the worker is done.
+// A running job whose lease expires, because its worker died, is claimed
+// again like a queued one.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// ErrLeaseLost is returned when a worker renews or finishes a job whose lease
+// it no longer holds.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// Job kinds. A job without a kind processes a source.
+const (
+	JobConflictScan = "conflict_scan"
+)
+
+// Job is a persisted request to process a source or, for a conflict scan,
+// to check similar snippets for conflicts.
+type Job struct {
+	ID   string `firestore:"-" json:"id"`
+	Kind string `firestore:"kind" json:"kind,omitempty"`
+	// SourceID is the source to process; a conflict scan has none.
+	SourceID string `firestore:"source_id" json:"sourceId,omitempty"`
+	// Limit is the snippet limit passed on to extraction, or the most
+	// pairs a conflict scan checks.
+	Limit int `firestore:"limit" json:"limit"`
+	// Threshold is the lowest similarity of the pairs a conflict scan
+	// checks.
+	Threshold float64 `firestore:"threshold" json:"threshold,omitempty"`
+	// Fetch asks the worker to download the source's URL before processing.
+	Fetch bool   `firestore:"fetch" json:"fetch"`
+	State string `firestore:"state" json:"state"`
+	// Attempts counts how many times the job has been claimed.
+	Attempts       int       `firestore:"attempts" json:"attempts"`
+	LeaseOwner     string    `firestore:"lease_owner" json:"leaseOwner,omitempty"`
+	LeaseExpiresAt time.Time `firestore:"lease_expires_at" json:"leaseExpiresAt"`
+	Error          string    `firestore:"error" json:"error,omitempty"`
+	CreatedAt      time.Time `firestore:"created_at" json:"createdAt"`
+	UpdatedAt      time.Time `firestore:"updated_at" json:"updatedAt"`
+
+	JobProgress
+}
+
+// Processing phases a job reports as it goes.
+const (
+	PhaseFetching    = "fetching"
+	PhaseChunking    = "chunking"
+	PhaseLabeling    = "labeling"
+	PhaseClassifying = "classifying"
+	PhaseEmbedding   = "embedding"
+	PhaseStoring     = "storing"
+	PhaseChecking    = "checking"
+	PhaseDone        = "done"
+)
+
+// JobProgress is how far a running job has got. Current and Total count
+// the snippets extracted from the source, Current being the one the phase
+// applies to. Of those already dealt with, Stored were new and stored,
+// Failed could not be stored and Kept were unchanged from the last run.
+// Retired counts snippets of the last run that are gone from the source.
+// A conflict scan counts pairs instead: Total is how many it checks, Stored
+// those it checked and Failed those the model could not check.
+type JobProgress struct {
+	Phase   string `firestore:"phase" json:"phase,omitempty"`
+	Current int    `firestore:"current" json:"current,omitempty"`
+	Total   int    `firestore:"total" json:"total,omitempty"`
+	Stored  int    `firestore:"stored" json:"stored"`
+	Failed  int    `firestore:"failed" json:"failed"`
+	Kept    int    `firestore:"kept" json:"kept"`
+	Retired int    `firestore:"retired" json:"retired"`
+}
+
+// JobStore persists the job queue. Every SnippetStore implementation is also
+// a JobStore, keeping jobs next to the sources they process.
+type JobStore interface {
+	// EnqueueJob stores job as a new queued job and returns its ID.
+	EnqueueJob(ctx context.Context, job *Job) (string, error)
+	// GetJob returns the job with the given ID, or ErrNotFound.
+	GetJob(ctx context.Context, id string) (*Job, error)
+	// ClaimJob takes the oldest job that is queued, or running with an
+	// expired lease, marks it running, counts an attempt and leases it to
+	// owner for the given duration. It returns ErrNotFound if there is no
+	// such job.
+	ClaimJob(ctx context.Context, owner string, lease time.Duration) (*Job, error)
+	// RenewJobLease extends owner's lease on a running job, or returns
+	// ErrLeaseLost if owner no longer holds it.
+	RenewJobLease(ctx context.Context, id, owner string, lease time.Duration) error
+	// FinishJob moves a job owner holds to JobSucceeded or JobFailed,
+	// recording errMsg, or returns ErrLeaseLost if owner no longer holds it.
+	FinishJob(ctx context.Context, id, owner, state, errMsg string) error
+	// UpdateJobProgress records the progress of a job owner holds, or
+	// returns ErrLeaseLost if owner no longer holds it.
+	UpdateJobProgress(ctx context.Context, id, owner string, progress JobProgress) error
+	// LatestJob returns the most recently enqueued job for a source, or
+	// ErrNotFound if it has none.
+	LatestJob(ctx context.Context, sourceID string) (*Job, error)
+}
+
+var (
+	_ JobStore = (*memoryStore)(nil)
+	_ JobStore = (*sqlStore)(nil)
+	_ JobStore = (*firestoreStore)(nil)
+)
+
+// Defaults for the job runner.
+const (
+	defaultJobWorkers = 4
+	defaultJobLease   = time.Minute
+	jobPollInterval   = 5 * time.Second
+)
+
+// jobRunner is a pool of workers that claim jobs from a JobStore and hand
+// them to run. While a job runs its lease is renewed every third of the
+// lease duration; if the lease is lost, the job's context is cancelled.
+type jobRunner struct {
+	jobs    JobStore
+	run     func(ctx context.Context, job *Job) error
+	owner   string
+	workers int
+	lease   time.Duration
+	poll    time.Duration
+	wake    chan struct{}
+	wg      sync.WaitGroup
+
+	// finished, if set, is called after a job has been marked finished.
+	finished func(job *Job)
+}
+
+func newJobRunner(jobs JobStore, run func(ctx context.Context, job *Job) error, workers int, lease time.Duration) *jobRunner {
+	host, _ := os.Hostname()
+	return &jobRunner{
+		jobs:    jobs,
+		run:     run,
+		owner:   fmt.Sprintf("%s-%d-%s", host, os.Getpid(), newID()[:8]),
+		workers: workers,
+		lease:   lease,
+		poll:    jobPollInterval,
+		wake:    make(chan struct{}, workers),
+	}
+}
+
+// Start launches the workers. They stop once ctx is cancelled; Wait waits
+// for them. Jobs left running by a previous process are picked up as soon as
+// their leases expire.
+func (r *jobRunner) Start(ctx context.Context) {
+	for i := 0; i < r.workers; i++ {
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.worker(ctx)
+		}()
+	}
+}
+
+// Wait blocks until every worker has stopped.
+func (r *jobRunner) Wait() {
+	r.wg.Wait()
+}
+
+// Notify wakes an idle worker to look for a job without waiting for the
+// next poll.
+func (r *jobRunner) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *jobRunner) worker(ctx context.Context) {
+	ticker := time.NewTicker(r.poll)
+	defer ticker.Stop()
+	for {
+		// Drain the queue before going idle.
+		for ctx.Err() == nil && r.runOne(ctx) {
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOne claims and runs a single job. It reports whether there was one.
+func (r *jobRunner) runOne(ctx context.Context) bool {
+	job, err := r.jobs.ClaimJob(ctx, r.owner, r.lease)
+	if errors.Is(err, ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to claim job: %v", err)
+		}
+		return false
+	}
+	if job.Kind != "" {
+		log.Printf("Running %s job %s (attempt %d)", job.Kind, job.ID, job.Attempts)
+	} else {
+		log.Printf("Running job %s for source %s (attempt %d)", job.ID, job.SourceID, job.Attempts)
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(r.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				if err := r.jobs.RenewJobLease(jobCtx, job.ID, r.owner, r.lease); err != nil && jobCtx.Err() == nil {
+					log.Printf("Failed to renew lease on job %s, abandoning it: %v", job.ID, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	runErr := r.run(jobCtx, job)
+	cancel()
+	<-renewed
+
+	state, errMsg := JobSucceeded, ""
+	if runErr != nil {
+		state, errMsg = JobFailed, runErr.Error()
+		log.Printf("Job %s failed: %v", job.ID, runErr)
+	}
+	if ctx.Err() != nil {
+		// Shutting down: leave the job to be reclaimed once its lease
+		// expires rather than recording a failure caused by the shutdown.
+		return true
+	}
+	if err := r.jobs.FinishJob(ctx, job.ID, r.owner, state, errMsg); err != nil {
+		log.Printf("Failed to finish job %s: %v", job.ID, err)
+	}
+	if r.finished != nil {
+		r.finished(job)
+	}
+	return true
+}
+
+// claimable reports whether a job can be claimed at now.
+func (j *Job) claimable(now time.Time) bool {
+	return j.State == JobQueued || (j.State == JobRunning && j.LeaseExpiresAt.Before(now))
+}
+
+// claim marks j running under owner's lease.
+func (j *Job) claim(owner string, lease time.Duration, now time.Time) {
+	j.State = JobRunning
+	j.Attempts++
+	j.LeaseOwner = owner
+	j.LeaseExpiresAt = now.Add(lease)
+	j.UpdatedAt = now
+}
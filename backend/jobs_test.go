@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// jobTestStore is a store holding both the sources jobs refer to and the
+// jobs themselves.
+type jobTestStore interface {
+	SnippetStore
+	JobStore
+}
+
+// testJobStore runs the behaviour every JobStore implementation must share.
+func testJobStore(t *testing.T, newStore func(t *testing.T) jobTestStore) {
+	t.Run("Lifecycle", func(t *testing.T) { testJobLifecycle(t, newStore(t)) })
+	t.Run("ExpiredLease", func(t *testing.T) { testJobExpiredLease(t, newStore(t)) })
+	t.Run("ConcurrentClaims", func(t *testing.T) { testJobConcurrentClaims(t, newStore(t)) })
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	testJobStore(t, func(t *testing.T) jobTestStore { return newMemoryStore() })
+}
+
+func TestSQLiteJobStore(t *testing.T) {
+	testJobStore(t, func(t *testing.T) jobTestStore {
+		store, err := newSQLiteStore(context.Background(), filepath.Join(t.TempDir(), "snippets.db"))
+		if err != nil {
+			t.Fatalf("newSQLiteStore: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func testJobLifecycle(t *testing.T, store jobTestStore) {
+	ctx := context.Background()
+	if _, err := store.ClaimJob(ctx, "w1", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ClaimJob on empty queue: got %v, want ErrNotFound", err)
+	}
+
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "jobs"})
+	first, err := store.EnqueueJob(ctx, &Job{SourceID: sourceID, Limit: 5})
+	if err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	second, _ := store.EnqueueJob(ctx, &Job{SourceID: sourceID, Fetch: true})
+	if latest, err := store.LatestJob(ctx, sourceID); err != nil || latest.ID != second || !latest.Fetch {
+		t.Errorf("LatestJob = %+v, %v, want the second job", latest, err)
+	}
+	if _, err := store.LatestJob(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LatestJob for a source without jobs: got %v, want ErrNotFound", err)
+	}
+
+	job, err := store.ClaimJob(ctx, "w1", time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if job.ID != first || job.State != JobRunning || job.Attempts != 1 || job.LeaseOwner != "w1" || job.Limit != 5 {
+		t.Errorf("claimed %+v, want the first job running under w1", job)
+	}
+	if !job.LeaseExpiresAt.After(time.Now()) {
+		t.Errorf("lease expires at %v, which is not in the future", job.LeaseExpiresAt)
+	}
+
+	if err := store.RenewJobLease(ctx, first, "w1", time.Minute); err != nil {
+		t.Errorf("RenewJobLease: %v", err)
+	}
+	progress := JobProgress{Phase: PhaseEmbedding, Current: 2, Total: 3, Stored: 1}
+	if err := store.UpdateJobProgress(ctx, first, "w1", progress); err != nil {
+		t.Errorf("UpdateJobProgress: %v", err)
+	}
+	if job, _ := store.GetJob(ctx, first); job.JobProgress != progress {
+		t.Errorf("progress = %+v, want %+v", job.JobProgress, progress)
+	}
+	if err := store.UpdateJobProgress(ctx, first, "w2", progress); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("UpdateJobProgress by another worker: got %v, want ErrLeaseLost", err)
+	}
+	if err := store.RenewJobLease(ctx, first, "w2", time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("RenewJobLease by another worker: got %v, want ErrLeaseLost", err)
+	}
+	if err := store.FinishJob(ctx, first, "w2", JobSucceeded, ""); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("FinishJob by another worker: got %v, want ErrLeaseLost", err)
+	}
+
+	// The first job is leased, so the next claim gets the second.
+	job, err = store.ClaimJob(ctx, "w2", time.Minute)
+	if err != nil || job.ID != second {
+		t.Fatalf("second ClaimJob = %+v, %v, want the second job", job, err)
+	}
+	if _, err := store.ClaimJob(ctx, "w3", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ClaimJob with every job leased: got %v, want ErrNotFound", err)
+	}
+
+	if err := store.FinishJob(ctx, first, "w1", JobSucceeded, ""); err != nil {
+		t.Fatalf("FinishJob: %v", err)
+	}
+	if err := store.FinishJob(ctx, second, "w2", JobFailed, "boom"); err != nil {
+		t.Fatalf("FinishJob: %v", err)
+	}
+	if job, _ := store.GetJob(ctx, first); job.State != JobSucceeded || job.LeaseOwner != "" {
+		t.Errorf("first job after finishing = %+v", job)
+	}
+	if job, _ := store.GetJob(ctx, second); job.State != JobFailed || job.Error != "boom" {
+		t.Errorf("second job after failing = %+v", job)
+	}
+	if err := store.RenewJobLease(ctx, first, "w1", time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("RenewJobLease on a finished job: got %v, want ErrLeaseLost", err)
+	}
+	if _, err := store.ClaimJob(ctx, "w1", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Errorf("finished jobs were claimed again: %v", err)
+	}
+	if _, err := store.GetJob(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetJob on missing job: got %v, want ErrNotFound", err)
+	}
+
+	// A conflict scan has no source.
+	scan, err := store.EnqueueJob(ctx, &Job{Kind: JobConflictScan, Limit: 10, Threshold: 0.8})
+	if err != nil {
+		t.Fatalf("EnqueueJob for a conflict scan: %v", err)
+	}
+	if job, err := store.ClaimJob(ctx, "w1", time.Minute); err != nil || job.ID != scan || job.Kind != JobConflictScan ||
+		job.SourceID != "" || job.Limit != 10 || job.Threshold != 0.8 {
+		t.Errorf("claimed conflict scan = %+v, %v", job, err)
+	}
+}
+
+func testJobExpiredLease(t *testing.T, store jobTestStore) {
+	ctx := context.Background()
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "jobs"})
+	id, _ := store.EnqueueJob(ctx, &Job{SourceID: sourceID})
+
+	// A worker that dies leaves its job running until the lease expires.
+	if _, err := store.ClaimJob(ctx, "dead", 50*time.Millisecond); err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if _, err := store.ClaimJob(ctx, "w2", time.Minute); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("job with a live lease was claimed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	job, err := store.ClaimJob(ctx, "w2", time.Minute)
+	if err != nil {
+		t.Fatalf("ClaimJob after the lease expired: %v", err)
+	}
+	if job.ID != id || job.Attempts != 2 || job.LeaseOwner != "w2" {
+		t.Errorf("reclaimed %+v, want attempt 2 under w2", job)
+	}
+	if err := store.FinishJob(ctx, id, "dead", JobSucceeded, ""); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("FinishJob by the expired worker: got %v, want ErrLeaseLost", err)
+	}
+}
+
+func testJobConcurrentClaims(t *testing.T, store jobTestStore) {
+	ctx := context.Background()
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "jobs"})
+	const jobs = 10
+	for i := 0; i < jobs; i++ {
+		if _, err := store.EnqueueJob(ctx, &Job{SourceID: sourceID}); err != nil {
+			t.Fatalf("EnqueueJob: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := store.ClaimJob(ctx, "worker", time.Minute)
+				if err != nil {
+					if !errors.Is(err, ErrNotFound) {
+						t.Errorf("ClaimJob: %v", err)
+					}
+					return
+				}
+				mu.Lock()
+				claimed[job.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(claimed) != jobs {
+		t.Errorf("claimed %d distinct jobs, want %d", len(claimed), jobs)
+	}
+	for id, n := range claimed {
+		if n != 1 {
+			t.Errorf("job %s claimed %d times", id, n)
+		}
+	}
+}
+
+func TestJobRunner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := newMemoryStore()
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "jobs"})
+
+	// A job orphaned by a previous process is recovered once its lease
+	// expires.
+	orphan, _ := store.EnqueueJob(ctx, &Job{SourceID: sourceID})
+	store.ClaimJob(ctx, "previous-process", 30*time.Millisecond)
+	failing, _ := store.EnqueueJob(ctx, &Job{SourceID: sourceID, Limit: -1})
+
+	var mu sync.Mutex
+	ran := make(map[string]int)
+	runner := newJobRunner(store, func(ctx context.Context, job *Job) error {
+		mu.Lock()
+		ran[job.ID]++
+		mu.Unlock()
+		if job.Limit < 0 {
+			return errors.New("bad limit")
+		}
+		// Outlive the lease to check it is renewed.
+		time.Sleep(60 * time.Millisecond)
+		return nil
+	}, 2, 30*time.Millisecond)
+	runner.poll = 10 * time.Millisecond
+	runner.Start(ctx)
+
+	later, _ := store.EnqueueJob(ctx, &Job{SourceID: sourceID})
+	runner.Notify()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range []string{orphan, failing, later} {
+		for {
+			job, _ := store.GetJob(ctx, id)
+			if job.State == JobSucceeded || job.State == JobFailed {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("job %s stuck in state %s", id, job.State)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	cancel()
+	runner.Wait()
+
+	if job, _ := store.GetJob(ctx, orphan); job.State != JobSucceeded || job.Attempts != 2 {
+		t.Errorf("orphaned job = %+v, want succeeded on attempt 2", job)
+	}
+	if job, _ := store.GetJob(ctx, failing); job.State != JobFailed || job.Error != "bad limit" {
+		t.Errorf("failing job = %+v", job)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for id, n := range ran {
+		if n != 1 {
+			t.Errorf("job %s ran %d times; its lease was not renewed", id, n)
+		}
+	}
+}
+
+func TestProcessSource_GivesUp(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	app := &App{store: store, jobs: store, llm: newFakeLLM()}
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "poison", Content: "# A\nb", Status: "processing"})
+
+	if err := app.processSource(ctx, &Job{SourceID: sourceID, Attempts: maxJobAttempts + 1}); err == nil {
+		t.Error("processSource ran a job past its last attempt")
+	}
+	if source, _ := store.GetSource(ctx, sourceID); source.Status != "error" {
+		t.Errorf("source status = %q, want error", source.Status)
+	}
+
+	// A rerun after a partial attempt retires snippets it does not extract.
+	store.AddSnippet(ctx, &Snippet{SourceID: sourceID, Content: "left over"})
+	if err := app.processSource(ctx, &Job{SourceID: sourceID, Attempts: 2}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	snippets, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(snippets) != 1 || snippets[0].Title != "A" {
+		t.Errorf("snippets after rerun = %+v, want only the extracted one", snippets)
+	}
+}
+
+// failingListStore fails to list the snippets of a source.
+type failingListStore struct {
+	*memoryStore
+}
+
+func (s failingListStore) ListSnippetsBySource(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return nil, errors.New("database is down")
+}
+
+func TestProcessSource_FailureSetsError(t *testing.T) {
+	ctx := context.Background()
+	store := failingListStore{newMemoryStore()}
+	app := &App{store: store, jobs: store, llm: newFakeLLM()}
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "notes", Content: "# A\nb", Status: "processing"})
+
+	if err := app.processSource(ctx, &Job{SourceID: sourceID, Attempts: 1}); err == nil {
+		t.Fatal("processSource succeeded without listing the existing snippets")
+	}
+	if source, _ := store.GetSource(ctx, sourceID); source.Status != "error" {
+		t.Errorf("source status = %q, want error", source.Status)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// BM25 parameters, at the values most implementations default to.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// titleWeight is how many times the words of a snippet's title count
+// towards its term frequencies.
+const titleWeight = 2
+
+// lexicalIndexTTL bounds how stale the cached index can get. Snippets can be
+// written by other instances or, for votes, by the frontend, so local
+// invalidation alone is not enough.
+const lexicalIndexTTL = time.Minute
+
+// bm25Index is an inverted index over the title, content and labels of a set
+// of snippets, scored with Okapi BM25.
+type bm25Index struct {
+	snippets []*Snippet
+	postings map[string][]posting
+	docLen   []int
+	avgLen   float64
+}
+
+// posting records how often a term occurs in the snippet at index doc.
+type posting struct {
+	doc  int
+	freq int
+}
+
+// newBM25Index indexes snippets. Embeddings are dropped from the indexed
+// copies, since lexical search never reads them.
+func newBM25Index(snippets []*Snippet) *bm25Index {
+	idx := &bm25Index{
+		snippets: make([]*Snippet, len(snippets)),
+		postings: make(map[string][]posting),
+		docLen:   make([]int, len(snippets)),
+	}
+	total := 0
+	for i, snippet := range snippets {
+		stored := *snippet
+		stored.Embedding = nil
+		idx.snippets[i] = &stored
+
+		freqs := make(map[string]int)
+		for _, term := range tokenize(snippet.Title) {
+			freqs[term] += titleWeight
+		}
+		for _, term := range tokenize(snippet.Content) {
+			freqs[term]++
+		}
+		for _, label := range snippet.Labels {
+			for _, term := range tokenize(label) {
+				freqs[term]++
+			}
+		}
+		for term, freq := range freqs {
+			idx.postings[term] = append(idx.postings[term], posting{doc: i, freq: freq})
+			idx.docLen[i] += freq
+		}
+		total += idx.docLen[i]
+	}
+	if len(snippets) > 0 {
+		idx.avgLen = float64(total) / float64(len(snippets))
+	}
+	return idx
+}
+
+// search returns up to limit snippets passing filter that share at least one
+// term with query, best BM25 score first.
+func (idx *bm25Index) search(query string, filter SnippetFilter, limit int) []ScoredSnippet {
+	n := float64(len(idx.snippets))
+	scores := make(map[int]float64)
+	seen := make(map[string]bool)
+	for _, term := range tokenize(query) {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		df := float64(len(postings))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for _, p := range postings {
+			tf := float64(p.freq)
+			norm := 1 - bm25B + bm25B*float64(idx.docLen[p.doc])/idx.avgLen
+			scores[p.doc] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	results := make([]ScoredSnippet, 0, len(scores))
+	for doc, score := range scores {
+		snippet := idx.snippets[doc]
+		if !filter.matches(snippet) {
+			continue
+		}
+		out := *snippet
+		results = append(results, ScoredSnippet{Snippet: &out, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score == results[j].Score {
+			return results[i].Snippet.ID < results[j].Snippet.ID
+		}
+		return results[i].Score > results[j].Score
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// tokenize lowercases text and splits it into runs of letters and digits, so
+// that "PEP 8" yields "pep" and "8" and "gofmt" stays whole.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// lexicalIndexCache holds the BM25 index over all snippets, rebuilt from the
+// store when it is invalidated or older than lexicalIndexTTL.
+type lexicalIndexCache struct {
+	mu      sync.Mutex
+	index   *bm25Index
+	builtAt time.Time
+}
+
+// get returns the cached index, rebuilding it from store if needed.
+func (c *lexicalIndexCache) get(ctx context.Context, store SnippetStore) (*bm25Index, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.index != nil && time.Since(c.builtAt) < lexicalIndexTTL {
+		return c.index, nil
+	}
+	snippets, err := store.ListSnippets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.index = newBM25Index(snippets)
+	c.builtAt = time.Now()
+	return c.index, nil
+}
+
+// invalidate makes the next get rebuild the index.
+func (c *lexicalIndexCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index = nil
+}
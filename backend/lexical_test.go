@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	got := tokenize("Follow PEP 8; run `gofmt -w` on *.go files.")
+	want := []string{"follow", "pep", "8", "run", "gofmt", "w", "on", "go", "files"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokenize = %q, want %q", got, want)
+	}
+}
+
+func TestBM25Index(t *testing.T) {
+	idx := newBM25Index([]*Snippet{
+		{ID: "pep8", Title: "Python style", Content: "Follow PEP 8 for all Python code.", Labels: []string{"python"}},
+		{ID: "black", Title: "Formatting", Content: "Format Python code with black. Python code must pass black.", Labels: []string{"python"}},
+		{ID: "gofmt", Title: "Go formatting", Content: "Run gofmt before committing.", Labels: []string{"go"}, Embedding: []float32{1}},
+	})
+
+	results := idx.search("PEP 8", SnippetFilter{}, 10)
+	if len(results) != 1 || results[0].Snippet.ID != "pep8" {
+		t.Fatalf("search(PEP 8) = %v, want only pep8", results)
+	}
+
+	results = idx.search("gofmt", SnippetFilter{}, 10)
+	if len(results) != 1 || results[0].Snippet.ID != "gofmt" {
+		t.Fatalf("search(gofmt) = %v, want only gofmt", results)
+	}
+	if results[0].Snippet.Embedding != nil {
+		t.Error("indexed snippets should not keep their embeddings")
+	}
+
+	// "black" occurs twice in its snippet, so it outranks the one matching
+	// only on "python".
+	results = idx.search("python black", SnippetFilter{}, 10)
+	if len(results) != 2 || results[0].Snippet.ID != "black" {
+		t.Errorf("search(python black) = %v, want black first", results)
+	}
+
+	// Title words count double.
+	results = idx.search("formatting", SnippetFilter{}, 10)
+	if len(results) != 2 || results[0].Score <= 0 {
+		t.Errorf("search(formatting) = %v", results)
+	}
+
+	if results := idx.search("python", SnippetFilter{Labels: []string{"go"}}, 10); len(results) != 0 {
+		t.Errorf("label filter let through %v", results)
+	}
+	if results := idx.search("python", SnippetFilter{}, 1); len(results) != 1 {
+		t.Errorf("limit 1 returned %d results", len(results))
+	}
+	if results := newBM25Index(nil).search("anything", SnippetFilter{}, 10); len(results) != 0 {
+		t.Errorf("empty index returned %v", results)
+	}
+}
+
+func TestLexicalIndexCache(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	var cache lexicalIndexCache
+
+	store.AddSnippet(ctx, &Snippet{Content: "use gofmt"})
+	idx, err := cache.get(ctx, store)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	store.AddSnippet(ctx, &Snippet{Content: "use goimports"})
+	if again, _ := cache.get(ctx, store); again != idx {
+		t.Error("cache rebuilt the index before it was invalidated")
+	}
+
+	cache.invalidate()
+	idx, _ = cache.get(ctx, store)
+	if results := idx.search("goimports", SnippetFilter{}, 10); len(results) != 1 {
+		t.Errorf("rebuilt index returned %v for a new snippet", results)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// Embedding task types, as understood by the Vertex AI embedding models.
+const (
+	TaskRetrievalDocument = "RETRIEVAL_DOCUMENT"
+	TaskRetrievalQuery    = "RETRIEVAL_QUERY"
+)
+
+// Names of the functions the model is asked to call when extracting
+// structured output.
+const (
+	extractSnippetsFunc = "extractSnippets"
+	extractLabelsFunc   = "extractLabels"
+	reportConflictFunc  = "reportConflict"
+)
+
+// LLMProvider is the language model used by the ingestion pipeline to chunk,
+// label, title and embed instruction snippets.
+type LLMProvider interface {
+	// ExtractSnippets breaks a markdown document into standalone instruction
+	// snippets. A positive limit caps the number of snippets requested.
+	ExtractSnippets(ctx context.Context, content string, limit int) ([]string, error)
+	// RefineSection breaks one section of a markdown document, found under
+	// the headings in headingPath, into standalone instruction snippets.
+	RefineSection(ctx context.Context, section string, headingPath []string) ([]string, error)
+	// ExtractLabels returns topic labels for a snippet.
+	ExtractLabels(ctx context.Context, snippet string) ([]string, error)
+	// CheckConflict reports whether following both snippets at once is
+	// impossible, and if so, explains why.
+	CheckConflict(ctx context.Context, a, b string) (bool, string, error)
+	// GenerateTitle returns a short title for a snippet.
+	GenerateTitle(ctx context.Context, content string) (string, error)
+	// Embed returns an embedding vector of text for the given task type.
+	Embed(ctx context.Context, text string, taskType string) ([]float32, error)
+}
+
+// newLLMProvider creates the provider selected by cfg.LLMProvider.
+func newLLMProvider(ctx context.Context, cfg Config) (LLMProvider, error) {
+	switch cfg.LLMProvider {
+	case "vertex":
+		genaiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
+			Project:  cfg.ProjectID,
+			Location: cfg.VertexLocation,
+			Backend:  genai.BackendVertexAI,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create genai client: %v", err)
+		}
+		return newVertexProvider(genaiClient, cfg.GenerationModel, cfg.EmbeddingModel, cfg.EmbeddingDimensions), nil
+	case "openai":
+		log.Printf("Using OpenAI-compatible models %s and %s at %s", cfg.GenerationModel, cfg.EmbeddingModel, cfg.OpenAIBaseURL)
+		return newOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, cfg.GenerationModel, cfg.EmbeddingModel), nil
+	case "fake":
+		log.Println("Using fake LLM provider; snippets will not be meaningful")
+		return newFakeLLM(), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM_PROVIDER %q", cfg.LLMProvider)
+	}
+}
+
+// functionCall is a provider-neutral function call returned by a model.
+type functionCall struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// stringsFromCall extracts the string array argument field from a call to the
+// function name.
+func stringsFromCall(fc *functionCall, name, field string) ([]string, error) {
+	if fc == nil || fc.Name != name {
+		return nil, fmt.Errorf("unexpected response format or empty response")
+	}
+	values, ok := fc.Args[field].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected response format or empty response")
+	}
+	var result []string
+	for _, v := range values {
+		if str, ok := v.(string); ok {
+			result = append(result, str)
+		}
+	}
+	return result, nil
+}
+
+// conflictSchema is the JSON schema of the arguments of reportConflict.
+var conflictSchema = map[string]interface{}{
+	"type": "object",
+	"properties": map[string]interface{}{
+		"conflict": map[string]interface{}{
+			"type":        "boolean",
+			"description": "Whether an agent cannot follow both instructions at once.",
+		},
+		"explanation": map[string]interface{}{
+			"type":        "string",
+			"description": "One sentence explaining the conflict, or empty if there is none.",
+		},
+	},
+	"required": []string{"conflict"},
+}
+
+// conflictFromCall extracts the verdict of a call to reportConflict.
+func conflictFromCall(fc *functionCall) (bool, string, error) {
+	if fc == nil || fc.Name != reportConflictFunc {
+		return false, "", fmt.Errorf("unexpected response format or empty response")
+	}
+	conflict, ok := fc.Args["conflict"].(bool)
+	if !ok {
+		return false, "", fmt.Errorf("unexpected response format or empty response")
+	}
+	explanation, _ := fc.Args["explanation"].(string)
+	return conflict, explanation, nil
+}
+
+func snippetsPrompt(content string, limit int) string {
+	prompt := "Break down the following markdown into discrete, standalone instruction snippets, preserving the original markdown formatting and carriage returns. Each snippet should be a self-contained piece of instruction roughly a paragraph or so in size."
+	if limit > 0 {
+		prompt = fmt.Sprintf("%s Please provide no more than %d snippets.", prompt, limit)
+	}
+	return prompt + " Markdown: " + content
+}
+
+func refinePrompt(section string, headingPath []string) string {
+	prompt := "Break down the following markdown section of a larger instruction document into discrete, standalone instruction snippets, preserving the original markdown formatting and carriage returns. Keep fenced code blocks and lists whole. If the section is already a single self-contained instruction, return it unchanged as one snippet."
+	if len(headingPath) > 0 {
+		prompt = fmt.Sprintf("%s The section is found under the headings: %s.", prompt, strings.Join(headingPath, " > "))
+	}
+	return prompt + " Markdown: " + section
+}
+
+func labelsPrompt(snippet string) string {
+	return "Generate a list of relevant topic labels for the following snippet. Snippet: " + snippet
+}
+
+func conflictPrompt(a, b string) string {
+	return "The following two instructions for a coding agent come from different instruction files. Decide whether they conflict, meaning an agent cannot follow both at once, such as \"indent with tabs\" and \"indent with two spaces\". Instructions on different topics, or where one only adds detail to the other, do not conflict. If they conflict, explain the conflict in one sentence. First instruction: " + a + " Second instruction: " + b
+}
+
+func titlePrompt(content string) string {
+	return "Generate a concise and descriptive title for the following snippet. Return one and only one proposed title, with no markdown formatting. Snippet: " + content
+}
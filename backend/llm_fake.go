@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// fakeEmbeddingDims is the size of the vectors returned by fakeLLM.Embed.
+const fakeEmbeddingDims = 64
+
+// Method names accepted by fakeLLM.QueueError.
+const (
+	fakeExtractSnippets = "ExtractSnippets"
+	fakeRefineSection   = "RefineSection"
+	fakeExtractLabels   = "ExtractLabels"
+	fakeCheckConflict   = "CheckConflict"
+	fakeGenerateTitle   = "GenerateTitle"
+	fakeEmbed           = "Embed"
+)
+
+// fakeLLM is a deterministic LLMProvider for tests and offline runs. Canned
+// function calls and errors can be queued up; once a queue is empty it falls
+// back to simple rule-based answers. Embeddings are derived from hashed word
+// counts, so texts that share words have similar vectors.
+type fakeLLM struct {
+	mu     sync.Mutex
+	queued map[string][]*functionCall
+	titles []string
+	errs   map[string][]error
+	counts map[string]int
+}
+
+func newFakeLLM() *fakeLLM {
+	return &fakeLLM{
+		queued: make(map[string][]*functionCall),
+		errs:   make(map[string][]error),
+		counts: make(map[string]int),
+	}
+}
+
+// QueueCall queues a canned function call to be returned by the next request
+// that offers the function name.
+func (f *fakeLLM) QueueCall(name string, args map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queued[name] = append(f.queued[name], &functionCall{Name: name, Args: args})
+}
+
+// QueueSnippets queues an extractSnippets call returning snippets.
+func (f *fakeLLM) QueueSnippets(snippets ...string) {
+	f.QueueCall(extractSnippetsFunc, map[string]interface{}{"snippets": toInterfaces(snippets)})
+}
+
+// QueueLabels queues an extractLabels call returning labels.
+func (f *fakeLLM) QueueLabels(labels ...string) {
+	f.QueueCall(extractLabelsFunc, map[string]interface{}{"labels": toInterfaces(labels)})
+}
+
+// QueueConflict queues a reportConflict call finding a conflict, explained
+// by explanation.
+func (f *fakeLLM) QueueConflict(explanation string) {
+	f.QueueCall(reportConflictFunc, map[string]interface{}{"conflict": true, "explanation": explanation})
+}
+
+// QueueTitle queues a title to be returned by the next GenerateTitle.
+func (f *fakeLLM) QueueTitle(title string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.titles = append(f.titles, title)
+}
+
+// QueueError makes the next call to method fail with err.
+func (f *fakeLLM) QueueError(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[method] = append(f.errs[method], err)
+}
+
+// Calls returns how many times method has been called.
+func (f *fakeLLM) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[method]
+}
+
+// begin records a call to method and returns its queued error, if any.
+func (f *fakeLLM) begin(method string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counts[method]++
+	if errs := f.errs[method]; len(errs) > 0 {
+		f.errs[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func (f *fakeLLM) next(name string) *functionCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.queued[name]
+	if len(calls) == 0 {
+		return nil
+	}
+	f.queued[name] = calls[1:]
+	return calls[0]
+}
+
+func (f *fakeLLM) ExtractSnippets(ctx context.Context, content string, limit int) ([]string, error) {
+	if err := f.begin(fakeExtractSnippets); err != nil {
+		return nil, err
+	}
+	if fc := f.next(extractSnippetsFunc); fc != nil {
+		return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+	}
+
+	// Without a canned answer, every heading starts a new snippet.
+	var snippets []string
+	var current []string
+	flush := func() {
+		if text := strings.TrimSpace(strings.Join(current, "\n")); text != "" {
+			snippets = append(snippets, text)
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "#") {
+			flush()
+		}
+		current = append(current, line)
+	}
+	flush()
+	if limit > 0 && len(snippets) > limit {
+		snippets = snippets[:limit]
+	}
+	return snippets, nil
+}
+
+func (f *fakeLLM) RefineSection(ctx context.Context, section string, headingPath []string) ([]string, error) {
+	if err := f.begin(fakeRefineSection); err != nil {
+		return nil, err
+	}
+	if fc := f.next(extractSnippetsFunc); fc != nil {
+		return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+	}
+	// Without a canned answer, the section is already one snippet.
+	return []string{strings.TrimSpace(section)}, nil
+}
+
+func (f *fakeLLM) ExtractLabels(ctx context.Context, snippet string) ([]string, error) {
+	if err := f.begin(fakeExtractLabels); err != nil {
+		return nil, err
+	}
+	if fc := f.next(extractLabelsFunc); fc != nil {
+		return stringsFromCall(fc, extractLabelsFunc, "labels")
+	}
+	return []string{"general"}, nil
+}
+
+func (f *fakeLLM) CheckConflict(ctx context.Context, a, b string) (bool, string, error) {
+	if err := f.begin(fakeCheckConflict); err != nil {
+		return false, "", err
+	}
+	if fc := f.next(reportConflictFunc); fc != nil {
+		return conflictFromCall(fc)
+	}
+	return false, "", nil
+}
+
+func (f *fakeLLM) GenerateTitle(ctx context.Context, content string) (string, error) {
+	if err := f.begin(fakeGenerateTitle); err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	if len(f.titles) > 0 {
+		title := f.titles[0]
+		f.titles = f.titles[1:]
+		f.mu.Unlock()
+		return title, nil
+	}
+	f.mu.Unlock()
+
+	words := strings.Fields(content)
+	if len(words) > 6 {
+		words = words[:6]
+	}
+	return strings.Join(words, " "), nil
+}
+
+func (f *fakeLLM) Embed(ctx context.Context, text string, taskType string) ([]float32, error) {
+	if err := f.begin(fakeEmbed); err != nil {
+		return nil, err
+	}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty embedding returned")
+	}
+	return hashEmbedding(words, fakeEmbeddingDims), nil
+}
+
+// hashEmbedding folds words into a normalized vector of the given size using
+// the hashing trick.
+func hashEmbedding(words []string, dims int) []float32 {
+	vec := make([]float32, dims)
+	for _, w := range words {
+		h := fnv.New32a()
+		h.Write([]byte(w))
+		vec[h.Sum32()%uint32(dims)]++
+	}
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v * v)
+	}
+	norm = math.Sqrt(norm)
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / norm)
+	}
+	return vec
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
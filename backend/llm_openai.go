@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// openAIProvider is an LLMProvider for servers speaking the OpenAI chat
+// completions and embeddings protocol, such as Ollama, vLLM or llama.cpp.
+// Structured output uses tool calls, mirroring the Vertex AI function calls.
+type openAIProvider struct {
+	baseURL         string
+	apiKey          string
+	generationModel string
+	embeddingModel  string
+	httpClient      *http.Client
+}
+
+func newOpenAIProvider(baseURL, apiKey, generationModel, embeddingModel string) *openAIProvider {
+	return &openAIProvider{
+		baseURL:         strings.TrimRight(baseURL, "/"),
+		apiKey:          apiKey,
+		generationModel: generationModel,
+		embeddingModel:  embeddingModel,
+		httpClient:      http.DefaultClient,
+	}
+}
+
+// apiError is a non-2xx response from an HTTP model server.
+type apiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("model server returned status %d: %s", e.StatusCode, e.Message)
+}
+
+type openAIMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIToolCall struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string             `json:"type"`
+	Function openAIToolFunction `json:"function"`
+}
+
+type openAIToolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type openAIChatRequest struct {
+	Model      string          `json:"model"`
+	Messages   []openAIMessage `json:"messages"`
+	Tools      []openAITool    `json:"tools,omitempty"`
+	ToolChoice interface{}     `json:"tool_choice,omitempty"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+}
+
+type openAIEmbeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// openAIStringArrayTool declares a function taking a single string array
+// argument, the counterpart of stringArrayTool.
+func openAIStringArrayTool(name, description, field, fieldDescription string) openAITool {
+	return openAITool{
+		Type: "function",
+		Function: openAIToolFunction{
+			Name:        name,
+			Description: description,
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					field: map[string]interface{}{
+						"type":        "array",
+						"description": fieldDescription,
+						"items":       map[string]interface{}{"type": "string"},
+					},
+				},
+				"required": []string{field},
+			},
+		},
+	}
+}
+
+// openAIConflictTool declares the function the model reports a conflict
+// verdict with, the counterpart of conflictTool.
+func openAIConflictTool() openAITool {
+	return openAITool{
+		Type: "function",
+		Function: openAIToolFunction{
+			Name:        reportConflictFunc,
+			Description: "Reports whether two instructions conflict.",
+			Parameters:  conflictSchema,
+		},
+	}
+}
+
+func (p *openAIProvider) ExtractSnippets(ctx context.Context, content string, limit int) ([]string, error) {
+	tool := openAIStringArrayTool(extractSnippetsFunc,
+		"Extracts discrete, standalone instruction snippets from a markdown document.",
+		"snippets", "List of instruction snippets.")
+	fc, err := p.callFunction(ctx, snippetsPrompt(content, limit), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+}
+
+func (p *openAIProvider) RefineSection(ctx context.Context, section string, headingPath []string) ([]string, error) {
+	tool := openAIStringArrayTool(extractSnippetsFunc,
+		"Extracts discrete, standalone instruction snippets from a section of a markdown document.",
+		"snippets", "List of instruction snippets.")
+	fc, err := p.callFunction(ctx, refinePrompt(section, headingPath), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+}
+
+func (p *openAIProvider) ExtractLabels(ctx context.Context, snippet string) ([]string, error) {
+	tool := openAIStringArrayTool(extractLabelsFunc,
+		"Extracts relevant labels from a code snippet.",
+		"labels", "List of relevant labels for a code snippet.")
+	fc, err := p.callFunction(ctx, labelsPrompt(snippet), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractLabelsFunc, "labels")
+}
+
+func (p *openAIProvider) CheckConflict(ctx context.Context, a, b string) (bool, string, error) {
+	fc, err := p.callFunction(ctx, conflictPrompt(a, b), openAIConflictTool())
+	if err != nil {
+		return false, "", err
+	}
+	return conflictFromCall(fc)
+}
+
+// callFunction sends prompt with a single tool the model is required to call
+// and returns the first tool call in the reply, if any.
+func (p *openAIProvider) callFunction(ctx context.Context, prompt string, tool openAITool) (*functionCall, error) {
+	req := openAIChatRequest{
+		Model:    p.generationModel,
+		Messages: []openAIMessage{{Role: "user", Content: prompt}},
+		Tools:    []openAITool{tool},
+		ToolChoice: map[string]interface{}{
+			"type":     "function",
+			"function": map[string]string{"name": tool.Function.Name},
+		},
+	}
+	var resp openAIChatResponse
+	if err := p.post(ctx, "/chat/completions", req, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+		return nil, nil
+	}
+
+	call := resp.Choices[0].Message.ToolCalls[0].Function
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+		return nil, fmt.Errorf("failed to decode arguments of %s: %v", call.Name, err)
+	}
+	return &functionCall{Name: call.Name, Args: args}, nil
+}
+
+func (p *openAIProvider) GenerateTitle(ctx context.Context, content string) (string, error) {
+	req := openAIChatRequest{
+		Model:    p.generationModel,
+		Messages: []openAIMessage{{Role: "user", Content: titlePrompt(content)}},
+	}
+	var resp openAIChatResponse
+	if err := p.post(ctx, "/chat/completions", req, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("unexpected response format or empty response")
+	}
+	return strings.TrimSpace(resp.Choices[0].Message.Content), nil
+}
+
+// Embed returns the embedding of text. The OpenAI protocol has no notion of
+// task types, so taskType is ignored.
+func (p *openAIProvider) Embed(ctx context.Context, text string, taskType string) ([]float32, error) {
+	var resp openAIEmbeddingResponse
+	if err := p.post(ctx, "/embeddings", openAIEmbeddingRequest{Model: p.embeddingModel, Input: text}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 || len(resp.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("empty embedding returned")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+// post sends body as JSON to the endpoint at path and decodes the reply into
+// out.
+func (p *openAIProvider) post(ctx context.Context, path string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &apiError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newOpenAITestServer returns a server that answers chat completions by
+// calling the offered tool with args, and embeddings with a fixed vector.
+func newOpenAITestServer(t *testing.T, args map[string]interface{}) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization header = %q", got)
+		}
+		switch r.URL.Path {
+		case "/v1/chat/completions":
+			var req openAIChatRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("decode chat request: %v", err)
+				return
+			}
+			if req.Model != "llama3.1" {
+				t.Errorf("chat model = %q, want llama3.1", req.Model)
+			}
+			msg := map[string]interface{}{"role": "assistant", "content": "A Title\n"}
+			if len(req.Tools) == 1 {
+				encoded, _ := json.Marshal(args)
+				msg["content"] = ""
+				msg["tool_calls"] = []map[string]interface{}{{
+					"type": "function",
+					"function": map[string]string{
+						"name":      req.Tools[0].Function.Name,
+						"arguments": string(encoded),
+					},
+				}}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"choices": []map[string]interface{}{{"message": msg}},
+			})
+		case "/v1/embeddings":
+			var req openAIEmbeddingRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Errorf("decode embedding request: %v", err)
+				return
+			}
+			if req.Model != "nomic-embed-text" || req.Input != "use gofmt" {
+				t.Errorf("unexpected embedding request %+v", req)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": []map[string]interface{}{{"embedding": []float32{0.5, -0.5}}},
+			})
+		default:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+func TestOpenAIProvider(t *testing.T) {
+	ctx := context.Background()
+	server := newOpenAITestServer(t, map[string]interface{}{
+		"snippets":    []string{"first", "second"},
+		"labels":      []string{"go", "style"},
+		"conflict":    true,
+		"explanation": "Tabs or spaces.",
+	})
+	defer server.Close()
+	p := newOpenAIProvider(server.URL+"/v1/", "secret", "llama3.1", "nomic-embed-text")
+
+	snippets, err := p.ExtractSnippets(ctx, "# Doc", 2)
+	if err != nil {
+		t.Fatalf("ExtractSnippets: %v", err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(snippets, want) {
+		t.Errorf("ExtractSnippets = %v, want %v", snippets, want)
+	}
+
+	snippets, err = p.RefineSection(ctx, "## Style\nfirst\n\nsecond", []string{"Doc", "Style"})
+	if err != nil {
+		t.Fatalf("RefineSection: %v", err)
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(snippets, want) {
+		t.Errorf("RefineSection = %v, want %v", snippets, want)
+	}
+
+	labels, err := p.ExtractLabels(ctx, "first")
+	if err != nil {
+		t.Fatalf("ExtractLabels: %v", err)
+	}
+	if want := []string{"go", "style"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("ExtractLabels = %v, want %v", labels, want)
+	}
+
+	conflict, explanation, err := p.CheckConflict(ctx, "Use tabs.", "Use spaces.")
+	if err != nil || !conflict || explanation != "Tabs or spaces." {
+		t.Errorf("CheckConflict = %v, %q, %v; want a conflict", conflict, explanation, err)
+	}
+
+	title, err := p.GenerateTitle(ctx, "first")
+	if err != nil || title != "A Title" {
+		t.Errorf("GenerateTitle = %q, %v; want %q", title, err, "A Title")
+	}
+
+	embedding, err := p.Embed(ctx, "use gofmt", TaskRetrievalDocument)
+	if err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+	if want := []float32{0.5, -0.5}; !reflect.DeepEqual(embedding, want) {
+		t.Errorf("Embed = %v, want %v", embedding, want)
+	}
+}
+
+func TestOpenAIProvider_HTTPError(t *testing.T) {
+	server := newOpenAITestServer(t, nil)
+	defer server.Close()
+	p := newOpenAIProvider(server.URL+"/wrong", "secret", "llama3.1", "nomic-embed-text")
+
+	_, err := p.Embed(context.Background(), "use gofmt", TaskRetrievalDocument)
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Embed error = %v, want an apiError with status 503", err)
+	}
+}
+
+func TestLoadConfig_ProviderDefaults(t *testing.T) {
+	t.Setenv("LLM_PROVIDER", "openai")
+	t.Setenv("LLM_MODEL", "")
+	t.Setenv("EMBEDDING_MODEL", "mxbai-embed-large")
+
+	cfg := loadConfig()
+	if cfg.GenerationModel != defaultOpenAIGenerationModel {
+		t.Errorf("GenerationModel = %q, want %q", cfg.GenerationModel, defaultOpenAIGenerationModel)
+	}
+	if cfg.EmbeddingModel != "mxbai-embed-large" {
+		t.Errorf("EmbeddingModel = %q, want the configured model", cfg.EmbeddingModel)
+	}
+
+	t.Setenv("LLM_PROVIDER", "")
+	t.Setenv("EMBEDDING_MODEL", "")
+	cfg = loadConfig()
+	if cfg.LLMProvider != "vertex" || cfg.GenerationModel != defaultGenerationModel || cfg.EmbeddingModel != defaultEmbeddingModel {
+		t.Errorf("default config = %+v, want Vertex AI defaults", cfg)
+	}
+}
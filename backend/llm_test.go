@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStringsFromCall(t *testing.T) {
+	fc := &functionCall{
+		Name: extractLabelsFunc,
+		Args: map[string]interface{}{"labels": []interface{}{"go", 42, "testing"}},
+	}
+	got, err := stringsFromCall(fc, extractLabelsFunc, "labels")
+	if err != nil {
+		t.Fatalf("stringsFromCall: %v", err)
+	}
+	if want := []string{"go", "testing"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stringsFromCall = %v, want %v", got, want)
+	}
+
+	if _, err := stringsFromCall(fc, extractSnippetsFunc, "snippets"); err == nil {
+		t.Error("stringsFromCall accepted a call to the wrong function")
+	}
+	if _, err := stringsFromCall(nil, extractLabelsFunc, "labels"); err == nil {
+		t.Error("stringsFromCall accepted a missing call")
+	}
+}
+
+func TestConflictFromCall(t *testing.T) {
+	fc := &functionCall{Name: reportConflictFunc, Args: map[string]interface{}{"conflict": true, "explanation": "Tabs or spaces."}}
+	if conflict, explanation, err := conflictFromCall(fc); err != nil || !conflict || explanation != "Tabs or spaces." {
+		t.Errorf("conflictFromCall = %v, %q, %v", conflict, explanation, err)
+	}
+	fc = &functionCall{Name: reportConflictFunc, Args: map[string]interface{}{"conflict": "yes"}}
+	if _, _, err := conflictFromCall(fc); err == nil {
+		t.Error("conflictFromCall accepted a verdict that is not a boolean")
+	}
+	if _, _, err := conflictFromCall(nil); err == nil {
+		t.Error("conflictFromCall accepted a missing call")
+	}
+}
+
+func TestFakeLLM_Scripted(t *testing.T) {
+	ctx := context.Background()
+	llm := newFakeLLM()
+	llm.QueueSnippets("one", "two")
+	llm.QueueLabels("go")
+	llm.QueueError(fakeExtractLabels, errors.New("quota exceeded"))
+
+	snippets, err := llm.ExtractSnippets(ctx, "ignored", 0)
+	if err != nil || !reflect.DeepEqual(snippets, []string{"one", "two"}) {
+		t.Errorf("ExtractSnippets = %v, %v; want the queued snippets", snippets, err)
+	}
+	if _, err := llm.ExtractLabels(ctx, "one"); err == nil {
+		t.Error("ExtractLabels did not return the queued error")
+	}
+	if labels, _ := llm.ExtractLabels(ctx, "one"); !reflect.DeepEqual(labels, []string{"go"}) {
+		t.Errorf("ExtractLabels = %v, want the queued labels", labels)
+	}
+	if labels, _ := llm.ExtractLabels(ctx, "two"); !reflect.DeepEqual(labels, []string{"general"}) {
+		t.Errorf("ExtractLabels with an empty queue = %v, want the default", labels)
+	}
+	if n := llm.Calls(fakeExtractLabels); n != 3 {
+		t.Errorf("Calls(ExtractLabels) = %d, want 3", n)
+	}
+}
+
+func TestFakeLLM_Embed(t *testing.T) {
+	ctx := context.Background()
+	llm := newFakeLLM()
+
+	a, _ := llm.Embed(ctx, "Run gofmt before committing", TaskRetrievalDocument)
+	b, _ := llm.Embed(ctx, "run GOFMT before committing!", TaskRetrievalQuery)
+	if !reflect.DeepEqual(a, b) {
+		t.Error("embeddings of texts with the same words differ")
+	}
+	if len(a) != fakeEmbeddingDims {
+		t.Errorf("embedding has %d dimensions, want %d", len(a), fakeEmbeddingDims)
+	}
+	if _, err := llm.Embed(ctx, "  ", TaskRetrievalDocument); err == nil {
+		t.Error("Embed of blank text succeeded")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/genai"
+)
+
+// Default Vertex AI models.
+const (
+	defaultGenerationModel = "gemini-2.5-flash"
+	defaultEmbeddingModel  = "gemini-embedding-001"
+
+	// defaultEmbeddingDimensions is one of the sizes gemini-embedding-001
+	// recommends, small enough for a Firestore vector index.
+	defaultEmbeddingDimensions = 768
+)
+
+// vertexProvider is an LLMProvider backed by Gemini models on Vertex AI.
+type vertexProvider struct {
+	client          *genai.Client
+	generationModel string
+	embeddingModel  string
+	dimensions      int32
+}
+
+func newVertexProvider(client *genai.Client, generationModel, embeddingModel string, dimensions int) *vertexProvider {
+	return &vertexProvider{
+		client:          client,
+		generationModel: generationModel,
+		embeddingModel:  embeddingModel,
+		dimensions:      int32(dimensions),
+	}
+}
+
+// stringArrayTool declares a function taking a single string array argument.
+func stringArrayTool(name, description, field, fieldDescription string) *genai.Tool {
+	schema := &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			field: {
+				Type:        genai.TypeArray,
+				Description: fieldDescription,
+				Items:       &genai.Schema{Type: genai.TypeString},
+			},
+		},
+		Required: []string{field},
+	}
+	return &genai.Tool{
+		FunctionDeclarations: []*genai.FunctionDeclaration{
+			{
+				Name:                 name,
+				Description:          description,
+				ParametersJsonSchema: schema,
+			},
+		},
+	}
+}
+
+// conflictTool declares the function the model reports a conflict verdict
+// with.
+func conflictTool() *genai.Tool {
+	return &genai.Tool{
+		FunctionDeclarations: []*genai.FunctionDeclaration{
+			{
+				Name:                 reportConflictFunc,
+				Description:          "Reports whether two instructions conflict.",
+				ParametersJsonSchema: conflictSchema,
+			},
+		},
+	}
+}
+
+func (p *vertexProvider) ExtractSnippets(ctx context.Context, content string, limit int) ([]string, error) {
+	tool := stringArrayTool(extractSnippetsFunc,
+		"Extracts discrete, standalone instruction snippets from a markdown document.",
+		"snippets", "List of instruction snippets.")
+	fc, err := p.callFunction(ctx, snippetsPrompt(content, limit), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+}
+
+func (p *vertexProvider) RefineSection(ctx context.Context, section string, headingPath []string) ([]string, error) {
+	tool := stringArrayTool(extractSnippetsFunc,
+		"Extracts discrete, standalone instruction snippets from a section of a markdown document.",
+		"snippets", "List of instruction snippets.")
+	fc, err := p.callFunction(ctx, refinePrompt(section, headingPath), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractSnippetsFunc, "snippets")
+}
+
+func (p *vertexProvider) ExtractLabels(ctx context.Context, snippet string) ([]string, error) {
+	tool := stringArrayTool(extractLabelsFunc,
+		"Extracts relevant labels from a code snippet.",
+		"labels", "List of relevant labels for a code snippet.")
+	fc, err := p.callFunction(ctx, labelsPrompt(snippet), tool)
+	if err != nil {
+		return nil, err
+	}
+	return stringsFromCall(fc, extractLabelsFunc, "labels")
+}
+
+func (p *vertexProvider) CheckConflict(ctx context.Context, a, b string) (bool, string, error) {
+	fc, err := p.callFunction(ctx, conflictPrompt(a, b), conflictTool())
+	if err != nil {
+		return false, "", err
+	}
+	return conflictFromCall(fc)
+}
+
+// callFunction sends prompt with a single tool and returns the function call
+// in the first part of the response, if any.
+func (p *vertexProvider) callFunction(ctx context.Context, prompt string, tool *genai.Tool) (*functionCall, error) {
+	config := &genai.GenerateContentConfig{Tools: []*genai.Tool{tool}}
+	resp, err := p.client.Models.GenerateContent(ctx, p.generationModel, genai.Text(prompt), config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil && len(resp.Candidates[0].Content.Parts) > 0 {
+		if fc := resp.Candidates[0].Content.Parts[0].FunctionCall; fc != nil {
+			return &functionCall{Name: fc.Name, Args: fc.Args}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (p *vertexProvider) GenerateTitle(ctx context.Context, content string) (string, error) {
+	resp, err := p.client.Models.GenerateContent(ctx, p.generationModel, genai.Text(titlePrompt(content)), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil && len(resp.Candidates[0].Content.Parts) > 0 {
+		part := resp.Candidates[0].Content.Parts[0]
+		return part.Text, nil
+	}
+
+	return "", fmt.Errorf("unexpected response format or empty response")
+}
+
+func (p *vertexProvider) Embed(ctx context.Context, text string, taskType string) ([]float32, error) {
+	contents := []*genai.Content{genai.NewContentFromText(text, genai.RoleUser)}
+	config := &genai.EmbedContentConfig{TaskType: taskType}
+	if p.dimensions > 0 {
+		config.OutputDimensionality = &p.dimensions
+	}
+	result, err := p.client.Models.EmbedContent(ctx, p.embeddingModel, contents, config)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Embeddings) == 0 || len(result.Embeddings[0].Values) == 0 {
+		return nil, fmt.Errorf("empty embedding returned")
+	}
+	return result.Embeddings[0].Values, nil
+}
@@ -2,26 +2,74 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"reflect"
 	"strings"
 	"time"
 
 	firebase "firebase.google.com/go"
 
 	"cloud.google.com/go/firestore"
-	"google.golang.org/genai"
+	"github.com/modelcontextprotocol/go-sdk/mcp"
 )
 
 // App holds application dependencies
 type App struct {
-	firestoreClient *firestore.Client
-	genaiClient     *genai.Client
-	firebaseApp     *firebase.App
+	store       SnippetStore
+	jobs        JobStore
+	llm         LLMProvider
+	firebaseApp *firebase.App
+
+	// retry governs retries of model calls that fail transiently.
+	retry retryPolicy
+
+	// events streams the progress of running jobs to status subscribers.
+	events eventHub
+
+	// runner works through the source processing jobs in jobs.
+	runner *jobRunner
+
+	// lexical caches the BM25 index searches use.
+	lexical lexicalIndexCache
+
+	// clusters caches the groups of near-duplicate snippets.
+	clusters clusterCache
+
+	// queryEmbeddings caches the embeddings of the recommendation queries.
+	queryEmbeddings queryEmbeddingCache
+
+	// conflictSimilarity is the lowest cosine similarity of the snippet
+	// pairs checked for a conflict. Zero means defaultConflictThreshold.
+	conflictSimilarity float64
+
+	// fidelity decides what happens to snippets that are not found in
+	// their source.
+	fidelity fidelityPolicy
+
+	// redaction decides what happens to content holding secrets or
+	// personal data.
+	redaction redactionPolicy
+
+	// safety, if set, rates every new snippet before it is stored.
+	safety SafetyClassifier
+
+	// chunking is how sources are broken into snippets: ChunkingMarkdown,
+	// ChunkingRefine or, if empty, ChunkingLLM.
+	chunking string
+
+	// refreshToken is the bearer token the scheduled endpoints require.
+	// If empty, they refuse every request.
+	refreshToken string
+	// mcpToken is a long-lived bearer token /mcp accepts in place of a
+	// Firebase ID token. If empty, only ID tokens are accepted.
+	mcpToken string
 }
 
 // ProcessRequest defines the structure for the incoming request
@@ -36,26 +84,80 @@ type ProcessRequest struct {
 
 // Source defines the structure for the sources collection
 type Source struct {
-	Content        string    `firestore:"content"`
-	URL            string    `firestore:"url,omitempty"`
-	LastRefreshed  time.Time `firestore:"last_refreshed"`
-	Type           string    `firestore:"type"`
-	Status         string    `firestore:"status"`
-	Key            string    `firestore:"key"`
-	SubmitterID    string    `firestore:"submitterId"`
-	SubmitterEmail string    `firestore:"submitterEmail"`
+	ID             string    `firestore:"-" json:"id"`
+	Content        string    `firestore:"content" json:"content"`
+	URL            string    `firestore:"url,omitempty" json:"url,omitempty"`
+	LastRefreshed  time.Time `firestore:"last_refreshed" json:"last_refreshed"`
+	Type           string    `firestore:"type" json:"type"`
+	Status         string    `firestore:"status" json:"status"`
+	Key            string    `firestore:"key" json:"key"`
+	SubmitterID    string    `firestore:"submitterId" json:"submitterId"`
+	SubmitterEmail string    `firestore:"submitterEmail" json:"submitterEmail"`
+	// ContentHash is the hash of the content as of the last processing run
+	// that stored every snippet. A run over the same content is skipped.
+	ContentHash string `firestore:"content_hash,omitempty" json:"contentHash,omitempty"`
+	// ETag and LastModified are the validators the server sent with the
+	// content last fetched from URL, used to refresh it conditionally.
+	ETag         string `firestore:"etag,omitempty" json:"etag,omitempty"`
+	LastModified string `firestore:"last_modified,omitempty" json:"lastModified,omitempty"`
+	// FailedSnippets lists the snippets the last processing run extracted
+	// but could not store, which leaves the source partially_processed.
+	FailedSnippets []FailedSnippet `firestore:"failed_snippets,omitempty" json:"failedSnippets,omitempty"`
+	// Quarantine lists why the source's content was quarantined, if its
+	// status is StatusQuarantined.
+	Quarantine []QuarantineReason `firestore:"quarantine,omitempty" json:"quarantine,omitempty"`
+	// Redactions lists the secrets and personal data found in the content
+	// when it was last submitted or fetched.
+	Redactions []Redaction `firestore:"redactions,omitempty" json:"redactions,omitempty"`
+	// Imports are the files the content pulls in with @path lines,
+	// resolved against the source's URL where possible. They are not part
+	// of the source; submitting them is left to the caller.
+	Imports []string `firestore:"imports,omitempty" json:"imports,omitempty"`
+}
+
+// FailedSnippet records a snippet that failed processing after retries.
+type FailedSnippet struct {
+	// Index is the snippet's position among those extracted from the source.
+	Index   int    `firestore:"index" json:"index"`
+	Content string `firestore:"content" json:"content"`
+	// Stage is the step that failed, such as "generate embedding".
+	Stage string `firestore:"stage" json:"stage"`
+	Error string `firestore:"error" json:"error"`
 }
 
 // Snippet defines the structure for the snippets collection
 type Snippet struct {
-	Title      string                 `firestore:"title,omitempty"`
-	Content    string                 `firestore:"content"`
-	Labels     []string               `firestore:"labels"`
-	Source     *firestore.DocumentRef `firestore:"source"`
-	ThumbsUp   int                    `firestore:"thumbs_up"`
-	ThumbsDown int                    `firestore:"thumbs_down"`
-	CreatedAt  time.Time              `firestore:"created_at"`
-	Embedding  []float32              `firestore:"embedding"`
+	ID         string    `firestore:"-" json:"id"`
+	Title      string    `firestore:"title,omitempty" json:"title,omitempty"`
+	Content    string    `firestore:"content" json:"content"`
+	Labels     []string  `firestore:"labels" json:"labels"`
+	SourceID   string    `firestore:"-" json:"sourceId"`
+	ThumbsUp   int       `firestore:"thumbs_up" json:"thumbs_up"`
+	ThumbsDown int       `firestore:"thumbs_down" json:"thumbs_down"`
+	CreatedAt  time.Time `firestore:"created_at" json:"created_at"`
+	// ContentHash is the hash of the text the snippet was extracted as,
+	// before its title was split off, and of the labels and scope its
+	// source declared for it. Reprocessing keeps snippets whose text and
+	// metadata come out the same.
+	ContentHash string `firestore:"content_hash,omitempty" json:"contentHash,omitempty"`
+	// Provenance is where in the source the snippet was taken from.
+	Provenance *Provenance `firestore:"provenance,omitempty" json:"provenance,omitempty"`
+	// Scope is where the snippet applies, as declared by the rule file it
+	// came from. It is nil for snippets that apply everywhere.
+	Scope *Scope `firestore:"scope,omitempty" json:"scope,omitempty"`
+	// Fidelity is the share of the snippet's text found in the source,
+	// from 0 to 1, if it was verified.
+	Fidelity *float64 `firestore:"fidelity,omitempty" json:"fidelity,omitempty"`
+	// Flags mark snippets for review, such as FlagLowFidelity.
+	Flags []string `firestore:"flags,omitempty" json:"flags,omitempty"`
+	// Safety maps safety categories, such as "prompt_injection", to scores
+	// from 0 (safe) to 1 (unsafe). It is empty if the snippet was not rated.
+	Safety map[string]float64 `firestore:"safety,omitempty" json:"safety,omitempty"`
+	// Quarantine lists why the snippet was quarantined. Quarantined
+	// snippets are kept for review apart from the others, where nothing
+	// that lists, fetches or searches snippets finds them.
+	Quarantine []QuarantineReason `firestore:"quarantine,omitempty" json:"quarantine,omitempty"`
+	Embedding  []float32          `firestore:"embedding" json:"-"`
 }
 
 func (app *App) processSnippet(ctx context.Context, snippet *Snippet) {
@@ -65,7 +167,11 @@ func (app *App) processSnippet(ctx context.Context, snippet *Snippet) {
 		snippet.Content = strings.Join(lines[1:], "\n")
 	} else {
 		// If there is no title, we will use the LLM to generate one.
-		title, err := app.generateTitle(ctx, snippet.Content)
+		var title string
+		err := app.retry.do(ctx, "Generating title", func() (err error) {
+			title, err = app.llm.GenerateTitle(ctx, snippet.Content)
+			return err
+		})
 		if err != nil {
 			log.Printf("Failed to generate title: %v", err)
 			snippet.Title = "Untitled Snippet"
@@ -77,45 +183,129 @@ func (app *App) processSnippet(ctx context.Context, snippet *Snippet) {
 
 func main() {
 	ctx := context.Background()
-	projectID := os.Getenv("GCP_PROJECT")
+	cfg := loadConfig()
 
-	firestoreClient, err := firestore.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatalf("Failed to create client: %v", err)
+	var store interface {
+		SnippetStore
+		JobStore
+	}
+	switch cfg.SnippetStore {
+	case "firestore":
+		firestoreClient, err := firestore.NewClient(ctx, cfg.ProjectID)
+		if err != nil {
+			log.Fatalf("Failed to create client: %v", err)
+		}
+		defer firestoreClient.Close()
+		if store, err = newFirestoreStore(firestoreClient, cfg.EmbeddingDimensions); err != nil {
+			log.Fatalf("Failed to open Firestore store: %v", err)
+		}
+	case "memory":
+		log.Println("Using in-memory snippet store; data will not be persisted")
+		store = newMemoryStore()
+	case "sqlite":
+		sqliteStore, err := newSQLiteStore(ctx, cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("Failed to open SQLite database %s: %v", cfg.SQLitePath, err)
+		}
+		defer sqliteStore.Close()
+		store = sqliteStore
+	case "postgres":
+		postgresStore, err := newPostgresStore(ctx, cfg.PostgresURL, cfg.EmbeddingDimensions)
+		if err != nil {
+			log.Fatalf("Failed to open Postgres database: %v", err)
+		}
+		defer postgresStore.Close()
+		store = postgresStore
+	default:
+		log.Fatalf("Unknown SNIPPET_STORE %q", cfg.SnippetStore)
 	}
-	defer firestoreClient.Close()
 
-	genaiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
-		Project:  projectID,
-		Location: "global",
-		Backend:  genai.BackendVertexAI,
-	})
+	switch cfg.Chunking {
+	case ChunkingLLM, ChunkingMarkdown, ChunkingRefine:
+	default:
+		log.Fatalf("Unknown CHUNKING %q", cfg.Chunking)
+	}
+	switch cfg.FidelityPolicy {
+	case FidelityFlag, FidelityReject, FidelityOff:
+	default:
+		log.Fatalf("Unknown FIDELITY_POLICY %q", cfg.FidelityPolicy)
+	}
+	switch cfg.RedactionPolicy {
+	case RedactionRedact, RedactionReject, RedactionWarn:
+	default:
+		log.Fatalf("Unknown REDACTION_POLICY %q", cfg.RedactionPolicy)
+	}
+	switch cfg.MCPTransport {
+	case MCPTransportHTTP, MCPTransportStdio:
+	default:
+		log.Fatalf("Unknown MCP_TRANSPORT %q", cfg.MCPTransport)
+	}
+
+	llm, err := newLLMProvider(ctx, cfg)
 	if err != nil {
-		log.Fatalf("Failed to create genai client: %v", err)
+		log.Fatalf("Failed to create LLM provider: %v", err)
+	}
+	safety, err := newSafetyClassifier(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to create safety classifier: %v", err)
 	}
 
-	conf := &firebase.Config{ProjectID: projectID}
+	conf := &firebase.Config{ProjectID: cfg.ProjectID}
 	firebaseApp, err := firebase.NewApp(ctx, conf)
 	if err != nil {
 		log.Fatalf("error initializing app: %v\n", err)
 	}
 
 	app := &App{
-		firestoreClient: firestoreClient,
-		genaiClient:     genaiClient,
-		firebaseApp:     firebaseApp,
+		store:        store,
+		jobs:         store,
+		llm:          llm,
+		retry:        defaultRetryPolicy,
+		firebaseApp:  firebaseApp,
+		refreshToken: cfg.RefreshToken,
+		mcpToken:     cfg.MCPToken,
+		chunking:     cfg.Chunking,
+		safety:       safety,
+		redaction:    redactionPolicy{Action: cfg.RedactionPolicy},
+		fidelity:     fidelityPolicy{Action: cfg.FidelityPolicy, Threshold: cfg.FidelityThreshold},
+	}
+	app.clusters.Threshold = cfg.SimilarityThreshold
+	app.conflictSimilarity = cfg.ConflictThreshold
+
+	if cfg.MCPTransport == MCPTransportStdio {
+		// Standard output carries the protocol; logs go to standard error.
+		if err := app.newMCPServer().Run(ctx, &mcp.StdioTransport{}); err != nil {
+			log.Printf("MCP server stopped: %v", err)
+		}
+		return
+	}
+	app.startJobRunner(ctx, cfg.JobWorkers, cfg.JobLease)
+	if cfg.RefreshToken == "" {
+		log.Println("REFRESH_TOKEN is not set; the refresh and conflict scan endpoints are disabled")
 	}
 
 	fs := http.FileServer(http.Dir("./frontend/build"))
 	http.Handle("/", fs)
 	http.Handle("/api/v1/process", app.authMiddleware(http.HandlerFunc(app.processHandler)))
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-	log.Printf("Server starting on port %s...", port)
-	if err := http.ListenAndServe(":"+port, http.DefaultServeMux); err != nil {
+	http.HandleFunc("/api/v1/search", app.searchHandler)
+	http.HandleFunc("GET /api/v1/sources/{id}/status", app.sourceStatusHandler)
+	http.HandleFunc("GET /api/v1/sources/{id}/status/stream", app.sourceStatusStreamHandler)
+	http.HandleFunc("GET /api/v1/jobs/{id}", app.jobHandler)
+	http.HandleFunc("GET /api/v1/snippets/{id}/similar", app.similarHandler)
+	http.HandleFunc("GET /api/v1/snippets/{id}/conflicts", app.snippetConflictsHandler)
+	http.HandleFunc("GET /api/v1/conflicts", app.conflictsHandler)
+	http.Handle("POST /api/v1/conflicts/scan", app.requireRefreshToken(http.HandlerFunc(app.conflictScanHandler)))
+	http.HandleFunc("POST /api/v1/compose", app.composeHandler)
+	http.HandleFunc("POST /api/v1/export", app.exportHandler)
+	http.HandleFunc("POST /api/v1/recommend", app.recommendHandler)
+	http.Handle("POST /api/v1/refresh", app.requireRefreshToken(http.HandlerFunc(app.refreshHandler)))
+	mcpServer := app.newMCPServer()
+	http.Handle("/mcp", app.requireMCPAuth(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+		return mcpServer
+	}, nil)))
+
+	log.Printf("Server starting on port %s...", cfg.Port)
+	if err := http.ListenAndServe(":"+cfg.Port, http.DefaultServeMux); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -150,72 +340,359 @@ func (app *App) authMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func (app *App) processSnippetsAsync(ctx context.Context, content string, sourceRef *firestore.DocumentRef, limit int) {
-	log.Println("Starting snippet processing...")
-	// Generate snippets from the markdown content
-	snippets, err := app.generateSnippets(ctx, content, limit)
-	if err != nil {
-		log.Printf("Failed to generate snippets: %v", err)
-		// Update the source document with an error status
-		_, updateErr := sourceRef.Set(ctx, map[string]interface{}{
-			"status": "error",
-		}, firestore.MergeAll)
-		if updateErr != nil {
-			log.Printf("Failed to update source status: %v", updateErr)
+// maxJobAttempts is how many times a processing job is claimed before it is
+// given up on. Attempts beyond the first come from workers dying mid-job.
+const maxJobAttempts = 3
+
+// startJobRunner starts workers that run queued jobs until ctx is cancelled.
+func (app *App) startJobRunner(ctx context.Context, workers int, lease time.Duration) {
+	app.runner = newJobRunner(app.jobs, app.runJob, workers, lease)
+	app.runner.finished = func(job *Job) {
+		if job.SourceID != "" {
+			app.events.publish(job.SourceID, sourceEvent{Type: eventDone})
 		}
-		return
 	}
+	app.runner.Start(ctx)
+}
 
-	log.Printf("Generated %d snippets", len(snippets))
+// runJob runs a job of any kind.
+func (app *App) runJob(ctx context.Context, job *Job) error {
+	switch job.Kind {
+	case "":
+		return app.processSource(ctx, job)
+	case JobConflictScan:
+		return app.scanConflicts(ctx, job)
+	default:
+		return fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+}
+
+// enqueueJob queues a job and wakes a worker.
+func (app *App) enqueueJob(ctx context.Context, job *Job) (string, error) {
+	id, err := app.jobs.EnqueueJob(ctx, job)
+	if err != nil {
+		return "", err
+	}
+	if app.runner != nil {
+		app.runner.Notify()
+	}
+	return id, nil
+}
 
-	// Process and store snippets
-	for i, snippetText := range snippets {
-		log.Printf("Processing snippet %d/%d: %s", i+1, len(snippets), snippetText)
+// processSource runs a processing job: it fetches the source if asked to and
+// brings its snippets in line with its content. Processing is incremental,
+// so the job is safe to run again after a worker died partway. A failed job
+// is not retried, so whatever makes it fail leaves the source in error.
+func (app *App) processSource(ctx context.Context, job *Job) (err error) {
+	p := app.newProgressReporter(job)
+	defer func() {
+		// A job cut short by shutdown is picked up again later.
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if updateErr := app.setSourceStatus(ctx, job.SourceID, "error"); updateErr != nil {
+			p.logf("Failed to update source status: %v", updateErr)
+		}
+	}()
+	if job.Attempts > maxJobAttempts {
+		return fmt.Errorf("giving up after %d attempts", job.Attempts-1)
+	}
+	source, err := app.store.GetSource(ctx, job.SourceID)
+	if err != nil {
+		return fmt.Errorf("failed to load source: %v", err)
+	}
 
-		labels, err := app.generateLabels(ctx, snippetText)
+	if job.Fetch {
+		p.phase(ctx, PhaseFetching, 0)
+		p.logf("Fetching %s", source.URL)
+		// Without content to fall back on, a conditional request is no use.
+		etag, lastModified := source.ETag, source.LastModified
+		if source.Content == "" {
+			etag, lastModified = "", ""
+		}
+		doc, err := fetchContent(ctx, source.URL, etag, lastModified)
 		if err != nil {
-			log.Printf("Failed to generate labels for snippet %d: %v", i+1, err)
+			p.logf("Failed to fetch URL %s: %v", source.URL, err)
+			return fmt.Errorf("failed to fetch URL: %v", err)
+		}
+		if doc.NotModified {
+			p.logf("%s is not modified since it was last fetched", source.URL)
+		} else {
+			content, redactions, err := app.redaction.scrub(doc.Content)
+			source.Redactions = redactions
+			if err != nil {
+				p.logf("Refusing content of %s: %v", source.URL, err)
+				if updateErr := app.store.UpdateSource(ctx, source); updateErr != nil {
+					p.logf("Failed to record redactions: %v", updateErr)
+				}
+				return fmt.Errorf("fetched %v", err)
+			}
+			if len(redactions) > 0 {
+				p.logf("Found %s in %s", describeRedactions(redactions), source.URL)
+			}
+			source.Content = content
+			source.ETag, source.LastModified = doc.ETag, doc.LastModified
+			if err := app.store.UpdateSource(ctx, source); err != nil {
+				return fmt.Errorf("failed to save fetched content: %v", err)
+			}
+		}
+	}
+
+	hash := contentHash(source.Content)
+	if hash == source.ContentHash {
+		p.logf("Content of source %s is unchanged since it was last processed", source.ID)
+		source.Status = "processed"
+		source.LastRefreshed = time.Now()
+		if err := app.store.UpdateSource(ctx, source); err != nil {
+			return fmt.Errorf("failed to update source status: %v", err)
+		}
+		p.phase(ctx, PhaseDone, 0)
+		return nil
+	}
+	if reasons := concealing(analyzeInstructions(source.Content)); len(reasons) > 0 {
+		return app.quarantineSource(ctx, p, source, reasons)
+	}
+	parsed := parseSource(source)
+	p.logf("Processing source %s as %s", source.ID, parsed.Format)
+	return app.processSnippets(ctx, p, source, parsed, job.Limit)
+}
+
+// quarantineSource sets a source aside without extracting snippets from it,
+// because its content hides text from readers. Snippets from earlier
+// content are left as they are.
+func (app *App) quarantineSource(ctx context.Context, p *progressReporter, source *Source, reasons []QuarantineReason) error {
+	for _, reason := range reasons {
+		p.logf("Quarantining source %s: %s on line %d: %s", source.ID, reason.Code, reason.Line, reason.Excerpt)
+	}
+	source.Status = StatusQuarantined
+	source.Quarantine = reasons
+	source.FailedSnippets = nil
+	source.ContentHash = ""
+	source.LastRefreshed = time.Now()
+	if err := app.store.UpdateSource(ctx, source); err != nil {
+		return fmt.Errorf("failed to update source status: %v", err)
+	}
+	p.phase(ctx, PhaseDone, 0)
+	return nil
+}
+
+// contentHash returns the hex SHA-256 of text, which identifies source and
+// snippet contents across processing runs.
+func contentHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])
+}
+
+// processSnippets extracts snippets from the parsed content of a source and
+// reconciles them with those stored for the source by a previous run:
+// snippets whose text and metadata are unchanged are kept as they are, with
+// their IDs and votes; new or changed ones are labeled, embedded and stored;
+// and stored ones no longer extracted are retired.
+func (app *App) processSnippets(ctx context.Context, p *progressReporter, source *Source, parsed *parsedSource, limit int) error {
+	p.logf("Starting snippet processing...")
+	content, sourceID := parsed.Content, source.ID
+	existing, err := app.store.ListSnippetsBySource(ctx, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to list existing snippets: %v", err)
+	}
+	previous := make(map[string][]*Snippet)
+	for _, snippet := range existing {
+		previous[snippet.ContentHash] = append(previous[snippet.ContentHash], snippet)
+	}
+	// Quarantined snippets have no votes to keep; those of the previous run
+	// are replaced by this run's once it has stored them.
+	quarantined, err := app.store.ListQuarantinedSnippets(ctx, sourceID)
+	if err != nil {
+		return fmt.Errorf("failed to list quarantined snippets: %v", err)
+	}
+
+	p.phase(ctx, PhaseChunking, 0)
+	snippets, err := app.extractSnippets(ctx, p, content, limit)
+	if err != nil {
+		p.logf("Failed to generate snippets: %v", err)
+		return fmt.Errorf("failed to generate snippets: %v", err)
+	}
+
+	p.logf("Generated %d snippets", len(snippets))
+	p.setTotal(ctx, len(snippets))
+
+	// Process and store snippets. Snippets that still fail after retries,
+	// or are rejected for not being found in the source, are recorded on
+	// the source rather than dropped silently.
+	fidelity := newFidelityChecker(content)
+	var failed []FailedSnippet
+	for i, snippet := range snippets {
+		snippetText, hash := snippet.Text, parsed.snippetHash(snippet.Text)
+		provenance := newProvenance(source, snippet)
+		// Snippets from before content hashes were recorded have none and
+		// are never kept. Kept snippets may have moved within the source.
+		if same := previous[hash]; len(same) > 0 {
+			previous[hash] = same[1:]
+			if !reflect.DeepEqual(same[0].Provenance, provenance) {
+				if err := app.store.SetSnippetProvenance(ctx, same[0].ID, provenance); err != nil {
+					p.logf("Failed to update provenance of snippet %s: %v", same[0].ID, err)
+				}
+			}
+			p.snippetKept(ctx)
+			p.logf("Snippet %d/%d is unchanged, keeping %s", i+1, len(snippets), same[0].ID)
 			continue
 		}
-		log.Printf("Generated labels for snippet %d: %v", i+1, labels)
 
-		embedding, err := app.generateEmbedding(ctx, snippetText)
+		p.logf("Processing snippet %d/%d: %s", i+1, len(snippets), snippetText)
+		draft := &Snippet{Content: snippetText, SourceID: sourceID, Provenance: provenance,
+			Labels: parsed.Labels, Scope: parsed.Scope, ContentHash: hash}
+		score := fidelity.score(snippetText)
+		draft.Fidelity = &score
+		flags, err := app.fidelity.check(score)
+		stage := stageFidelity
+		if err == nil {
+			if draft.Flags = flags; len(flags) > 0 {
+				p.logf("Snippet %d scored %.2f against the source, flagging it", i+1, score)
+			}
+			for _, reason := range analyzeInstructions(snippetText) {
+				p.logf("Quarantining snippet %d: %s on line %d: %s", i+1, reason.Code, reason.Line, reason.Excerpt)
+				draft.Quarantine = append(draft.Quarantine, reason)
+			}
+			stage, err = app.storeSnippet(ctx, p, i+1, draft)
+		}
+		p.snippetDone(ctx, err)
 		if err != nil {
-			log.Printf("Failed to generate embedding for snippet %d: %v", i+1, err)
+			p.logf("Failed to %s for snippet %d: %v", stage, i+1, err)
+			failed = append(failed, FailedSnippet{Index: i, Content: snippetText, Stage: stage, Error: err.Error()})
 			continue
 		}
+		p.logf("Successfully stored snippet %d", i+1)
+	}
 
-		newSnippet := Snippet{
-			Content:    snippetText,
-			Labels:     labels,
-			Source:     sourceRef,
-			ThumbsUp:   0,
-			ThumbsDown: 0,
-			CreatedAt:  time.Now(),
-			Embedding:  embedding,
+	// Retire the snippets of the previous run that were not extracted again.
+	for _, stale := range previous {
+		for _, snippet := range stale {
+			if err := app.store.DeleteSnippet(ctx, snippet.ID); err != nil && !errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("failed to retire snippet %s: %v", snippet.ID, err)
+			}
+			p.snippetRetired(ctx)
+			p.logf("Retired snippet %s", snippet.ID)
+		}
+	}
+	for _, snippet := range quarantined {
+		if err := app.store.DeleteQuarantinedSnippet(ctx, snippet.ID); err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("failed to retire quarantined snippet %s: %v", snippet.ID, err)
 		}
+	}
 
-		app.processSnippet(ctx, &newSnippet)
+	p.logf("Snippet processing complete.")
+	app.lexical.invalidate()
+	app.clusters.invalidate()
 
-		_, _, err = app.firestoreClient.Collection("snippets").Add(ctx, newSnippet)
+	// Update the source document to indicate processing is complete. Only
+	// a complete run records the content hash, so that a partial one is
+	// retried in full next time.
+	status, hash := "processed", contentHash(source.Content)
+	if len(failed) > 0 {
+		status, hash = "partially_processed", ""
+	}
+	source, err = app.store.GetSource(ctx, sourceID)
+	if err == nil {
+		source.Status = status
+		source.FailedSnippets = failed
+		source.Quarantine = nil
+		source.ContentHash = hash
+		source.Imports = sourceImports(source, parsed.Imports)
+		source.LastRefreshed = time.Now()
+		err = app.store.UpdateSource(ctx, source)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update source status: %v", err)
+	}
+	p.phase(ctx, PhaseDone, 0)
+	p.logf("Source document status updated to '%s'", status)
+	return nil
+}
+
+// Stages of processing a snippet, as recorded on failed snippets.
+const (
+	stageFidelity  = "verify against the source"
+	stageLabels    = "generate labels"
+	stageSafety    = "classify safety"
+	stageEmbedding = "generate embedding"
+	stageStore     = "store snippet"
+)
+
+// storeSnippet labels, embeds, titles and stores the n-th extracted snippet,
+// given as a draft with its content, hash, source, provenance, verification
+// results and any labels and scope its source declares, retrying transient
+// model errors. The model's labels are added to the declared ones. On
+// failure it returns the stage that failed along with the error.
+func (app *App) storeSnippet(ctx context.Context, p *progressReporter, n int, draft *Snippet) (string, error) {
+	snippetText := draft.Content
+	// Quarantined snippets are stored for review without being shown to
+	// the model or to readers.
+	if len(draft.Quarantine) > 0 {
+		p.phase(ctx, PhaseStoring, n)
+		newSnippet := *draft
+		newSnippet.CreatedAt = time.Now()
+		if _, err := app.store.QuarantineSnippet(ctx, &newSnippet); err != nil {
+			return stageStore, err
+		}
+		return "", nil
+	}
+
+	p.phase(ctx, PhaseLabeling, n)
+	var labels []string
+	err := app.retry.do(ctx, "Generating labels", func() (err error) {
+		labels, err = app.llm.ExtractLabels(ctx, snippetText)
+		return err
+	})
+	if err != nil {
+		return stageLabels, err
+	}
+	p.logf("Generated labels for snippet %d: %v", n, labels)
+
+	var safety map[string]float64
+	if app.safety != nil {
+		p.phase(ctx, PhaseClassifying, n)
+		err = app.retry.do(ctx, "Classifying safety", func() (err error) {
+			safety, err = app.safety.Classify(ctx, snippetText)
+			return err
+		})
 		if err != nil {
-			log.Printf("Failed to store snippet %d: %v", i+1, err)
-			continue
+			return stageSafety, err
 		}
-		log.Printf("Successfully stored snippet %d", i+1)
 	}
 
-	log.Println("Snippet processing complete.")
+	p.phase(ctx, PhaseEmbedding, n)
+	var embedding []float32
+	err = app.retry.do(ctx, "Generating embedding", func() (err error) {
+		embedding, err = app.llm.Embed(ctx, snippetText, TaskRetrievalDocument)
+		return err
+	})
+	if err != nil {
+		return stageEmbedding, err
+	}
+
+	p.phase(ctx, PhaseStoring, n)
+	newSnippet := *draft
+	newSnippet.Labels = mergeLabels(draft.Labels, labels)
+	newSnippet.Safety = safety
+	newSnippet.CreatedAt = time.Now()
+	newSnippet.Embedding = embedding
+
+	app.processSnippet(ctx, &newSnippet)
+
+	if _, err := app.store.AddSnippet(ctx, &newSnippet); err != nil {
+		return stageStore, err
+	}
+	return "", nil
+}
 
-	// Update the source document to indicate processing is complete
-	_, err = sourceRef.Set(ctx, map[string]interface{}{
-		"status":         "processed",
-		"last_refreshed": time.Now(),
-	}, firestore.MergeAll)
+// setSourceStatus updates the status field of the source with the given ID.
+func (app *App) setSourceStatus(ctx context.Context, sourceID, status string) error {
+	source, err := app.store.GetSource(ctx, sourceID)
 	if err != nil {
-		log.Printf("Failed to update source status: %v", err)
+		return err
 	}
-	log.Println("Source document status updated to 'processed'")
+	source.Status = status
+	return app.store.UpdateSource(ctx, source)
 }
 
 func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
@@ -232,7 +709,6 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to read request body: %v", err)
 		return
 	}
-	log.Printf("Request body: %s", string(body))
 
 	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, "Failed to decode request", http.StatusBadRequest)
@@ -245,42 +721,22 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
-	var content string
-
-	// If URL is provided, fetch content from it
-	if req.URL != "" {
-		url := req.URL
-		if strings.Contains(url, "github.com") && strings.Contains(url, "/blob/") {
-			url = strings.Replace(url, "github.com", "raw.githubusercontent.com", 1)
-			url = strings.Replace(url, "/blob/", "/", 1)
-		}
-
-		resp, err := http.Get(url)
+	// Pasted content is scrubbed before it is stored, logged or shown to
+	// the model; fetched content is scrubbed by the job.
+	var redactions []Redaction
+	if req.URL == "" {
+		req.Content, redactions, err = app.redaction.scrub(req.Content)
 		if err != nil {
-			http.Error(w, "Failed to fetch URL", http.StatusInternalServerError)
-			log.Printf("Failed to fetch URL %s: %v", req.URL, err)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, fmt.Sprintf("Failed to fetch URL: status code %d", resp.StatusCode), http.StatusInternalServerError)
-			log.Printf("Failed to fetch URL %s: status code %d", req.URL, resp.StatusCode)
+			http.Error(w, "Refusing content: "+err.Error(), http.StatusUnprocessableEntity)
+			log.Printf("Refusing content for key %q: %v", req.Key, err)
 			return
 		}
-
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Failed to read response body", http.StatusInternalServerError)
-			log.Printf("Failed to read response body from %s: %v", req.URL, err)
-			return
+		if len(redactions) > 0 {
+			log.Printf("Found %s in content for key %q", describeRedactions(redactions), req.Key)
 		}
-		content = string(body)
-	} else {
-		content = req.Content
 	}
 
+	ctx := context.Background()
 	// Use the provided key or default to the URL
 	key := req.Key
 	if key == "" {
@@ -292,47 +748,32 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if a source with the given key already exists
-	iter := app.firestoreClient.Collection("sources").Where("key", "==", key).Limit(1).Documents(ctx)
-	doc, err := iter.Next()
-	if err != nil {
-		if err.Error() == "no more items in iterator" {
-			doc = nil // Source doesn't exist yet
-		} else {
-			http.Error(w, "Failed to query for existing source", http.StatusInternalServerError)
-			log.Printf("Failed to query for existing source: %v", err)
-			return
-		}
+	existing, err := app.store.FindSourceByKey(ctx, key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		http.Error(w, "Failed to query for existing source", http.StatusInternalServerError)
+		log.Printf("Failed to query for existing source: %v", err)
+		return
 	}
 
-	var sourceRef *firestore.DocumentRef
-	if doc != nil {
-		// Source exists, delete old snippets and update
-		sourceRef = doc.Ref
+	var sourceID string
+	if existing != nil {
+		// Source exists; the processing job replaces its snippets
+		sourceID = existing.ID
 		log.Printf("Source with key '%s' found, reprocessing...", key)
 
-		_, err := sourceRef.Set(ctx, map[string]interface{}{"status": "processing"}, firestore.MergeAll)
-		if err != nil {
-			http.Error(w, "Failed to update source status", http.StatusInternalServerError)
-			log.Printf("Failed to update source status: %v", err)
-			return
-		}
-
-		if err := app.deleteSnippetsBySource(ctx, sourceRef); err != nil {
-			http.Error(w, "Failed to delete old snippets", http.StatusInternalServerError)
-			log.Printf("Failed to delete old snippets: %v", err)
-			return
-		}
-
-		updateData := map[string]interface{}{
-			"content":        content,
-			"last_refreshed": time.Now(),
-		}
+		existing.Status = "processing"
+		existing.LastRefreshed = time.Now()
 		if req.URL != "" {
-			updateData["url"] = req.URL
+			if req.URL != existing.URL {
+				existing.ETag, existing.LastModified = "", ""
+			}
+			existing.URL = req.URL
+		} else {
+			existing.Content = req.Content
+			existing.Redactions = redactions
 		}
 
-		_, err = sourceRef.Set(ctx, updateData, firestore.MergeAll)
-		if err != nil {
+		if err := app.store.UpdateSource(ctx, existing); err != nil {
 			http.Error(w, "Failed to update source", http.StatusInternalServerError)
 			log.Printf("Failed to update source: %v", err)
 			return
@@ -344,7 +785,6 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 			sourceType = "url"
 		}
 		source := Source{
-			Content:        content,
 			URL:            req.URL,
 			LastRefreshed:  time.Now(),
 			Type:           sourceType,
@@ -353,7 +793,11 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 			SubmitterID:    req.SubmitterID,
 			SubmitterEmail: req.SubmitterEmail,
 		}
-		sourceRef, _, err = app.firestoreClient.Collection("sources").Add(ctx, source)
+		if req.URL == "" {
+			source.Content = req.Content
+			source.Redactions = redactions
+		}
+		sourceID, err = app.store.CreateSource(ctx, &source)
 		if err != nil {
 			http.Error(w, "Failed to store source", http.StatusInternalServerError)
 			log.Printf("Failed to add source: %v", err)
@@ -361,165 +805,15 @@ func (app *App) processHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	go app.processSnippetsAsync(context.Background(), content, sourceRef, req.Limit)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"documentId": sourceRef.ID})
-}
-
-func (app *App) deleteSnippetsBySource(ctx context.Context, sourceRef *firestore.DocumentRef) error {
-	iter := app.firestoreClient.Collection("snippets").Where("source", "==", sourceRef).Documents(ctx)
-	for {
-		doc, err := iter.Next()
-		if err != nil {
-			if err.Error() == "no more items in iterator" {
-				break // All done
-			}
-			return fmt.Errorf("failed to iterate snippets: %v", err)
-		}
-		_, err = doc.Ref.Delete(ctx)
-		if err != nil {
-			log.Printf("Failed to delete snippet %s: %v", doc.Ref.ID, err)
-			// Decide if you want to continue or return an error
-		}
-	}
-	log.Printf("Deleted all snippets for source %s", sourceRef.ID)
-	return nil
-}
-
-func (app *App) generateSnippets(ctx context.Context, content string, limit int) ([]string, error) {
-	snippetSchema := &genai.Schema{
-		Type: genai.TypeObject,
-		Properties: map[string]*genai.Schema{
-			"snippets": {
-				Type:        genai.TypeArray,
-				Description: "List of instruction snippets.",
-				Items:       &genai.Schema{Type: genai.TypeString},
-			},
-		},
-		Required: []string{"snippets"},
-	}
-
-	tools := []*genai.Tool{
-		{
-			FunctionDeclarations: []*genai.FunctionDeclaration{
-				{
-					Name:                 "extractSnippets",
-					Description:          "Extracts discrete, standalone instruction snippets from a markdown document.",
-					ParametersJsonSchema: snippetSchema,
-				},
-			},
-		},
-	}
-
-	prompt := "Break down the following markdown into discrete, standalone instruction snippets, preserving the original markdown formatting and carriage returns. Each snippet should be a self-contained piece of instruction roughly a paragraph or so in size."
-	if limit > 0 {
-		prompt = fmt.Sprintf("%s Please provide no more than %d snippets.", prompt, limit)
-	}
-	prompt = prompt + " Markdown: " + content
-
-	config := &genai.GenerateContentConfig{Tools: tools}
-	resp, err := app.genaiClient.Models.GenerateContent(ctx, "gemini-2.5-flash", genai.Text(prompt), config)
+	// URLs are fetched by the job, so that fetching is retried along with
+	// the rest of processing and shows up in the source's status.
+	jobID, err := app.enqueueJob(ctx, &Job{SourceID: sourceID, Limit: req.Limit, Fetch: req.URL != ""})
 	if err != nil {
-		return nil, err
-	}
-
-	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil && len(resp.Candidates[0].Content.Parts) > 0 {
-		part := resp.Candidates[0].Content.Parts[0]
-		if fc := part.FunctionCall; fc != nil {
-			if fc.Name == "extractSnippets" {
-				if snippets, ok := fc.Args["snippets"].([]interface{}); ok {
-					var result []string
-					for _, s := range snippets {
-						if str, ok := s.(string); ok {
-							result = append(result, str)
-						}
-					}
-					return result, nil
-				}
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("unexpected response format or empty response")
-}
-
-func (app *App) generateLabels(ctx context.Context, snippet string) ([]string, error) {
-	labelSchema := &genai.Schema{
-		Type: genai.TypeObject,
-		Properties: map[string]*genai.Schema{
-			"labels": {
-				Type:        genai.TypeArray,
-				Description: "List of relevant labels for a code snippet.",
-				Items:       &genai.Schema{Type: genai.TypeString},
-			},
-		},
-		Required: []string{"labels"},
-	}
-
-	tools := []*genai.Tool{
-		{
-			FunctionDeclarations: []*genai.FunctionDeclaration{
-				{
-					Name:                 "extractLabels",
-					Description:          "Extracts relevant labels from a code snippet.",
-					ParametersJsonSchema: labelSchema,
-				},
-			},
-		},
-	}
-
-	prompt := "Generate a list of relevant topic labels for the following snippet. Snippet: " + snippet
-	config := &genai.GenerateContentConfig{Tools: tools}
-	resp, err := app.genaiClient.Models.GenerateContent(ctx, "gemini-2.5-flash", genai.Text(prompt), config)
-	if err != nil {
-		return nil, err
-	}
-
-	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil && len(resp.Candidates[0].Content.Parts) > 0 {
-		part := resp.Candidates[0].Content.Parts[0]
-		if fc := part.FunctionCall; fc != nil {
-			if fc.Name == "extractLabels" {
-				if labels, ok := fc.Args["labels"].([]interface{}); ok {
-					var result []string
-					for _, l := range labels {
-						if str, ok := l.(string); ok {
-							result = append(result, str)
-						}
-					}
-					return result, nil
-				}
-			}
-		}
-	}
-
-	return nil, fmt.Errorf("unexpected response format or empty response")
-}
-
-func (app *App) generateTitle(ctx context.Context, content string) (string, error) {
-	prompt := "Generate a concise and descriptive title for the following snippet. Return one and only one proposed title, with no markdown formatting. Snippet: " + content
-	resp, err := app.genaiClient.Models.GenerateContent(ctx, "gemini-2.5-flash", genai.Text(prompt), nil)
-	if err != nil {
-		return "", err
-	}
-
-	if len(resp.Candidates) > 0 && resp.Candidates[0].Content != nil && len(resp.Candidates[0].Content.Parts) > 0 {
-		part := resp.Candidates[0].Content.Parts[0]
-		return part.Text, nil
+		http.Error(w, "Failed to queue source for processing", http.StatusInternalServerError)
+		log.Printf("Failed to enqueue processing job: %v", err)
+		return
 	}
 
-	return "", fmt.Errorf("unexpected response format or empty response")
-}
-
-func (app *App) generateEmbedding(ctx context.Context, snippet string) ([]float32, error) {
-	contents := []*genai.Content{genai.NewContentFromText(snippet, genai.RoleUser)}
-	config := &genai.EmbedContentConfig{TaskType: "RETRIEVAL_DOCUMENT"}
-	result, err := app.genaiClient.Models.EmbedContent(ctx, "gemini-embedding-001", contents, config)
-	if err != nil {
-		return nil, err
-	}
-	if len(result.Embeddings) == 0 || len(result.Embeddings[0].Values) == 0 {
-		return nil, fmt.Errorf("empty embedding returned")
-	}
-	return result.Embeddings[0].Values, nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"documentId": sourceID, "jobId": jobID})
 }
@@ -26,41 +26,9 @@ func TestReadSampleFile(t *testing.T) {
 }
 
 func TestProcessHandler_Integration(t *testing.T) {
-
-	// This test makes real calls to Google Cloud Vertex AI APIs.
-	// Ensure you have authenticated with `gcloud auth application-default login`.
-	if os.Getenv("GOOGLE_APPLICATION_CREDENTIALS") == "" {
-		// Check for ADC file existence as a proxy for being logged in.
-		home, err := os.UserHomeDir()
-		if err != nil {
-			t.Fatalf("could not get user home directory: %v", err)
-		}
-		adcFile := home + "/.config/gcloud/application_default_credentials.json"
-		if _, err := os.Stat(adcFile); os.IsNotExist(err) {
-			t.Skip("Skipping integration test: Application Default Credentials not found. Run 'gcloud auth application-default login'.")
-		}
-	}
-
 	ctx := context.Background()
-	firestoreClient, err := firestore.NewClient(ctx, "new-test-297222")
-	if err != nil {
-		t.Fatalf("Failed to create client: %v", err)
-	}
-	defer firestoreClient.Close()
-
-	genaiClient, err := genai.NewClient(ctx, &genai.ClientConfig{
-		Project:  "new-test-297222",
-		Location: "global",
-		Backend:  genai.BackendVertexAI,
-	})
-	if err != nil {
-		t.Fatalf("Failed to create genai client: %v", err)
-	}
-
-	app := &App{
-		firestoreClient: firestoreClient,
-		genaiClient:     genaiClient,
-	}
+	llm := newFakeLLM()
+	app := newTestApp(t, newMemoryStore(), llm)
 
 	content, err := ioutil.ReadFile("../samples/GEMINI-brief.md")
 	if err != nil {
@@ -79,11 +47,57 @@ func TestProcessHandler_Integration(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	processAndVerify(t, app, body, firestoreClient, ctx)
+	documentID := processAndVerify(t, app, body, ctx, 10*time.Millisecond)
+
+	snippets, err := app.store.ListSnippetsBySource(ctx, documentID)
+	if err != nil {
+		t.Fatalf("Failed to list snippets: %v", err)
+	}
+	// The fake starts a snippet at every heading of the sample file.
+	if len(snippets) != 4 {
+		t.Fatalf("got %d snippets, want 4", len(snippets))
+	}
+	for _, snippet := range snippets {
+		if snippet.Title == "" || len(snippet.Labels) == 0 || len(snippet.Embedding) != fakeEmbeddingDims {
+			t.Errorf("snippet was not fully processed: %+v", snippet)
+		}
+	}
+	if got := snippets[0].Title; got != "Building and running" {
+		t.Errorf("first snippet title = %q, want the heading text", got)
+	}
+
+	// Resubmitting unchanged content to the same key neither adds snippets
+	// nor extracts them again.
+	processAndVerify(t, app, body, ctx, 10*time.Millisecond)
+	all, err := app.store.ListSnippets(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list snippets: %v", err)
+	}
+	if len(all) != 4 {
+		t.Errorf("got %d snippets after reprocessing, want 4", len(all))
+	}
+	if n := llm.Calls(fakeExtractSnippets); n != 1 {
+		t.Errorf("ExtractSnippets called %d times, want 1", n)
+	}
+}
 
+// newTestApp returns an app on store and llm with a running job runner that
+// is stopped when the test ends.
+func newTestApp(t *testing.T, store jobTestStore, llm LLMProvider) *App {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &App{store: store, jobs: store, llm: llm, retry: fastRetry}
+	app.startJobRunner(ctx, 2, time.Minute)
+	t.Cleanup(func() {
+		cancel()
+		app.runner.Wait()
+	})
+	return app
 }
 
-func processAndVerify(t *testing.T, app *App, body []byte, firestoreClient *firestore.Client, ctx context.Context) {
+// processAndVerify submits body to the process handler and polls the source
+// every retryInterval until it is processed. It returns the source ID.
+func processAndVerify(t *testing.T, app *App, body []byte, ctx context.Context, retryInterval time.Duration) string {
 	req, err := http.NewRequest("POST", "/process", bytes.NewBuffer(body))
 	if err != nil {
 		t.Fatal(err)
@@ -112,25 +126,25 @@ func processAndVerify(t *testing.T, app *App, body []byte, firestoreClient *fire
 
 	// Poll the source document until the status is "processed"
 	const maxRetries = 30
-	const retryInterval = 10 * time.Second
-	var sourceDoc *firestore.DocumentSnapshot
+	var source *Source
 
 	for i := 0; i < maxRetries; i++ {
-		sourceDoc, err = firestoreClient.Collection("sources").Doc(documentID).Get(ctx)
+		source, err = app.store.GetSource(ctx, documentID)
 		if err != nil {
 			t.Fatalf("Failed to get source document: %v", err)
 		}
 
-		if status, err := sourceDoc.DataAt("status"); err == nil && status == "processed" {
+		if source.Status == "processed" {
 			break
 		}
 
 		time.Sleep(retryInterval)
 	}
 
-	if status, err := sourceDoc.DataAt("status"); err != nil || status != "processed" {
+	if source.Status != "processed" {
 		t.Fatalf("Source document did not reach 'processed' status")
 	}
+	return documentID
 }
 
 func TestProcessHandler_URL_Integration(t *testing.T) {
@@ -164,10 +178,12 @@ func TestProcessHandler_URL_Integration(t *testing.T) {
 		t.Fatalf("Failed to create genai client: %v", err)
 	}
 
-	app := &App{
-		firestoreClient: firestoreClient,
-		genaiClient:     genaiClient,
+	store, err := newFirestoreStore(firestoreClient, defaultEmbeddingDimensions)
+	if err != nil {
+		t.Fatalf("newFirestoreStore: %v", err)
 	}
+	app := newTestApp(t, store,
+		newVertexProvider(genaiClient, defaultGenerationModel, defaultEmbeddingModel, defaultEmbeddingDimensions))
 
 	// Use a fixed key for the test to allow for manual re-runs
 	testURL := "https://github.com/google-gemini/gemini-cli/blob/main/GEMINI.md"
@@ -181,6 +197,71 @@ func TestProcessHandler_URL_Integration(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	processAndVerify(t, app, body, firestoreClient, ctx)
+	processAndVerify(t, app, body, ctx, 10*time.Second)
 
 }
+
+func TestProcessSource_Incremental(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	llm := newFakeLLM()
+	app := &App{store: store, jobs: store, llm: llm}
+	sourceID, _ := store.CreateSource(ctx, &Source{
+		Key:     "incremental",
+		Content: "# Keep\nUse gofmt.\n# Change\nRun go vet.\n# Remove\nAvoid globals.",
+		Status:  "processing",
+	})
+	if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	before, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(before) != 3 {
+		t.Fatalf("got %d snippets, want 3", len(before))
+	}
+	kept := before[0]
+	if err := store.SetVote(ctx, kept.ID, "alice", VoteThumbsUp); err != nil {
+		t.Fatalf("SetVote: %v", err)
+	}
+
+	// Change one section, drop another and reprocess.
+	source, _ := store.GetSource(ctx, sourceID)
+	source.Content = "# Keep\nUse gofmt.\n# Change\nRun go vet and staticcheck."
+	store.UpdateSource(ctx, source)
+	labels := llm.Calls(fakeExtractLabels)
+	job := &Job{SourceID: sourceID}
+	if err := app.processSource(ctx, job); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	if n := llm.Calls(fakeExtractLabels) - labels; n != 1 {
+		t.Errorf("ExtractLabels called %d times on reprocessing, want 1 for the changed snippet", n)
+	}
+	if job.Kept != 1 || job.Stored != 1 || job.Retired != 2 {
+		t.Errorf("progress = %+v, want 1 kept, 1 stored and 2 retired", job.JobProgress)
+	}
+
+	after, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(after) != 2 {
+		t.Fatalf("got %d snippets after reprocessing, want 2", len(after))
+	}
+	got, err := store.GetSnippet(ctx, kept.ID)
+	if err != nil || got.ThumbsUp != 1 {
+		t.Errorf("unchanged snippet = %+v, %v; want it kept with its vote", got, err)
+	}
+	for _, snippet := range after {
+		if snippet.ID != kept.ID && snippet.Content != "Run go vet and staticcheck." {
+			t.Errorf("unexpected snippet after reprocessing: %+v", snippet)
+		}
+	}
+
+	// Unchanged content is not extracted again.
+	extracted := llm.Calls(fakeExtractSnippets)
+	if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	if n := llm.Calls(fakeExtractSnippets) - extracted; n != 0 {
+		t.Errorf("ExtractSnippets called %d times for unchanged content, want 0", n)
+	}
+	if source, _ := store.GetSource(ctx, sourceID); source.Status != "processed" {
+		t.Errorf("source status = %q, want processed", source.Status)
+	}
+}
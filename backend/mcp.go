@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// MCP transports selected by MCP_TRANSPORT.
+const (
+	MCPTransportHTTP  = "http"
+	MCPTransportStdio = "stdio"
+)
+
+// mcpVersion is the version the MCP server reports to clients.
+const mcpVersion = "1.0.0"
+
+// defaultMCPSearchLimit is how many results search_snippets returns unless
+// asked for another number. It is lower than the API's, as every result
+// takes up room in the agent's context.
+const defaultMCPSearchLimit = 10
+
+// labelURIPrefix starts the URIs of the label resources, which end in the
+// escaped label.
+const labelURIPrefix = "snippets://label/"
+
+// mcpSnippet is a snippet as MCP tools return it: what an agent needs to
+// follow it, without the bookkeeping.
+type mcpSnippet struct {
+	ID      string   `json:"id"`
+	Title   string   `json:"title,omitempty"`
+	Content string   `json:"content"`
+	Labels  []string `json:"labels,omitempty"`
+	Scope   *Scope   `json:"scope,omitempty"`
+	// Source is the URL or key of the source the snippet came from, and
+	// URL links to its lines there.
+	Source string `json:"source,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Score is how well the snippet matched a search.
+	Score float64 `json:"score,omitempty"`
+}
+
+func newMCPSnippet(snippet *Snippet) mcpSnippet {
+	s := mcpSnippet{ID: snippet.ID, Title: snippet.Title, Content: snippet.Content, Labels: snippet.Labels, Scope: snippet.Scope}
+	if snippet.Provenance != nil {
+		s.URL = snippet.Provenance.URL
+	}
+	return s
+}
+
+type searchSnippetsInput struct {
+	Query     string   `json:"query" jsonschema:"what to look for, such as 'go error handling'"`
+	Labels    []string `json:"labels,omitempty" jsonschema:"labels every result must carry"`
+	Mode      string   `json:"mode,omitempty" jsonschema:"ranking: hybrid (the default), vector or lexical"`
+	MaxSafety *float64 `json:"maxSafety,omitempty" jsonschema:"leave out snippets scoring above this, between 0 and 1, in any safety category"`
+	Limit     int      `json:"limit,omitempty" jsonschema:"how many snippets to return, 10 by default and at most 100"`
+}
+
+type searchSnippetsOutput struct {
+	Results []mcpSnippet `json:"results"`
+}
+
+type getSnippetInput struct {
+	ID string `json:"id" jsonschema:"the snippet's ID"`
+}
+
+type composeInstructionsInput struct {
+	SnippetIDs []string `json:"snippetIds,omitempty" jsonschema:"the snippets to include, in order; give these or a query"`
+	Query      string   `json:"query,omitempty" jsonschema:"include the snippets best matching this; give this or snippetIds"`
+	Labels     []string `json:"labels,omitempty" jsonschema:"with a query, labels every snippet must carry"`
+	MaxSafety  *float64 `json:"maxSafety,omitempty" jsonschema:"with a query, leave out snippets scoring above this, between 0 and 1, in any safety category"`
+	Limit      int      `json:"limit,omitempty" jsonschema:"with a query, how many snippets to include, 20 by default"`
+	Format     string   `json:"format,omitempty" jsonschema:"the file to write: agents (the default), claude, gemini, copilot or windsurf"`
+	Title      string   `json:"title,omitempty" jsonschema:"the document's heading, in place of the format's"`
+}
+
+// newMCPServer returns a Model Context Protocol server exposing the snippet
+// library to coding agents. Its tools search, fetch and compose snippets
+// with the code behind the HTTP API, and there is a resource for every
+// label with the instructions carrying it, served through a template. Like
+// the API, it never hands out quarantined snippets. One server serves every
+// session.
+func (app *App) newMCPServer() *mcp.Server {
+	server := mcp.NewServer(&mcp.Implementation{Name: "instruction-snippets", Version: mcpVersion}, &mcp.ServerOptions{
+		Instructions: "A library of instructions for coding agents. Search it for guidance on the task at hand, " +
+			"or compose the relevant snippets into an instruction file such as AGENTS.md.",
+	})
+
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "search_snippets",
+		Description: "Search the library for instruction snippets relevant to a task, best first. Near-duplicates are left out.",
+	}, app.searchSnippetsTool)
+	mcp.AddTool(server, &mcp.Tool{
+		Name:        "get_snippet",
+		Description: "Get an instruction snippet by ID, with the source it came from.",
+	}, app.getSnippetTool)
+	mcp.AddTool(server, &mcp.Tool{
+		Name: "compose_instructions",
+		Description: "Compose an instruction file, such as AGENTS.md or CLAUDE.md, from snippets given by ID or found by a query. " +
+			"Returns the file's content; its path and any conflicts between the snippets are in the structured result.",
+	}, app.composeInstructionsTool)
+
+	server.AddResourceTemplate(&mcp.ResourceTemplate{
+		Name:        "label",
+		Title:       "Instructions by label",
+		Description: "The instruction snippets carrying a label, such as python or testing, as markdown.",
+		MIMEType:    "text/markdown",
+		URITemplate: labelURIPrefix + "{label}",
+	}, app.readLabelResource)
+	// The labels in use change as sources are processed, so the resource
+	// list is answered from the store rather than registered up front.
+	server.AddReceivingMiddleware(func(next mcp.MethodHandler) mcp.MethodHandler {
+		return func(ctx context.Context, method string, req mcp.Request) (mcp.Result, error) {
+			if method != "resources/list" {
+				return next(ctx, method, req)
+			}
+			return app.listLabelResources(ctx)
+		}
+	})
+	return server
+}
+
+// listLabelResources lists a resource for every label carried by a snippet,
+// in alphabetical order.
+func (app *App) listLabelResources(ctx context.Context) (*mcp.ListResourcesResult, error) {
+	snippets, err := app.store.ListSnippets(ctx)
+	if err != nil {
+		log.Printf("Failed to list snippets: %v", err)
+		return nil, errors.New("failed to list labels")
+	}
+	counts := make(map[string]int)
+	for _, snippet := range snippets {
+		if len(snippet.Quarantine) > 0 {
+			continue
+		}
+		for _, label := range snippet.Labels {
+			counts[label]++
+		}
+	}
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	result := &mcp.ListResourcesResult{Resources: []*mcp.Resource{}}
+	for _, label := range labels {
+		result.Resources = append(result.Resources, &mcp.Resource{
+			Name:        label,
+			Title:       labelHeading(label) + " instructions",
+			Description: fmt.Sprintf("%d instruction snippets labelled %q.", counts[label], label),
+			MIMEType:    "text/markdown",
+			URI:         labelURI(label),
+		})
+	}
+	return result, nil
+}
+
+// searchSnippetsTool serves the search_snippets tool: a deduplicated search,
+// as the search endpoint does with dedup set.
+func (app *App) searchSnippetsTool(ctx context.Context, _ *mcp.CallToolRequest, in searchSnippetsInput) (*mcp.CallToolResult, searchSnippetsOutput, error) {
+	out := searchSnippetsOutput{Results: []mcpSnippet{}}
+	query := strings.TrimSpace(in.Query)
+	if query == "" {
+		return nil, out, errors.New("'query' is required")
+	}
+	mode := in.Mode
+	switch mode {
+	case "":
+		mode = SearchModeHybrid
+	case SearchModeHybrid, SearchModeVector, SearchModeLexical:
+	default:
+		return nil, out, fmt.Errorf("invalid 'mode': must be %q, %q or %q", SearchModeHybrid, SearchModeVector, SearchModeLexical)
+	}
+	limit := in.Limit
+	if limit == 0 {
+		limit = defaultMCPSearchLimit
+	}
+	if limit < 1 || limit > maxSearchLimit {
+		return nil, out, fmt.Errorf("invalid 'limit': must be between 1 and %d", maxSearchLimit)
+	}
+	if in.MaxSafety != nil && (*in.MaxSafety < 0 || *in.MaxSafety > 1) {
+		return nil, out, errors.New("invalid 'maxSafety': must be between 0 and 1")
+	}
+
+	results, err := app.search(ctx, query, mode, 0, SnippetFilter{Labels: in.Labels, MaxSafety: in.MaxSafety}, true, limit)
+	if err != nil {
+		log.Printf("Failed to search snippets: %v", err)
+		return nil, out, errors.New("failed to search snippets")
+	}
+	for _, result := range results {
+		s := newMCPSnippet(result.Snippet)
+		s.Score = result.Score
+		out.Results = append(out.Results, s)
+	}
+	return nil, out, nil
+}
+
+// getSnippetTool serves the get_snippet tool.
+func (app *App) getSnippetTool(ctx context.Context, _ *mcp.CallToolRequest, in getSnippetInput) (*mcp.CallToolResult, mcpSnippet, error) {
+	snippet, err := app.store.GetSnippet(ctx, in.ID)
+	if errors.Is(err, ErrNotFound) || err == nil && len(snippet.Quarantine) > 0 {
+		return nil, mcpSnippet{}, fmt.Errorf("snippet %q not found", in.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to get snippet %s: %v", in.ID, err)
+		return nil, mcpSnippet{}, errors.New("failed to get snippet")
+	}
+	out := newMCPSnippet(snippet)
+	source, err := app.store.GetSource(ctx, snippet.SourceID)
+	if err == nil {
+		out.Source = source.URL
+		if out.Source == "" {
+			out.Source = source.Key
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		log.Printf("Failed to get source %s: %v", snippet.SourceID, err)
+	}
+	return nil, out, nil
+}
+
+// composeInstructionsTool serves the compose_instructions tool, which does
+// what the compose endpoint does. The file is the tool's text result, and
+// the ComposeResponse its structured one.
+func (app *App) composeInstructionsTool(ctx context.Context, _ *mcp.CallToolRequest, in composeInstructionsInput) (*mcp.CallToolResult, any, error) {
+	if in.Format == "" {
+		in.Format = FormatAgents
+	}
+	format, ok := instructionFormats[in.Format]
+	if !ok || format.Path == "" {
+		var formats []string
+		for _, name := range exportFormats {
+			if instructionFormats[name].Path != "" {
+				formats = append(formats, name)
+			}
+		}
+		return nil, nil, fmt.Errorf("invalid 'format': must be one of %s", strings.Join(formats, ", "))
+	}
+	sel := SnippetSelection{SnippetIDs: in.SnippetIDs, Query: in.Query, Labels: in.Labels, MaxSafety: in.MaxSafety, Limit: in.Limit}
+	if err := sel.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	c, omitted, err := app.composeSelection(ctx, sel, in.Title)
+	var invalid *invalidSelectionError
+	if errors.As(err, &invalid) {
+		return nil, nil, invalid
+	}
+	if err != nil {
+		log.Printf("Failed to compose instructions: %v", err)
+		return nil, nil, errors.New("failed to compose instructions")
+	}
+	file := format.export(c, format)[0]
+	resp := ComposeResponse{Format: in.Format, Path: file.Path, Content: file.Content, Snippets: c.snippetIDs(), Omitted: omitted}
+	if resp.Conflicts, err = app.conflictsAmong(ctx, resp.Snippets); err != nil {
+		log.Printf("Failed to look up conflicts: %v", err)
+	}
+	return &mcp.CallToolResult{
+		Content:           []mcp.Content{&mcp.TextContent{Text: file.Content}},
+		StructuredContent: resp,
+	}, nil, nil
+}
+
+// readLabelResource serves the resource of a label: the snippets carrying
+// it, best voted first, up to maxSearchLimit of them, as a markdown
+// document ending with their sources.
+func (app *App) readLabelResource(ctx context.Context, req *mcp.ReadResourceRequest) (*mcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	escaped, ok := strings.CutPrefix(uri, labelURIPrefix)
+	label, err := url.PathUnescape(escaped)
+	if !ok || err != nil || label == "" {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	all, err := app.store.ListSnippets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snippets: %v", err)
+	}
+	filter := SnippetFilter{Labels: []string{label}}
+	var snippets []*Snippet
+	for _, snippet := range all {
+		if filter.matches(snippet) {
+			snippets = append(snippets, snippet)
+		}
+	}
+	if len(snippets) == 0 {
+		return nil, mcp.ResourceNotFoundError(uri)
+	}
+	sort.SliceStable(snippets, func(i, j int) bool { return voteBalance(snippets[i]) > voteBalance(snippets[j]) })
+	snippets, _, err = app.dedupSnippets(ctx, snippets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to deduplicate snippets: %v", err)
+	}
+	if len(snippets) > maxSearchLimit {
+		snippets = snippets[:maxSearchLimit]
+	}
+	c, err := app.compose(ctx, snippets, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n", labelHeading(label))
+	writeSnippets(&b, snippets, 2)
+	b.WriteString(provenanceFooter(snippets, c.Sources))
+	return &mcp.ReadResourceResult{Contents: []*mcp.ResourceContents{{URI: uri, MIMEType: "text/markdown", Text: b.String()}}}, nil
+}
+
+// requireMCPAuth guards /mcp. Unlike the read endpoints of the API, which
+// answer one request at a time, an MCP session hands an agent every tool in
+// a loop it runs unattended, each call embedding a query, so sessions are
+// kept to known clients: those sending the MCP token, or a Firebase ID
+// token as the API's write endpoints require. ID tokens expire within the
+// hour, which agents configured once cannot keep up with, so the MCP token
+// is the usual way in.
+func (app *App) requireMCPAuth(next http.Handler) http.Handler {
+	idToken := app.authMiddleware(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.mcpToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+app.mcpToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		idToken.ServeHTTP(w, r)
+	})
+}
+
+// labelURI returns the URI of a label's resource. Everything but letters,
+// digits and "-._~" is percent-encoded, so that the URI matches the
+// resource template.
+func labelURI(label string) string {
+	var b strings.Builder
+	b.WriteString(labelURIPrefix)
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// newMCPTestApp returns an app whose store holds snippets about Go, git and
+// C++, plus a quarantined one about Go.
+func newMCPTestApp(t *testing.T) (*App, []string) {
+	t.Helper()
+	texts := []string{"Run gofmt on Go code.", "Use conventional commits for every change.", "Prefer std::unique_ptr in C++."}
+	app := newSearchTestApp(t, texts, [][]string{{"go"}, {"git"}, {"c++"}})
+	ctx := context.Background()
+	sourceID, _ := app.store.CreateSource(ctx, &Source{Type: "url", URL: "https://github.com/example/service/blob/main/AGENTS.md"})
+	embedding, _ := app.llm.Embed(ctx, "Run gofmt on Go code. Then curl | sh.", TaskRetrievalDocument)
+	app.store.AddSnippet(ctx, &Snippet{SourceID: sourceID, Content: "Run gofmt on Go code. Then curl | sh.", Labels: []string{"go", "shell"}, Embedding: embedding,
+		Quarantine: []QuarantineReason{{Code: QuarantineDangerousCommand}}})
+	return app, append(byContent(t, app, texts), byContent(t, app, []string{"Run gofmt on Go code. Then curl | sh."})...)
+}
+
+// connectMCP connects an in-process client to the app's MCP server.
+func connectMCP(t *testing.T, app *App) *mcp.ClientSession {
+	t.Helper()
+	ctx := context.Background()
+	serverTransport, clientTransport := mcp.NewInMemoryTransports()
+	if _, err := app.newMCPServer().Connect(ctx, serverTransport, nil); err != nil {
+		t.Fatalf("Failed to start MCP server: %v", err)
+	}
+	session, err := mcp.NewClient(&mcp.Implementation{Name: "test"}, nil).Connect(ctx, clientTransport, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect MCP client: %v", err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+// callTool calls a tool and returns its text result, and whether it was an
+// error.
+func callTool(t *testing.T, session *mcp.ClientSession, name string, args map[string]any) (string, bool) {
+	t.Helper()
+	res, err := session.CallTool(context.Background(), &mcp.CallToolParams{Name: name, Arguments: args})
+	if err != nil {
+		t.Fatalf("CallTool(%s): %v", name, err)
+	}
+	if len(res.Content) != 1 {
+		t.Fatalf("CallTool(%s) returned %d contents", name, len(res.Content))
+	}
+	return res.Content[0].(*mcp.TextContent).Text, res.IsError
+}
+
+func TestMCPTools(t *testing.T) {
+	app, ids := newMCPTestApp(t)
+	session := connectMCP(t, app)
+	ctx := context.Background()
+
+	tools, err := session.ListTools(ctx, nil)
+	if err != nil {
+		t.Fatalf("ListTools: %v", err)
+	}
+	var names []string
+	for _, tool := range tools.Tools {
+		names = append(names, tool.Name)
+		if tool.InputSchema == nil || tool.Description == "" {
+			t.Errorf("tool %s has no schema or description", tool.Name)
+		}
+	}
+	if want := []string{"compose_instructions", "get_snippet", "search_snippets"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("tools = %v, want %v", names, want)
+	}
+
+	text, isError := callTool(t, session, "search_snippets", map[string]any{"query": "gofmt Go code"})
+	var found searchSnippetsOutput
+	if err := json.Unmarshal([]byte(text), &found); isError || err != nil {
+		t.Fatalf("search_snippets returned %s", text)
+	}
+	if len(found.Results) == 0 || found.Results[0].ID != ids[0] || found.Results[0].Score == 0 {
+		t.Errorf("search_snippets = %+v, want the gofmt snippet first", found.Results)
+	}
+	for _, result := range found.Results {
+		if result.ID == ids[3] {
+			t.Error("search_snippets returned a quarantined snippet")
+		}
+	}
+	text, _ = callTool(t, session, "search_snippets", map[string]any{"query": "gofmt", "labels": []string{"git"}})
+	if json.Unmarshal([]byte(text), &found); len(found.Results) != 1 || found.Results[0].ID != ids[1] {
+		t.Errorf("search_snippets with labels = %s", text)
+	}
+	if text, isError := callTool(t, session, "search_snippets", map[string]any{"query": "gofmt", "mode": "fuzzy"}); !isError {
+		t.Errorf("search_snippets in an unknown mode returned %s", text)
+	}
+
+	text, isError = callTool(t, session, "get_snippet", map[string]any{"id": ids[0]})
+	var snippet mcpSnippet
+	if err := json.Unmarshal([]byte(text), &snippet); isError || err != nil || snippet.Content != "Run gofmt on Go code." || snippet.Source != "search-test" {
+		t.Errorf("get_snippet = %s", text)
+	}
+	for _, id := range []string{ids[3], "missing"} {
+		if text, isError := callTool(t, session, "get_snippet", map[string]any{"id": id}); !isError || !strings.Contains(text, "not found") {
+			t.Errorf("get_snippet(%s) = %s", id, text)
+		}
+	}
+
+	text, isError = callTool(t, session, "compose_instructions", map[string]any{"snippetIds": []string{ids[0], ids[1]}, "format": "claude"})
+	if isError || !strings.HasPrefix(text, "# CLAUDE.md\n") || !strings.Contains(text, "gofmt") || !strings.Contains(text, "conventional commits") {
+		t.Errorf("compose_instructions = %s", text)
+	}
+	for _, args := range []map[string]any{
+		{"snippetIds": []string{ids[3]}},
+		{"query": "gofmt", "format": "cursor"},
+		{"query": "gofmt", "snippetIds": []string{ids[0]}},
+	} {
+		if text, isError := callTool(t, session, "compose_instructions", args); !isError {
+			t.Errorf("compose_instructions(%v) = %s", args, text)
+		}
+	}
+}
+
+func TestMCPResources(t *testing.T) {
+	app, _ := newMCPTestApp(t)
+	session := connectMCP(t, app)
+	ctx := context.Background()
+
+	// Every label in use is listed, and served through the template.
+	resources, err := session.ListResources(ctx, nil)
+	if err != nil {
+		t.Fatalf("ListResources: %v", err)
+	}
+	var uris []string
+	for _, resource := range resources.Resources {
+		uris = append(uris, resource.URI)
+	}
+	if want := []string{"snippets://label/c%2B%2B", "snippets://label/git", "snippets://label/go"}; !reflect.DeepEqual(uris, want) {
+		t.Errorf("resources = %v, want %v", uris, want)
+	}
+	templates, err := session.ListResourceTemplates(ctx, nil)
+	if err != nil || len(templates.ResourceTemplates) != 1 || templates.ResourceTemplates[0].URITemplate != "snippets://label/{label}" {
+		t.Errorf("ListResourceTemplates = %+v, %v", templates, err)
+	}
+
+	res, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: "snippets://label/go"})
+	if err != nil {
+		t.Fatalf("ReadResource: %v", err)
+	}
+	text := res.Contents[0].Text
+	if res.Contents[0].MIMEType != "text/markdown" || !strings.HasPrefix(text, "# Go\n") || !strings.Contains(text, "Run gofmt on Go code.") ||
+		strings.Contains(text, "curl") || !strings.Contains(text, "## Sources") {
+		t.Errorf("go resource = %q", text)
+	}
+	if res, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: labelURI("c++")}); err != nil || !strings.Contains(res.Contents[0].Text, "unique_ptr") {
+		t.Errorf("c++ resource = %+v, %v", res, err)
+	}
+
+	// Labels added since the server started are served too; labels only on
+	// quarantined snippets, or on none, are not found.
+	app.store.AddSnippet(ctx, &Snippet{SourceID: "s1", Content: "Pin base images by digest.", Labels: []string{"docker"}})
+	if res, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: "snippets://label/docker"}); err != nil || !strings.Contains(res.Contents[0].Text, "digest") {
+		t.Errorf("docker resource = %+v, %v", res, err)
+	}
+	if resources, err := session.ListResources(ctx, nil); err != nil || len(resources.Resources) != 4 || resources.Resources[1].Name != "docker" {
+		t.Errorf("ListResources after adding docker = %+v, %v", resources, err)
+	}
+	for _, uri := range []string{"snippets://label/shell", "snippets://label/rust"} {
+		if _, err := session.ReadResource(ctx, &mcp.ReadResourceParams{URI: uri}); err == nil {
+			t.Errorf("ReadResource(%s) succeeded", uri)
+		}
+	}
+}
+
+// bearerTransport sends every request with a bearer token.
+type bearerTransport struct {
+	token string
+}
+
+func (b bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMCPStreamableHTTP(t *testing.T) {
+	app, ids := newMCPTestApp(t)
+	app.mcpToken = "agent-token"
+	mcpServer := app.newMCPServer()
+	server := httptest.NewServer(app.requireMCPAuth(mcp.NewStreamableHTTPHandler(func(*http.Request) *mcp.Server {
+		return mcpServer
+	}, nil)))
+	defer server.Close()
+
+	// The MCP token is accepted without a Firebase ID token.
+	ctx := context.Background()
+	transport := &mcp.StreamableClientTransport{Endpoint: server.URL, HTTPClient: &http.Client{Transport: bearerTransport{"agent-token"}}}
+	session, err := mcp.NewClient(&mcp.Implementation{Name: "test"}, nil).Connect(ctx, transport, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect MCP client: %v", err)
+	}
+	defer session.Close()
+	text, isError := callTool(t, session, "get_snippet", map[string]any{"id": ids[1]})
+	if isError || !strings.Contains(text, "conventional commits") {
+		t.Errorf("get_snippet over HTTP = %s", text)
+	}
+}
@@ -0,0 +1,37 @@
+CREATE EXTENSION IF NOT EXISTS vector;
+
+CREATE TABLE sources (
+    id              TEXT PRIMARY KEY,
+    key             TEXT NOT NULL UNIQUE,
+    content         TEXT NOT NULL,
+    url             TEXT NOT NULL DEFAULT '',
+    type            TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    submitter_id    TEXT NOT NULL DEFAULT '',
+    submitter_email TEXT NOT NULL DEFAULT '',
+    last_refreshed  TIMESTAMPTZ NOT NULL
+);
+
+-- The embedding column has no fixed dimension so that different embedding
+-- models can be used; the ANN index is a partial index per dimension, created
+-- by the application for the configured model.
+CREATE TABLE snippets (
+    id          TEXT PRIMARY KEY,
+    source_id   TEXT NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+    title       TEXT NOT NULL DEFAULT '',
+    content     TEXT NOT NULL,
+    labels      JSONB NOT NULL DEFAULT '[]',
+    thumbs_up   INTEGER NOT NULL DEFAULT 0,
+    thumbs_down INTEGER NOT NULL DEFAULT 0,
+    created_at  TIMESTAMPTZ NOT NULL,
+    embedding   vector
+);
+
+CREATE INDEX snippets_source_id ON snippets (source_id);
+
+CREATE TABLE votes (
+    snippet_id TEXT NOT NULL REFERENCES snippets (id) ON DELETE CASCADE,
+    user_id    TEXT NOT NULL,
+    vote       TEXT NOT NULL CHECK (vote IN ('thumbs_up', 'thumbs_down')),
+    PRIMARY KEY (snippet_id, user_id)
+);
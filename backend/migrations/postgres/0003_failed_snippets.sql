@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN failed_snippets JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,2 @@
+ALTER TABLE sources ADD COLUMN etag TEXT NOT NULL DEFAULT '';
+ALTER TABLE sources ADD COLUMN last_modified TEXT NOT NULL DEFAULT '';
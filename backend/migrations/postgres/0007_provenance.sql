@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN provenance JSONB NOT NULL DEFAULT 'null';
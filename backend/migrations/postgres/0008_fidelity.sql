@@ -0,0 +1,2 @@
+ALTER TABLE snippets ADD COLUMN fidelity DOUBLE PRECISION;
+ALTER TABLE snippets ADD COLUMN flags JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN safety JSONB NOT NULL DEFAULT '{}';
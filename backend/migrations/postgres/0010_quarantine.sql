@@ -0,0 +1,2 @@
+ALTER TABLE sources ADD COLUMN quarantine JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE snippets ADD COLUMN quarantine JSONB NOT NULL DEFAULT '[]';
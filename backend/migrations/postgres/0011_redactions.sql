@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN redactions JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,13 @@
+-- The model's verdicts on whether pairs of similar snippets conflict.
+-- snippet_a sorts before snippet_b, so each pair has one row.
+CREATE TABLE conflict_checks (
+    snippet_a   TEXT NOT NULL REFERENCES snippets (id) ON DELETE CASCADE,
+    snippet_b   TEXT NOT NULL REFERENCES snippets (id) ON DELETE CASCADE,
+    similarity  DOUBLE PRECISION NOT NULL,
+    conflict    BOOLEAN NOT NULL,
+    explanation TEXT NOT NULL DEFAULT '',
+    checked_at  TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (snippet_a, snippet_b)
+);
+
+CREATE INDEX conflict_checks_snippet_b ON conflict_checks (snippet_b);
@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN scope JSONB NOT NULL DEFAULT 'null';
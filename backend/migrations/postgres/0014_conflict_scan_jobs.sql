@@ -0,0 +1,4 @@
+-- Conflict scans run as jobs too, without a source.
+ALTER TABLE jobs ALTER COLUMN source_id DROP NOT NULL;
+ALTER TABLE jobs ADD COLUMN kind TEXT NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN threshold DOUBLE PRECISION NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN imports JSONB NOT NULL DEFAULT '[]';
@@ -0,0 +1,30 @@
+-- Quarantined snippets are kept apart from the others, so that nothing
+-- reading snippets shows them. The columns are those of snippets.
+CREATE TABLE quarantined_snippets (
+    id           TEXT PRIMARY KEY,
+    source_id    TEXT NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+    title        TEXT NOT NULL DEFAULT '',
+    content      TEXT NOT NULL,
+    labels       JSONB NOT NULL DEFAULT '[]',
+    thumbs_up    INTEGER NOT NULL DEFAULT 0,
+    thumbs_down  INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ NOT NULL,
+    embedding    vector,
+    content_hash TEXT NOT NULL DEFAULT '',
+    provenance   JSONB NOT NULL DEFAULT 'null',
+    fidelity     DOUBLE PRECISION,
+    flags        JSONB NOT NULL DEFAULT '[]',
+    safety       JSONB NOT NULL DEFAULT '{}',
+    quarantine   JSONB NOT NULL DEFAULT '[]',
+    scope        JSONB NOT NULL DEFAULT 'null'
+);
+
+CREATE INDEX quarantined_snippets_source_id ON quarantined_snippets (source_id);
+
+INSERT INTO quarantined_snippets (id, source_id, title, content, labels, thumbs_up, thumbs_down, created_at,
+    embedding, content_hash, provenance, fidelity, flags, safety, quarantine, scope)
+SELECT id, source_id, title, content, labels, thumbs_up, thumbs_down, created_at,
+    embedding, content_hash, provenance, fidelity, flags, safety, quarantine, scope
+FROM snippets WHERE quarantine <> '[]';
+
+DELETE FROM snippets WHERE quarantine <> '[]';
@@ -0,0 +1,32 @@
+CREATE TABLE sources (
+    id              TEXT PRIMARY KEY,
+    key             TEXT NOT NULL UNIQUE,
+    content         TEXT NOT NULL,
+    url             TEXT NOT NULL DEFAULT '',
+    type            TEXT NOT NULL,
+    status          TEXT NOT NULL,
+    submitter_id    TEXT NOT NULL DEFAULT '',
+    submitter_email TEXT NOT NULL DEFAULT '',
+    last_refreshed  TIMESTAMP NOT NULL
+);
+
+CREATE TABLE snippets (
+    id          TEXT PRIMARY KEY,
+    source_id   TEXT NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+    title       TEXT NOT NULL DEFAULT '',
+    content     TEXT NOT NULL,
+    labels      TEXT NOT NULL DEFAULT '[]', -- JSON array of strings
+    thumbs_up   INTEGER NOT NULL DEFAULT 0,
+    thumbs_down INTEGER NOT NULL DEFAULT 0,
+    created_at  TIMESTAMP NOT NULL,
+    embedding   BLOB -- little-endian float32 values
+);
+
+CREATE INDEX snippets_source_id ON snippets (source_id);
+
+CREATE TABLE votes (
+    snippet_id TEXT NOT NULL REFERENCES snippets (id) ON DELETE CASCADE,
+    user_id    TEXT NOT NULL,
+    vote       TEXT NOT NULL CHECK (vote IN ('thumbs_up', 'thumbs_down')),
+    PRIMARY KEY (snippet_id, user_id)
+);
@@ -0,0 +1,17 @@
+CREATE TABLE jobs (
+    id               TEXT PRIMARY KEY,
+    source_id        TEXT NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+    snippet_limit    INTEGER NOT NULL DEFAULT 0,
+    state            TEXT NOT NULL CHECK (state IN ('queued', 'running', 'succeeded', 'failed')),
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    lease_owner      TEXT NOT NULL DEFAULT '',
+    lease_expires_at TIMESTAMP NOT NULL,
+    error            TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP NOT NULL,
+    updated_at       TIMESTAMP NOT NULL
+);
+
+-- Workers look for the oldest queued job and for running jobs whose lease
+-- has expired.
+CREATE INDEX jobs_state_created_at ON jobs (state, created_at);
+CREATE INDEX jobs_source_id ON jobs (source_id);
@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN failed_snippets TEXT NOT NULL DEFAULT '[]'; -- JSON array of failed snippets
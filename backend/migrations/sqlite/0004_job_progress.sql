@@ -0,0 +1,6 @@
+ALTER TABLE jobs ADD COLUMN fetch BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE jobs ADD COLUMN phase TEXT NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN current_snippet INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN total_snippets INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN stored_snippets INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN failed_snippets INTEGER NOT NULL DEFAULT 0;
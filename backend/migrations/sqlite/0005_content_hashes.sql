@@ -0,0 +1,4 @@
+ALTER TABLE sources ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE snippets ADD COLUMN content_hash TEXT NOT NULL DEFAULT '';
+ALTER TABLE jobs ADD COLUMN kept_snippets INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN retired_snippets INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN provenance TEXT NOT NULL DEFAULT 'null'; -- JSON object, or null if unknown
@@ -0,0 +1,2 @@
+ALTER TABLE snippets ADD COLUMN fidelity REAL;
+ALTER TABLE snippets ADD COLUMN flags TEXT NOT NULL DEFAULT '[]'; -- JSON array of review flags
@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN safety TEXT NOT NULL DEFAULT '{}'; -- JSON object of safety scores by category
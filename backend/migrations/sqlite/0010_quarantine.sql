@@ -0,0 +1,2 @@
+ALTER TABLE sources ADD COLUMN quarantine TEXT NOT NULL DEFAULT '[]'; -- JSON array of quarantine reasons
+ALTER TABLE snippets ADD COLUMN quarantine TEXT NOT NULL DEFAULT '[]';
@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN redactions TEXT NOT NULL DEFAULT '[]'; -- JSON array of secrets and personal data found
@@ -0,0 +1 @@
+ALTER TABLE snippets ADD COLUMN scope TEXT NOT NULL DEFAULT 'null'; -- JSON object, or null if the snippet applies everywhere
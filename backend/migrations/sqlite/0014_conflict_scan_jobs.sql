@@ -0,0 +1,38 @@
+-- Conflict scans run as jobs too. They have no source, and SQLite cannot
+-- drop a NOT NULL constraint, so the table is rebuilt.
+CREATE TABLE jobs_new (
+    id               TEXT PRIMARY KEY,
+    kind             TEXT NOT NULL DEFAULT '',
+    source_id        TEXT REFERENCES sources (id) ON DELETE CASCADE,
+    snippet_limit    INTEGER NOT NULL DEFAULT 0,
+    threshold        REAL NOT NULL DEFAULT 0,
+    fetch            BOOLEAN NOT NULL DEFAULT FALSE,
+    state            TEXT NOT NULL CHECK (state IN ('queued', 'running', 'succeeded', 'failed')),
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    lease_owner      TEXT NOT NULL DEFAULT '',
+    lease_expires_at TIMESTAMP NOT NULL,
+    error            TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP NOT NULL,
+    updated_at       TIMESTAMP NOT NULL,
+    phase            TEXT NOT NULL DEFAULT '',
+    current_snippet  INTEGER NOT NULL DEFAULT 0,
+    total_snippets   INTEGER NOT NULL DEFAULT 0,
+    stored_snippets  INTEGER NOT NULL DEFAULT 0,
+    failed_snippets  INTEGER NOT NULL DEFAULT 0,
+    kept_snippets    INTEGER NOT NULL DEFAULT 0,
+    retired_snippets INTEGER NOT NULL DEFAULT 0
+);
+
+INSERT INTO jobs_new (id, source_id, snippet_limit, fetch, state, attempts, lease_owner, lease_expires_at, error,
+    created_at, updated_at, phase, current_snippet, total_snippets, stored_snippets, failed_snippets,
+    kept_snippets, retired_snippets)
+SELECT id, source_id, snippet_limit, fetch, state, attempts, lease_owner, lease_expires_at, error,
+    created_at, updated_at, phase, current_snippet, total_snippets, stored_snippets, failed_snippets,
+    kept_snippets, retired_snippets
+FROM jobs;
+
+DROP TABLE jobs;
+ALTER TABLE jobs_new RENAME TO jobs;
+
+CREATE INDEX jobs_state_created_at ON jobs (state, created_at);
+CREATE INDEX jobs_source_id ON jobs (source_id);
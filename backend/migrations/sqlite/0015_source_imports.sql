@@ -0,0 +1 @@
+ALTER TABLE sources ADD COLUMN imports TEXT NOT NULL DEFAULT '[]'; -- JSON array of the files the source imports
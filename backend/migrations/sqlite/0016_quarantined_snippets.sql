@@ -0,0 +1,30 @@
+-- Quarantined snippets are kept apart from the others, so that nothing
+-- reading snippets shows them. The columns are those of snippets.
+CREATE TABLE quarantined_snippets (
+    id           TEXT PRIMARY KEY,
+    source_id    TEXT NOT NULL REFERENCES sources (id) ON DELETE CASCADE,
+    title        TEXT NOT NULL DEFAULT '',
+    content      TEXT NOT NULL,
+    labels       TEXT NOT NULL DEFAULT '[]',
+    thumbs_up    INTEGER NOT NULL DEFAULT 0,
+    thumbs_down  INTEGER NOT NULL DEFAULT 0,
+    created_at   TIMESTAMP NOT NULL,
+    embedding    BLOB,
+    content_hash TEXT NOT NULL DEFAULT '',
+    provenance   TEXT NOT NULL DEFAULT 'null',
+    fidelity     REAL,
+    flags        TEXT NOT NULL DEFAULT '[]',
+    safety       TEXT NOT NULL DEFAULT '{}',
+    quarantine   TEXT NOT NULL DEFAULT '[]',
+    scope        TEXT NOT NULL DEFAULT 'null'
+);
+
+CREATE INDEX quarantined_snippets_source_id ON quarantined_snippets (source_id);
+
+INSERT INTO quarantined_snippets (id, source_id, title, content, labels, thumbs_up, thumbs_down, created_at,
+    embedding, content_hash, provenance, fidelity, flags, safety, quarantine, scope)
+SELECT id, source_id, title, content, labels, thumbs_up, thumbs_down, created_at,
+    embedding, content_hash, provenance, fidelity, flags, safety, quarantine, scope
+FROM snippets WHERE quarantine <> '[]';
+
+DELETE FROM snippets WHERE quarantine <> '[]';
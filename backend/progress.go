@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Event types sent on a source's status stream.
+const (
+	eventLog    = "log"
+	eventStatus = "status"
+	eventDone   = "done"
+)
+
+// maxEventHistory is how many log lines of a running job are kept for
+// subscribers that connect after it started.
+const maxEventHistory = 200
+
+// statusStreamPoll is how often a status stream rereads the status, which
+// catches progress made on other instances.
+const statusStreamPoll = time.Second
+
+// sourceEvent is a notification about a source being processed.
+type sourceEvent struct {
+	Type string
+	Data string
+}
+
+// eventHub fans out the events of the jobs running in this process to the
+// clients streaming their sources' status. Each source keeps the log lines of
+// its current job so late subscribers can catch up. The zero value is ready
+// to use.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan sourceEvent]struct{}
+	history     map[string][]sourceEvent
+}
+
+// subscribe returns a channel receiving the events of sourceID, preceded by
+// the log lines of its current job, and a function to unsubscribe. Events
+// are dropped for subscribers that fall behind.
+func (h *eventHub) subscribe(sourceID string) (<-chan sourceEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[string]map[chan sourceEvent]struct{})
+	}
+	history := h.history[sourceID]
+	ch := make(chan sourceEvent, len(history)+64)
+	for _, event := range history {
+		ch <- event
+	}
+	if h.subscribers[sourceID] == nil {
+		h.subscribers[sourceID] = make(map[chan sourceEvent]struct{})
+	}
+	h.subscribers[sourceID][ch] = struct{}{}
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscribers[sourceID], ch)
+		if len(h.subscribers[sourceID]) == 0 {
+			delete(h.subscribers, sourceID)
+		}
+	}
+}
+
+// publish sends event to the subscribers of sourceID, remembering log lines
+// until the job finishes.
+func (h *eventHub) publish(sourceID string, event sourceEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch event.Type {
+	case eventLog:
+		if h.history == nil {
+			h.history = make(map[string][]sourceEvent)
+		}
+		history := append(h.history[sourceID], event)
+		if len(history) > maxEventHistory {
+			history = history[len(history)-maxEventHistory:]
+		}
+		h.history[sourceID] = history
+	case eventDone:
+		delete(h.history, sourceID)
+	}
+	for ch := range h.subscribers[sourceID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// progressReporter tracks the progress of one processing job. Log lines go
+// to the process log and to the source's status stream; progress is also
+// saved on the job for the status endpoint.
+type progressReporter struct {
+	app *App
+	job *Job
+}
+
+func (app *App) newProgressReporter(job *Job) *progressReporter {
+	app.events.publish(job.SourceID, sourceEvent{Type: eventStatus})
+	return &progressReporter{app: app, job: job}
+}
+
+// logf logs a line about the job.
+func (p *progressReporter) logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	log.Print(line)
+	p.app.events.publish(p.job.SourceID, sourceEvent{Type: eventLog, Data: line})
+}
+
+// phase moves the job to a phase, working on snippet current of the total.
+func (p *progressReporter) phase(ctx context.Context, phase string, current int) {
+	p.job.Phase = phase
+	p.job.Current = current
+	p.save(ctx)
+}
+
+// setTotal records how many snippets were extracted.
+func (p *progressReporter) setTotal(ctx context.Context, total int) {
+	p.job.Total = total
+	p.save(ctx)
+}
+
+// snippetDone counts a snippet as stored or, if err is set, failed.
+func (p *progressReporter) snippetDone(ctx context.Context, err error) {
+	if err != nil {
+		p.job.Failed++
+	} else {
+		p.job.Stored++
+	}
+	p.save(ctx)
+}
+
+// snippetKept counts a snippet left as it was by a previous run.
+func (p *progressReporter) snippetKept(ctx context.Context) {
+	p.job.Kept++
+	p.save(ctx)
+}
+
+// snippetRetired counts a snippet of a previous run that was removed.
+func (p *progressReporter) snippetRetired(ctx context.Context) {
+	p.job.Retired++
+	p.save(ctx)
+}
+
+func (p *progressReporter) save(ctx context.Context) {
+	// Jobs run outside the queue, as in tests, have nothing to save to.
+	if p.job.ID != "" {
+		if err := p.app.jobs.UpdateJobProgress(ctx, p.job.ID, p.job.LeaseOwner, p.job.JobProgress); err != nil {
+			log.Printf("Failed to save progress of job %s: %v", p.job.ID, err)
+		}
+	}
+	p.app.events.publish(p.job.SourceID, sourceEvent{Type: eventStatus})
+}
+
+// SourceStatus is the body returned by the source status endpoint.
+type SourceStatus struct {
+	SourceID string `json:"sourceId"`
+	// Status is the source's status, such as "processing" or "processed".
+	Status string `json:"status"`
+	// Job is the source's latest processing job, if it has one.
+	Job *Job `json:"job,omitempty"`
+	// Phase and Progress describe what the job is doing, as in "labeling"
+	// and "labeling 3/10".
+	Phase    string `json:"phase,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	// Stored, Failed and Kept count the snippets processed so far, out of
+	// Total; Retired counts those of the previous run that were removed.
+	Total   int `json:"total"`
+	Stored  int `json:"stored"`
+	Failed  int `json:"failed"`
+	Kept    int `json:"kept"`
+	Retired int `json:"retired"`
+	// FailedSnippets are the snippets the last run could not store.
+	FailedSnippets []FailedSnippet `json:"failedSnippets,omitempty"`
+	// Quarantine lists why the source was quarantined, if it was.
+	Quarantine []QuarantineReason `json:"quarantine,omitempty"`
+	// Redactions lists the secrets and personal data found in the source.
+	Redactions []Redaction `json:"redactions,omitempty"`
+	// Imports lists the files the source imports, which are not processed
+	// unless submitted as sources of their own.
+	Imports []string `json:"imports,omitempty"`
+	// Errors collects the job's error and those of failed snippets.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// active reports whether the source is still waiting for or being processed.
+func (s *SourceStatus) active() bool {
+	return s.Job != nil && (s.Job.State == JobQueued || s.Job.State == JobRunning)
+}
+
+// sourceStatus gathers the status of a source and its latest job.
+func (app *App) sourceStatus(ctx context.Context, sourceID string) (*SourceStatus, error) {
+	source, err := app.store.GetSource(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	status := &SourceStatus{
+		SourceID:       source.ID,
+		Status:         source.Status,
+		FailedSnippets: source.FailedSnippets,
+		Quarantine:     source.Quarantine,
+		Redactions:     source.Redactions,
+		Imports:        source.Imports,
+	}
+	job, err := app.jobs.LatestJob(ctx, sourceID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if job != nil {
+		status.Job = job
+		status.Phase = job.Phase
+		status.Progress = job.Phase
+		if job.State == JobQueued {
+			status.Phase, status.Progress = JobQueued, JobQueued
+		}
+		if job.Current > 0 && job.Total > 0 {
+			status.Progress = fmt.Sprintf("%s %d/%d", job.Phase, job.Current, job.Total)
+		}
+		status.Total, status.Stored, status.Failed = job.Total, job.Stored, job.Failed
+		status.Kept, status.Retired = job.Kept, job.Retired
+		if job.Error != "" {
+			status.Errors = append(status.Errors, job.Error)
+		}
+	}
+	for _, failed := range source.FailedSnippets {
+		status.Errors = append(status.Errors, fmt.Sprintf("snippet %d: failed to %s: %s", failed.Index+1, failed.Stage, failed.Error))
+	}
+	return status, nil
+}
+
+// sourceStatusHandler serves GET /api/v1/sources/{id}/status.
+func (app *App) sourceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, err := app.sourceStatus(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get source status", http.StatusInternalServerError)
+		log.Printf("Failed to get source status: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// jobHandler serves GET /api/v1/jobs/{id}. It returns the job, with its
+// state and progress.
+func (app *App) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := app.jobs.GetJob(r.Context(), r.PathValue("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		log.Printf("Failed to get job: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// sourceStatusStreamHandler serves GET /api/v1/sources/{id}/status/stream,
+// a server-sent event stream. It sends a "status" event with the current
+// SourceStatus whenever it changes and a "log" event for each log line of a
+// job running in this process, and ends with a "done" event once the source
+// is no longer queued or being processed.
+func (app *App) sourceStatusStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ctx := r.Context()
+	sourceID := r.PathValue("id")
+
+	// Subscribe before reading the status so nothing falls in between.
+	events, unsubscribe := app.events.subscribe(sourceID)
+	defer unsubscribe()
+	status, err := app.sourceStatus(ctx, sourceID)
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get source status", http.StatusInternalServerError)
+		log.Printf("Failed to get source status: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(event string, data interface{}) {
+		var payload string
+		if s, ok := data.(string); ok {
+			payload = s
+		} else {
+			b, _ := json.Marshal(data)
+			payload = string(b)
+		}
+		fmt.Fprintf(w, "event: %s\n", event)
+		writeSSEData(w, payload)
+		flusher.Flush()
+	}
+
+	send(eventStatus, status)
+	last := status
+	// refresh sends the status if it changed and reports whether the
+	// stream is over.
+	refresh := func() bool {
+		status, err := app.sourceStatus(ctx, sourceID)
+		if err != nil {
+			log.Printf("Failed to get source status: %v", err)
+			return false
+		}
+		if !reflect.DeepEqual(status, last) {
+			send(eventStatus, status)
+			last = status
+		}
+		return !status.active()
+	}
+	if !last.active() {
+		send(eventDone, last.Status)
+		return
+	}
+
+	ticker := time.NewTicker(statusStreamPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			if event.Type == eventLog {
+				send(eventLog, event.Data)
+				continue
+			}
+			if refresh() {
+				send(eventDone, last.Status)
+				return
+			}
+		case <-ticker.C:
+			if refresh() {
+				send(eventDone, last.Status)
+				return
+			}
+		}
+	}
+}
+
+// writeSSEData writes payload as the data of an event, one data field per
+// line, followed by the blank line that ends the event.
+func writeSSEData(w http.ResponseWriter, payload string) {
+	start := 0
+	for i := 0; i < len(payload); i++ {
+		if payload[i] == '\n' {
+			fmt.Fprintf(w, "data: %s\n", payload[start:i])
+			start = i + 1
+		}
+	}
+	fmt.Fprintf(w, "data: %s\n\n", payload[start:])
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStatusServer serves the source status endpoints of app.
+func newStatusServer(t *testing.T, app *App) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/sources/{id}/status", app.sourceStatusHandler)
+	mux.HandleFunc("GET /api/v1/sources/{id}/status/stream", app.sourceStatusStreamHandler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func getStatus(t *testing.T, server *httptest.Server, sourceID string) (int, SourceStatus) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/api/v1/sources/" + sourceID + "/status")
+	if err != nil {
+		t.Fatalf("GET status: %v", err)
+	}
+	defer resp.Body.Close()
+	var status SourceStatus
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("Failed to decode status: %v", err)
+		}
+	}
+	return resp.StatusCode, status
+}
+
+func submitSource(t *testing.T, app *App, req ProcessRequest) string {
+	t.Helper()
+	body, _ := json.Marshal(req)
+	rr := httptest.NewRecorder()
+	app.processHandler(rr, httptest.NewRequest(http.MethodPost, "/api/v1/process", strings.NewReader(string(body))))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("process returned status %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp map[string]string
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp["jobId"] == "" {
+		t.Errorf("process response %v has no jobId", resp)
+	}
+	return resp["documentId"]
+}
+
+// waitForJob waits until the latest job of a source has finished.
+func waitForJob(t *testing.T, app *App, sourceID string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := app.jobs.LatestJob(context.Background(), sourceID)
+		if err == nil && (job.State == JobSucceeded || job.State == JobFailed) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job for source %s did not finish: %+v, %v", sourceID, job, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSourceStatusHandler(t *testing.T) {
+	app := newTestApp(t, newMemoryStore(), newFakeLLM())
+	server := newStatusServer(t, app)
+
+	content, err := ioutil.ReadFile("../samples/GEMINI-brief.md")
+	if err != nil {
+		t.Fatalf("Failed to read sample file: %v", err)
+	}
+	sourceID := submitSource(t, app, ProcessRequest{Content: string(content), Key: "status"})
+	waitForJob(t, app, sourceID)
+
+	code, status := getStatus(t, server, sourceID)
+	if code != http.StatusOK {
+		t.Fatalf("status returned %d", code)
+	}
+	if status.Status != "processed" || status.Phase != PhaseDone || status.Total != 4 || status.Stored != 4 || status.Failed != 0 {
+		t.Errorf("status = %+v", status)
+	}
+	if status.Job == nil || status.Job.State != JobSucceeded || len(status.Errors) != 0 {
+		t.Errorf("job = %+v, errors %v", status.Job, status.Errors)
+	}
+
+	if code, _ := getStatus(t, server, "missing"); code != http.StatusNotFound {
+		t.Errorf("status of a missing source returned %d", code)
+	}
+}
+
+func TestSourceStatusHandler_FetchesURL(t *testing.T) {
+	docs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/GEMINI.md" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("# Testing\nRun go test.\n# Style\nRun gofmt.\n"))
+	}))
+	defer docs.Close()
+	app := newTestApp(t, newMemoryStore(), newFakeLLM())
+	server := newStatusServer(t, app)
+	ctx := context.Background()
+
+	sourceID := submitSource(t, app, ProcessRequest{URL: docs.URL + "/GEMINI.md"})
+	waitForJob(t, app, sourceID)
+	if source, _ := app.store.GetSource(ctx, sourceID); source.Status != "processed" || !strings.Contains(source.Content, "Run gofmt.") {
+		t.Errorf("source after fetching = %+v", source)
+	}
+	if _, status := getStatus(t, server, sourceID); status.Stored != 2 {
+		t.Errorf("status = %+v, want 2 snippets stored", status)
+	}
+
+	// A URL that cannot be fetched fails the job and says why.
+	sourceID = submitSource(t, app, ProcessRequest{URL: docs.URL + "/missing.md"})
+	waitForJob(t, app, sourceID)
+	_, status := getStatus(t, server, sourceID)
+	if status.Status != "error" || status.Job.State != JobFailed || status.Phase != PhaseFetching {
+		t.Errorf("status after a failed fetch = %+v", status)
+	}
+	if len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "404") {
+		t.Errorf("errors = %v, want the fetch failure", status.Errors)
+	}
+}
+
+// sseEvent is an event read from a server-sent event stream.
+type sseEvent struct {
+	name, data string
+}
+
+func readEvents(t *testing.T, resp *http.Response) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var current sseEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			current.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if current.data != "" {
+				current.data += "\n"
+			}
+			current.data += strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, current)
+			current = sseEvent{}
+		}
+	}
+	return events
+}
+
+func TestSourceStatusStreamHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := newMemoryStore()
+	// No workers yet, so the job stays queued until the stream is open.
+	app := &App{store: store, jobs: store, llm: newFakeLLM(), retry: fastRetry}
+	server := newStatusServer(t, app)
+
+	sourceID := submitSource(t, app, ProcessRequest{Content: "# One\nfirst\n# Two\nsecond\n", Key: "stream"})
+	resp, err := http.Get(server.URL + "/api/v1/sources/" + sourceID + "/status/stream")
+	if err != nil {
+		t.Fatalf("GET stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	app.startJobRunner(ctx, 1, time.Minute)
+	defer func() {
+		cancel()
+		app.runner.Wait()
+	}()
+	events := readEvents(t, resp)
+	if len(events) < 3 {
+		t.Fatalf("got events %+v", events)
+	}
+
+	var first SourceStatus
+	json.Unmarshal([]byte(events[0].data), &first)
+	if events[0].name != eventStatus || first.Phase != JobQueued {
+		t.Errorf("first event = %+v, want the queued status", events[0])
+	}
+	last := events[len(events)-1]
+	if last.name != eventDone || last.data != "processed" {
+		t.Errorf("last event = %+v, want done with the final status", last)
+	}
+
+	var logs []string
+	phases := make(map[string]bool)
+	for _, event := range events {
+		switch event.name {
+		case eventLog:
+			logs = append(logs, event.data)
+		case eventStatus:
+			var status SourceStatus
+			json.Unmarshal([]byte(event.data), &status)
+			phases[status.Phase] = true
+		}
+	}
+	joined := strings.Join(logs, "\n")
+	for _, want := range []string{"Generated 2 snippets", "Processing snippet 2/2: # Two\nsecond", "Successfully stored snippet 2"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("log events do not include %q:\n%s", want, joined)
+		}
+	}
+	if !phases[PhaseDone] {
+		t.Errorf("status events covered phases %v, want done among them", phases)
+	}
+
+	// Once the source is processed, the stream ends straight away.
+	resp, err = http.Get(server.URL + "/api/v1/sources/" + sourceID + "/status/stream")
+	if err != nil {
+		t.Fatalf("GET stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if events := readEvents(t, resp); len(events) != 2 || events[1].name != eventDone {
+		t.Errorf("stream of a processed source = %+v", events)
+	}
+}
+
+func TestEventHub(t *testing.T) {
+	var hub eventHub
+	for i := 0; i < maxEventHistory+5; i++ {
+		hub.publish("s", sourceEvent{Type: eventLog, Data: "line"})
+	}
+	events, unsubscribe := hub.subscribe("s")
+	if len(events) != maxEventHistory {
+		t.Errorf("late subscriber replayed %d lines, want %d", len(events), maxEventHistory)
+	}
+	hub.publish("other", sourceEvent{Type: eventLog, Data: "elsewhere"})
+	hub.publish("s", sourceEvent{Type: eventDone})
+	if len(events) != maxEventHistory+1 {
+		t.Errorf("subscriber has %d events queued, want the done event only added", len(events))
+	}
+	unsubscribe()
+	if replay, _ := hub.subscribe("s"); len(replay) != 0 {
+		t.Errorf("history survived the job finishing: %d events", len(replay))
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Provenance records where in its source a snippet came from, so that it
+// can be traced back to, and checked against, the original text.
+type Provenance struct {
+	// HeadingPath is the titles of the headings the snippet is under in
+	// the source, outermost first.
+	HeadingPath []string `firestore:"heading_path" json:"headingPath,omitempty"`
+	// StartByte and EndByte are the byte offsets of the snippet's text in
+	// the source's content, EndByte exclusive, and StartLine and EndLine
+	// the 1-based lines they fall on. All four are zero when the text
+	// could not be found in the source.
+	StartByte int `firestore:"start_byte" json:"startByte"`
+	EndByte   int `firestore:"end_byte" json:"endByte"`
+	StartLine int `firestore:"start_line" json:"startLine"`
+	EndLine   int `firestore:"end_line" json:"endLine"`
+	// URL links to the snippet's lines in the source, for sources hosted
+	// on GitHub.
+	URL string `firestore:"url,omitempty" json:"url,omitempty"`
+}
+
+// Located reports whether the snippet's text was found in the source.
+func (p *Provenance) Located() bool {
+	return p != nil && p.StartLine > 0
+}
+
+// newProvenance describes where snippet was found in source.
+func newProvenance(source *Source, snippet extractedSnippet) *Provenance {
+	provenance := &Provenance{HeadingPath: snippet.HeadingPath}
+	if snippet.End > snippet.Start {
+		provenance.StartByte, provenance.EndByte = snippet.Start, snippet.End
+		provenance.StartLine = lineAt(source.Content, snippet.Start)
+		provenance.EndLine = lineAt(source.Content, snippet.End-1)
+		provenance.URL = githubLineURL(source.URL, provenance.StartLine, provenance.EndLine)
+	}
+	return provenance
+}
+
+// lineAt returns the 1-based line of content that offset falls on.
+func lineAt(content string, offset int) int {
+	return strings.Count(content[:offset], "\n") + 1
+}
+
+// githubLineURL links to lines start to end of a file on GitHub, given its
+// file page or raw URL, or returns "" for URLs elsewhere. Links ask for the
+// plain file, since rendered markdown has no line anchors.
+func githubLineURL(sourceURL string, start, end int) string {
+	parts := githubBlobPath(sourceURL)
+	if parts == nil {
+		return ""
+	}
+	anchor := fmt.Sprintf("L%d", start)
+	if end > start {
+		anchor = fmt.Sprintf("L%d-L%d", start, end)
+	}
+	return "https://github.com/" + strings.Join(parts, "/") + "?plain=1#" + anchor
+}
+
+// githubBlobPath splits the URL of a file on GitHub, given as its file page
+// or raw URL, into the path of its file page: owner, repository, "blob",
+// ref and the file's path in the repository. It returns nil for URLs
+// elsewhere.
+func githubBlobPath(sourceURL string) []string {
+	u, err := url.Parse(sourceURL)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch u.Host {
+	case "github.com":
+		// /owner/repo/blob/ref/path...
+		if len(parts) < 5 || parts[2] != "blob" {
+			return nil
+		}
+	case "raw.githubusercontent.com":
+		// /owner/repo/ref/path...
+		if len(parts) < 4 {
+			return nil
+		}
+		parts = append(parts[:2], append([]string{"blob"}, parts[2:]...)...)
+	default:
+		return nil
+	}
+	return parts
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestGithubLineURL(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"https://github.com/google-gemini/gemini-cli/blob/main/GEMINI.md", "https://github.com/google-gemini/gemini-cli/blob/main/GEMINI.md?plain=1#L10-L24"},
+		{"https://raw.githubusercontent.com/google-gemini/gemini-cli/main/docs/GEMINI.md", "https://github.com/google-gemini/gemini-cli/blob/main/docs/GEMINI.md?plain=1#L10-L24"},
+		{"https://github.com/google-gemini/gemini-cli", ""},
+		{"https://example.com/GEMINI.md", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := githubLineURL(tt.url, 10, 24); got != tt.want {
+			t.Errorf("githubLineURL(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+	if got := githubLineURL(tests[0].url, 7, 7); got != "https://github.com/google-gemini/gemini-cli/blob/main/GEMINI.md?plain=1#L7" {
+		t.Errorf("githubLineURL for one line = %q", got)
+	}
+}
+
+func TestProcessSnippets_Provenance(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	app := &App{store: store, jobs: store, llm: newFakeLLM()}
+	sourceID, _ := store.CreateSource(ctx, &Source{
+		Key:     "provenance",
+		URL:     "https://github.com/example/repo/blob/main/AGENTS.md",
+		Content: "# A\nfirst\n## B\nsecond\nthird",
+		Status:  "processing",
+	})
+	if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	snippets, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(snippets) != 2 {
+		t.Fatalf("got %d snippets, want 2", len(snippets))
+	}
+	b := snippets[1]
+	want := &Provenance{
+		HeadingPath: []string{"A", "B"},
+		StartByte:   10,
+		EndByte:     27,
+		StartLine:   3,
+		EndLine:     5,
+		URL:         "https://github.com/example/repo/blob/main/AGENTS.md?plain=1#L3-L5",
+	}
+	if !reflect.DeepEqual(b.Provenance, want) {
+		t.Errorf("provenance = %+v, want %+v", b.Provenance, want)
+	}
+
+	// A snippet kept when the source changes follows its text.
+	source, _ := store.GetSource(ctx, sourceID)
+	source.Content = "Intro.\n\n" + source.Content
+	store.UpdateSource(ctx, source)
+	if err := app.processSource(ctx, &Job{SourceID: sourceID}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	got, err := store.GetSnippet(ctx, b.ID)
+	if err != nil {
+		t.Fatalf("snippet B was not kept: %v", err)
+	}
+	if p := got.Provenance; p.StartLine != 5 || p.EndLine != 7 || p.StartByte != 18 {
+		t.Errorf("provenance after the source changed = %+v", p)
+	}
+}
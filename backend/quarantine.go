@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Reason codes the analyzer quarantines sources and snippets for.
+const (
+	// QuarantineDangerousCommand marks shell commands that run remote code
+	// or destroy data, such as "curl ... | sh" or "rm -rf ~".
+	QuarantineDangerousCommand = "dangerous_command"
+	// QuarantineCredentialAccess marks references to where credentials
+	// are kept, such as ~/.ssh or ~/.aws/credentials.
+	QuarantineCredentialAccess = "credential_access"
+	// QuarantineHiddenUnicode marks invisible characters, such as zero
+	// width spaces, bidirectional overrides and tag characters, that hide
+	// text from readers but not from models.
+	QuarantineHiddenUnicode = "hidden_unicode"
+	// QuarantineHTMLComment marks HTML comments, which markdown renderers
+	// hide but models read.
+	QuarantineHTMLComment = "html_comment"
+)
+
+// StatusQuarantined is the status of a source whose content hides text
+// from readers. It is not processed until its content changes.
+const StatusQuarantined = "quarantined"
+
+// maxExcerptBytes caps the text quoted in a quarantine reason.
+const maxExcerptBytes = 120
+
+// QuarantineReason records why a source or snippet was quarantined.
+type QuarantineReason struct {
+	// Code is one of the Quarantine* reason codes.
+	Code string `firestore:"code" json:"code"`
+	// Line is the 1-based line of the scanned text the match is on.
+	Line int `firestore:"line" json:"line"`
+	// Excerpt is the matching text. For hidden characters it is the line,
+	// quoted so that they show.
+	Excerpt string `firestore:"excerpt" json:"excerpt"`
+}
+
+// instructionRule is a pattern the analyzer looks for on each line.
+type instructionRule struct {
+	code    string
+	pattern *regexp.Regexp
+}
+
+// instructionRules catch commands an agent should never be told to run
+// unattended and the files holding credentials.
+var instructionRules = []instructionRule{
+	// Remote scripts piped or handed to a shell or interpreter.
+	{QuarantineDangerousCommand, regexp.MustCompile(`(?i)\b(curl|wget)\b[^\n|]*\|\s*(sudo\s+)?(env\s+)?((ba|z|k|da|fi)?sh|python[0-9.]*|perl|ruby|node)\b`)},
+	{QuarantineDangerousCommand, regexp.MustCompile(`(?i)\b(ba|z)?sh\s+(-c\s+)?["']?(\$\(|<\()\s*(curl|wget)\b`)},
+	{QuarantineDangerousCommand, regexp.MustCompile(`(?i)\b(iwr|irm|invoke-webrequest|invoke-restmethod)\b[^\n|]*\|\s*(iex|invoke-expression)\b|\b(iex|invoke-expression)\b[^\n]*\b(downloadstring|iwr|irm|invoke-webrequest|invoke-restmethod)\b`)},
+	{QuarantineDangerousCommand, regexp.MustCompile(`(?i)\bbase64\s+(-d|--decode)\b[^\n|]*\|\s*(sudo\s+)?(ba|z)?sh\b`)},
+	// Destructive commands and reverse shells.
+	{QuarantineDangerousCommand, regexp.MustCompile(`\brm\s+(-[a-zA-Z]*[rR][a-zA-Z]*\s+|-[a-zA-Z]+\s+-[a-zA-Z]+\s+)(--no-preserve-root\s+)?(/|~/?|\$HOME/?)(\*|\s|$|["'` + "`" + `])`)},
+	{QuarantineDangerousCommand, regexp.MustCompile(`\bchmod\s+(-R\s+)?0?777\s+/|\bmkfs(\.[a-z0-9]+)?\s|\bdd\s+[^\n]*\bof=/dev/(sd|hd|nvme|disk|xvd)`)},
+	{QuarantineDangerousCommand, regexp.MustCompile(`:\(\)\s*\{\s*:\s*\|\s*:\s*&\s*\}\s*;\s*:|/dev/tcp/|\b(nc|ncat|netcat)\s+[^\n]*-[ec]\s`)},
+	// Where SSH keys, cloud and package registry credentials live.
+	{QuarantineCredentialAccess, regexp.MustCompile(`(~|\$HOME|\$\{HOME\})/\.(ssh|aws|gnupg|kube|docker|netrc|npmrc|pypirc|git-credentials|config/gcloud)\b|\bid_(rsa|dsa|ecdsa|ed25519)\b|\.aws/credentials\b|application_default_credentials\.json`)},
+	{QuarantineCredentialAccess, regexp.MustCompile(`/etc/(shadow|sudoers|gshadow)\b|(?i)\bsecurity\s+(find|dump)-(generic-password|internet-password|keychain)\b|\bgcloud\s+auth\s+print-(access|identity)-token\b`)},
+}
+
+// htmlCommentPattern matches HTML comments, including one left open.
+var htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?(-->|$)`)
+
+// hiddenRune reports whether r is invisible when rendered: zero width
+// characters, bidirectional controls, the soft hyphen and tag characters.
+func hiddenRune(r rune) bool {
+	switch {
+	case r == '\u00ad', r == '\u180e', r == '\ufeff':
+		return true
+	case r >= '\u200b' && r <= '\u200f':
+		return true
+	case r >= '\u202a' && r <= '\u202e':
+		return true
+	case r >= '\u2060' && r <= '\u2064', r >= '\u2066' && r <= '\u2069':
+		return true
+	case r >= 0xe0000 && r <= 0xe007f:
+		return true
+	}
+	return false
+}
+
+// emojiRune reports whether r is a pictograph that a zero width joiner may
+// legitimately follow, as in the emoji sequence for a technologist.
+func emojiRune(r rune) bool {
+	return r >= 0x1f000 || (r >= '\u2600' && r <= '\u27bf') || r == '\ufe0f'
+}
+
+// analyzeInstructions scans text meant for a coding agent for dangerous
+// shell commands, credential access, hidden characters and HTML comments.
+// It returns a reason for each line with a match, in line order.
+func analyzeInstructions(text string) []QuarantineReason {
+	var reasons []QuarantineReason
+	for i, line := range strings.Split(text, "\n") {
+		for _, rule := range instructionRules {
+			if match := rule.pattern.FindString(line); match != "" {
+				reasons = append(reasons, QuarantineReason{Code: rule.code, Line: i + 1, Excerpt: excerpt(strings.TrimSpace(match))})
+			}
+		}
+		if hiddenLine(line, i == 0) {
+			reasons = append(reasons, QuarantineReason{Code: QuarantineHiddenUnicode, Line: i + 1, Excerpt: excerpt(fmt.Sprintf("%+q", line))})
+		}
+	}
+	for _, loc := range htmlCommentPattern.FindAllStringIndex(text, -1) {
+		line := strings.Count(text[:loc[0]], "\n") + 1
+		reasons = append(reasons, QuarantineReason{Code: QuarantineHTMLComment, Line: line, Excerpt: excerpt(text[loc[0]:loc[1]])})
+	}
+
+	// Keep one reason per code and line.
+	sort.SliceStable(reasons, func(i, j int) bool { return reasons[i].Line < reasons[j].Line })
+	seen := make(map[QuarantineReason]bool)
+	out := reasons[:0]
+	for _, reason := range reasons {
+		key := QuarantineReason{Code: reason.Code, Line: reason.Line}
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, reason)
+		}
+	}
+	return out
+}
+
+// hiddenLine reports whether line has hidden characters. A byte order mark
+// at the start of the text and zero width joiners within emoji sequences
+// are allowed.
+func hiddenLine(line string, first bool) bool {
+	var prev rune
+	for i, r := range line {
+		allowed := (r == '\ufeff' && first && i == 0) || (r == '\u200d' && emojiRune(prev))
+		if hiddenRune(r) && !allowed {
+			return true
+		}
+		prev = r
+	}
+	return false
+}
+
+// concealing returns the reasons that hide text from readers. Such a
+// source is quarantined as a whole rather than shown to the model, which
+// would read the hidden text while extracting snippets.
+func concealing(reasons []QuarantineReason) []QuarantineReason {
+	var out []QuarantineReason
+	for _, reason := range reasons {
+		if reason.Code == QuarantineHiddenUnicode || reason.Code == QuarantineHTMLComment {
+			out = append(out, reason)
+		}
+	}
+	return out
+}
+
+// excerpt shortens text to at most maxExcerptBytes, on a rune boundary.
+func excerpt(text string) string {
+	if len(text) <= maxExcerptBytes {
+		return text
+	}
+	cut := maxExcerptBytes
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
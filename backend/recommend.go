@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Kinds of technology detected in a repository's manifests.
+const (
+	TechLanguage  = "language"
+	TechFramework = "framework"
+	TechTool      = "tool"
+)
+
+// Limits on what the recommend endpoint reads and searches for. Manifests
+// are small, so a request near these limits is not a repository's.
+const (
+	maxManifestFiles = 50
+	maxManifestBytes = 1 << 20
+	// maxRecommendTechnologies bounds the searches a request runs, two
+	// per technology.
+	maxRecommendTechnologies = 20
+)
+
+// technology is something a repository can be built with, keyed by the
+// label snippets about it carry.
+type technology struct {
+	Name string
+	Kind string
+	// Query finds snippets about the technology that are not labelled
+	// for it.
+	Query string
+}
+
+// technologies are the technologies recommendations are made for.
+var technologies = map[string]technology{
+	"go":         {"Go", TechLanguage, "Go code style, error handling and package layout"},
+	"javascript": {"JavaScript", TechLanguage, "JavaScript code style and modules"},
+	"typescript": {"TypeScript", TechLanguage, "TypeScript types, strict mode and code style"},
+	"python":     {"Python", TechLanguage, "Python code style, type hints and packaging"},
+	"rust":       {"Rust", TechLanguage, "Rust idioms, ownership and error handling"},
+
+	"angular":    {"Angular", TechFramework, "Angular components, services and modules"},
+	"actix":      {"Actix Web", TechFramework, "Actix Web handlers and extractors"},
+	"axum":       {"Axum", TechFramework, "Axum routers, handlers and extractors"},
+	"chi":        {"chi", TechFramework, "chi routers and HTTP middleware in Go"},
+	"django":     {"Django", TechFramework, "Django models, views and migrations"},
+	"echo":       {"Echo", TechFramework, "Echo HTTP handlers and middleware in Go"},
+	"express":    {"Express", TechFramework, "Express routes and middleware"},
+	"fastapi":    {"FastAPI", TechFramework, "FastAPI endpoints, dependencies and Pydantic models"},
+	"fiber":      {"Fiber", TechFramework, "Fiber HTTP handlers in Go"},
+	"flask":      {"Flask", TechFramework, "Flask routes, blueprints and application factories"},
+	"gin":        {"Gin", TechFramework, "Gin HTTP handlers and middleware in Go"},
+	"grpc":       {"gRPC", TechFramework, "gRPC services and protocol buffers"},
+	"nestjs":     {"NestJS", TechFramework, "NestJS modules, controllers and providers"},
+	"nextjs":     {"Next.js", TechFramework, "Next.js pages, routing and server components"},
+	"react":      {"React", TechFramework, "React components, hooks and state"},
+	"svelte":     {"Svelte", TechFramework, "Svelte components and stores"},
+	"tokio":      {"Tokio", TechFramework, "Tokio async tasks and runtimes in Rust"},
+	"vue":        {"Vue", TechFramework, "Vue components and the composition API"},
+	"cobra":      {"Cobra", TechFramework, "Cobra command line interfaces in Go"},
+	"gorm":       {"GORM", TechFramework, "GORM models and database queries in Go"},
+	"sqlalchemy": {"SQLAlchemy", TechFramework, "SQLAlchemy models, sessions and queries"},
+	"pydantic":   {"Pydantic", TechFramework, "Pydantic models and validation"},
+	"serde":      {"Serde", TechFramework, "Serde serialization and deserialization in Rust"},
+	"clap":       {"clap", TechFramework, "clap command line argument parsing in Rust"},
+
+	"black":      {"Black", TechTool, "formatting Python code with Black"},
+	"docker":     {"Docker", TechTool, "Dockerfile and container image best practices"},
+	"eslint":     {"ESLint", TechTool, "ESLint rules and linting JavaScript"},
+	"jest":       {"Jest", TechTool, "writing tests with Jest"},
+	"mypy":       {"mypy", TechTool, "static type checking Python with mypy"},
+	"playwright": {"Playwright", TechTool, "end-to-end tests with Playwright"},
+	"poetry":     {"Poetry", TechTool, "managing Python dependencies with Poetry"},
+	"prettier":   {"Prettier", TechTool, "formatting code with Prettier"},
+	"pytest":     {"pytest", TechTool, "writing tests with pytest and fixtures"},
+	"ruff":       {"Ruff", TechTool, "linting and formatting Python with Ruff"},
+	"tailwind":   {"Tailwind CSS", TechTool, "styling with Tailwind CSS utility classes"},
+	"testify":    {"testify", TechTool, "Go tests with testify assertions"},
+	"uv":         {"uv", TechTool, "managing Python projects with uv"},
+	"vitest":     {"Vitest", TechTool, "writing tests with Vitest"},
+}
+
+// Dependencies, by the name their ecosystem gives them, that reveal a
+// technology's label.
+var (
+	goModules = map[string]string{
+		"github.com/gin-gonic/gin":    "gin",
+		"github.com/go-chi/chi":       "chi",
+		"github.com/gofiber/fiber":    "fiber",
+		"github.com/labstack/echo":    "echo",
+		"github.com/spf13/cobra":      "cobra",
+		"github.com/stretchr/testify": "testify",
+		"google.golang.org/grpc":      "grpc",
+		"gorm.io/gorm":                "gorm",
+	}
+	npmPackages = map[string]string{
+		"@angular/core":    "angular",
+		"@nestjs/core":     "nestjs",
+		"@playwright/test": "playwright",
+		"@sveltejs/kit":    "svelte",
+		"eslint":           "eslint",
+		"express":          "express",
+		"jest":             "jest",
+		"next":             "nextjs",
+		"nuxt":             "vue",
+		"prettier":         "prettier",
+		"react":            "react",
+		"svelte":           "svelte",
+		"tailwindcss":      "tailwind",
+		"typescript":       "typescript",
+		"vitest":           "vitest",
+		"vue":              "vue",
+	}
+	pythonPackages = map[string]string{
+		"black":      "black",
+		"django":     "django",
+		"fastapi":    "fastapi",
+		"flask":      "flask",
+		"mypy":       "mypy",
+		"pydantic":   "pydantic",
+		"pytest":     "pytest",
+		"ruff":       "ruff",
+		"sqlalchemy": "sqlalchemy",
+	}
+	// pythonTools are configured in pyproject.toml's [tool.<name>] tables.
+	pythonTools = map[string]string{
+		"black":  "black",
+		"mypy":   "mypy",
+		"poetry": "poetry",
+		"pytest": "pytest",
+		"ruff":   "ruff",
+		"uv":     "uv",
+	}
+	crates = map[string]string{
+		"actix-web": "actix",
+		"axum":      "axum",
+		"clap":      "clap",
+		"serde":     "serde",
+		"tokio":     "tokio",
+	}
+	// dockerImages are base images that reveal the language built in
+	// them.
+	dockerImages = map[string]string{
+		"golang": "go",
+		"node":   "javascript",
+		"python": "python",
+		"rust":   "rust",
+	}
+)
+
+// queryEmbeddingCache holds the embeddings of the queries of the
+// technologies catalogue, which never change.
+type queryEmbeddingCache struct {
+	mu         sync.Mutex
+	embeddings map[string][]float32
+}
+
+// get returns the embedding of query, embedding it with llm the first time.
+func (c *queryEmbeddingCache) get(ctx context.Context, llm LLMProvider, query string) ([]float32, error) {
+	c.mu.Lock()
+	embedding, ok := c.embeddings[query]
+	c.mu.Unlock()
+	if ok {
+		return embedding, nil
+	}
+	embedding, err := llm.Embed(ctx, query, TaskRetrievalQuery)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.embeddings == nil {
+		c.embeddings = make(map[string][]float32)
+	}
+	c.embeddings[query] = embedding
+	return embedding, nil
+}
+
+// ManifestFile is a file describing how a repository is built, such as
+// go.mod or package.json.
+type ManifestFile struct {
+	// Path is the file's path in the repository; only its name matters.
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// RecommendRequest is the body accepted by the recommend endpoint.
+type RecommendRequest struct {
+	// Files are at most maxManifestFiles manifests, of at most
+	// maxManifestBytes together.
+	Files []ManifestFile `json:"files"`
+	// Limit is how many snippets to recommend, defaultSearchLimit by
+	// default.
+	Limit int `json:"limit,omitempty"`
+	// MaxSafety leaves out snippets less safe than it, as in searches.
+	MaxSafety *float64 `json:"maxSafety,omitempty"`
+}
+
+// RecommendResponse is the body returned by the recommend endpoint.
+type RecommendResponse struct {
+	Technologies []DetectedTechnology `json:"technologies"`
+	Results      []Recommendation     `json:"results"`
+	// SnippetIDs are the IDs of the results, in order, to pass to the
+	// compose and export endpoints.
+	SnippetIDs []string `json:"snippetIds"`
+	// Omitted lists the matching snippets left out as duplicates.
+	Omitted []OmittedSnippet `json:"omitted,omitempty"`
+	// Ignored lists the files that are not manifests this recognises.
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+// DetectedTechnology is a technology found in a repository's manifests,
+// with the label and query its snippets are found by.
+type DetectedTechnology struct {
+	Label string `json:"label"`
+	Name  string `json:"name"`
+	Kind  string `json:"kind"`
+	Query string `json:"query"`
+	// Files are the paths of the manifests it was found in.
+	Files []string `json:"files"`
+}
+
+// Recommendation is a snippet recommended for a repository.
+type Recommendation struct {
+	Snippet *Snippet `json:"snippet"`
+	Score   float64  `json:"score"`
+	// Technologies are the labels of the detected technologies the
+	// snippet was found for.
+	Technologies []string `json:"technologies"`
+}
+
+// recommendHandler serves POST /api/v1/recommend. It reads a repository's
+// manifests (go.mod, package.json, pyproject.toml, Cargo.toml and
+// Dockerfiles), detects the languages, frameworks and tools it is built
+// with, and returns the snippets best suited to it: for each technology,
+// the snippets labelled for it and those matching its query are ranked,
+// and the rankings are fused so that snippets relevant to several
+// technologies, or found both ways, come first. Near-duplicates are left
+// out. Only the first maxRecommendTechnologies technologies detected are
+// searched for. The IDs of the results can be passed on to the compose and
+// export endpoints.
+func (app *App) recommendHandler(w http.ResponseWriter, r *http.Request) {
+	// JSON escapes can make the body up to twice the size of the content.
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxManifestBytes)
+	var req RecommendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) == 0 {
+		http.Error(w, "'files' is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) > maxManifestFiles {
+		http.Error(w, fmt.Sprintf("Too many files: at most %d are accepted", maxManifestFiles), http.StatusBadRequest)
+		return
+	}
+	size := 0
+	for _, file := range req.Files {
+		size += len(file.Content)
+	}
+	if size > maxManifestBytes {
+		http.Error(w, fmt.Sprintf("Files too large: at most %d bytes are accepted", maxManifestBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultSearchLimit
+	}
+	if req.Limit < 1 || req.Limit > maxSearchLimit {
+		http.Error(w, fmt.Sprintf("Invalid 'limit': must be between 1 and %d", maxSearchLimit), http.StatusBadRequest)
+		return
+	}
+	if req.MaxSafety != nil && (*req.MaxSafety < 0 || *req.MaxSafety > 1) {
+		http.Error(w, "Invalid 'maxSafety': must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+
+	detected, ignored, err := detectTechnologies(req.Files)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(detected) > maxRecommendTechnologies {
+		detected = detected[:maxRecommendTechnologies]
+	}
+	results, omitted, err := app.recommend(r.Context(), detected, SnippetFilter{MaxSafety: req.MaxSafety}, req.Limit)
+	if err != nil {
+		http.Error(w, "Failed to recommend snippets", http.StatusInternalServerError)
+		log.Printf("Failed to recommend snippets: %v", err)
+		return
+	}
+
+	resp := RecommendResponse{
+		Technologies: detected,
+		Results:      results,
+		SnippetIDs:   make([]string, len(results)),
+		Omitted:      omitted,
+		Ignored:      ignored,
+	}
+	for i, result := range results {
+		resp.SnippetIDs[i] = result.Snippet.ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recommend returns up to limit snippets passing filter for the detected
+// technologies, best first, and the near-duplicates it left out. Each
+// technology contributes two rankings, one of the snippets labelled for it
+// and one of all snippets, both searched for with its query, and the
+// rankings are combined with reciprocal rank fusion. The queries come from
+// the technologies catalogue, so each is embedded once and reused.
+func (app *App) recommend(ctx context.Context, detected []DetectedTechnology, filter SnippetFilter, limit int) ([]Recommendation, []OmittedSnippet, error) {
+	byID := make(map[string]*Recommendation)
+	var ranked []*Recommendation
+	for _, tech := range detected {
+		embedding, err := app.queryEmbeddings.get(ctx, app.llm, tech.Query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to embed query for %s: %v", tech.Label, err)
+		}
+		labelled := filter
+		labelled.Labels = []string{tech.Label}
+		for _, f := range []SnippetFilter{labelled, filter} {
+			results, err := app.searchEmbedded(ctx, tech.Query, embedding, SearchModeHybrid, 0, f, true, limit)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to search for %s: %v", tech.Label, err)
+			}
+			for i, result := range results {
+				rec, ok := byID[result.Snippet.ID]
+				if !ok {
+					rec = &Recommendation{Snippet: result.Snippet}
+					byID[result.Snippet.ID] = rec
+					ranked = append(ranked, rec)
+				}
+				rec.Score += 1.0 / float64(rrfK+i+1)
+				if n := len(rec.Technologies); n == 0 || rec.Technologies[n-1] != tech.Label {
+					rec.Technologies = append(rec.Technologies, tech.Label)
+				}
+			}
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score > ranked[j].Score })
+
+	snippets := make([]*Snippet, len(ranked))
+	for i, rec := range ranked {
+		snippets[i] = rec.Snippet
+	}
+	snippets, omitted, err := app.dedupSnippets(ctx, snippets)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to deduplicate snippets: %v", err)
+	}
+	if len(snippets) > limit {
+		snippets = snippets[:limit]
+	}
+	results := make([]Recommendation, len(snippets))
+	for i, snippet := range snippets {
+		results[i] = *byID[snippet.ID]
+	}
+	return results, omitted, nil
+}
+
+// detectTechnologies returns the technologies the manifests among files
+// show a repository is built with, languages first, and the paths of the
+// files that are not manifests. A manifest that cannot be read is an error
+// meant for the client.
+func detectTechnologies(files []ManifestFile) ([]DetectedTechnology, []string, error) {
+	found := make(map[string]*DetectedTechnology)
+	var ignored []string
+	for _, file := range files {
+		labels, err := manifestLabels(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid manifest %s: %v", file.Path, err)
+		}
+		if labels == nil {
+			ignored = append(ignored, file.Path)
+			continue
+		}
+		for _, label := range labels {
+			tech, ok := found[label]
+			if !ok {
+				t := technologies[label]
+				tech = &DetectedTechnology{Label: label, Name: t.Name, Kind: t.Kind, Query: t.Query}
+				found[label] = tech
+			}
+			if n := len(tech.Files); n == 0 || tech.Files[n-1] != file.Path {
+				tech.Files = append(tech.Files, file.Path)
+			}
+		}
+	}
+
+	detected := []DetectedTechnology{}
+	for _, tech := range found {
+		detected = append(detected, *tech)
+	}
+	kinds := map[string]int{TechLanguage: 0, TechFramework: 1, TechTool: 2}
+	sort.Slice(detected, func(i, j int) bool {
+		if a, b := kinds[detected[i].Kind], kinds[detected[j].Kind]; a != b {
+			return a < b
+		}
+		return detected[i].Label < detected[j].Label
+	})
+	return detected, ignored, nil
+}
+
+// manifestLabels returns the labels of the technologies a manifest shows,
+// or nil if the file is not a manifest.
+func manifestLabels(file ManifestFile) ([]string, error) {
+	name := path.Base(strings.ReplaceAll(file.Path, "\\", "/"))
+	var labels []string
+	switch {
+	case name == "go.mod":
+		labels = append([]string{"go"}, dependencyLabels(goModDependencies(file.Content), goModules, true)...)
+	case name == "package.json":
+		deps, err := packageJSONDependencies(file.Content)
+		if err != nil {
+			return nil, err
+		}
+		labels = append([]string{"javascript"}, dependencyLabels(deps, npmPackages, false)...)
+	case name == "pyproject.toml":
+		labels = append([]string{"python"}, pyprojectLabels(file.Content)...)
+	case name == "Cargo.toml":
+		labels = append([]string{"rust"}, dependencyLabels(cargoDependencies(file.Content), crates, false)...)
+	case name == "Dockerfile" || strings.HasPrefix(name, "Dockerfile.") || strings.HasSuffix(name, ".dockerfile"):
+		labels = append([]string{"docker"}, dockerfileLabels(file.Content)...)
+	default:
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// dependencyLabels returns the labels known maps the dependencies to. With
+// prefixes set, a dependency also matches the entries its name starts
+// with, as Go modules add major versions to their paths.
+func dependencyLabels(deps []string, known map[string]string, prefixes bool) []string {
+	var labels []string
+	for _, dep := range deps {
+		if label, ok := known[dep]; ok {
+			labels = append(labels, label)
+			continue
+		}
+		if !prefixes {
+			continue
+		}
+		for name, label := range known {
+			if strings.HasPrefix(dep, name+"/") {
+				labels = append(labels, label)
+				break
+			}
+		}
+	}
+	return labels
+}
+
+// goModDependencies returns the module paths a go.mod file requires.
+func goModDependencies(content string) []string {
+	var deps []string
+	inBlock := false
+	for _, line := range strings.Split(content, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case inBlock && fields[0] == ")":
+			inBlock = false
+		case inBlock:
+			deps = append(deps, fields[0])
+		case fields[0] == "require" && len(fields) > 1 && fields[1] == "(":
+			inBlock = true
+		case fields[0] == "require" && len(fields) > 1:
+			deps = append(deps, fields[1])
+		}
+	}
+	return deps
+}
+
+// packageJSONDependencies returns the names of the packages a package.json
+// file depends on, including those it only needs for development.
+func packageJSONDependencies(content string) ([]string, error) {
+	var manifest struct {
+		Dependencies     map[string]string `json:"dependencies"`
+		DevDependencies  map[string]string `json:"devDependencies"`
+		PeerDependencies map[string]string `json:"peerDependencies"`
+	}
+	if err := json.Unmarshal([]byte(content), &manifest); err != nil {
+		return nil, err
+	}
+	var deps []string
+	for _, m := range []map[string]string{manifest.Dependencies, manifest.DevDependencies, manifest.PeerDependencies} {
+		for name := range m {
+			deps = append(deps, name)
+		}
+	}
+	sort.Strings(deps)
+	return deps, nil
+}
+
+// pyprojectLabels returns the labels of the packages a pyproject.toml file
+// depends on, whether declared as in PEP 621 or for Poetry, and of the
+// tools it configures.
+func pyprojectLabels(content string) []string {
+	var deps []string
+	var labels []string
+	for _, entry := range tomlEntries(content) {
+		table := entry.table
+		switch {
+		case table == "project" && entry.key == "dependencies",
+			table == "project.optional-dependencies", table == "dependency-groups":
+			for _, requirement := range quotedStrings(entry.value) {
+				deps = append(deps, requirementName(requirement))
+			}
+		case strings.HasPrefix(table, "tool.poetry.") && strings.HasSuffix(table, "dependencies"):
+			deps = append(deps, requirementName(entry.key))
+		}
+		if name, ok := strings.CutPrefix(table, "tool."); ok {
+			name, _, _ = strings.Cut(name, ".")
+			if label, ok := pythonTools[name]; ok {
+				labels = append(labels, label)
+			}
+		}
+	}
+	return append(labels, dependencyLabels(deps, pythonPackages, false)...)
+}
+
+// cargoDependencies returns the names of the crates a Cargo.toml file
+// depends on, in any of its dependency tables.
+func cargoDependencies(content string) []string {
+	var deps []string
+	for _, entry := range tomlEntries(content) {
+		table := entry.table
+		if i := strings.LastIndex(table, "dependencies."); i >= 0 && !strings.Contains(table[i+len("dependencies."):], ".") {
+			// [dependencies.tokio] declares tokio itself.
+			deps = append(deps, table[i+len("dependencies."):])
+		} else if strings.HasSuffix(table, "dependencies") {
+			deps = append(deps, entry.key)
+		}
+	}
+	return deps
+}
+
+// dockerfileLabels returns the labels of the languages a Dockerfile's base
+// images are for.
+func dockerfileLabels(content string) []string {
+	var labels []string
+	stages := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+		fields = fields[1:]
+		for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		image := strings.ToLower(fields[0])
+		base := stages[image]
+		if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+			stages[strings.ToLower(fields[2])] = true
+		}
+		if base {
+			// Building on an earlier stage.
+			continue
+		}
+		image, _, _ = strings.Cut(image, "@")
+		image = path.Base(image)
+		image, _, _ = strings.Cut(image, ":")
+		if label, ok := dockerImages[image]; ok {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// tomlEntry is a key in a TOML file, with the table it is in and its value
+// as written.
+type tomlEntry struct {
+	table, key, value string
+}
+
+// tomlEntries lists the keys of a TOML file. It reads just enough TOML for
+// manifests: tables, keys and values, including arrays spanning lines.
+func tomlEntries(content string) []tomlEntry {
+	var entries []tomlEntry
+	table := ""
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			name, _, _ := strings.Cut(strings.Trim(line, "[]"), "]")
+			table = strings.ReplaceAll(strings.ReplaceAll(strings.TrimSpace(name), `"`, ""), " ", "")
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		for strings.HasPrefix(value, "[") && strings.Count(value, "[") > strings.Count(value, "]") && i+1 < len(lines) {
+			i++
+			value += "\n" + lines[i]
+		}
+		entries = append(entries, tomlEntry{table: table, key: unquote(strings.TrimSpace(key)), value: value})
+	}
+	return entries
+}
+
+// quotedStrings returns the strings quoted in a TOML value, skipping
+// comments.
+func quotedStrings(value string) []string {
+	var strs []string
+	for _, line := range strings.Split(value, "\n") {
+		for {
+			i := strings.IndexAny(line, `"'#`)
+			if i < 0 || line[i] == '#' {
+				break
+			}
+			end := strings.IndexByte(line[i+1:], line[i])
+			if end < 0 {
+				break
+			}
+			strs = append(strs, line[i+1:i+1+end])
+			line = line[i+end+2:]
+		}
+	}
+	return strs
+}
+
+// requirementName returns the normalized name of the package a Python
+// requirement, such as "Django>=4.2", is for.
+func requirementName(requirement string) string {
+	requirement = strings.TrimSpace(requirement)
+	end := strings.IndexFunc(requirement, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.')
+	})
+	if end >= 0 {
+		requirement = requirement[:end]
+	}
+	return strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(requirement))
+}
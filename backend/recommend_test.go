@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDetectTechnologies(t *testing.T) {
+	files := []ManifestFile{
+		{Path: "go.mod", Content: "module example.com/svc\n\ngo 1.24\n\nrequire github.com/spf13/cobra v1.8.0\n\nrequire (\n\tgithub.com/labstack/echo/v4 v4.12.0 // indirect\n\tgithub.com/gin-gonic/ginny v1.0.0\n)\n"},
+		{Path: "web/package.json", Content: `{"dependencies": {"react": "^18", "next": "14"}, "devDependencies": {"typescript": "^5", "vitest": "^1"}}`},
+		{Path: "pyproject.toml", Content: `[project]
+name = "tools"
+dependencies = [
+  "Django>=4.2", # the web app
+  'pydantic_core',
+]
+
+[project.optional-dependencies]
+test = ["pytest>=8"]
+
+[tool.ruff.lint]
+select = ["E"]
+`},
+		{Path: "cli/Cargo.toml", Content: "[package]\nname = \"cli\"\n\n[dependencies]\nserde = { version = \"1\", features = [\"derive\"] }\n\n[dependencies.tokio]\nversion = \"1\"\n"},
+		{Path: "Dockerfile", Content: "FROM --platform=$BUILDPLATFORM golang:1.24 AS build\nRUN go build\nFROM build AS test\nFROM gcr.io/distroless/static@sha256:abc\n"},
+		{Path: "README.md", Content: "# Service"},
+	}
+	detected, ignored, err := detectTechnologies(files)
+	if err != nil {
+		t.Fatalf("detectTechnologies: %v", err)
+	}
+	var labels []string
+	for _, tech := range detected {
+		labels = append(labels, tech.Label)
+	}
+	want := []string{"go", "javascript", "python", "rust", "typescript", "cobra", "django", "echo", "nextjs", "react", "serde", "tokio", "docker", "pytest", "ruff", "vitest"}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("labels = %v, want %v", labels, want)
+	}
+	if !reflect.DeepEqual(detected[0].Files, []string{"go.mod", "Dockerfile"}) || detected[0].Query == "" {
+		t.Errorf("go = %+v, want it found in go.mod and the Dockerfile", detected[0])
+	}
+	if !reflect.DeepEqual(ignored, []string{"README.md"}) {
+		t.Errorf("ignored = %v", ignored)
+	}
+
+	if _, _, err := detectTechnologies([]ManifestFile{{Path: "package.json", Content: "{"}}); err == nil {
+		t.Error("detectTechnologies accepted a broken package.json")
+	}
+}
+
+func TestRecommendHandler(t *testing.T) {
+	texts := []string{
+		"Run gofmt on Go code.",
+		"Always run gofmt on Go code.",
+		"Wrap errors with context in Go.",
+		"Use conventional commits for every change.",
+		"Keep React components small.",
+	}
+	app := newSearchTestApp(t, texts, [][]string{{"go"}, {"go"}, nil, {"git"}, {"react"}})
+	ids := byContent(t, app, texts)
+
+	recommend := func(body string) (int, RecommendResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/recommend", bytes.NewBufferString(body))
+		rr := httptest.NewRecorder()
+		app.recommendHandler(rr, req)
+		var resp RecommendResponse
+		if rr.Code == http.StatusOK {
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Failed to unmarshal response body: %v", err)
+			}
+		}
+		return rr.Code, resp
+	}
+
+	code, resp := recommend(`{"files": [{"path": "go.mod", "content": "module example.com/svc\n"}], "limit": 2}`)
+	if code != http.StatusOK {
+		t.Fatalf("recommend returned %d", code)
+	}
+	if len(resp.Technologies) != 1 || resp.Technologies[0].Label != "go" {
+		t.Errorf("technologies = %+v, want go", resp.Technologies)
+	}
+	// The labelled snippets rank first, and only one of the two about
+	// gofmt is kept.
+	if len(resp.SnippetIDs) != 2 || resp.SnippetIDs[0] != ids[0] && resp.SnippetIDs[0] != ids[1] {
+		t.Fatalf("snippetIds = %v, want a gofmt snippet first", resp.SnippetIDs)
+	}
+	if resp.SnippetIDs[1] != ids[2] || !reflect.DeepEqual(resp.Results[1].Technologies, []string{"go"}) {
+		t.Errorf("recommendations = %+v, want the unlabelled Go snippet second", resp.Results)
+	}
+
+	// The go query was embedded once, by the first request.
+	llm := app.llm.(*fakeLLM)
+	embeds := llm.Calls(fakeEmbed)
+	if _, resp := recommend(`{"files": [{"path": "go.mod", "content": "module example.com/svc\n"}]}`); len(resp.Results) == 0 {
+		t.Error("second recommendation found nothing")
+	}
+	if n := llm.Calls(fakeEmbed) - embeds; n != 0 {
+		t.Errorf("second recommendation embedded %d queries, want none", n)
+	}
+
+	tooMany, _ := json.Marshal(RecommendRequest{Files: make([]ManifestFile, maxManifestFiles+1)})
+	for _, body := range []string{`{}`, `{"files": [{"path": "go.mod"}], "limit": 101}`, `{"files": [{"path": "package.json", "content": "["}]}`, string(tooMany)} {
+		if code, _ := recommend(body); code != http.StatusBadRequest {
+			t.Errorf("recommend(%.40s) returned %d, want 400", body, code)
+		}
+	}
+	// Only the first technologies detected are searched for.
+	deps := make(map[string]string)
+	for name := range npmPackages {
+		deps[name] = "1"
+	}
+	packageJSON, _ := json.Marshal(map[string]any{"dependencies": deps})
+	var goMod, cargo strings.Builder
+	for module := range goModules {
+		fmt.Fprintf(&goMod, "require %s v1.0.0\n", module)
+	}
+	cargo.WriteString("[dependencies]\n")
+	for crate := range crates {
+		fmt.Fprintf(&cargo, "%s = \"1\"\n", crate)
+	}
+	many, _ := json.Marshal(RecommendRequest{Files: []ManifestFile{
+		{Path: "package.json", Content: string(packageJSON)},
+		{Path: "go.mod", Content: goMod.String()},
+		{Path: "Cargo.toml", Content: cargo.String()},
+	}})
+	if code, resp := recommend(string(many)); code != http.StatusOK || len(resp.Technologies) != maxRecommendTechnologies {
+		t.Errorf("recommend for many technologies = %d with %d technologies, want %d", code, len(resp.Technologies), maxRecommendTechnologies)
+	}
+	tooLarge, _ := json.Marshal(RecommendRequest{Files: []ManifestFile{
+		{Path: "go.mod", Content: strings.Repeat("a", maxManifestBytes/2)},
+		{Path: "Cargo.toml", Content: strings.Repeat("a", maxManifestBytes/2+1)},
+	}})
+	if code, _ := recommend(string(tooLarge)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("recommend for too large files returned %d, want 413", code)
+	}
+	code, resp = recommend(`{"files": [{"path": "Makefile", "content": "all:"}]}`)
+	if code != http.StatusOK || len(resp.Results) != 0 || resp.SnippetIDs == nil || len(resp.Ignored) != 1 {
+		t.Errorf("recommend for no manifests = %d %+v", code, resp)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Redaction policies selectable with REDACTION_POLICY.
+const (
+	// RedactionRedact replaces secrets and personal data with a marker
+	// naming what was removed.
+	RedactionRedact = "redact"
+	// RedactionReject refuses content containing secrets or personal data.
+	RedactionReject = "reject"
+	// RedactionWarn keeps content as it is and only records what was found.
+	RedactionWarn = "warn"
+)
+
+// Categories of sensitive data.
+const (
+	RedactionSecret = "secret"
+	RedactionPII    = "pii"
+)
+
+// Redaction records a secret or piece of personal data found in a source's
+// content. The value itself is never recorded.
+type Redaction struct {
+	// Kind names what was found, such as "aws_access_key" or "email".
+	Kind string `firestore:"kind" json:"kind"`
+	// Category is RedactionSecret or RedactionPII.
+	Category string `firestore:"category" json:"category"`
+	// Line is the 1-based line of the content it starts on.
+	Line int `firestore:"line" json:"line"`
+}
+
+// sensitivePattern detects one kind of sensitive data. If the pattern has a
+// group named "value", only that part of the match is sensitive; a group
+// named "domain" marks an email domain, and a group named "quote" the quote
+// a value may be wrapped in.
+type sensitivePattern struct {
+	kind     string
+	category string
+	pattern  *regexp.Regexp
+}
+
+// sensitivePatterns are checked in order; where matches overlap, the
+// earlier pattern wins.
+var sensitivePatterns = []sensitivePattern{
+	{"private_key", RedactionSecret, regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----(?s:.*?)(-----END [A-Z0-9 ]*PRIVATE KEY-----|$)`)},
+	{"aws_access_key", RedactionSecret, regexp.MustCompile(`\b(AKIA|ASIA|AIDA|AROA)[0-9A-Z]{16}\b`)},
+	{"aws_secret_key", RedactionSecret, regexp.MustCompile(`(?i)aws_?secret_?(access_?)?key["']?\s*[:=]\s*["']?(?P<value>[A-Za-z0-9/+=]{40})\b`)},
+	{"gcp_api_key", RedactionSecret, regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}`)},
+	{"gcp_oauth_token", RedactionSecret, regexp.MustCompile(`\bya29\.[0-9A-Za-z_\-]{20,}`)},
+	{"github_token", RedactionSecret, regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"slack_token", RedactionSecret, regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`)},
+	{"api_key", RedactionSecret, regexp.MustCompile(`\b(sk-(proj-|ant-)?[A-Za-z0-9_\-]{20,}|sk_live_[A-Za-z0-9]{20,}|glpat-[A-Za-z0-9_\-]{20,})`)},
+	{"jwt", RedactionSecret, regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]{8,}\.eyJ[A-Za-z0-9_\-]{8,}\.[A-Za-z0-9_\-]{8,}`)},
+	{"bearer_token", RedactionSecret, regexp.MustCompile(`(?i)\bbearer\s+(?P<value>[A-Za-z0-9._~+/\-]{20,}=*)`)},
+	{"password", RedactionSecret, regexp.MustCompile(`(?i)\b\w*(password|passwd|pwd|secret|api_?key|access_?token|auth_?token|client_?secret)["']?\s*[:=]\s*(?P<quote>["']?)(?P<value>[^\s"'$<{][^\s"']{6,}[^\s"'.,;:)])`)},
+	{"email", RedactionPII, regexp.MustCompile(`\b[A-Za-z0-9._%+\-]+@(?P<domain>[A-Za-z0-9\-]+(\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,})\b`)},
+	{"internal_host", RedactionPII, regexp.MustCompile(`(?i)\b[a-z0-9\-]+(\.[a-z0-9\-]+)*\.(internal|corp|intranet|lan)\b`)},
+	{"private_ip", RedactionPII, regexp.MustCompile(`\b(10\.\d{1,3}|192\.168|172\.(1[6-9]|2\d|3[01]))\.\d{1,3}\.\d{1,3}\b`)},
+}
+
+// exampleEmailDomains are domains reserved for documentation, whose
+// addresses are not personal data.
+var exampleEmailDomains = []string{"example.com", "example.org", "example.net", "users.noreply.github.com"}
+
+// sensitiveMatch is a span of content holding sensitive data.
+type sensitiveMatch struct {
+	kind, category string
+	start, end     int
+}
+
+// findSensitive returns the non-overlapping spans of content holding
+// secrets or personal data, in order.
+func findSensitive(content string) []sensitiveMatch {
+	var matches []sensitiveMatch
+	taken := func(start, end int) bool {
+		for _, m := range matches {
+			if start < m.end && m.start < end {
+				return true
+			}
+		}
+		return false
+	}
+	for _, p := range sensitivePatterns {
+		value, domain, quote := p.pattern.SubexpIndex("value"), p.pattern.SubexpIndex("domain"), p.pattern.SubexpIndex("quote")
+		for _, loc := range p.pattern.FindAllStringSubmatchIndex(content, -1) {
+			start, end := loc[0], loc[1]
+			if value > 0 && loc[2*value] >= 0 {
+				start, end = loc[2*value], loc[2*value+1]
+			}
+			if domain > 0 && !personalEmail(content[loc[0]:loc[1]], content[loc[2*domain]:loc[2*domain+1]]) {
+				continue
+			}
+			if quote > 0 && !assignedSecret(content, content[loc[2*quote]:loc[2*quote+1]], loc[2*value], loc[2*value+1]) {
+				continue
+			}
+			if !taken(start, end) {
+				matches = append(matches, sensitiveMatch{p.kind, p.category, start, end})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+	return matches
+}
+
+// personalEmail reports whether an address found in content is likely to
+// be someone's: addresses at documentation domains and git remotes such as
+// git@github.com are not.
+func personalEmail(address, domain string) bool {
+	if strings.HasPrefix(address, "git@") {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	for _, example := range exampleEmailDomains {
+		if domain == example || strings.HasSuffix(domain, "."+example) {
+			return false
+		}
+	}
+	return true
+}
+
+// assignedSecret reports whether the value at content[start:end], assigned
+// to a keyword such as "password", is likely to be a secret rather than
+// prose such as "password: rotate-it-quarterly". A value in matching quotes
+// is taken to be one; a bare value must mix letters and digits, as
+// generated secrets do.
+func assignedSecret(content, quote string, start, end int) bool {
+	if quote != "" {
+		return strings.HasPrefix(content[end:], quote)
+	}
+	value := content[start:end]
+	return strings.ContainsFunc(value, unicode.IsLetter) && strings.ContainsFunc(value, unicode.IsDigit)
+}
+
+// redactionPolicy decides what happens to content holding secrets or
+// personal data. The zero value redacts them.
+type redactionPolicy struct {
+	// Action is RedactionRedact, RedactionReject or RedactionWarn. Empty
+	// means RedactionRedact.
+	Action string
+}
+
+// scrub applies the policy to content before it is stored, logged or sent
+// to a model. It returns the content to use, what was found in it and, if
+// the policy rejects the content, an error listing what was found.
+func (r redactionPolicy) scrub(content string) (string, []Redaction, error) {
+	matches := findSensitive(content)
+	if len(matches) == 0 {
+		return content, nil, nil
+	}
+	redactions := make([]Redaction, len(matches))
+	for i, m := range matches {
+		redactions[i] = Redaction{Kind: m.kind, Category: m.category, Line: strings.Count(content[:m.start], "\n") + 1}
+	}
+
+	switch r.Action {
+	case RedactionReject:
+		return "", redactions, fmt.Errorf("content contains secrets or personal data: %s", describeRedactions(redactions))
+	case RedactionWarn:
+		return content, redactions, nil
+	}
+	// Markers keep the line breaks of what they replace, so that the lines
+	// after a multi-line secret keep their numbers, as provenance links to
+	// the lines of the original file.
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		b.WriteString(content[last:m.start])
+		b.WriteString("[REDACTED:" + m.kind + "]")
+		b.WriteString(strings.Repeat("\n", strings.Count(content[m.start:m.end], "\n")))
+		last = m.end
+	}
+	b.WriteString(content[last:])
+	return b.String(), redactions, nil
+}
+
+// describeRedactions lists redactions as "email on line 3, jwt on line 9".
+func describeRedactions(redactions []Redaction) string {
+	parts := make([]string, len(redactions))
+	for i, r := range redactions {
+		parts[i] = fmt.Sprintf("%s on line %d", r.Kind, r.Line)
+	}
+	return strings.Join(parts, ", ")
+}
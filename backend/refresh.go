@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultRefreshMaxAge is how long a URL source goes unchecked before a
+// refresh fetches it again.
+const defaultRefreshMaxAge = 24 * time.Hour
+
+// refreshConcurrency bounds how many sources a refresh fetches at once.
+const refreshConcurrency = 8
+
+// Reasons a refresh gives for skipping a source.
+const (
+	refreshNotModified = "not modified"
+	refreshUnchanged   = "unchanged"
+	refreshProcessing  = "processing"
+)
+
+// RefreshResponse is the body returned by the refresh endpoint. Every URL
+// source that was due ends up in exactly one of the lists.
+type RefreshResponse struct {
+	// MaxAge is how long ago a source must have been refreshed to be due.
+	MaxAge  string            `json:"maxAge"`
+	Checked int               `json:"checked"`
+	Changed []RefreshedSource `json:"changed"`
+	Skipped []RefreshedSource `json:"skipped"`
+	Failed  []RefreshedSource `json:"failed"`
+}
+
+// RefreshedSource is the outcome of refreshing one source.
+type RefreshedSource struct {
+	SourceID string `json:"sourceId"`
+	URL      string `json:"url"`
+	// Reason says why a source was skipped: "not modified" when the
+	// server said so, "unchanged" when it sent the same content again, or
+	// "processing" when the source was already being processed.
+	Reason string `json:"reason,omitempty"`
+	// JobID is the processing job queued for a changed source.
+	JobID string `json:"jobId,omitempty"`
+	// Error is why a source could not be refreshed.
+	Error string `json:"error,omitempty"`
+}
+
+// refreshOutcome is what refreshSource did with a source.
+type refreshOutcome int
+
+const (
+	refreshedSkipped refreshOutcome = iota
+	refreshedChanged
+	refreshedFailed
+)
+
+// refreshHandler serves POST /api/v1/refresh, meant to be called on a
+// schedule by Cloud Scheduler or cron. It sends a conditional GET for every
+// URL source not refreshed within maxAge, a duration such as "6h" that
+// defaults to 24h, and queues processing jobs for the sources whose content
+// changed.
+func (app *App) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	maxAge := defaultRefreshMaxAge
+	if value := r.URL.Query().Get("maxAge"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid maxAge: must be a non-negative duration such as 6h", http.StatusBadRequest)
+			return
+		}
+		maxAge = d
+	}
+
+	resp, err := app.refreshSources(r.Context(), maxAge)
+	if err != nil {
+		http.Error(w, "Failed to refresh sources", http.StatusInternalServerError)
+		log.Printf("Failed to refresh sources: %v", err)
+		return
+	}
+	log.Printf("Refreshed %d sources: %d changed, %d skipped, %d failed",
+		resp.Checked, len(resp.Changed), len(resp.Skipped), len(resp.Failed))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// requireRefreshToken guards the endpoints meant to be called on a schedule:
+// the request must carry the refresh token as a bearer token. Without a
+// configured token the endpoints are unavailable rather than open.
+func (app *App) requireRefreshToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.refreshToken == "" {
+			http.Error(w, "Refresh token not configured", http.StatusServiceUnavailable)
+			return
+		}
+		want := "Bearer " + app.refreshToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(want)) != 1 {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refreshSources checks the URL sources last refreshed more than maxAge ago
+// and queues the changed ones for processing.
+func (app *App) refreshSources(ctx context.Context, maxAge time.Duration) (*RefreshResponse, error) {
+	sources, err := app.store.ListSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	var due []*Source
+	for _, source := range sources {
+		if source.URL != "" && !source.LastRefreshed.After(cutoff) {
+			due = append(due, source)
+		}
+	}
+
+	results := make([]RefreshedSource, len(due))
+	outcomes := make([]refreshOutcome, len(due))
+	sem := make(chan struct{}, refreshConcurrency)
+	var wg sync.WaitGroup
+	for i, source := range due {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], outcomes[i] = app.refreshSource(ctx, source)
+		}()
+	}
+	wg.Wait()
+
+	resp := &RefreshResponse{
+		MaxAge:  maxAge.String(),
+		Checked: len(due),
+		Changed: []RefreshedSource{},
+		Skipped: []RefreshedSource{},
+		Failed:  []RefreshedSource{},
+	}
+	for i, result := range results {
+		switch outcomes[i] {
+		case refreshedChanged:
+			resp.Changed = append(resp.Changed, result)
+		case refreshedSkipped:
+			resp.Skipped = append(resp.Skipped, result)
+		default:
+			resp.Failed = append(resp.Failed, result)
+		}
+	}
+	return resp, nil
+}
+
+// refreshSource fetches a source's URL conditionally and, if its content
+// changed, saves the new content and queues a job to process it. A source
+// that fails to fetch is left as it was, to be tried again next time.
+func (app *App) refreshSource(ctx context.Context, source *Source) (RefreshedSource, refreshOutcome) {
+	result := RefreshedSource{SourceID: source.ID, URL: source.URL}
+	fail := func(err error) (RefreshedSource, refreshOutcome) {
+		log.Printf("Failed to refresh source %s: %v", source.ID, err)
+		result.Error = err.Error()
+		return result, refreshedFailed
+	}
+
+	if source.Status == "processing" {
+		result.Reason = refreshProcessing
+		return result, refreshedSkipped
+	}
+
+	etag, lastModified := source.ETag, source.LastModified
+	if source.Content == "" {
+		etag, lastModified = "", ""
+	}
+	doc, err := fetchContent(ctx, source.URL, etag, lastModified)
+	if err != nil {
+		return fail(fmt.Errorf("failed to fetch URL: %v", err))
+	}
+
+	source.LastRefreshed = time.Now()
+	content, redactions := source.Content, source.Redactions
+	if !doc.NotModified {
+		if content, redactions, err = app.redaction.scrub(doc.Content); err != nil {
+			return fail(fmt.Errorf("refusing fetched content: %v", err))
+		}
+	}
+	if doc.NotModified || content == source.Content {
+		result.Reason = refreshNotModified
+		if !doc.NotModified {
+			result.Reason = refreshUnchanged
+			source.ETag, source.LastModified = doc.ETag, doc.LastModified
+			source.Redactions = redactions
+		}
+		if err := app.store.UpdateSource(ctx, source); err != nil {
+			return fail(fmt.Errorf("failed to update source: %v", err))
+		}
+		return result, refreshedSkipped
+	}
+
+	// Reprocess with the snippet limit the source was last processed with.
+	limit := 0
+	latest, err := app.jobs.LatestJob(ctx, source.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fail(fmt.Errorf("failed to look up the latest job: %v", err))
+	}
+	if latest != nil {
+		limit = latest.Limit
+	}
+
+	source.Content, source.Redactions = content, redactions
+	source.ETag, source.LastModified = doc.ETag, doc.LastModified
+	source.Status = "processing"
+	if err := app.store.UpdateSource(ctx, source); err != nil {
+		return fail(fmt.Errorf("failed to save fetched content: %v", err))
+	}
+	jobID, err := app.enqueueJob(ctx, &Job{SourceID: source.ID, Limit: limit})
+	if err != nil {
+		if updateErr := app.setSourceStatus(ctx, source.ID, "error"); updateErr != nil {
+			log.Printf("Failed to update source status: %v", updateErr)
+		}
+		return fail(fmt.Errorf("failed to enqueue processing job: %v", err))
+	}
+	result.JobID = jobID
+	return result, refreshedChanged
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// refresh calls the refresh handler with the given query and bearer token
+// and returns the response code and body.
+func refresh(t *testing.T, app *App, query, token string) (int, RefreshResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/refresh"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	app.requireRefreshToken(http.HandlerFunc(app.refreshHandler)).ServeHTTP(rr, req)
+	var resp RefreshResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid refresh response %q: %v", rr.Body.String(), err)
+		}
+	}
+	return rr.Code, resp
+}
+
+func TestRefreshHandler(t *testing.T) {
+	var mu sync.Mutex
+	versioned := "# Testing\nRun go test.\n"
+	var conditional int
+	docs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/versioned.md":
+			etag := `"` + contentHash(versioned)[:8] + `"`
+			if r.Header.Get("If-None-Match") != "" {
+				conditional++
+			}
+			if r.Header.Get("If-None-Match") == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(versioned))
+		case "/plain.md":
+			w.Write([]byte("# Style\nRun gofmt.\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer docs.Close()
+	app := newTestApp(t, newMemoryStore(), newFakeLLM())
+	app.refreshToken = "secret"
+	ctx := context.Background()
+
+	versionedID := submitSource(t, app, ProcessRequest{URL: docs.URL + "/versioned.md"})
+	plainID := submitSource(t, app, ProcessRequest{URL: docs.URL + "/plain.md"})
+	missingID := submitSource(t, app, ProcessRequest{URL: docs.URL + "/missing.md"})
+	fileID := submitSource(t, app, ProcessRequest{Content: "# Docs\nWrite them.", Key: "file"})
+	for _, id := range []string{versionedID, plainID, missingID, fileID} {
+		waitForJob(t, app, id)
+	}
+	if source, _ := app.store.GetSource(ctx, versionedID); source.ETag == "" {
+		t.Errorf("source %+v did not record the ETag", source)
+	}
+
+	// Everything was just fetched, so nothing is due yet.
+	if code, resp := refresh(t, app, "", "secret"); code != http.StatusOK || resp.Checked != 0 {
+		t.Errorf("refresh = %d, %+v; want nothing checked", code, resp)
+	}
+
+	code, resp := refresh(t, app, "?maxAge=0s", "secret")
+	if code != http.StatusOK {
+		t.Fatalf("refresh returned %d", code)
+	}
+	if resp.Checked != 3 || len(resp.Changed) != 0 || len(resp.Skipped) != 2 || len(resp.Failed) != 1 {
+		t.Fatalf("refresh = %+v, want the URL sources checked and none changed", resp)
+	}
+	reasons := map[string]string{}
+	for _, skipped := range resp.Skipped {
+		reasons[skipped.SourceID] = skipped.Reason
+	}
+	if reasons[versionedID] != refreshNotModified || reasons[plainID] != refreshUnchanged {
+		t.Errorf("skipped reasons = %v", reasons)
+	}
+	if resp.Failed[0].SourceID != missingID || !strings.Contains(resp.Failed[0].Error, "404") {
+		t.Errorf("failed = %+v, want the missing document", resp.Failed)
+	}
+	mu.Lock()
+	if conditional != 1 {
+		t.Errorf("%d conditional requests, want 1", conditional)
+	}
+
+	// A changed document is stored and processed again.
+	versioned = "# Testing\nRun go test -race.\n"
+	mu.Unlock()
+	_, resp = refresh(t, app, "?maxAge=0s", "secret")
+	if len(resp.Changed) != 1 || resp.Changed[0].SourceID != versionedID || resp.Changed[0].JobID == "" {
+		t.Fatalf("refresh = %+v, want the versioned source changed", resp)
+	}
+	if job := waitForJob(t, app, versionedID); job.ID != resp.Changed[0].JobID || job.State != JobSucceeded {
+		t.Errorf("job = %+v, want the refresh job to succeed", job)
+	}
+	snippets, _ := app.store.ListSnippetsBySource(ctx, versionedID)
+	if len(snippets) != 1 || !strings.Contains(snippets[0].Content, "-race") {
+		t.Errorf("snippets after refresh = %+v", snippets)
+	}
+}
+
+func TestRefreshHandler_Token(t *testing.T) {
+	app := newTestApp(t, newMemoryStore(), newFakeLLM())
+	if code, _ := refresh(t, app, "", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("refresh without a configured token returned %d, want 503", code)
+	}
+
+	app.refreshToken = "secret"
+	if code, _ := refresh(t, app, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("refresh without a token returned %d, want 401", code)
+	}
+	if code, _ := refresh(t, app, "", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("refresh with the wrong token returned %d, want 401", code)
+	}
+	if code, _ := refresh(t, app, "", "secret"); code != http.StatusOK {
+		t.Errorf("refresh with the token returned %d, want 200", code)
+	}
+	if code, _ := refresh(t, app, "?maxAge=soon", "secret"); code != http.StatusBadRequest {
+		t.Errorf("refresh with a bad maxAge returned %d, want 400", code)
+	}
+}
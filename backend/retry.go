@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryPolicy retries model calls that fail with transient errors, waiting
+// an exponentially growing, jittered delay between attempts.
+type retryPolicy struct {
+	// Attempts is the most calls made, including the first. Zero or one
+	// means no retries.
+	Attempts int
+	// Initial is the delay before the first retry; each later one doubles
+	// it, up to Max.
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// defaultRetryPolicy rides out rate limiting and brief outages, giving up
+// after about a minute.
+var defaultRetryPolicy = retryPolicy{Attempts: 6, Initial: time.Second, Max: 30 * time.Second}
+
+// do calls fn until it succeeds, fails with an error that is not transient,
+// runs out of attempts or ctx is done. It returns fn's last error.
+func (p retryPolicy) do(ctx context.Context, what string, fn func() error) error {
+	delay := p.Initial
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		// Equal jitter: wait between half and all of the current delay.
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Printf("%s failed (attempt %d/%d), retrying in %v: %v", what, attempt, p.Attempts, wait, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if delay *= 2; delay > p.Max {
+			delay = p.Max
+		}
+	}
+}
+
+// isTransient reports whether err is worth retrying: rate limiting, an
+// unavailable backend or a timed out call, whichever provider reported it.
+func isTransient(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var genaiErr genai.APIError
+	if errors.As(err, &genaiErr) {
+		return transientStatus(genaiErr.Code)
+	}
+	var httpErr *apiError
+	if errors.As(err, &httpErr) {
+		return transientStatus(httpErr.StatusCode)
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+func transientStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fastRetry retries like defaultRetryPolicy but without the waiting.
+var fastRetry = retryPolicy{Attempts: 4, Initial: time.Millisecond, Max: 2 * time.Millisecond}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{genai.APIError{Code: http.StatusTooManyRequests}, true},
+		{fmt.Errorf("wrapped: %w", genai.APIError{Code: http.StatusServiceUnavailable}), true},
+		{genai.APIError{Code: http.StatusBadRequest}, false},
+		{&apiError{StatusCode: http.StatusTooManyRequests}, true},
+		{&apiError{StatusCode: http.StatusUnauthorized}, false},
+		{status.Error(codes.Unavailable, "down"), true},
+		{status.Error(codes.ResourceExhausted, "quota"), true},
+		{status.Error(codes.InvalidArgument, "bad"), false},
+		{fmt.Errorf("call: %w", context.DeadlineExceeded), true},
+		{errors.New("malformed response"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	unavailable := genai.APIError{Code: http.StatusServiceUnavailable}
+
+	calls := 0
+	err := fastRetry.do(ctx, "test", func() error {
+		if calls++; calls < 3 {
+			return unavailable
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("transient failures: err = %v after %d calls, want success on the third", err, calls)
+	}
+
+	calls = 0
+	err = fastRetry.do(ctx, "test", func() error { calls++; return unavailable })
+	if !isTransient(err) || calls != fastRetry.Attempts {
+		t.Errorf("persistent failure: err = %v after %d calls, want %d calls", err, calls, fastRetry.Attempts)
+	}
+
+	calls = 0
+	permanent := errors.New("bad request")
+	err = fastRetry.do(ctx, "test", func() error { calls++; return permanent })
+	if err != permanent || calls != 1 {
+		t.Errorf("permanent failure: err = %v after %d calls, want one call", err, calls)
+	}
+
+	calls = 0
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	fastRetry.do(cancelled, "test", func() error { calls++; return unavailable })
+	if calls != 1 {
+		t.Errorf("cancelled context: %d calls, want 1", calls)
+	}
+
+	calls = 0
+	retryPolicy{}.do(ctx, "test", func() error { calls++; return unavailable })
+	if calls != 1 {
+		t.Errorf("zero policy: %d calls, want 1", calls)
+	}
+}
+
+func TestProcessSnippets_Retries(t *testing.T) {
+	ctx := context.Background()
+	llm := newFakeLLM()
+	store := newMemoryStore()
+	app := &App{store: store, jobs: store, llm: llm, retry: fastRetry}
+
+	content, err := ioutil.ReadFile("../samples/GEMINI-brief.md")
+	if err != nil {
+		t.Fatalf("Failed to read sample file: %v", err)
+	}
+	sourceID, _ := store.CreateSource(ctx, &Source{Key: "retries", Content: string(content), Status: "processing"})
+
+	// Two rate limited embeddings are retried; the third snippet's labels
+	// fail for good.
+	llm.QueueError(fakeEmbed, genai.APIError{Code: http.StatusTooManyRequests})
+	llm.QueueError(fakeEmbed, genai.APIError{Code: http.StatusTooManyRequests})
+	llm.QueueError(fakeExtractLabels, nil)
+	llm.QueueError(fakeExtractLabels, nil)
+	llm.QueueError(fakeExtractLabels, errors.New("invalid function call"))
+
+	if err := app.processSource(ctx, &Job{SourceID: sourceID, Attempts: 1}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+
+	snippets, _ := store.ListSnippetsBySource(ctx, sourceID)
+	if len(snippets) != 3 {
+		t.Errorf("stored %d snippets, want 3 of 4", len(snippets))
+	}
+	source, _ := store.GetSource(ctx, sourceID)
+	if source.Status != "partially_processed" {
+		t.Errorf("source status = %q, want partially_processed", source.Status)
+	}
+	if len(source.FailedSnippets) != 1 {
+		t.Fatalf("FailedSnippets = %+v, want one entry", source.FailedSnippets)
+	}
+	failed := source.FailedSnippets[0]
+	if failed.Index != 2 || failed.Stage != stageLabels || failed.Error != "invalid function call" || failed.Content == "" {
+		t.Errorf("failed snippet = %+v", failed)
+	}
+
+	// A clean rerun clears the failures.
+	if err := app.processSource(ctx, &Job{SourceID: sourceID, Attempts: 1}); err != nil {
+		t.Fatalf("processSource: %v", err)
+	}
+	source, _ = store.GetSource(ctx, sourceID)
+	if source.Status != "processed" || len(source.FailedSnippets) != 0 {
+		t.Errorf("after a clean rerun source = %q with failures %+v", source.Status, source.FailedSnippets)
+	}
+}
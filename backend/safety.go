@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// Safety classifiers selectable with SAFETY_CLASSIFIER.
+const (
+	// SafetyGenAI rates snippets with the Gemini safety filters, alongside
+	// the rules.
+	SafetyGenAI = "genai"
+	// SafetyRules rates snippets with the local rules only.
+	SafetyRules = "rules"
+	// SafetyOff leaves snippets unrated.
+	SafetyOff = "off"
+)
+
+// Safety categories scored by the rule-based classifier. Those rated by
+// Gemini take their names from its harm categories, such as
+// "dangerous_content".
+const (
+	// SafetyPromptInjection rates text that tries to override the
+	// instructions an agent was given.
+	SafetyPromptInjection = "prompt_injection"
+	// SafetyExfiltration rates text that tells an agent to send secrets or
+	// data somewhere.
+	SafetyExfiltration = "exfiltration"
+)
+
+// SafetyClassifier rates how unsafe a snippet is to hand to a coding agent.
+type SafetyClassifier interface {
+	// Classify returns a score from 0 (safe) to 1 (unsafe) for each
+	// category it rates.
+	Classify(ctx context.Context, text string) (map[string]float64, error)
+}
+
+// newSafetyClassifier creates the classifier selected by
+// cfg.SafetyClassifier. It returns nil for SafetyOff.
+func newSafetyClassifier(ctx context.Context, cfg Config) (SafetyClassifier, error) {
+	switch cfg.SafetyClassifier {
+	case SafetyGenAI:
+		client, err := genai.NewClient(ctx, &genai.ClientConfig{
+			Project:  cfg.ProjectID,
+			Location: cfg.VertexLocation,
+			Backend:  genai.BackendVertexAI,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create genai client: %v", err)
+		}
+		model := cfg.GenerationModel
+		if cfg.LLMProvider != "vertex" {
+			model = defaultGenerationModel
+		}
+		return combinedClassifier{newGenAIClassifier(client, model), ruleClassifier{}}, nil
+	case SafetyRules:
+		return ruleClassifier{}, nil
+	case SafetyOff:
+		log.Println("Safety classification is off; snippets will not be rated")
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown SAFETY_CLASSIFIER %q", cfg.SafetyClassifier)
+	}
+}
+
+// combinedClassifier runs several classifiers and keeps the highest score
+// each gives a category.
+type combinedClassifier []SafetyClassifier
+
+func (c combinedClassifier) Classify(ctx context.Context, text string) (map[string]float64, error) {
+	scores := make(map[string]float64)
+	for _, classifier := range c {
+		s, err := classifier.Classify(ctx, text)
+		if err != nil {
+			return nil, err
+		}
+		for category, score := range s {
+			scores[category] = max(scores[category], score)
+		}
+	}
+	return scores, nil
+}
+
+// safetyRule scores a category when its pattern matches.
+type safetyRule struct {
+	category string
+	score    float64
+	pattern  *regexp.Regexp
+}
+
+// safetyRules are the phrases the rule-based classifier looks for. Scores
+// reflect how rarely the phrase has an innocent reading in instructions for
+// coding agents.
+var safetyRules = []safetyRule{
+	{SafetyPromptInjection, 1, regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\b.{0,30}\b(previous|prior|above|earlier|all|any|other|system)\b.{0,20}\b(instructions?|prompts?|rules|directions|guidelines)\b`)},
+	{SafetyPromptInjection, 0.8, regexp.MustCompile(`(?i)\b(reveal|print|show|repeat|output)\b.{0,30}\b(system prompt|hidden instructions|initial instructions)\b`)},
+	{SafetyPromptInjection, 0.7, regexp.MustCompile(`(?i)\byou are (now|no longer)\b|\bfrom now on,? you\b|\bnew instructions:`)},
+	{SafetyPromptInjection, 0.6, regexp.MustCompile(`(?i)\b(do not|don't|never)\b.{0,20}\b(tell|inform|mention|alert)\b.{0,20}\b(the )?(user|human|developer)\b`)},
+	{SafetyExfiltration, 1, regexp.MustCompile(`(?i)\b(send|post|upload|exfiltrate|transmit|forward|leak)\b.{0,60}(\b(secrets?|credentials?|api[ _-]?keys?|tokens?|passwords?|private keys?|ssh keys?|environment variables)\b|\.env\b).{0,60}\b(to|at)\b`)},
+	{SafetyExfiltration, 0.9, regexp.MustCompile(`(?i)\b(curl|wget)\b[^\n]*(\$\{?[A-Z_]*(KEY|TOKEN|SECRET|PASSWORD)|\benv\b|\.env\b|\.ssh/)`)},
+	{SafetyExfiltration, 0.6, regexp.MustCompile(`(?i)\b(send|post|upload|copy)\b.{0,40}\b(source code|repository|codebase|files)\b.{0,30}\bto\b.{0,30}(https?://|webhook|pastebin|gist)`)},
+}
+
+// ruleClassifier is a SafetyClassifier that needs no model. It rates
+// SafetyPromptInjection and SafetyExfiltration by looking for phrases that
+// try to take over an agent or get it to send data away.
+type ruleClassifier struct{}
+
+func (ruleClassifier) Classify(ctx context.Context, text string) (map[string]float64, error) {
+	scores := map[string]float64{SafetyPromptInjection: 0, SafetyExfiltration: 0}
+	for _, rule := range safetyRules {
+		if rule.score > scores[rule.category] && rule.pattern.MatchString(text) {
+			scores[rule.category] = rule.score
+		}
+	}
+	return scores, nil
+}
+
+// genAIClassifier is a SafetyClassifier that reads the safety ratings
+// Gemini gives a snippet. Ratings cover what the model writes, so it is
+// asked to repeat the snippet back with blocking turned off.
+type genAIClassifier struct {
+	client *genai.Client
+	model  string
+}
+
+func newGenAIClassifier(client *genai.Client, model string) *genAIClassifier {
+	return &genAIClassifier{client: client, model: model}
+}
+
+// genAIHarmCategories are the categories rated by Gemini.
+var genAIHarmCategories = []genai.HarmCategory{
+	genai.HarmCategoryHarassment,
+	genai.HarmCategoryHateSpeech,
+	genai.HarmCategorySexuallyExplicit,
+	genai.HarmCategoryDangerousContent,
+}
+
+func (c *genAIClassifier) Classify(ctx context.Context, text string) (map[string]float64, error) {
+	budget := int32(0)
+	config := &genai.GenerateContentConfig{
+		ThinkingConfig: &genai.ThinkingConfig{ThinkingBudget: &budget},
+	}
+	for _, category := range genAIHarmCategories {
+		config.SafetySettings = append(config.SafetySettings, &genai.SafetySetting{
+			Category:  category,
+			Threshold: genai.HarmBlockThresholdOff,
+		})
+	}
+	prompt := "Repeat the following text exactly, without comment. Text: " + text
+	resp, err := c.client.Models.GenerateContent(ctx, c.model, genai.Text(prompt), config)
+	if err != nil {
+		return nil, err
+	}
+
+	var ratings []*genai.SafetyRating
+	if resp.PromptFeedback != nil {
+		ratings = append(ratings, resp.PromptFeedback.SafetyRatings...)
+	}
+	if len(resp.Candidates) > 0 {
+		ratings = append(ratings, resp.Candidates[0].SafetyRatings...)
+	}
+	if len(ratings) == 0 {
+		return nil, fmt.Errorf("no safety ratings returned")
+	}
+	scores := make(map[string]float64)
+	for _, rating := range ratings {
+		category := harmCategoryName(rating.Category)
+		scores[category] = max(scores[category], harmScore(rating))
+	}
+	return scores, nil
+}
+
+// harmCategoryName turns "HARM_CATEGORY_HATE_SPEECH" into "hate_speech".
+func harmCategoryName(category genai.HarmCategory) string {
+	return strings.ToLower(strings.TrimPrefix(string(category), "HARM_CATEGORY_"))
+}
+
+// harmScore is a rating's probability score or, for models that only give
+// a probability level, a score standing in for that level.
+func harmScore(rating *genai.SafetyRating) float64 {
+	if rating.ProbabilityScore > 0 {
+		return float64(rating.ProbabilityScore)
+	}
+	switch rating.Probability {
+	case genai.HarmProbabilityLow:
+		return 0.25
+	case genai.HarmProbabilityMedium:
+		return 0.5
+	case genai.HarmProbabilityHigh:
+		return 1
+	}
+	return 0
+}
+
+// maxSafetyScore returns the highest score a snippet has in any of the
+// categories, or in any category at all if none are given.
+func maxSafetyScore(scores map[string]float64, categories []string) float64 {
+	highest := 0.0
+	for category, score := range scores {
+		if len(categories) > 0 && !containsString(categories, category) {
+			continue
+		}
+		highest = max(highest, score)
+	}
+	return highest
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
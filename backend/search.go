@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Page sizes accepted by the search endpoint. Deep pages are refused, as
+// every page ranks all the results before it.
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchOffset    = 500
+)
+
+// Ranking modes accepted by the search endpoint.
+const (
+	SearchModeHybrid  = "hybrid"
+	SearchModeVector  = "vector"
+	SearchModeLexical = "lexical"
+)
+
+// rrfK is the constant of reciprocal rank fusion. The usual value of 60
+// keeps a single first place from outweighing agreement between the lists.
+const rrfK = 60
+
+// minFusionCandidates is the fewest results taken from each ranking before
+// they are fused, so that a snippet ranked modestly by both can still surface.
+const minFusionCandidates = 50
+
+// SearchResponse is the body returned by the search endpoint.
+type SearchResponse struct {
+	Query      string         `json:"query"`
+	Labels     []string       `json:"labels,omitempty"`
+	MaxSafety  *float64       `json:"maxSafety,omitempty"`
+	Mode       string         `json:"mode"`
+	VoteWeight float64        `json:"voteWeight"`
+	Dedup      bool           `json:"dedup,omitempty"`
+	Results    []SearchResult `json:"results"`
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	// NextOffset is the offset of the next page, if there is one.
+	NextOffset *int `json:"nextOffset,omitempty"`
+}
+
+// SearchResult is a snippet returned by the search endpoint. Score is what
+// results are ordered by; Components breaks it down.
+type SearchResult struct {
+	Snippet    *Snippet        `json:"snippet"`
+	Score      float64         `json:"score"`
+	Components ScoreComponents `json:"components"`
+	// Cluster is the snippet's cluster of near-duplicates in deduplicated
+	// searches.
+	Cluster *Cluster `json:"cluster,omitempty"`
+}
+
+// ScoreComponents are the signals that went into a search result's score.
+// Ranks are 1-based and zero when the snippet was not in that ranking.
+type ScoreComponents struct {
+	// Vector is the cosine similarity between the query and the snippet.
+	Vector     *float64 `json:"vector,omitempty"`
+	VectorRank int      `json:"vectorRank,omitempty"`
+	// Lexical is the BM25 score of the snippet for the query.
+	Lexical     *float64 `json:"lexical,omitempty"`
+	LexicalRank int      `json:"lexicalRank,omitempty"`
+	// Fused is the reciprocal rank fusion score in hybrid mode.
+	Fused float64 `json:"fused,omitempty"`
+	// Votes is the smoothed vote balance of the snippet, or of its cluster
+	// in deduplicated searches, between -1 and 1.
+	Votes float64 `json:"votes"`
+	// VoteFactor is what the score was multiplied by for votes.
+	VoteFactor float64 `json:"voteFactor"`
+}
+
+// searchHandler serves GET /api/v1/search. It returns the snippets that best
+// match the query q. The mode parameter picks the ranking: "vector" orders by
+// embedding similarity, "lexical" by BM25 over titles, content and labels,
+// and "hybrid", the default, fuses the two with reciprocal rank fusion.
+// voteWeight, between 0 and 1, boosts snippets users voted up and demotes
+// those they voted down. The optional labels parameter is a comma separated
+// list of labels every result must carry. maxSafety, between 0 and 1, drops
+// snippets with a higher safety score in any category, or in those listed
+// in safetyCategories. dedup collapses near-duplicate snippets into one
+// result per cluster, ranked on the cluster's votes. limit and offset page
+// through the results.
+func (app *App) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is accepted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	query := strings.TrimSpace(params.Get("q"))
+	if query == "" {
+		http.Error(w, "Query parameter 'q' is required", http.StatusBadRequest)
+		return
+	}
+	limit, err := intParam(params.Get("limit"), defaultSearchLimit, 1, maxSearchLimit)
+	if err != nil {
+		http.Error(w, "Invalid 'limit': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	offset, err := intParam(params.Get("offset"), 0, 0, maxSearchOffset)
+	if err != nil {
+		http.Error(w, "Invalid 'offset': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := params.Get("mode")
+	switch mode {
+	case "":
+		mode = SearchModeHybrid
+	case SearchModeHybrid, SearchModeVector, SearchModeLexical:
+	default:
+		http.Error(w, fmt.Sprintf("Invalid 'mode': must be %q, %q or %q", SearchModeHybrid, SearchModeVector, SearchModeLexical), http.StatusBadRequest)
+		return
+	}
+	voteWeight, err := floatParam(params.Get("voteWeight"), 0, 0, 1)
+	if err != nil {
+		http.Error(w, "Invalid 'voteWeight': "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter := SnippetFilter{
+		Labels:           splitList(params.Get("labels")),
+		SafetyCategories: splitList(params.Get("safetyCategories")),
+	}
+	if value := params.Get("maxSafety"); value != "" {
+		maxSafety, err := floatParam(value, 1, 0, 1)
+		if err != nil {
+			http.Error(w, "Invalid 'maxSafety': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.MaxSafety = &maxSafety
+	}
+	dedup := false
+	if value := params.Get("dedup"); value != "" {
+		if dedup, err = strconv.ParseBool(value); err != nil {
+			http.Error(w, "Invalid 'dedup': "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Ask for one extra result to learn whether there is another page.
+	results, err := app.search(r.Context(), query, mode, voteWeight, filter, dedup, offset+limit+1)
+	if err != nil {
+		http.Error(w, "Failed to search snippets", http.StatusInternalServerError)
+		log.Printf("Failed to search snippets: %v", err)
+		return
+	}
+
+	resp := SearchResponse{
+		Query:      query,
+		Labels:     filter.Labels,
+		MaxSafety:  filter.MaxSafety,
+		Mode:       mode,
+		VoteWeight: voteWeight,
+		Dedup:      dedup,
+		Results:    []SearchResult{},
+		Offset:     offset,
+		Limit:      limit,
+	}
+	if offset < len(results) {
+		resp.Results = results[offset:]
+	}
+	if len(resp.Results) > limit {
+		resp.Results = resp.Results[:limit]
+		if next := offset + limit; next <= maxSearchOffset {
+			resp.NextOffset = &next
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// search ranks snippets passing filter against query in the given mode and
+// returns up to limit of them, best first. If dedup is set, near-duplicates
+// are collapsed into one result per cluster.
+func (app *App) search(ctx context.Context, query, mode string, voteWeight float64, filter SnippetFilter, dedup bool, limit int) ([]SearchResult, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	var embedding []float32
+	if mode != SearchModeLexical {
+		var err error
+		if embedding, err = app.llm.Embed(ctx, query, TaskRetrievalQuery); err != nil {
+			return nil, fmt.Errorf("failed to embed query: %v", err)
+		}
+	}
+	return app.searchEmbedded(ctx, query, embedding, mode, voteWeight, filter, dedup, limit)
+}
+
+// searchEmbedded is search with the query already embedded, for callers
+// that run several searches for the same query. The embedding is not used
+// in lexical mode.
+func (app *App) searchEmbedded(ctx context.Context, query string, embedding []float32, mode string, voteWeight float64,
+	filter SnippetFilter, dedup bool, limit int) ([]SearchResult, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	depth := limit
+	if mode == SearchModeHybrid {
+		depth = max(2*limit, minFusionCandidates)
+	}
+	if dedup {
+		depth *= dedupCandidateFactor
+	}
+
+	var vector, lexical []ScoredSnippet
+	if mode != SearchModeLexical {
+		var err error
+		if vector, err = app.store.NearestSnippets(ctx, embedding, filter, depth); err != nil {
+			return nil, err
+		}
+	}
+	if mode != SearchModeVector {
+		index, err := app.lexical.get(ctx, app.store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build lexical index: %v", err)
+		}
+		lexical = index.search(query, filter, depth)
+	}
+
+	// Merge the rankings by snippet ID, preferring the snippets returned by
+	// the store over the possibly stale copies in the lexical index.
+	byID := make(map[string]*SearchResult)
+	var results []*SearchResult
+	result := func(snippet *Snippet) *SearchResult {
+		if r, ok := byID[snippet.ID]; ok {
+			return r
+		}
+		r := &SearchResult{Snippet: snippet}
+		byID[snippet.ID] = r
+		results = append(results, r)
+		return r
+	}
+	for i, scored := range vector {
+		r := result(scored.Snippet)
+		score := scored.Score
+		r.Components.Vector = &score
+		r.Components.VectorRank = i + 1
+	}
+	for i, scored := range lexical {
+		r := result(scored.Snippet)
+		score := scored.Score
+		r.Components.Lexical = &score
+		r.Components.LexicalRank = i + 1
+	}
+
+	for _, r := range results {
+		c := &r.Components
+		switch mode {
+		case SearchModeVector:
+			r.Score = *c.Vector
+		case SearchModeLexical:
+			r.Score = *c.Lexical
+		default:
+			if c.VectorRank > 0 {
+				c.Fused += 1.0 / float64(rrfK+c.VectorRank)
+			}
+			if c.LexicalRank > 0 {
+				c.Fused += 1.0 / float64(rrfK+c.LexicalRank)
+			}
+			r.Score = c.Fused
+		}
+	}
+
+	if dedup {
+		clusters, err := app.clusters.get(ctx, app.store)
+		if err != nil {
+			return nil, fmt.Errorf("failed to cluster snippets: %v", err)
+		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+		results = dedupResults(results, clusters, filter)
+	}
+
+	for _, r := range results {
+		c := &r.Components
+		c.Votes = voteBalance(r.Snippet)
+		if r.Cluster != nil {
+			c.Votes = voteBalance(&Snippet{ThumbsUp: r.Cluster.ThumbsUp, ThumbsDown: r.Cluster.ThumbsDown})
+		}
+		c.VoteFactor = 1 + voteWeight*c.Votes
+		// Dividing negative scores keeps a boost a boost whatever the sign.
+		if r.Score >= 0 {
+			r.Score *= c.VoteFactor
+		} else {
+			r.Score /= c.VoteFactor
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	out := make([]SearchResult, len(results))
+	for i, r := range results {
+		out[i] = *r
+	}
+	return out, nil
+}
+
+// voteBalance summarises a snippet's votes as (up - down) / (up + down + 2),
+// which stays strictly between -1 and 1 and lets a handful of votes count
+// for less than many.
+func voteBalance(snippet *Snippet) float64 {
+	up, down := float64(snippet.ThumbsUp), float64(snippet.ThumbsDown)
+	return (up - down) / (up + down + 2)
+}
+
+// intParam parses an integer query parameter, returning def when it is empty.
+// The value must be at least min and, unless max is negative, at most max.
+func intParam(value string, def, min, max int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < min {
+		return 0, fmt.Errorf("must be at least %d", min)
+	}
+	if max >= 0 && n > max {
+		return 0, fmt.Errorf("must be at most %d", max)
+	}
+	return n, nil
+}
+
+// floatParam is intParam for floating point parameters. The value must lie
+// between min and max inclusive.
+func floatParam(value string, def, min, max float64) (float64, error) {
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || f < min || f > max {
+		return 0, fmt.Errorf("must be between %g and %g", min, max)
+	}
+	return f, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
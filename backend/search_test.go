@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newSearchTestApp returns an app whose store holds one snippet per text,
+// embedded with the fake provider and labelled with labels[i].
+func newSearchTestApp(t *testing.T, texts []string, labels [][]string) *App {
+	t.Helper()
+	ctx := context.Background()
+	app := &App{store: newMemoryStore(), llm: newFakeLLM()}
+	sourceID, _ := app.store.CreateSource(ctx, &Source{Key: "search-test"})
+	for i, text := range texts {
+		embedding, err := app.llm.Embed(ctx, text, TaskRetrievalDocument)
+		if err != nil {
+			t.Fatalf("Embed: %v", err)
+		}
+		snippet := &Snippet{SourceID: sourceID, Content: text, Labels: labels[i], Embedding: embedding}
+		if _, err := app.store.AddSnippet(ctx, snippet); err != nil {
+			t.Fatalf("AddSnippet: %v", err)
+		}
+	}
+	return app
+}
+
+func doSearch(t *testing.T, app *App, query string) (int, SearchResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/search?"+query, nil)
+	rr := httptest.NewRecorder()
+	app.searchHandler(rr, req)
+	var resp SearchResponse
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("Failed to unmarshal response body: %v", err)
+		}
+	}
+	return rr.Code, resp
+}
+
+func TestSearchHandler(t *testing.T) {
+	app := newSearchTestApp(t,
+		[]string{
+			"Always run gofmt on Go code.",
+			"Write table driven tests in Go.",
+			"Prefer pnpm over npm for JavaScript packages.",
+		},
+		[][]string{{"go", "formatting"}, {"go", "testing"}, {"javascript"}},
+	)
+
+	code, resp := doSearch(t, app, "q=gofmt+Go+code")
+	if code != http.StatusOK {
+		t.Fatalf("search returned status %d", code)
+	}
+	if len(resp.Results) != 3 || resp.Results[0].Snippet.Content != "Always run gofmt on Go code." {
+		t.Errorf("unexpected ranking: %+v", resp.Results)
+	}
+	if resp.NextOffset != nil {
+		t.Errorf("NextOffset = %d, want none", *resp.NextOffset)
+	}
+
+	_, resp = doSearch(t, app, "q=gofmt&labels=go,testing")
+	if len(resp.Results) != 1 || resp.Results[0].Snippet.Content != "Write table driven tests in Go." {
+		t.Errorf("label filter returned %+v", resp.Results)
+	}
+
+	_, first := doSearch(t, app, "q=Go+code&limit=2")
+	if len(first.Results) != 2 || first.NextOffset == nil || *first.NextOffset != 2 {
+		t.Fatalf("first page = %+v, want 2 results and a next offset of 2", first)
+	}
+	_, second := doSearch(t, app, "q=Go+code&limit=2&offset=2")
+	if len(second.Results) != 1 || second.NextOffset != nil {
+		t.Errorf("second page = %+v, want the last result", second)
+	}
+	if second.Results[0].Snippet.ID == first.Results[0].Snippet.ID || second.Results[0].Snippet.ID == first.Results[1].Snippet.ID {
+		t.Error("second page repeats a result from the first")
+	}
+}
+
+func TestSearchHandler_BadRequests(t *testing.T) {
+	app := newSearchTestApp(t, nil, nil)
+	for _, query := range []string{"", "q=+", "q=go&limit=0", "q=go&limit=500", "q=go&offset=-1", "q=go&limit=ten",
+		"q=go&offset=501", "q=go&offset=9223372036854775807", "q=go&mode=vector&offset=9223372036854775807"} {
+		if code, _ := doSearch(t, app, query); code != http.StatusBadRequest {
+			t.Errorf("search %q returned status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/search?q=go", nil)
+	rr := httptest.NewRecorder()
+	app.searchHandler(rr, req)
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST returned status %d, want %d", rr.Code, http.StatusMethodNotAllowed)
+	}
+
+	code, resp := doSearch(t, app, "q=anything")
+	if code != http.StatusOK || resp.Results == nil || len(resp.Results) != 0 {
+		t.Errorf("search of an empty store = %d %+v, want an empty result list", code, resp)
+	}
+	if code, resp := doSearch(t, app, "q=anything&offset=500"); code != http.StatusOK || len(resp.Results) != 0 {
+		t.Errorf("search at the last offset = %d %+v", code, resp)
+	}
+	if results, err := app.search(context.Background(), "go", SearchModeHybrid, 0, SnippetFilter{}, false, 0); err != nil || results != nil {
+		t.Errorf("search with no limit = %v, %v", results, err)
+	}
+}
+
+func TestSearchHandler_Modes(t *testing.T) {
+	app := newSearchTestApp(t,
+		[]string{
+			"Follow PEP 8 for all Python code.",
+			"Format Python code with black.",
+			"Run gofmt before committing Go code.",
+		},
+		[][]string{{"python"}, {"python"}, {"go"}},
+	)
+
+	// Only the lexical ranking knows "8" is in a single snippet.
+	code, resp := doSearch(t, app, "q=PEP+8&mode=lexical")
+	if code != http.StatusOK {
+		t.Fatalf("lexical search returned status %d", code)
+	}
+	if resp.Mode != SearchModeLexical || len(resp.Results) != 1 || resp.Results[0].Snippet.Content != "Follow PEP 8 for all Python code." {
+		t.Errorf("lexical search = %+v", resp)
+	}
+	if c := resp.Results[0].Components; c.Lexical == nil || c.LexicalRank != 1 || c.Vector != nil {
+		t.Errorf("lexical components = %+v", c)
+	}
+
+	_, resp = doSearch(t, app, "q=PEP+8&mode=vector")
+	if len(resp.Results) != 3 || resp.Results[0].Components.Vector == nil || resp.Results[0].Components.Lexical != nil {
+		t.Errorf("vector search = %+v", resp)
+	}
+
+	_, resp = doSearch(t, app, "q=PEP+8")
+	if resp.Mode != SearchModeHybrid || len(resp.Results) != 3 {
+		t.Fatalf("hybrid search = %+v", resp)
+	}
+	top := resp.Results[0]
+	if top.Snippet.Content != "Follow PEP 8 for all Python code." {
+		t.Errorf("hybrid search ranked %q first", top.Snippet.Content)
+	}
+	want := 1.0/float64(rrfK+top.Components.VectorRank) + 1.0/float64(rrfK+top.Components.LexicalRank)
+	if top.Components.Fused != want || top.Score != want {
+		t.Errorf("hybrid score = %v (fused %v), want %v", top.Score, top.Components.Fused, want)
+	}
+	if top.Components.VoteFactor != 1 {
+		t.Errorf("vote factor without a vote weight = %v, want 1", top.Components.VoteFactor)
+	}
+
+	if code, _ := doSearch(t, app, "q=go&mode=fuzzy"); code != http.StatusBadRequest {
+		t.Errorf("unknown mode returned status %d", code)
+	}
+	if code, _ := doSearch(t, app, "q=go&voteWeight=2"); code != http.StatusBadRequest {
+		t.Errorf("voteWeight 2 returned status %d", code)
+	}
+}
+
+func TestSearchHandler_VoteWeight(t *testing.T) {
+	app := newSearchTestApp(t,
+		[]string{"Use black to format Python.", "Use ruff to format Python."},
+		[][]string{{"python"}, {"python"}},
+	)
+	ctx := context.Background()
+	snippets, _ := app.store.ListSnippets(ctx)
+	var ruff string
+	for _, snippet := range snippets {
+		if snippet.Content == "Use ruff to format Python." {
+			ruff = snippet.ID
+		}
+	}
+	for _, user := range []string{"alice", "bob", "carol"} {
+		if err := app.store.SetVote(ctx, ruff, user, VoteThumbsUp); err != nil {
+			t.Fatalf("SetVote: %v", err)
+		}
+	}
+
+	_, resp := doSearch(t, app, "q=format+Python+black&mode=vector&voteWeight=1")
+	if len(resp.Results) != 2 || resp.Results[0].Snippet.ID != ruff {
+		t.Fatalf("votes did not lift the upvoted snippet: %+v", resp.Results)
+	}
+	c := resp.Results[0].Components
+	if c.Votes != 0.6 || c.VoteFactor != 1.6 || resp.Results[0].Score != *c.Vector*1.6 {
+		t.Errorf("vote components = %+v, score %v", c, resp.Results[0].Score)
+	}
+
+	_, resp = doSearch(t, app, "q=format+Python+black&mode=vector")
+	if resp.Results[0].Snippet.ID == ruff {
+		t.Error("without a vote weight the closer match should come first")
+	}
+}
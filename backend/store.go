@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrNotFound is returned by a SnippetStore when a requested source, snippet
+// or vote does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Vote values recorded against a snippet. They double as the names of the
+// snippet counters they increment.
+const (
+	VoteThumbsUp   = "thumbs_up"
+	VoteThumbsDown = "thumbs_down"
+)
+
+// SnippetStore persists sources, the snippets extracted from them and the
+// votes users cast on snippets.
+type SnippetStore interface {
+	// CreateSource stores a new source and returns its ID.
+	CreateSource(ctx context.Context, source *Source) (string, error)
+	// GetSource returns the source with the given ID, or ErrNotFound.
+	GetSource(ctx context.Context, id string) (*Source, error)
+	// FindSourceByKey returns the source with the given key, or ErrNotFound.
+	FindSourceByKey(ctx context.Context, key string) (*Source, error)
+	// UpdateSource overwrites the stored source identified by source.ID.
+	UpdateSource(ctx context.Context, source *Source) error
+	// ListSources returns all sources, most recently refreshed first.
+	ListSources(ctx context.Context) ([]*Source, error)
+
+	// AddSnippet stores a new snippet and returns its ID.
+	AddSnippet(ctx context.Context, snippet *Snippet) (string, error)
+	// GetSnippet returns the snippet with the given ID, or ErrNotFound.
+	GetSnippet(ctx context.Context, id string) (*Snippet, error)
+	// ListSnippets returns all snippets, oldest first.
+	ListSnippets(ctx context.Context) ([]*Snippet, error)
+	// ListSnippetsBySource returns the snippets extracted from a source.
+	ListSnippetsBySource(ctx context.Context, sourceID string) ([]*Snippet, error)
+	// SetSnippetProvenance replaces the provenance of a snippet, or returns
+	// ErrNotFound.
+	SetSnippetProvenance(ctx context.Context, id string, provenance *Provenance) error
+	// DeleteSnippet removes a snippet, the votes cast on it and the conflict
+	// checks it is part of, or returns ErrNotFound.
+	DeleteSnippet(ctx context.Context, id string) error
+	// DeleteSnippetsBySource removes every snippet extracted from a source,
+	// along with the votes cast on them and their conflict checks.
+	DeleteSnippetsBySource(ctx context.Context, sourceID string) error
+	// QuarantineSnippet stores a new quarantined snippet apart from the
+	// others, where listing, getting and searching snippets never finds it,
+	// and returns its ID.
+	QuarantineSnippet(ctx context.Context, snippet *Snippet) (string, error)
+	// ListQuarantinedSnippets returns the quarantined snippets extracted
+	// from a source.
+	ListQuarantinedSnippets(ctx context.Context, sourceID string) ([]*Snippet, error)
+	// DeleteQuarantinedSnippet removes a quarantined snippet, or returns
+	// ErrNotFound.
+	DeleteQuarantinedSnippet(ctx context.Context, id string) error
+	// NearestSnippets returns up to limit snippets passing filter whose
+	// embeddings are closest to embedding by cosine similarity, most similar
+	// first. The score of each result is its cosine similarity.
+	NearestSnippets(ctx context.Context, embedding []float32, filter SnippetFilter, limit int) ([]ScoredSnippet, error)
+
+	// SaveConflictCheck records the verdict on a pair of snippets,
+	// replacing any earlier verdict on the same pair.
+	SaveConflictCheck(ctx context.Context, check *ConflictCheck) error
+	// ListConflictChecks returns every recorded verdict.
+	ListConflictChecks(ctx context.Context) ([]*ConflictCheck, error)
+	// ListConflictChecksBySnippet returns the verdicts on pairs including
+	// the snippet with the given ID.
+	ListConflictChecksBySnippet(ctx context.Context, snippetID string) ([]*ConflictCheck, error)
+
+	// GetVote returns the vote userID cast on a snippet, or "" if none.
+	GetVote(ctx context.Context, snippetID, userID string) (string, error)
+	// SetVote records userID's vote on a snippet and adjusts the snippet's
+	// thumbs up/down counters. An empty vote revokes any existing vote.
+	SetVote(ctx context.Context, snippetID, userID, vote string) error
+}
+
+// vectorIndexer is implemented by stores that can tell whether their
+// NearestSnippets uses a vector index. Stores that do not implement it, or
+// have none, compare the query against every snippet.
+type vectorIndexer interface {
+	vectorIndexed() bool
+}
+
+// newID returns a random 20 character document ID, like Firestore's.
+func newID() string {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// validVote reports whether vote is an accepted value for SetVote.
+func validVote(vote string) bool {
+	return vote == "" || vote == VoteThumbsUp || vote == VoteThumbsDown
+}
+
+// applyVote adjusts a snippet's counters for a change from oldVote to newVote.
+func applyVote(snippet *Snippet, oldVote, newVote string) {
+	switch oldVote {
+	case VoteThumbsUp:
+		snippet.ThumbsUp--
+	case VoteThumbsDown:
+		snippet.ThumbsDown--
+	}
+	switch newVote {
+	case VoteThumbsUp:
+		snippet.ThumbsUp++
+	case VoteThumbsDown:
+		snippet.ThumbsDown++
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// firestoreStore is a SnippetStore backed by the "sources" and "snippets"
+// Firestore collections. Votes live in a "votes" subcollection of each
+// snippet, keyed by user ID, which is the layout the frontend reads.
+// Conflict checks live in a "conflict_checks" collection, keyed by the IDs
+// of the pair. Quarantined snippets live in a "quarantined_snippets"
+// collection, which the frontend never reads.
+type firestoreStore struct {
+	client *firestore.Client
+}
+
+// firestoreSnippet is the document shape of a snippet. The source is kept as
+// a document reference so existing documents and client queries still work.
+// Embeddings are written as Firestore vectors so they can be searched with
+// FindNearest; older documents hold them as plain arrays.
+type firestoreSnippet struct {
+	Snippet
+	Source    *firestore.DocumentRef `firestore:"source"`
+	Embedding interface{}            `firestore:"embedding"`
+}
+
+// vectorDistanceField is the field FindNearest reports distances in.
+const vectorDistanceField = "vector_distance"
+
+// maxNearestLimit is the most results Firestore's FindNearest returns.
+const maxNearestLimit = 1000
+
+// maxVectorDimensions is the largest embedding a Firestore vector index
+// holds.
+const maxVectorDimensions = 2048
+
+// newFirestoreStore returns a store using client, for embeddings of the
+// given number of dimensions, which Firestore must be able to index.
+func newFirestoreStore(client *firestore.Client, dimensions int) (*firestoreStore, error) {
+	if dimensions <= 0 || dimensions > maxVectorDimensions {
+		return nil, fmt.Errorf("embedding dimensions must be between 1 and %d, got %d", maxVectorDimensions, dimensions)
+	}
+	return &firestoreStore{client: client}, nil
+}
+
+func (s *firestoreStore) sources() *firestore.CollectionRef {
+	return s.client.Collection("sources")
+}
+
+func (s *firestoreStore) snippets() *firestore.CollectionRef {
+	return s.client.Collection("snippets")
+}
+
+func (s *firestoreStore) quarantined() *firestore.CollectionRef {
+	return s.client.Collection("quarantined_snippets")
+}
+
+func (s *firestoreStore) CreateSource(ctx context.Context, source *Source) (string, error) {
+	ref, _, err := s.sources().Add(ctx, source)
+	if err != nil {
+		return "", err
+	}
+	source.ID = ref.ID
+	return ref.ID, nil
+}
+
+func (s *firestoreStore) GetSource(ctx context.Context, id string) (*Source, error) {
+	doc, err := s.sources().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreErr(err)
+	}
+	return sourceFromDoc(doc)
+}
+
+func (s *firestoreStore) FindSourceByKey(ctx context.Context, key string) (*Source, error) {
+	iter := s.sources().Where("key", "==", key).Limit(1).Documents(ctx)
+	defer iter.Stop()
+	doc, err := iter.Next()
+	if errors.Is(err, iterator.Done) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sourceFromDoc(doc)
+}
+
+func (s *firestoreStore) UpdateSource(ctx context.Context, source *Source) error {
+	_, err := s.sources().Doc(source.ID).Set(ctx, source)
+	return err
+}
+
+func (s *firestoreStore) ListSources(ctx context.Context) ([]*Source, error) {
+	docs, err := s.sources().OrderBy("last_refreshed", firestore.Desc).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]*Source, 0, len(docs))
+	for _, doc := range docs {
+		source, err := sourceFromDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+func (s *firestoreStore) AddSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	return s.addSnippet(ctx, s.snippets(), snippet)
+}
+
+// addSnippet adds a snippet to a collection, snippets or quarantined.
+func (s *firestoreStore) addSnippet(ctx context.Context, collection *firestore.CollectionRef, snippet *Snippet) (string, error) {
+	doc := firestoreSnippet{
+		Snippet: *snippet,
+		Source:  s.sources().Doc(snippet.SourceID),
+	}
+	if len(snippet.Embedding) > 0 {
+		doc.Embedding = firestore.Vector32(snippet.Embedding)
+	}
+	ref, _, err := collection.Add(ctx, doc)
+	if err != nil {
+		return "", err
+	}
+	snippet.ID = ref.ID
+	return ref.ID, nil
+}
+
+func (s *firestoreStore) GetSnippet(ctx context.Context, id string) (*Snippet, error) {
+	doc, err := s.snippets().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreErr(err)
+	}
+	return snippetFromDoc(doc)
+}
+
+func (s *firestoreStore) ListSnippets(ctx context.Context) ([]*Snippet, error) {
+	return s.querySnippets(ctx, s.snippets().OrderBy("created_at", firestore.Asc))
+}
+
+func (s *firestoreStore) ListSnippetsBySource(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return s.querySnippets(ctx, s.snippets().Where("source", "==", s.sources().Doc(sourceID)))
+}
+
+func (s *firestoreStore) querySnippets(ctx context.Context, q firestore.Query) ([]*Snippet, error) {
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	snippets := make([]*Snippet, 0, len(docs))
+	for _, doc := range docs {
+		snippet, err := snippetFromDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, nil
+}
+
+func (s *firestoreStore) vectorIndexed() bool {
+	return true
+}
+
+// NearestSnippets uses Firestore vector search, which needs a vector index on
+// the embedding field. Firestore allows a single array-contains filter, so
+// only the first label is filtered on by the query; any others are checked
+// on the results, of which extra are requested to compensate.
+func (s *firestoreStore) NearestSnippets(ctx context.Context, embedding []float32, filter SnippetFilter, limit int) ([]ScoredSnippet, error) {
+	q := s.snippets().Query
+	fetch := limit
+	if len(filter.Labels) > 0 {
+		q = q.Where("labels", "array-contains", filter.Labels[0])
+		if len(filter.Labels) > 1 {
+			fetch = limit * 4
+		}
+	}
+	if fetch > maxNearestLimit {
+		fetch = maxNearestLimit
+	}
+
+	docs, err := q.FindNearest("embedding", firestore.Vector32(embedding), fetch, firestore.DistanceMeasureCosine,
+		&firestore.FindNearestOptions{DistanceResultField: vectorDistanceField}).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var results []ScoredSnippet
+	for _, doc := range docs {
+		snippet, err := snippetFromDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.matches(snippet) {
+			continue
+		}
+		distance, _ := doc.Data()[vectorDistanceField].(float64)
+		results = append(results, ScoredSnippet{Snippet: snippet, Score: 1 - distance})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
+
+func (s *firestoreStore) SetSnippetProvenance(ctx context.Context, id string, provenance *Provenance) error {
+	_, err := s.snippets().Doc(id).Update(ctx, []firestore.Update{{Path: "provenance", Value: provenance}})
+	return firestoreErr(err)
+}
+
+func (s *firestoreStore) DeleteSnippet(ctx context.Context, id string) error {
+	ref := s.snippets().Doc(id)
+	if _, err := ref.Get(ctx); err != nil {
+		return firestoreErr(err)
+	}
+	if err := s.deleteVotes(ctx, ref); err != nil {
+		return fmt.Errorf("failed to delete votes: %v", err)
+	}
+	if err := s.deleteConflictChecks(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete conflict checks: %v", err)
+	}
+	_, err := ref.Delete(ctx)
+	return err
+}
+
+func (s *firestoreStore) DeleteSnippetsBySource(ctx context.Context, sourceID string) error {
+	iter := s.snippets().Where("source", "==", s.sources().Doc(sourceID)).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to iterate snippets: %v", err)
+		}
+		if err := s.deleteVotes(ctx, doc.Ref); err != nil {
+			log.Printf("Failed to delete votes for snippet %s: %v", doc.Ref.ID, err)
+		}
+		if err := s.deleteConflictChecks(ctx, doc.Ref.ID); err != nil {
+			log.Printf("Failed to delete conflict checks for snippet %s: %v", doc.Ref.ID, err)
+		}
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			log.Printf("Failed to delete snippet %s: %v", doc.Ref.ID, err)
+		}
+	}
+	log.Printf("Deleted all snippets for source %s", sourceID)
+	return nil
+}
+
+func (s *firestoreStore) QuarantineSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	return s.addSnippet(ctx, s.quarantined(), snippet)
+}
+
+func (s *firestoreStore) ListQuarantinedSnippets(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return s.querySnippets(ctx, s.quarantined().Where("source", "==", s.sources().Doc(sourceID)))
+}
+
+func (s *firestoreStore) DeleteQuarantinedSnippet(ctx context.Context, id string) error {
+	ref := s.quarantined().Doc(id)
+	if _, err := ref.Get(ctx); err != nil {
+		return firestoreErr(err)
+	}
+	_, err := ref.Delete(ctx)
+	return err
+}
+
+func (s *firestoreStore) deleteVotes(ctx context.Context, snippetRef *firestore.DocumentRef) error {
+	refs, err := snippetRef.Collection("votes").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if _, err := ref.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *firestoreStore) conflictChecks() *firestore.CollectionRef {
+	return s.client.Collection("conflict_checks")
+}
+
+// firestoreConflictCheck is the document shape of a conflict check. The
+// snippets field holds both IDs so that the checks of a snippet can be
+// found with a single array-contains query.
+type firestoreConflictCheck struct {
+	ConflictCheck
+	Snippets []string `firestore:"snippets"`
+}
+
+func (s *firestoreStore) SaveConflictCheck(ctx context.Context, check *ConflictCheck) error {
+	doc := firestoreConflictCheck{ConflictCheck: *check, Snippets: []string{check.SnippetA, check.SnippetB}}
+	_, err := s.conflictChecks().Doc(check.SnippetA+"_"+check.SnippetB).Set(ctx, doc)
+	return err
+}
+
+func (s *firestoreStore) ListConflictChecks(ctx context.Context) ([]*ConflictCheck, error) {
+	return s.queryConflictChecks(ctx, s.conflictChecks().Query)
+}
+
+func (s *firestoreStore) ListConflictChecksBySnippet(ctx context.Context, snippetID string) ([]*ConflictCheck, error) {
+	return s.queryConflictChecks(ctx, s.conflictChecks().Where("snippets", "array-contains", snippetID))
+}
+
+func (s *firestoreStore) queryConflictChecks(ctx context.Context, q firestore.Query) ([]*ConflictCheck, error) {
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]*ConflictCheck, 0, len(docs))
+	for _, doc := range docs {
+		var check ConflictCheck
+		if err := doc.DataTo(&check); err != nil {
+			return nil, err
+		}
+		checks = append(checks, &check)
+	}
+	return checks, nil
+}
+
+// deleteConflictChecks removes the checks of pairs including the snippet
+// with the given ID.
+func (s *firestoreStore) deleteConflictChecks(ctx context.Context, snippetID string) error {
+	docs, err := s.conflictChecks().Where("snippets", "array-contains", snippetID).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *firestoreStore) GetVote(ctx context.Context, snippetID, userID string) (string, error) {
+	doc, err := s.snippets().Doc(snippetID).Collection("votes").Doc(userID).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	vote, _ := doc.Data()["vote"].(string)
+	return vote, nil
+}
+
+func (s *firestoreStore) SetVote(ctx context.Context, snippetID, userID, vote string) error {
+	if !validVote(vote) {
+		return fmt.Errorf("invalid vote %q", vote)
+	}
+	snippetRef := s.snippets().Doc(snippetID)
+	voteRef := snippetRef.Collection("votes").Doc(userID)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(snippetRef); err != nil {
+			return firestoreErr(err)
+		}
+		var oldVote string
+		doc, err := tx.Get(voteRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			oldVote, _ = doc.Data()["vote"].(string)
+		}
+		if oldVote == vote {
+			return nil
+		}
+
+		var updates []firestore.Update
+		if oldVote != "" {
+			updates = append(updates, firestore.Update{Path: oldVote, Value: firestore.Increment(-1)})
+		}
+		if vote != "" {
+			updates = append(updates, firestore.Update{Path: vote, Value: firestore.Increment(1)})
+		}
+		if err := tx.Update(snippetRef, updates); err != nil {
+			return err
+		}
+		if vote == "" {
+			return tx.Delete(voteRef)
+		}
+		return tx.Set(voteRef, map[string]interface{}{"vote": vote})
+	})
+}
+
+func (s *firestoreStore) jobs() *firestore.CollectionRef {
+	return s.client.Collection("jobs")
+}
+
+func (s *firestoreStore) EnqueueJob(ctx context.Context, job *Job) (string, error) {
+	now := time.Now()
+	job.State = JobQueued
+	job.CreatedAt, job.UpdatedAt = now, now
+	ref, _, err := s.jobs().Add(ctx, job)
+	if err != nil {
+		return "", err
+	}
+	job.ID = ref.ID
+	return ref.ID, nil
+}
+
+func (s *firestoreStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	doc, err := s.jobs().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, firestoreErr(err)
+	}
+	return jobFromDoc(doc)
+}
+
+// ClaimJob runs in a transaction, so a job claimed concurrently by another
+// worker makes the transaction retry. The queries need composite indexes on
+// (state, created_at) and (state, lease_expires_at).
+func (s *firestoreStore) ClaimJob(ctx context.Context, owner string, lease time.Duration) (*Job, error) {
+	var claimed *Job
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now()
+		queries := []firestore.Query{
+			s.jobs().Where("state", "==", JobQueued).OrderBy("created_at", firestore.Asc).Limit(1),
+			s.jobs().Where("state", "==", JobRunning).Where("lease_expires_at", "<", now).OrderBy("lease_expires_at", firestore.Asc).Limit(1),
+		}
+		for _, q := range queries {
+			docs, err := tx.Documents(q).GetAll()
+			if err != nil {
+				return err
+			}
+			if len(docs) == 0 {
+				continue
+			}
+			job, err := jobFromDoc(docs[0])
+			if err != nil {
+				return err
+			}
+			job.claim(owner, lease, now)
+			claimed = job
+			return tx.Set(docs[0].Ref, job)
+		}
+		claimed = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claimed == nil {
+		return nil, ErrNotFound
+	}
+	return claimed, nil
+}
+
+func (s *firestoreStore) RenewJobLease(ctx context.Context, id, owner string, lease time.Duration) error {
+	return s.updateHeldJob(ctx, id, owner, func(job *Job) {
+		job.LeaseExpiresAt = time.Now().Add(lease)
+	})
+}
+
+func (s *firestoreStore) FinishJob(ctx context.Context, id, owner, state, errMsg string) error {
+	return s.updateHeldJob(ctx, id, owner, func(job *Job) {
+		job.State = state
+		job.Error = errMsg
+		job.LeaseOwner = ""
+	})
+}
+
+func (s *firestoreStore) UpdateJobProgress(ctx context.Context, id, owner string, progress JobProgress) error {
+	return s.updateHeldJob(ctx, id, owner, func(job *Job) {
+		job.JobProgress = progress
+	})
+}
+
+// LatestJob needs a composite index on (source_id, created_at desc).
+func (s *firestoreStore) LatestJob(ctx context.Context, sourceID string) (*Job, error) {
+	iter := s.jobs().Where("source_id", "==", sourceID).OrderBy("created_at", firestore.Desc).Limit(1).Documents(ctx)
+	defer iter.Stop()
+	doc, err := iter.Next()
+	if errors.Is(err, iterator.Done) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jobFromDoc(doc)
+}
+
+// updateHeldJob applies update to a running job owner holds the lease on.
+func (s *firestoreStore) updateHeldJob(ctx context.Context, id, owner string, update func(job *Job)) error {
+	ref := s.jobs().Doc(id)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrLeaseLost
+		}
+		if err != nil {
+			return err
+		}
+		job, err := jobFromDoc(doc)
+		if err != nil {
+			return err
+		}
+		if job.State != JobRunning || job.LeaseOwner != owner {
+			return ErrLeaseLost
+		}
+		update(job)
+		job.UpdatedAt = time.Now()
+		return tx.Set(ref, job)
+	})
+}
+
+func jobFromDoc(doc *firestore.DocumentSnapshot) (*Job, error) {
+	var job Job
+	if err := doc.DataTo(&job); err != nil {
+		return nil, err
+	}
+	job.ID = doc.Ref.ID
+	return &job, nil
+}
+
+func sourceFromDoc(doc *firestore.DocumentSnapshot) (*Source, error) {
+	var source Source
+	if err := doc.DataTo(&source); err != nil {
+		return nil, err
+	}
+	source.ID = doc.Ref.ID
+	return &source, nil
+}
+
+func snippetFromDoc(doc *firestore.DocumentSnapshot) (*Snippet, error) {
+	var fs firestoreSnippet
+	if err := doc.DataTo(&fs); err != nil {
+		return nil, err
+	}
+	snippet := fs.Snippet
+	snippet.ID = doc.Ref.ID
+	if fs.Source != nil {
+		snippet.SourceID = fs.Source.ID
+	}
+	switch v := fs.Embedding.(type) {
+	case firestore.Vector64:
+		snippet.Embedding = make([]float32, len(v))
+		for i, f := range v {
+			snippet.Embedding[i] = float32(f)
+		}
+	case []interface{}:
+		snippet.Embedding = make([]float32, 0, len(v))
+		for _, f := range v {
+			if f, ok := f.(float64); ok {
+				snippet.Embedding = append(snippet.Embedding, float32(f))
+			}
+		}
+	}
+	return &snippet, nil
+}
+
+// firestoreErr maps Firestore's NotFound status onto ErrNotFound.
+func firestoreErr(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
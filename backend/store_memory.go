@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a SnippetStore that keeps everything in process memory.
+// It is meant for tests and for running the service offline.
+type memoryStore struct {
+	mu       sync.Mutex
+	sources  map[string]*Source
+	snippets map[string]*Snippet
+	// quarantined holds quarantined snippets, apart from the others.
+	quarantined map[string]*Snippet
+	votes       map[string]map[string]string // snippet ID -> user ID -> vote
+	checks      map[[2]string]*ConflictCheck // snippet IDs of the pair -> verdict
+	jobs        map[string]*Job
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		sources:     make(map[string]*Source),
+		snippets:    make(map[string]*Snippet),
+		quarantined: make(map[string]*Snippet),
+		votes:       make(map[string]map[string]string),
+		checks:      make(map[[2]string]*ConflictCheck),
+		jobs:        make(map[string]*Job),
+	}
+}
+
+func (s *memoryStore) CreateSource(ctx context.Context, source *Source) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	source.ID = newID()
+	stored := *source
+	s.sources[source.ID] = &stored
+	return source.ID, nil
+}
+
+func (s *memoryStore) GetSource(ctx context.Context, id string) (*Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	source, ok := s.sources[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *source
+	return &out, nil
+}
+
+func (s *memoryStore) FindSourceByKey(ctx context.Context, key string) (*Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, source := range s.sources {
+		if source.Key == key {
+			out := *source
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) UpdateSource(ctx context.Context, source *Source) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sources[source.ID]; !ok {
+		return ErrNotFound
+	}
+	stored := *source
+	s.sources[source.ID] = &stored
+	return nil
+}
+
+func (s *memoryStore) ListSources(ctx context.Context) ([]*Source, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sources := make([]*Source, 0, len(s.sources))
+	for _, source := range s.sources {
+		out := *source
+		sources = append(sources, &out)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].LastRefreshed.After(sources[j].LastRefreshed)
+	})
+	return sources, nil
+}
+
+func (s *memoryStore) AddSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet.ID = newID()
+	s.snippets[snippet.ID] = copySnippet(snippet)
+	return snippet.ID, nil
+}
+
+func (s *memoryStore) GetSnippet(ctx context.Context, id string) (*Snippet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet, ok := s.snippets[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copySnippet(snippet), nil
+}
+
+func (s *memoryStore) ListSnippets(ctx context.Context) ([]*Snippet, error) {
+	return s.listSnippets(func(*Snippet) bool { return true }), nil
+}
+
+func (s *memoryStore) ListSnippetsBySource(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return s.listSnippets(func(snippet *Snippet) bool { return snippet.SourceID == sourceID }), nil
+}
+
+func (s *memoryStore) listSnippets(match func(*Snippet) bool) []*Snippet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedSnippets(s.snippets, match)
+}
+
+// sortedSnippets copies the snippets of a map that match, oldest first. The
+// caller must hold the store's lock.
+func sortedSnippets(from map[string]*Snippet, match func(*Snippet) bool) []*Snippet {
+	var snippets []*Snippet
+	for _, snippet := range from {
+		if match(snippet) {
+			snippets = append(snippets, copySnippet(snippet))
+		}
+	}
+	sort.Slice(snippets, func(i, j int) bool {
+		if snippets[i].CreatedAt.Equal(snippets[j].CreatedAt) {
+			return snippets[i].ID < snippets[j].ID
+		}
+		return snippets[i].CreatedAt.Before(snippets[j].CreatedAt)
+	})
+	return snippets
+}
+
+func (s *memoryStore) NearestSnippets(ctx context.Context, embedding []float32, filter SnippetFilter, limit int) ([]ScoredSnippet, error) {
+	snippets, _ := s.ListSnippets(ctx)
+	return rankByEmbedding(snippets, embedding, filter, limit), nil
+}
+
+func (s *memoryStore) SetSnippetProvenance(ctx context.Context, id string, provenance *Provenance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet, ok := s.snippets[id]
+	if !ok {
+		return ErrNotFound
+	}
+	snippet.Provenance = copyProvenance(provenance)
+	return nil
+}
+
+func (s *memoryStore) DeleteSnippet(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.snippets[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.snippets, id)
+	delete(s.votes, id)
+	s.deleteConflictChecks(id)
+	return nil
+}
+
+func (s *memoryStore) DeleteSnippetsBySource(ctx context.Context, sourceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, snippet := range s.snippets {
+		if snippet.SourceID == sourceID {
+			delete(s.snippets, id)
+			delete(s.votes, id)
+			s.deleteConflictChecks(id)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) QuarantineSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet.ID = newID()
+	s.quarantined[snippet.ID] = copySnippet(snippet)
+	return snippet.ID, nil
+}
+
+func (s *memoryStore) ListQuarantinedSnippets(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedSnippets(s.quarantined, func(snippet *Snippet) bool { return snippet.SourceID == sourceID }), nil
+}
+
+func (s *memoryStore) DeleteQuarantinedSnippet(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.quarantined[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.quarantined, id)
+	return nil
+}
+
+// deleteConflictChecks removes the checks of pairs including the snippet
+// with the given ID. The caller must hold s.mu.
+func (s *memoryStore) deleteConflictChecks(id string) {
+	for pair := range s.checks {
+		if pair[0] == id || pair[1] == id {
+			delete(s.checks, pair)
+		}
+	}
+}
+
+func (s *memoryStore) SaveConflictCheck(ctx context.Context, check *ConflictCheck) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := *check
+	s.checks[[2]string{check.SnippetA, check.SnippetB}] = &stored
+	return nil
+}
+
+func (s *memoryStore) ListConflictChecks(ctx context.Context) ([]*ConflictCheck, error) {
+	return s.listConflictChecks(""), nil
+}
+
+func (s *memoryStore) ListConflictChecksBySnippet(ctx context.Context, snippetID string) ([]*ConflictCheck, error) {
+	return s.listConflictChecks(snippetID), nil
+}
+
+// listConflictChecks returns copies of the checks of pairs including the
+// snippet with the given ID, or of all pairs if it is empty, in a stable
+// order.
+func (s *memoryStore) listConflictChecks(snippetID string) []*ConflictCheck {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*ConflictCheck
+	for pair, check := range s.checks {
+		if snippetID == "" || pair[0] == snippetID || pair[1] == snippetID {
+			c := *check
+			out = append(out, &c)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].SnippetA != out[j].SnippetA {
+			return out[i].SnippetA < out[j].SnippetA
+		}
+		return out[i].SnippetB < out[j].SnippetB
+	})
+	return out
+}
+
+func (s *memoryStore) GetVote(ctx context.Context, snippetID, userID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.votes[snippetID][userID], nil
+}
+
+func (s *memoryStore) SetVote(ctx context.Context, snippetID, userID, vote string) error {
+	if !validVote(vote) {
+		return fmt.Errorf("invalid vote %q", vote)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet, ok := s.snippets[snippetID]
+	if !ok {
+		return ErrNotFound
+	}
+	votes := s.votes[snippetID]
+	if votes == nil {
+		votes = make(map[string]string)
+		s.votes[snippetID] = votes
+	}
+	applyVote(snippet, votes[userID], vote)
+	if vote == "" {
+		delete(votes, userID)
+	} else {
+		votes[userID] = vote
+	}
+	return nil
+}
+
+func (s *memoryStore) EnqueueJob(ctx context.Context, job *Job) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	job.ID = newID()
+	job.State = JobQueued
+	job.CreatedAt, job.UpdatedAt = now, now
+	stored := *job
+	s.jobs[job.ID] = &stored
+	return job.ID, nil
+}
+
+func (s *memoryStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := *job
+	return &out, nil
+}
+
+func (s *memoryStore) ClaimJob(ctx context.Context, owner string, lease time.Duration) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var oldest *Job
+	for _, job := range s.jobs {
+		if job.claimable(now) && (oldest == nil || job.CreatedAt.Before(oldest.CreatedAt)) {
+			oldest = job
+		}
+	}
+	if oldest == nil {
+		return nil, ErrNotFound
+	}
+	oldest.claim(owner, lease, now)
+	out := *oldest
+	return &out, nil
+}
+
+func (s *memoryStore) RenewJobLease(ctx context.Context, id, owner string, lease time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State != JobRunning || job.LeaseOwner != owner {
+		return ErrLeaseLost
+	}
+	job.LeaseExpiresAt = time.Now().Add(lease)
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *memoryStore) FinishJob(ctx context.Context, id, owner, state, errMsg string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State != JobRunning || job.LeaseOwner != owner {
+		return ErrLeaseLost
+	}
+	job.State = state
+	job.Error = errMsg
+	job.LeaseOwner = ""
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *memoryStore) UpdateJobProgress(ctx context.Context, id, owner string, progress JobProgress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok || job.State != JobRunning || job.LeaseOwner != owner {
+		return ErrLeaseLost
+	}
+	job.JobProgress = progress
+	job.UpdatedAt = time.Now()
+	return nil
+}
+
+func (s *memoryStore) LatestJob(ctx context.Context, sourceID string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var latest *Job
+	for _, job := range s.jobs {
+		if job.SourceID == sourceID && (latest == nil || job.CreatedAt.After(latest.CreatedAt)) {
+			latest = job
+		}
+	}
+	if latest == nil {
+		return nil, ErrNotFound
+	}
+	out := *latest
+	return &out, nil
+}
+
+// copySnippet returns a copy of snippet that shares no slices with it.
+func copySnippet(snippet *Snippet) *Snippet {
+	out := *snippet
+	out.Labels = append([]string(nil), snippet.Labels...)
+	out.Embedding = append([]float32(nil), snippet.Embedding...)
+	out.Provenance = copyProvenance(snippet.Provenance)
+	out.Flags = append([]string(nil), snippet.Flags...)
+	out.Quarantine = append([]QuarantineReason(nil), snippet.Quarantine...)
+	if snippet.Scope != nil {
+		scope := *snippet.Scope
+		scope.Globs = append([]string(nil), snippet.Scope.Globs...)
+		out.Scope = &scope
+	}
+	if snippet.Safety != nil {
+		out.Safety = make(map[string]float64, len(snippet.Safety))
+		for category, score := range snippet.Safety {
+			out.Safety[category] = score
+		}
+	}
+	if snippet.Fidelity != nil {
+		fidelity := *snippet.Fidelity
+		out.Fidelity = &fidelity
+	}
+	return &out
+}
+
+func copyProvenance(provenance *Provenance) *Provenance {
+	if provenance == nil {
+		return nil
+	}
+	out := *provenance
+	out.HeadingPath = append([]string(nil), provenance.HeadingPath...)
+	return &out
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"strconv"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// maxIndexedDimensions is the largest embedding pgvector can index with
+// HNSW when stored as halfvec.
+const maxIndexedDimensions = 4000
+
+// postgresDialect stores embeddings in a pgvector column, sent and read in
+// the vector text format "[1,2,3]".
+var postgresDialect = sqlDialect{
+	rebind: func(query string) string {
+		var b strings.Builder
+		n := 0
+		for _, r := range query {
+			if r == '?' {
+				n++
+				b.WriteString("$" + strconv.Itoa(n))
+				continue
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	},
+	encodeEmbedding: func(embedding []float32) interface{} {
+		if len(embedding) == 0 {
+			return nil
+		}
+		return formatVector(embedding)
+	},
+	decodeEmbedding: parseVector,
+	// The query repeats the expression and predicate of the partial HNSW
+	// index so the planner can use it. The embedding, the first parameter,
+	// is referenced again as $1 in the ORDER BY, and the safety categories,
+	// the fourth, as $4.
+	nearestQuery: func(dimensions int) string {
+		return fmt.Sprintf(`SELECT %[1]s, 1 - (embedding::halfvec(%[2]d) <=> CAST(? AS halfvec(%[2]d))) AS score
+			FROM snippets
+			WHERE vector_dims(embedding) = %[2]d AND labels @> CAST(? AS jsonb)
+				AND NOT EXISTS (SELECT 1 FROM jsonb_each_text(safety) AS rating
+					WHERE rating.value::float8 > CAST(? AS float8)
+						AND (jsonb_array_length(CAST(? AS jsonb)) = 0 OR CAST($4 AS jsonb) @> jsonb_build_array(rating.key)))
+			ORDER BY embedding::halfvec(%[2]d) <=> CAST($1 AS halfvec(%[2]d))
+			LIMIT ?`, sqlSnippetColumns, dimensions)
+	},
+}
+
+// newPostgresStore connects to the Postgres database at url, brings its
+// schema up to date and makes sure there is an HNSW index for embeddings of
+// the given number of dimensions.
+func newPostgresStore(ctx context.Context, url string, dimensions int) (*sqlStore, error) {
+	if dimensions <= 0 || dimensions > maxIndexedDimensions {
+		return nil, fmt.Errorf("embedding dimensions must be between 1 and %d, got %d", maxIndexedDimensions, dimensions)
+	}
+	db, err := sql.Open("pgx", url)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(ctx, db, postgresMigrations, "migrations/postgres"); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// The index covers only embeddings of the configured size, cast to
+	// halfvec so that models with up to 4000 dimensions can be indexed.
+	// dimensions is a validated integer, so formatting it in is safe.
+	index := fmt.Sprintf(`CREATE INDEX IF NOT EXISTS snippets_embedding_hnsw_%[1]d ON snippets
+		USING hnsw ((embedding::halfvec(%[1]d)) halfvec_cosine_ops)
+		WHERE vector_dims(embedding) = %[1]d`, dimensions)
+	if _, err := db.ExecContext(ctx, index); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create embedding index: %v", err)
+	}
+	return &sqlStore{db: db, dialect: postgresDialect}, nil
+}
+
+// formatVector renders an embedding in pgvector's text format.
+func formatVector(embedding []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range embedding {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+// parseVector is the inverse of formatVector. An empty input is a NULL
+// embedding.
+func parseVector(raw []byte) ([]float32, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	text := string(raw)
+	if !strings.HasPrefix(text, "[") || !strings.HasSuffix(text, "]") {
+		return nil, fmt.Errorf("malformed vector %q", text)
+	}
+	text = text[1 : len(text)-1]
+	if text == "" {
+		return nil, nil
+	}
+	fields := strings.Split(text, ",")
+	embedding := make([]float32, len(fields))
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 32)
+		if err != nil {
+			return nil, fmt.Errorf("malformed vector element %q: %v", f, err)
+		}
+		embedding[i] = float32(v)
+	}
+	return embedding, nil
+}
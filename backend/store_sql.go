@@ -0,0 +1,661 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// sqlDialect captures what differs between the SQL databases sqlStore runs
+// on. Queries are written with ? placeholders and rebound per dialect.
+type sqlDialect struct {
+	rebind          func(query string) string
+	encodeEmbedding func(embedding []float32) interface{}
+	decodeEmbedding func(raw []byte) ([]float32, error)
+
+	// nearestQuery, if set, returns a query ranking snippets against an
+	// embedding of the given size. It selects sqlSnippetColumns plus a
+	// similarity score and takes the query embedding, a JSON array of
+	// required labels, the highest safety score allowed, a JSON array of the
+	// safety categories it applies to and a limit as parameters. Without
+	// it, NearestSnippets scans every snippet.
+	nearestQuery func(dimensions int) string
+}
+
+// sqlStore is a SnippetStore on top of database/sql. Labels are stored as
+// JSON; how embeddings are stored is up to the dialect.
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return s.db.ExecContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return s.db.QueryContext(ctx, s.dialect.rebind(query), args...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return s.db.QueryRowContext(ctx, s.dialect.rebind(query), args...)
+}
+
+const sqlSourceColumns = "id, key, content, url, type, status, submitter_id, submitter_email, last_refreshed, failed_snippets, content_hash, etag, last_modified, quarantine, redactions, imports"
+
+func scanSource(row interface{ Scan(...interface{}) error }) (*Source, error) {
+	var source Source
+	var failed, quarantine, redactions, imports string
+	err := row.Scan(&source.ID, &source.Key, &source.Content, &source.URL, &source.Type, &source.Status,
+		&source.SubmitterID, &source.SubmitterEmail, &source.LastRefreshed, &failed, &source.ContentHash, &source.ETag, &source.LastModified,
+		&quarantine, &redactions, &imports)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(failed), &source.FailedSnippets); err != nil {
+		return nil, fmt.Errorf("invalid failed snippets on source %s: %v", source.ID, err)
+	}
+	if source.Quarantine, err = decodeQuarantine(quarantine); err != nil {
+		return nil, fmt.Errorf("invalid quarantine reasons on source %s: %v", source.ID, err)
+	}
+	if err := json.Unmarshal([]byte(redactions), &source.Redactions); err != nil {
+		return nil, fmt.Errorf("invalid redactions on source %s: %v", source.ID, err)
+	}
+	if len(source.Redactions) == 0 {
+		source.Redactions = nil
+	}
+	if err := json.Unmarshal([]byte(imports), &source.Imports); err != nil {
+		return nil, fmt.Errorf("invalid imports on source %s: %v", source.ID, err)
+	}
+	if len(source.Imports) == 0 {
+		source.Imports = nil
+	}
+	return &source, nil
+}
+
+// nonNilRedactions returns redactions, or an empty slice if it is nil, so
+// that it encodes as a JSON array.
+func nonNilRedactions(redactions []Redaction) []Redaction {
+	if redactions == nil {
+		return []Redaction{}
+	}
+	return redactions
+}
+
+// encodeQuarantine renders quarantine reasons as JSON.
+func encodeQuarantine(reasons []QuarantineReason) (string, error) {
+	if reasons == nil {
+		reasons = []QuarantineReason{}
+	}
+	b, err := json.Marshal(reasons)
+	return string(b), err
+}
+
+// decodeQuarantine is the inverse of encodeQuarantine. No reasons decode
+// as nil.
+func decodeQuarantine(encoded string) ([]QuarantineReason, error) {
+	var reasons []QuarantineReason
+	if err := json.Unmarshal([]byte(encoded), &reasons); err != nil || len(reasons) == 0 {
+		return nil, err
+	}
+	return reasons, nil
+}
+
+// encodeFailedSnippets renders a source's failed snippets as JSON.
+func encodeFailedSnippets(failed []FailedSnippet) (string, error) {
+	if failed == nil {
+		failed = []FailedSnippet{}
+	}
+	b, err := json.Marshal(failed)
+	return string(b), err
+}
+
+func (s *sqlStore) CreateSource(ctx context.Context, source *Source) (string, error) {
+	failed, err := encodeFailedSnippets(source.FailedSnippets)
+	if err != nil {
+		return "", err
+	}
+	quarantine, err := encodeQuarantine(source.Quarantine)
+	if err != nil {
+		return "", err
+	}
+	redactions, err := json.Marshal(nonNilRedactions(source.Redactions))
+	if err != nil {
+		return "", err
+	}
+	imports, err := json.Marshal(nonNilStrings(source.Imports))
+	if err != nil {
+		return "", err
+	}
+	id := newID()
+	_, err = s.exec(ctx, `INSERT INTO sources (`+sqlSourceColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, source.Key, source.Content, source.URL, source.Type, source.Status,
+		source.SubmitterID, source.SubmitterEmail, source.LastRefreshed.UTC(), failed, source.ContentHash, source.ETag, source.LastModified,
+		quarantine, string(redactions), string(imports))
+	if err != nil {
+		return "", err
+	}
+	source.ID = id
+	return id, nil
+}
+
+func (s *sqlStore) GetSource(ctx context.Context, id string) (*Source, error) {
+	return scanSource(s.queryRow(ctx, "SELECT "+sqlSourceColumns+" FROM sources WHERE id = ?", id))
+}
+
+func (s *sqlStore) FindSourceByKey(ctx context.Context, key string) (*Source, error) {
+	return scanSource(s.queryRow(ctx, "SELECT "+sqlSourceColumns+" FROM sources WHERE key = ?", key))
+}
+
+func (s *sqlStore) UpdateSource(ctx context.Context, source *Source) error {
+	failed, err := encodeFailedSnippets(source.FailedSnippets)
+	if err != nil {
+		return err
+	}
+	quarantine, err := encodeQuarantine(source.Quarantine)
+	if err != nil {
+		return err
+	}
+	redactions, err := json.Marshal(nonNilRedactions(source.Redactions))
+	if err != nil {
+		return err
+	}
+	imports, err := json.Marshal(nonNilStrings(source.Imports))
+	if err != nil {
+		return err
+	}
+	res, err := s.exec(ctx, `UPDATE sources SET key = ?, content = ?, url = ?, type = ?, status = ?,
+		submitter_id = ?, submitter_email = ?, last_refreshed = ?, failed_snippets = ?, content_hash = ?,
+		etag = ?, last_modified = ?, quarantine = ?, redactions = ?, imports = ? WHERE id = ?`,
+		source.Key, source.Content, source.URL, source.Type, source.Status,
+		source.SubmitterID, source.SubmitterEmail, source.LastRefreshed.UTC(), failed, source.ContentHash, source.ETag, source.LastModified,
+		quarantine, string(redactions), string(imports), source.ID)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+func (s *sqlStore) ListSources(ctx context.Context) ([]*Source, error) {
+	rows, err := s.query(ctx, "SELECT "+sqlSourceColumns+" FROM sources ORDER BY last_refreshed DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sources []*Source
+	for rows.Next() {
+		source, err := scanSource(rows)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	return sources, rows.Err()
+}
+
+const sqlSnippetColumns = "id, source_id, title, content, labels, thumbs_up, thumbs_down, created_at, content_hash, provenance, fidelity, flags, safety, quarantine, scope, embedding"
+
+func (s *sqlStore) scanSnippet(row interface{ Scan(...interface{}) error }) (*Snippet, error) {
+	var snippet Snippet
+	var labels, provenance, flags, safety, quarantine, scope string
+	var fidelity sql.NullFloat64
+	var embedding []byte
+	err := row.Scan(&snippet.ID, &snippet.SourceID, &snippet.Title, &snippet.Content, &labels,
+		&snippet.ThumbsUp, &snippet.ThumbsDown, &snippet.CreatedAt, &snippet.ContentHash, &provenance,
+		&fidelity, &flags, &safety, &quarantine, &scope, &embedding)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(labels), &snippet.Labels); err != nil {
+		return nil, fmt.Errorf("invalid labels on snippet %s: %v", snippet.ID, err)
+	}
+	if err := json.Unmarshal([]byte(provenance), &snippet.Provenance); err != nil {
+		return nil, fmt.Errorf("invalid provenance on snippet %s: %v", snippet.ID, err)
+	}
+	if fidelity.Valid {
+		snippet.Fidelity = &fidelity.Float64
+	}
+	if err := json.Unmarshal([]byte(flags), &snippet.Flags); err != nil {
+		return nil, fmt.Errorf("invalid flags on snippet %s: %v", snippet.ID, err)
+	}
+	if len(snippet.Flags) == 0 {
+		snippet.Flags = nil
+	}
+	if err := json.Unmarshal([]byte(safety), &snippet.Safety); err != nil {
+		return nil, fmt.Errorf("invalid safety scores on snippet %s: %v", snippet.ID, err)
+	}
+	if len(snippet.Safety) == 0 {
+		snippet.Safety = nil
+	}
+	if snippet.Quarantine, err = decodeQuarantine(quarantine); err != nil {
+		return nil, fmt.Errorf("invalid quarantine reasons on snippet %s: %v", snippet.ID, err)
+	}
+	if err := json.Unmarshal([]byte(scope), &snippet.Scope); err != nil {
+		return nil, fmt.Errorf("invalid scope on snippet %s: %v", snippet.ID, err)
+	}
+	if snippet.Embedding, err = s.dialect.decodeEmbedding(embedding); err != nil {
+		return nil, fmt.Errorf("invalid embedding on snippet %s: %v", snippet.ID, err)
+	}
+	return &snippet, nil
+}
+
+func (s *sqlStore) AddSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	return s.insertSnippet(ctx, "snippets", snippet)
+}
+
+// insertSnippet adds a snippet to table, snippets or quarantined_snippets,
+// which have the same columns.
+func (s *sqlStore) insertSnippet(ctx context.Context, table string, snippet *Snippet) (string, error) {
+	labels, err := json.Marshal(nonNilStrings(snippet.Labels))
+	if err != nil {
+		return "", err
+	}
+	provenance, err := json.Marshal(snippet.Provenance)
+	if err != nil {
+		return "", err
+	}
+	flags, err := json.Marshal(nonNilStrings(snippet.Flags))
+	if err != nil {
+		return "", err
+	}
+	// Unrated snippets store an empty object, which the nearest query's
+	// safety filter can read.
+	safety := snippet.Safety
+	if safety == nil {
+		safety = map[string]float64{}
+	}
+	encodedSafety, err := json.Marshal(safety)
+	if err != nil {
+		return "", err
+	}
+	quarantine, err := encodeQuarantine(snippet.Quarantine)
+	if err != nil {
+		return "", err
+	}
+	scope, err := json.Marshal(snippet.Scope)
+	if err != nil {
+		return "", err
+	}
+	id := newID()
+	_, err = s.exec(ctx, `INSERT INTO `+table+` (`+sqlSnippetColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, snippet.SourceID, snippet.Title, snippet.Content, string(labels),
+		snippet.ThumbsUp, snippet.ThumbsDown, snippet.CreatedAt.UTC(), snippet.ContentHash, string(provenance),
+		snippet.Fidelity, string(flags), string(encodedSafety), quarantine, string(scope), s.dialect.encodeEmbedding(snippet.Embedding))
+	if err != nil {
+		return "", err
+	}
+	snippet.ID = id
+	return id, nil
+}
+
+func (s *sqlStore) SetSnippetProvenance(ctx context.Context, id string, provenance *Provenance) error {
+	encoded, err := json.Marshal(provenance)
+	if err != nil {
+		return err
+	}
+	res, err := s.exec(ctx, "UPDATE snippets SET provenance = ? WHERE id = ?", string(encoded), id)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+func (s *sqlStore) GetSnippet(ctx context.Context, id string) (*Snippet, error) {
+	return s.scanSnippet(s.queryRow(ctx, "SELECT "+sqlSnippetColumns+" FROM snippets WHERE id = ?", id))
+}
+
+func (s *sqlStore) ListSnippets(ctx context.Context) ([]*Snippet, error) {
+	return s.querySnippets(ctx, "SELECT "+sqlSnippetColumns+" FROM snippets ORDER BY created_at, id")
+}
+
+func (s *sqlStore) ListSnippetsBySource(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return s.querySnippets(ctx, "SELECT "+sqlSnippetColumns+" FROM snippets WHERE source_id = ? ORDER BY created_at, id", sourceID)
+}
+
+func (s *sqlStore) querySnippets(ctx context.Context, query string, args ...interface{}) ([]*Snippet, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var snippets []*Snippet
+	for rows.Next() {
+		snippet, err := s.scanSnippet(rows)
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, rows.Err()
+}
+
+// vectorIndexed reports whether the dialect searches embeddings with an
+// index, as Postgres does; SQLite compares them all.
+func (s *sqlStore) vectorIndexed() bool {
+	return s.dialect.nearestQuery != nil
+}
+
+func (s *sqlStore) NearestSnippets(ctx context.Context, embedding []float32, filter SnippetFilter, limit int) ([]ScoredSnippet, error) {
+	if s.dialect.nearestQuery == nil {
+		snippets, err := s.ListSnippets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return rankByEmbedding(snippets, embedding, filter, limit), nil
+	}
+
+	labels, err := json.Marshal(nonNilStrings(filter.Labels))
+	if err != nil {
+		return nil, err
+	}
+	// Scores never exceed 1, so a limit of 1 filters nothing.
+	maxSafety := 1.0
+	if filter.MaxSafety != nil {
+		maxSafety = *filter.MaxSafety
+	}
+	categories, err := json.Marshal(nonNilStrings(filter.SafetyCategories))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.query(ctx, s.dialect.nearestQuery(len(embedding)),
+		s.dialect.encodeEmbedding(embedding), string(labels), maxSafety, string(categories), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []ScoredSnippet
+	for rows.Next() {
+		var result ScoredSnippet
+		result.Snippet, err = s.scanSnippet(scoreScanner{rows, &result.Score})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// scoreScanner scans a snippet row followed by a score column.
+type scoreScanner struct {
+	rows  *sql.Rows
+	score *float64
+}
+
+func (s scoreScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.score)...)
+}
+
+func (s *sqlStore) DeleteSnippet(ctx context.Context, id string) error {
+	res, err := s.exec(ctx, "DELETE FROM snippets WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+// DeleteSnippetsBySource removes a source's snippets; their votes and
+// conflict checks go with them through ON DELETE CASCADE foreign keys.
+func (s *sqlStore) DeleteSnippetsBySource(ctx context.Context, sourceID string) error {
+	_, err := s.exec(ctx, "DELETE FROM snippets WHERE source_id = ?", sourceID)
+	return err
+}
+
+func (s *sqlStore) QuarantineSnippet(ctx context.Context, snippet *Snippet) (string, error) {
+	return s.insertSnippet(ctx, "quarantined_snippets", snippet)
+}
+
+func (s *sqlStore) ListQuarantinedSnippets(ctx context.Context, sourceID string) ([]*Snippet, error) {
+	return s.querySnippets(ctx, "SELECT "+sqlSnippetColumns+" FROM quarantined_snippets WHERE source_id = ? ORDER BY created_at, id", sourceID)
+}
+
+func (s *sqlStore) DeleteQuarantinedSnippet(ctx context.Context, id string) error {
+	res, err := s.exec(ctx, "DELETE FROM quarantined_snippets WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	return requireRow(res)
+}
+
+func (s *sqlStore) GetVote(ctx context.Context, snippetID, userID string) (string, error) {
+	var vote string
+	err := s.queryRow(ctx, "SELECT vote FROM votes WHERE snippet_id = ? AND user_id = ?", snippetID, userID).Scan(&vote)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return vote, err
+}
+
+func (s *sqlStore) SetVote(ctx context.Context, snippetID, userID, vote string) error {
+	if !validVote(vote) {
+		return fmt.Errorf("invalid vote %q", vote)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRowContext(ctx, s.dialect.rebind("SELECT 1 FROM snippets WHERE id = ?"), snippetID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var oldVote string
+	err = tx.QueryRowContext(ctx, s.dialect.rebind("SELECT vote FROM votes WHERE snippet_id = ? AND user_id = ?"), snippetID, userID).Scan(&oldVote)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if oldVote == vote {
+		return nil
+	}
+
+	// Apply the change as increments so concurrent votes by other users
+	// are not lost.
+	var delta Snippet
+	applyVote(&delta, oldVote, vote)
+	if _, err := tx.ExecContext(ctx, s.dialect.rebind("UPDATE snippets SET thumbs_up = thumbs_up + ?, thumbs_down = thumbs_down + ? WHERE id = ?"),
+		delta.ThumbsUp, delta.ThumbsDown, snippetID); err != nil {
+		return err
+	}
+	if vote == "" {
+		_, err = tx.ExecContext(ctx, s.dialect.rebind("DELETE FROM votes WHERE snippet_id = ? AND user_id = ?"), snippetID, userID)
+	} else {
+		_, err = tx.ExecContext(ctx, s.dialect.rebind(`INSERT INTO votes (snippet_id, user_id, vote) VALUES (?, ?, ?)
+			ON CONFLICT (snippet_id, user_id) DO UPDATE SET vote = excluded.vote`), snippetID, userID, vote)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const sqlConflictColumns = "snippet_a, snippet_b, similarity, conflict, explanation, checked_at"
+
+// SaveConflictCheck upserts the check. Checks are deleted along with either
+// snippet through ON DELETE CASCADE foreign keys.
+func (s *sqlStore) SaveConflictCheck(ctx context.Context, check *ConflictCheck) error {
+	_, err := s.exec(ctx, `INSERT INTO conflict_checks (`+sqlConflictColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (snippet_a, snippet_b) DO UPDATE SET similarity = excluded.similarity, conflict = excluded.conflict,
+		explanation = excluded.explanation, checked_at = excluded.checked_at`,
+		check.SnippetA, check.SnippetB, check.Similarity, check.Conflict, check.Explanation, check.CheckedAt.UTC())
+	return err
+}
+
+func (s *sqlStore) ListConflictChecks(ctx context.Context) ([]*ConflictCheck, error) {
+	return s.queryConflictChecks(ctx, "SELECT "+sqlConflictColumns+" FROM conflict_checks ORDER BY snippet_a, snippet_b")
+}
+
+func (s *sqlStore) ListConflictChecksBySnippet(ctx context.Context, snippetID string) ([]*ConflictCheck, error) {
+	return s.queryConflictChecks(ctx, "SELECT "+sqlConflictColumns+" FROM conflict_checks WHERE snippet_a = ? OR snippet_b = ? ORDER BY snippet_a, snippet_b",
+		snippetID, snippetID)
+}
+
+func (s *sqlStore) queryConflictChecks(ctx context.Context, query string, args ...interface{}) ([]*ConflictCheck, error) {
+	rows, err := s.query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var checks []*ConflictCheck
+	for rows.Next() {
+		var check ConflictCheck
+		if err := rows.Scan(&check.SnippetA, &check.SnippetB, &check.Similarity, &check.Conflict, &check.Explanation, &check.CheckedAt); err != nil {
+			return nil, err
+		}
+		checks = append(checks, &check)
+	}
+	return checks, rows.Err()
+}
+
+// requireRow returns ErrNotFound if res affected no rows.
+func requireRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+const sqlJobColumns = `id, kind, source_id, snippet_limit, threshold, fetch, state, attempts, lease_owner,
+	lease_expires_at, error, created_at, updated_at, phase, current_snippet, total_snippets, stored_snippets,
+	failed_snippets, kept_snippets, retired_snippets`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var sourceID sql.NullString
+	err := row.Scan(&job.ID, &job.Kind, &sourceID, &job.Limit, &job.Threshold, &job.Fetch, &job.State, &job.Attempts,
+		&job.LeaseOwner, &job.LeaseExpiresAt, &job.Error, &job.CreatedAt, &job.UpdatedAt,
+		&job.Phase, &job.Current, &job.Total, &job.Stored, &job.Failed, &job.Kept, &job.Retired)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.SourceID = sourceID.String
+	return &job, nil
+}
+
+func (s *sqlStore) EnqueueJob(ctx context.Context, job *Job) (string, error) {
+	now := time.Now().UTC()
+	id := newID()
+	_, err := s.exec(ctx, `INSERT INTO jobs (`+sqlJobColumns+`)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?, 0, '', ?, '', ?, ?, '', 0, 0, 0, 0, 0, 0)`,
+		id, job.Kind, job.SourceID, job.Limit, job.Threshold, job.Fetch, JobQueued, time.Time{}, now, now)
+	if err != nil {
+		return "", err
+	}
+	job.ID, job.State, job.CreatedAt, job.UpdatedAt = id, JobQueued, now, now
+	return id, nil
+}
+
+func (s *sqlStore) GetJob(ctx context.Context, id string) (*Job, error) {
+	return scanJob(s.queryRow(ctx, "SELECT "+sqlJobColumns+" FROM jobs WHERE id = ?", id))
+}
+
+// sqlClaimable is the condition a job must meet to be claimed, taking the
+// current time as its parameter.
+const sqlClaimable = "(state = 'queued' OR (state = 'running' AND lease_expires_at < ?))"
+
+// ClaimJob picks a candidate and claims it with an UPDATE that rechecks the
+// condition, so that of two workers racing for the same job only one wins;
+// the loser tries the next candidate.
+func (s *sqlStore) ClaimJob(ctx context.Context, owner string, lease time.Duration) (*Job, error) {
+	for {
+		now := time.Now().UTC()
+		var id string
+		err := s.queryRow(ctx, "SELECT id FROM jobs WHERE "+sqlClaimable+" ORDER BY created_at, id LIMIT 1", now).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.exec(ctx, `UPDATE jobs SET state = ?, attempts = attempts + 1, lease_owner = ?,
+			lease_expires_at = ?, updated_at = ? WHERE id = ? AND `+sqlClaimable,
+			JobRunning, owner, now.Add(lease), now, id, now)
+		if err != nil {
+			return nil, err
+		}
+		err = requireRow(res)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return s.GetJob(ctx, id)
+	}
+}
+
+func (s *sqlStore) RenewJobLease(ctx context.Context, id, owner string, lease time.Duration) error {
+	now := time.Now().UTC()
+	res, err := s.exec(ctx, `UPDATE jobs SET lease_expires_at = ?, updated_at = ?
+		WHERE id = ? AND state = ? AND lease_owner = ?`, now.Add(lease), now, id, JobRunning, owner)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(res)
+}
+
+func (s *sqlStore) FinishJob(ctx context.Context, id, owner, state, errMsg string) error {
+	res, err := s.exec(ctx, `UPDATE jobs SET state = ?, error = ?, lease_owner = '', updated_at = ?
+		WHERE id = ? AND state = ? AND lease_owner = ?`, state, errMsg, time.Now().UTC(), id, JobRunning, owner)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(res)
+}
+
+func (s *sqlStore) UpdateJobProgress(ctx context.Context, id, owner string, progress JobProgress) error {
+	res, err := s.exec(ctx, `UPDATE jobs SET phase = ?, current_snippet = ?, total_snippets = ?, stored_snippets = ?,
+		failed_snippets = ?, kept_snippets = ?, retired_snippets = ?, updated_at = ?
+		WHERE id = ? AND state = ? AND lease_owner = ?`,
+		progress.Phase, progress.Current, progress.Total, progress.Stored, progress.Failed, progress.Kept, progress.Retired,
+		time.Now().UTC(), id, JobRunning, owner)
+	if err != nil {
+		return err
+	}
+	return leaseHeld(res)
+}
+
+func (s *sqlStore) LatestJob(ctx context.Context, sourceID string) (*Job, error) {
+	return scanJob(s.queryRow(ctx, "SELECT "+sqlJobColumns+" FROM jobs WHERE source_id = ? ORDER BY created_at DESC, id DESC LIMIT 1", sourceID))
+}
+
+// leaseHeld maps an update that matched no job onto ErrLeaseLost.
+func leaseHeld(res sql.Result) error {
+	err := requireRow(res)
+	if errors.Is(err, ErrNotFound) {
+		return ErrLeaseLost
+	}
+	return err
+}
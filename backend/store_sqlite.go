@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/sqlite/*.sql
+var sqliteMigrations embed.FS
+
+// sqliteDialect stores embeddings as blobs of little-endian float32 values.
+var sqliteDialect = sqlDialect{
+	rebind: func(query string) string { return query },
+	encodeEmbedding: func(embedding []float32) interface{} {
+		if len(embedding) == 0 {
+			return nil
+		}
+		return encodeEmbedding(embedding)
+	},
+	decodeEmbedding: decodeEmbedding,
+}
+
+// newSQLiteStore opens (creating if needed) the SQLite database at path, for
+// self-hosted deployments on a single machine, and brings its schema up to
+// date.
+func newSQLiteStore(ctx context.Context, path string) (*sqlStore, error) {
+	dsn := "file:" + path + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; serializing access through one
+	// connection avoids SQLITE_BUSY errors on concurrent transactions.
+	db.SetMaxOpenConns(1)
+	if err := migrate(ctx, db, sqliteMigrations, "migrations/sqlite"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db, dialect: sqliteDialect}, nil
+}
+
+// encodeEmbedding packs an embedding into little-endian float32 bytes.
+func encodeEmbedding(embedding []float32) []byte {
+	if len(embedding) == 0 {
+		return nil
+	}
+	buf := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return buf
+}
+
+// decodeEmbedding is the inverse of encodeEmbedding.
+func decodeEmbedding(buf []byte) ([]float32, error) {
+	if len(buf)%4 != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of 4", len(buf))
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	embedding := make([]float32, len(buf)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return embedding, nil
+}
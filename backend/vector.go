@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// SnippetFilter restricts the snippets a search considers.
+type SnippetFilter struct {
+	// Labels lists labels a snippet must all carry.
+	Labels []string
+	// MaxSafety, if set, excludes snippets scoring above it in any of
+	// SafetyCategories, or in any safety category if that is empty.
+	// Snippets that were never rated pass.
+	MaxSafety        *float64
+	SafetyCategories []string
+}
+
+// matches reports whether snippet passes the filter. Quarantined snippets
+// never do.
+func (f SnippetFilter) matches(snippet *Snippet) bool {
+	if len(snippet.Quarantine) > 0 {
+		return false
+	}
+	if f.MaxSafety != nil && maxSafetyScore(snippet.Safety, f.SafetyCategories) > *f.MaxSafety {
+		return false
+	}
+	for _, want := range f.Labels {
+		found := false
+		for _, label := range snippet.Labels {
+			if label == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ScoredSnippet is a search result: a snippet and how well it matched.
+type ScoredSnippet struct {
+	Snippet *Snippet `json:"snippet"`
+	Score   float64  `json:"score"`
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, or 0 if
+// they differ in length or either is zero.
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// rankByEmbedding is an exact nearest neighbour search over snippets for
+// stores without a vector index. It returns up to limit snippets that pass
+// filter and have an embedding of the same size as query, most similar
+// first.
+func rankByEmbedding(snippets []*Snippet, query []float32, filter SnippetFilter, limit int) []ScoredSnippet {
+	var results []ScoredSnippet
+	for _, snippet := range snippets {
+		if len(snippet.Embedding) != len(query) || !filter.matches(snippet) {
+			continue
+		}
+		results = append(results, ScoredSnippet{Snippet: snippet, Score: cosineSimilarity(query, snippet.Embedding)})
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}